@@ -8,6 +8,9 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -485,3 +488,58 @@ func TestPublicAPIOpenFSReopenSmoke(t *testing.T) {
 		t.Fatalf("diagnose issues: %+v", diagnose.Issues)
 	}
 }
+
+func TestConditionalPutUpdateAndDelete(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	var wins atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := store.PutWithOptions(ctx, "tenant-a", "lock", strings.NewReader("owner"), PutOptions{Preconditions: Preconditions{IfNoneMatch: true}})
+			switch {
+			case err == nil:
+				wins.Add(1)
+			case !errors.Is(err, ErrPreconditionFailed):
+				t.Errorf("create-only put: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	if wins.Load() != 1 {
+		t.Fatalf("create-only winners = %d, want 1", wins.Load())
+	}
+	current, err := store.StatObject(ctx, "tenant-a", "lock")
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	stale := Preconditions{IfGenerationMatch: current.Generation + 1}
+	if _, err := store.PutWithOptions(ctx, "tenant-a", "lock", strings.NewReader("next"), PutOptions{Preconditions: stale}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("put with stale generation = %v", err)
+	}
+	if _, err := store.PutWithOptions(ctx, "tenant-a", "missing", strings.NewReader("x"), PutOptions{Preconditions: Preconditions{IfETagMatch: current.FileHash}}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("put with etag on missing object = %v", err)
+	}
+	put, err := store.PutWithOptions(ctx, "tenant-a", "lock", strings.NewReader("next"), PutOptions{
+		Options:       map[string]string{"owner": "b"},
+		Preconditions: Preconditions{IfGenerationMatch: current.Generation, IfETagMatch: current.FileHash},
+	})
+	if err != nil {
+		t.Fatalf("put with matching generation: %v", err)
+	}
+	if _, err := store.UpdateMetadataWithOptions(ctx, "tenant-a", "lock", nil, Preconditions{IfETagMatch: current.FileHash}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("update with stale etag = %v", err)
+	}
+	info, err := store.UpdateMetadataWithOptions(ctx, "tenant-a", "lock", map[string]string{"owner": "c"}, Preconditions{IfGenerationMatch: put.Generation})
+	if err != nil || info.Options["owner"] != "c" {
+		t.Fatalf("update with matching generation = %+v, %v", info, err)
+	}
+	if err := store.DeleteObjectWithOptions(ctx, "tenant-a", "lock", DeleteOptions{Preconditions: Preconditions{IfGenerationMatch: put.Generation}}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("delete with stale generation = %v", err)
+	}
+	if err := store.DeleteObjectWithOptions(ctx, "tenant-a", "lock", DeleteOptions{Preconditions: Preconditions{IfGenerationMatch: info.Generation}}); err != nil {
+		t.Fatalf("delete with matching generation: %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	batchPut            = "put"
+	batchDelete         = "delete"
+	batchRename         = "rename"
+	batchUpdateMetadata = "update metadata"
+)
+
+// Batch collects object changes that commit together in one metadata
+// transaction: readers and watchers see either every change or none. Items
+// apply in the order they were added, so a later item sees the effect of an
+// earlier one. A Batch is not safe for concurrent use.
+type Batch struct {
+	store *Store
+	items []batchItem
+}
+
+type batchItem struct {
+	op       string
+	tenantID string
+	path     string
+	newPath  string
+	input    io.Reader
+	options  map[string]string
+	cond     Preconditions
+	prepared *preparedObject
+}
+
+// BatchResult reports the node an item left behind. Generation and FileHash
+// are zero for deletes.
+type BatchResult struct {
+	Path       string
+	Generation uint64
+	FileHash   string
+}
+
+// NewBatch returns an empty batch for s.
+func (s *Store) NewBatch() *Batch {
+	return &Batch{store: s}
+}
+
+// Put stages a write of input to tenantID/path. input is read by Commit.
+func (b *Batch) Put(tenantID, path string, input io.Reader, opts PutOptions) {
+	b.items = append(b.items, batchItem{op: batchPut, tenantID: tenantID, path: path, input: input, options: copyOptions(opts.Options), cond: opts.Preconditions})
+}
+
+// Delete stages the removal of the file or symlink at tenantID/path.
+func (b *Batch) Delete(tenantID, path string, opts DeleteOptions) {
+	b.items = append(b.items, batchItem{op: batchDelete, tenantID: tenantID, path: path, cond: opts.Preconditions})
+}
+
+// Rename stages a rename within tenantID. IfGenerationMatch and IfETagMatch
+// in cond apply to oldPath; IfNoneMatch requires that newPath does not exist.
+func (b *Batch) Rename(tenantID, oldPath, newPath string, cond Preconditions) {
+	b.items = append(b.items, batchItem{op: batchRename, tenantID: tenantID, path: oldPath, newPath: newPath, cond: cond})
+}
+
+// UpdateMetadata stages a replacement of the user options of a file.
+func (b *Batch) UpdateMetadata(tenantID, path string, options map[string]string, cond Preconditions) {
+	b.items = append(b.items, batchItem{op: batchUpdateMetadata, tenantID: tenantID, path: path, options: copyOptions(options), cond: cond})
+}
+
+// Len returns the number of staged items.
+func (b *Batch) Len() int {
+	return len(b.items)
+}
+
+// Commit writes the data of every Put, then applies all items in one
+// metadata transaction. If any item fails, including a failed precondition,
+// nothing is published and the error names the item. The batch is emptied
+// whether or not Commit succeeds.
+func (b *Batch) Commit(ctx context.Context) ([]BatchResult, error) {
+	s := b.store
+	items := b.items
+	b.items = nil
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	for i := range items {
+		if err := s.validateBatchItem(&items[i]); err != nil {
+			return nil, batchItemError(i, err)
+		}
+	}
+	defer func() {
+		for _, item := range items {
+			if item.prepared != nil {
+				s.releasePreparedPins(item.prepared)
+			}
+		}
+	}()
+	results, err := s.commitBatch(ctx, items)
+	if err != nil {
+		var commitErr metadataCommitError
+		var cleanupErrs []error
+		for _, item := range items {
+			switch {
+			case item.prepared == nil:
+			case errors.As(err, &commitErr):
+				s.keepOpenSegments(item.prepared)
+			default:
+				cleanupErrs = append(cleanupErrs, s.abandonOpenSegments(item.prepared))
+			}
+		}
+		if cleanupErr := errors.Join(cleanupErrs...); cleanupErr != nil {
+			return nil, errors.Join(err, cleanupErr)
+		}
+		return nil, err
+	}
+	return results, nil
+}
+
+func (s *Store) validateBatchItem(item *batchItem) error {
+	if err := validateTenantID(item.tenantID, s.cfg); err != nil {
+		return pathError(item.op, item.tenantID, err)
+	}
+	path, err := normalizePath(item.path, s.cfg)
+	if err != nil {
+		return pathError(item.op, item.path, err)
+	}
+	item.path = path
+	switch item.op {
+	case batchPut:
+		if item.input == nil {
+			return ErrNilReader
+		}
+	case batchRename:
+		newPath, err := normalizePath(item.newPath, s.cfg)
+		if err != nil {
+			return pathError(item.op, item.newPath, err)
+		}
+		item.newPath = newPath
+	}
+	return nil
+}
+
+func batchItemError(index int, err error) error {
+	return fmt.Errorf("batch item %d: %w", index, err)
+}
+
+// commitBatch prepares the data of every Put and commits all items. Items are
+// staged one by one in memory so each sees the ones before it; the staged
+// state is then undone and the combined ops commit as one transaction.
+func (s *Store) commitBatch(ctx context.Context, items []batchItem) ([]BatchResult, error) {
+	tenants := map[string]bool{}
+	for i := range items {
+		item := &items[i]
+		if item.op == batchPut {
+			prepared, err := s.prepareObject(ctx, item.tenantID, item.path, item.input)
+			if err != nil {
+				return nil, batchItemError(i, err)
+			}
+			item.prepared = prepared
+		}
+		if !tenants[item.tenantID] {
+			tenants[item.tenantID] = true
+			if err := s.ensureTenantRoot(item.tenantID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := contextError(ctx); err != nil {
+		return nil, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	var all []metaOp
+	var undo []func(*metadata)
+	defer func() {
+		for i := len(undo) - 1; i >= 0; i-- {
+			undo[i](s.meta)
+		}
+	}()
+	results := make([]BatchResult, len(items))
+	for i := range items {
+		var ops []metaOp
+		result, err := s.stageBatchItemLocked(&items[i], &ops)
+		if err != nil {
+			return nil, batchItemError(i, err)
+		}
+		undo = append(undo, stageMetaLocked(s.meta, ops)...)
+		all = append(all, ops...)
+		if items[i].op == batchRename {
+			// The moved node keeps its inode; report its staged record.
+			if inode, err := s.lookupPathLocked(items[i].tenantID, result.Path); err == nil {
+				result.Generation = inode.Generation
+				result.FileHash = inode.FileHash
+			}
+		}
+		results[i] = result
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i](s.meta)
+	}
+	undo = nil
+	if err := s.checkQuotaLocked(all); err != nil {
+		return nil, err
+	}
+	if err := s.commitMetaFinalLocked(all); err != nil {
+		return nil, metadataCommitError{err: err}
+	}
+	return results, nil
+}
+
+// stageBatchItemLocked queues the ops of one item and returns what it will
+// leave behind.
+func (s *Store) stageBatchItemLocked(item *batchItem, ops *[]metaOp) (BatchResult, error) {
+	result := BatchResult{Path: item.path}
+	switch item.op {
+	case batchPut:
+		put, err := s.putPreparedLocked(item.prepared, putCommitOptions{options: item.options, preconditions: item.cond}, ops)
+		if err != nil {
+			return result, err
+		}
+		result.Generation = put.Generation
+		result.FileHash = put.FileHash
+	case batchDelete:
+		return result, s.deleteObjectLocked(item.tenantID, item.path, item.cond, ops)
+	case batchRename:
+		if err := s.renameOpsLocked(item.tenantID, item.path, item.tenantID, item.newPath, item.path, item.newPath, item.cond, ops); err != nil {
+			return result, err
+		}
+		result.Path = item.newPath
+	case batchUpdateMetadata:
+		info, err := s.updateMetadataLocked(item.tenantID, item.path, item.options, item.cond, ops)
+		if err != nil {
+			return result, err
+		}
+		result.Generation = info.Generation
+		result.FileHash = info.FileHash
+	}
+	return result, nil
+}
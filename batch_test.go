@@ -0,0 +1,98 @@
+package blobfs
+
+import (
+	"errors"
+	"io/fs"
+	"strings"
+	"testing"
+)
+
+func TestBatchCommitsAllItemsInOneTransaction(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	old := putTestBytes(t, store, "tenant-a", "old.idx", []byte("old index"))
+	putTestBytes(t, store, "tenant-a", "stale.dat", []byte("stale"))
+	before := watchStartTxID(t, store)
+	watcher, err := store.Watch(ctx, before, WatchFilter{TenantID: "tenant-a"})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	batch := store.NewBatch()
+	batch.Put("tenant-a", "part.dat", strings.NewReader("shared data"), PutOptions{Preconditions: Preconditions{IfNoneMatch: true}})
+	batch.Put("tenant-a", "copy.dat", strings.NewReader("shared data"), PutOptions{})
+	batch.Rename("tenant-a", "part.dat", "data.dat", Preconditions{IfNoneMatch: true})
+	batch.UpdateMetadata("tenant-a", "old.idx", map[string]string{"points-to": "data.dat"}, Preconditions{IfGenerationMatch: old.Generation})
+	batch.Delete("tenant-a", "stale.dat", DeleteOptions{})
+	results, err := batch.Commit(ctx)
+	if err != nil {
+		t.Fatalf("commit: %v", err)
+	}
+	if len(results) != 5 || results[2].Path != "data.dat" || results[2].FileHash != results[0].FileHash || results[4].Generation != 0 {
+		t.Fatalf("results = %+v", results)
+	}
+	if batch.Len() != 0 {
+		t.Fatalf("batch keeps %d items after commit", batch.Len())
+	}
+	if got := readTestBytes(t, store, "tenant-a", "data.dat"); string(got) != "shared data" {
+		t.Fatalf("data = %q", got)
+	}
+	info, err := store.StatObject(ctx, "tenant-a", "old.idx")
+	if err != nil || info.Options["points-to"] != "data.dat" || info.Generation != results[3].Generation {
+		t.Fatalf("index = %+v, %v", info, err)
+	}
+	for _, path := range []string{"part.dat", "stale.dat"} {
+		if _, err := store.StatObject(ctx, "tenant-a", path); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("stat %s = %v", path, err)
+		}
+	}
+	data, err := store.StatObject(ctx, "tenant-a", "data.dat")
+	if err != nil {
+		t.Fatalf("stat data: %v", err)
+	}
+	store.metaMu.RLock()
+	txID := store.meta.TxID
+	refs := store.meta.Manifests[info.ManifestID].RefCount
+	shared := store.meta.Manifests[data.ManifestID].RefCount
+	store.metaMu.RUnlock()
+	if txID != before+1 || refs != 1 || shared != 2 {
+		t.Fatalf("txid = %d (before %d), index refs = %d, shared refs = %d", txID, before, refs, shared)
+	}
+	for i := 0; i < 4; i++ {
+		event, err := watcher.Next()
+		if err != nil || event.TxID != txID {
+			t.Fatalf("event = %+v, %v", event, err)
+		}
+	}
+}
+
+func TestBatchFailedPreconditionPublishesNothing(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	putTestBytes(t, store, "tenant-a", "index", []byte("v1"))
+	before := watchStartTxID(t, store)
+
+	batch := store.NewBatch()
+	batch.Put("tenant-a", "data", strings.NewReader("new data"), PutOptions{})
+	batch.Delete("tenant-a", "index", DeleteOptions{})
+	batch.Put("tenant-a", "index", strings.NewReader("v2"), PutOptions{Preconditions: Preconditions{IfGenerationMatch: 1}})
+	if _, err := batch.Commit(ctx); !errors.Is(err, ErrPreconditionFailed) || !strings.Contains(err.Error(), "batch item 2") {
+		t.Fatalf("commit = %v", err)
+	}
+	if _, err := store.StatObject(ctx, "tenant-a", "data"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat data = %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "index"); string(got) != "v1" {
+		t.Fatalf("index = %q", got)
+	}
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	if store.meta.TxID != before {
+		t.Fatalf("txid moved from %d to %d", before, store.meta.TxID)
+	}
+	for _, manifest := range store.meta.Manifests {
+		if manifest.RefCount != 1 {
+			t.Fatalf("manifest after failed batch: %+v", manifest)
+		}
+	}
+}
@@ -147,11 +147,14 @@ func corruptFirstChunkPayloadByte(t *testing.T, store *Store, tenantID, path str
 
 func markCompactionCandidatesForTest(t *testing.T, store *Store) ([]compactCandidate, *GCResult) {
 	t.Helper()
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 	now := nowUnix()
 	store.metaMu.Lock()
 	ops := []metaOp{}
 	result := &GCResult{}
-	store.markUnreferencedChunksLocked(now, now+int64(time.Second), 1, result, &ops)
+	store.markUnreferencedChunksLocked(now, now+int64(time.Second), nil, 1, result, &ops)
 	if err := store.commitMetaLocked(ops); err != nil {
 		store.metaMu.Unlock()
 		t.Fatalf("mark garbage: %v", err)
@@ -397,6 +400,10 @@ func TestGCCollectSegmentWorkFindsCompactionAndDeadSegments(t *testing.T) {
 	putTestBytes(t, store, "tenant-a", "gcwork/source", data)
 	livePayload, _ := firstChunkPayload(t, store, "tenant-a", "gcwork/source")
 	putTestBytes(t, store, "tenant-a", "gcwork/live", livePayload)
+	// Keep the dead object in a segment of its own.
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 	putTestBytes(t, store, "tenant-a", "gcwork/dead", bytes.Repeat([]byte("dead"), 64))
 	if err := store.DeleteObject(testContext(t), "tenant-a", "gcwork/source"); err != nil {
 		t.Fatalf("delete source: %v", err)
@@ -404,12 +411,15 @@ func TestGCCollectSegmentWorkFindsCompactionAndDeadSegments(t *testing.T) {
 	if err := store.DeleteObject(testContext(t), "tenant-a", "gcwork/dead"); err != nil {
 		t.Fatalf("delete dead: %v", err)
 	}
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 
 	now := nowUnix()
 	store.metaMu.Lock()
 	ops := []metaOp{}
 	result := &GCResult{}
-	store.markUnreferencedChunksLocked(now, now+int64(time.Second), 1, result, &ops)
+	store.markUnreferencedChunksLocked(now, now+int64(time.Second), nil, 1, result, &ops)
 	if err := store.commitMetaLocked(ops); err != nil {
 		store.metaMu.Unlock()
 		t.Fatalf("mark garbage: %v", err)
@@ -66,7 +66,7 @@ func (s *Store) checkObject(ctx context.Context, tenantID, path string) (*CheckR
 		if err := contextError(ctx); err != nil {
 			return result, err
 		}
-		raw, issue := s.checkChunkSnapshot(snap)
+		raw, _, issue := s.checkChunkSnapshot(snap)
 		result.CheckedChunks++
 		if snap.HasSeg {
 			result.CheckedSegments++
@@ -141,10 +141,11 @@ func (s *Store) checkSnapshots(tenantID, path string) ([]chunkCheckSnapshot, str
 		}
 		snapshots = append(snapshots, snap)
 	}
-	return snapshots, inode.FileHash, inode.Size, s.dedupScopeID(tenantID), pinned, nil
+	return snapshots, inode.FileHash, inode.Size, manifest.TenantID, pinned, nil
 }
 
-// Scrub verifies stored chunks and optionally active file hashes across the whole store.
+// Scrub verifies stored chunks, the persisted tenant usage and optionally
+// active file hashes across the whole store.
 func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, error) {
 	if err := s.beginOp(ctx); err != nil {
 		return nil, err
@@ -156,11 +157,17 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 	var fileSnapshots []fileCheckSnapshot
 	var metadataIssues []CheckIssue
 	var pinned []string
+	var shredded int
 	seenPins := map[string]bool{}
 	for _, chunk := range s.meta.Chunks {
 		if chunk == nil || chunk.State == chunkStateDeleted || chunk.SegmentID == "" {
 			continue
 		}
+		// Shredded chunks are garbage waiting for GC, not corruption.
+		if chunk.State == chunkStateShredded {
+			shredded++
+			continue
+		}
 		snap := chunkCheckSnapshot{Chunk: *chunk, HasChunk: true}
 		if seg := s.meta.Segments[chunk.SegmentID]; seg != nil {
 			snap.Segment = *seg
@@ -197,7 +204,7 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 				Path:     path,
 				FileHash: inode.FileHash,
 				Size:     inode.Size,
-				ScopeID:  s.dedupScopeID(inode.TenantID),
+				ScopeID:  manifest.TenantID,
 				Chunks:   make([]chunkCheckSnapshot, 0, len(refs)),
 			}
 			for _, ref := range refs {
@@ -221,6 +228,9 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 			fileSnapshots = append(fileSnapshots, fileSnap)
 		}
 	}
+	for _, op := range usageDrift(s.meta) {
+		metadataIssues = append(metadataIssues, CheckIssue{Kind: "usage_mismatch", ID: op.TenantID, TenantID: op.TenantID, Reason: "persisted usage differs from a recount"})
+	}
 	s.metaMu.RUnlock()
 	defer func() {
 		for _, segmentID := range pinned {
@@ -228,7 +238,7 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 		}
 	}()
 
-	result := &ScrubResult{Healthy: true}
+	result := &ScrubResult{Healthy: true, ShreddedChunks: shredded}
 	seenSegments := map[string]bool{}
 	seenCorruptChunks := map[string]bool{}
 	seenCorruptSegments := map[string]bool{}
@@ -243,12 +253,15 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 		if err := contextError(ctx); err != nil {
 			return result, err
 		}
-		raw, issue := s.checkChunkSnapshot(snap)
+		raw, reconstructed, issue := s.checkChunkSnapshot(snap)
 		result.CheckedChunks++
 		if snap.HasSeg && !seenSegments[snap.Segment.SegmentID] {
 			result.CheckedSegments++
 			seenSegments[snap.Segment.SegmentID] = true
 		}
+		if reconstructed {
+			result.ReconstructedChunks = append(result.ReconstructedChunks, snap.Chunk.ChunkID)
+		}
 		if issue == nil {
 			result.CheckedBytes += int64(len(raw))
 			continue
@@ -274,8 +287,13 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 		contentHash := scopedHasher(fileSnap.ScopeID, fileSnap.ScopeID != "")
 		var contentSize int64
 		var fileIssues []CheckIssue
+		shredded := false
 		for _, snap := range fileSnap.Chunks {
-			raw, issue := s.checkChunkSnapshot(snap)
+			raw, _, issue := s.checkChunkSnapshot(snap)
+			if issue != nil && issue.Kind == "chunk_shredded" {
+				shredded = true
+				break
+			}
 			if issue != nil {
 				fileIssues = append(fileIssues, *issue)
 				continue
@@ -283,6 +301,10 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 			contentHash.Write(raw)
 			contentSize += int64(len(raw))
 		}
+		// Files of a shredded tenant wait for GC like their chunks.
+		if shredded {
+			continue
+		}
 		if len(fileIssues) == 0 {
 			gotHash := hex.EncodeToString(contentHash.Sum(nil))
 			if gotHash != fileSnap.FileHash || contentSize != fileSnap.Size {
@@ -315,6 +337,7 @@ func (s *Store) Scrub(ctx context.Context, opts ScrubOptions) (*ScrubResult, err
 	for key := range seenAffected {
 		result.AffectedFiles = append(result.AffectedFiles, key)
 	}
+	sort.Strings(result.ReconstructedChunks)
 	sort.Strings(result.CorruptChunks)
 	sort.Strings(result.CorruptSegments)
 	sort.Strings(result.AffectedFiles)
@@ -361,34 +384,41 @@ func (s *Store) pathsForChunk(chunkID string) ([]string, []CheckIssue) {
 	return paths, issues
 }
 
-func (s *Store) checkChunkSnapshot(snap chunkCheckSnapshot) ([]byte, *CheckIssue) {
+// checkChunkSnapshot verifies one chunk, rebuilding a damaged record from
+// segment parity when it can; reconstructed reports whether it did.
+func (s *Store) checkChunkSnapshot(snap chunkCheckSnapshot) (raw []byte, reconstructed bool, issue *CheckIssue) {
 	if !snap.HasChunk {
-		return nil, &CheckIssue{Kind: "chunk_missing", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Ref.ChunkID, Reason: "chunk metadata is missing"}
+		return nil, false, &CheckIssue{Kind: "chunk_missing", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Ref.ChunkID, Reason: "chunk metadata is missing"}
 	}
 	if !snap.HasSeg {
-		return nil, &CheckIssue{Kind: "segment_missing", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Chunk.SegmentID, Reason: "segment metadata is missing"}
+		return nil, false, &CheckIssue{Kind: "segment_missing", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Chunk.SegmentID, Reason: "segment metadata is missing"}
+	}
+	if snap.Chunk.State == chunkStateShredded {
+		return nil, false, &CheckIssue{Kind: "chunk_shredded", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Chunk.SegmentID, Reason: "chunk key was destroyed"}
 	}
 	if snap.Chunk.State == chunkStateCorrupt {
-		return nil, &CheckIssue{Kind: "chunk_corrupt", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Chunk.SegmentID, Reason: snap.Chunk.CorruptReason}
+		return nil, false, &CheckIssue{Kind: "chunk_corrupt", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Chunk.SegmentID, Reason: snap.Chunk.CorruptReason}
 	}
 	if snap.Segment.State == segmentStateCorrupt {
-		return nil, &CheckIssue{Kind: "segment_corrupt", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: snap.Segment.CorruptReason}
+		return nil, false, &CheckIssue{Kind: "segment_corrupt", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: snap.Segment.CorruptReason}
 	}
-	raw, err := s.readChunkPayloadAt(snap.Segment, snap.Chunk)
+	raw, reconstructed, err := s.readChunkPayload(snap.Segment, snap.Chunk)
 	if err != nil {
 		kind := "chunk_read_failed"
 		if errors.Is(err, os.ErrNotExist) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, io.EOF) {
 			kind = "segment_read_failed"
 		} else if errors.Is(err, errChunkHashMismatch) {
 			kind = "chunk_hash_mismatch"
+		} else if errors.Is(err, ErrKeyUnavailable) {
+			kind = "key_unavailable"
 		}
-		return nil, &CheckIssue{Kind: kind, Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: err.Error()}
+		return nil, false, &CheckIssue{Kind: kind, Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: err.Error()}
 	}
 	gotChunkID := hashBytes(snap.Chunk.TenantID, snap.Chunk.TenantID != "", raw)
 	if gotChunkID != snap.Chunk.ChunkID {
-		return nil, &CheckIssue{Kind: "chunk_hash_mismatch", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: "chunk sha256 mismatch"}
+		return nil, false, &CheckIssue{Kind: "chunk_hash_mismatch", Path: snap.Path, TenantID: snap.TenantID, ChunkID: snap.Chunk.ChunkID, SegmentID: snap.Segment.SegmentID, Reason: "chunk sha256 mismatch"}
 	}
-	return raw, nil
+	return raw, reconstructed, nil
 }
 
 func (s *Store) markCorruption(issues []CheckIssue) error {
@@ -397,6 +427,10 @@ func (s *Store) markCorruption(issues []CheckIssue) error {
 	now := nowUnix()
 	ops := make([]metaOp, 0, len(issues)*2)
 	for _, issue := range issues {
+		// A chunk without its key cannot be read, but its bytes may be intact.
+		if issue.Kind == "key_unavailable" || issue.Kind == "chunk_shredded" {
+			continue
+		}
 		if issue.ChunkID != "" {
 			if chunk := s.meta.Chunks[issue.ChunkID]; chunk != nil && chunk.State != chunkStateDeleted {
 				next := *chunk
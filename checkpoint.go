@@ -0,0 +1,320 @@
+package blobfs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+const (
+	metaDeltaDir           = "delta"
+	metaDeltaSuffix        = ".delta"
+	metaDeltaMergeInterval = 8
+)
+
+// metaDirty names the records changed since the last checkpoint. A delta
+// checkpoint writes these records at their current state, or a tombstone for
+// records that no longer exist.
+type metaDirty struct {
+	tenants   map[string]struct{}
+	inodes    map[uint64]struct{}
+	dirents   map[uint64]map[string]struct{}
+	manifests map[string]struct{}
+	chunks    map[string]struct{}
+	segments  map[string]struct{}
+	snapshots map[string]struct{}
+	settings  map[string]struct{}
+	versions  map[string]struct{}
+	trash     map[uint64]struct{}
+	keyrings  map[string]struct{}
+	usage     map[string]struct{}
+}
+
+func newMetaDirty() *metaDirty {
+	return &metaDirty{
+		tenants:   map[string]struct{}{},
+		inodes:    map[uint64]struct{}{},
+		dirents:   map[uint64]map[string]struct{}{},
+		manifests: map[string]struct{}{},
+		chunks:    map[string]struct{}{},
+		segments:  map[string]struct{}{},
+		snapshots: map[string]struct{}{},
+		settings:  map[string]struct{}{},
+		versions:  map[string]struct{}{},
+		trash:     map[uint64]struct{}{},
+		keyrings:  map[string]struct{}{},
+		usage:     map[string]struct{}{},
+	}
+}
+
+func (meta *metadata) dirtySet() *metaDirty {
+	if meta.dirty == nil {
+		meta.dirty = newMetaDirty()
+	}
+	return meta.dirty
+}
+
+func (d *metaDirty) markDirEntry(parentID uint64, name string) {
+	if d.dirents[parentID] == nil {
+		d.dirents[parentID] = map[string]struct{}{}
+	}
+	d.dirents[parentID][name] = struct{}{}
+}
+
+func (d *metaDirty) empty() bool {
+	return d == nil || len(d.tenants)+len(d.inodes)+len(d.dirents)+len(d.manifests)+len(d.chunks)+len(d.segments)+len(d.snapshots)+len(d.settings)+len(d.versions)+len(d.trash)+len(d.keyrings)+len(d.usage) == 0
+}
+
+// markMetaOpDirty runs before op is applied, so the usage of the tenants
+// charged for both the old and the new record is marked.
+func markMetaOpDirty(meta *metadata, op metaOp) {
+	dirty := meta.dirtySet()
+	for _, tenantID := range usageTenants(meta, op) {
+		dirty.usage[tenantID] = struct{}{}
+	}
+	switch op.Type {
+	case "put_tenant", "del_tenant":
+		dirty.tenants[op.TenantID] = struct{}{}
+	case "put_inode":
+		if op.Inode != nil {
+			dirty.inodes[op.Inode.InodeID] = struct{}{}
+		}
+	case "put_dirent", "delete_dirent":
+		dirty.markDirEntry(op.ParentID, op.Name)
+	case "put_manifest":
+		if op.Manifest != nil {
+			dirty.manifests[op.Manifest.ManifestID] = struct{}{}
+		}
+	case "put_chunk":
+		if op.Chunk != nil {
+			dirty.chunks[op.Chunk.ChunkID] = struct{}{}
+		}
+	case "put_segment":
+		if op.Segment != nil {
+			dirty.segments[op.Segment.SegmentID] = struct{}{}
+		}
+	case "put_snapshot":
+		if op.Snapshot != nil {
+			dirty.snapshots[snapshotKey(op.Snapshot.TenantID, op.Snapshot.Name)] = struct{}{}
+		}
+	case "delete_snapshot":
+		dirty.snapshots[snapshotKey(op.TenantID, op.Name)] = struct{}{}
+	case "put_tenant_settings":
+		if op.Settings != nil {
+			dirty.settings[op.Settings.TenantID] = struct{}{}
+		}
+	case "delete_tenant_settings":
+		dirty.settings[op.TenantID] = struct{}{}
+	case "put_versions":
+		if op.Versions != nil {
+			dirty.versions[versionKey(op.Versions.TenantID, op.Versions.Path)] = struct{}{}
+		}
+	case "delete_versions":
+		dirty.versions[versionKey(op.TenantID, op.Name)] = struct{}{}
+	case "put_trash":
+		if op.Trash != nil {
+			dirty.trash[op.Trash.InodeID] = struct{}{}
+		}
+	case "delete_trash":
+		dirty.trash[op.ChildID] = struct{}{}
+	case "put_keyring":
+		if op.Keyring != nil {
+			dirty.keyrings[op.Keyring.Scope] = struct{}{}
+		}
+	case "delete_keyring":
+		dirty.keyrings[op.TenantID] = struct{}{}
+	}
+}
+
+func metaDeltaPath(metaDir string, seq uint64) string {
+	return filepath.Join(metaDir, metaDeltaDir, fmt.Sprintf("%020d%s", seq, metaDeltaSuffix))
+}
+
+// listMetaDeltas returns the sequence numbers of delta checkpoints on disk in
+// ascending order.
+func listMetaDeltas(fs afero.Fs, metaDir string) ([]uint64, error) {
+	entries, err := afero.ReadDir(fs, filepath.Join(metaDir, metaDeltaDir))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seqs := make([]uint64, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, metaDeltaSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, metaDeltaSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		seqs = append(seqs, seq)
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i] < seqs[j] })
+	return seqs, nil
+}
+
+// loadMetaDeltas applies the delta checkpoints written after the base image,
+// in order. Deltas already merged into the base are skipped. The chain stops
+// at a missing delta or one that fails verification; the stop is returned as
+// a fallback and the txlog generations must cover the rest.
+func loadMetaDeltas(fs afero.Fs, metaDir string, meta *metadata) ([]metadataCheckpointFallback, error) {
+	seqs, err := listMetaDeltas(fs, metaDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		if seq <= meta.DeltaSeq {
+			continue
+		}
+		path := metaDeltaPath(metaDir, meta.DeltaSeq+1)
+		if seq != meta.DeltaSeq+1 {
+			return []metadataCheckpointFallback{{Path: path, Reason: fmt.Sprintf("metadata delta checkpoint %d missing", meta.DeltaSeq+1)}}, nil
+		}
+		data, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return nil, err
+		}
+		if _, _, err := verifyMetaImage(data, metaDeltaCheckpointMagic); err != nil {
+			return []metadataCheckpointFallback{{Path: path, Reason: fmt.Sprintf("metadata delta checkpoint %d: %v", seq, err)}}, nil
+		}
+		if err := decodeMetaDelta(data, meta); err != nil {
+			return nil, fmt.Errorf("metadata delta checkpoint %d: %w", seq, err)
+		}
+		if meta.DeltaSeq != seq {
+			return nil, fmt.Errorf("metadata delta checkpoint %d has sequence %d", seq, meta.DeltaSeq)
+		}
+	}
+	return nil, nil
+}
+
+func saveMetaDelta(fs afero.Fs, metaDir string, meta *metadata, seq uint64) error {
+	return writeMetaImageVerified(fs, metaDeltaPath(metaDir, seq), encodeMetaDelta(meta, meta.dirty, seq), metaDeltaCheckpointMagic)
+}
+
+// removeMetaDeltas removes the delta checkpoints with sequence numbers in
+// [from, through].
+func removeMetaDeltas(fs afero.Fs, metaDir string, from, through uint64) error {
+	seqs, err := listMetaDeltas(fs, metaDir)
+	if err != nil {
+		return err
+	}
+	var removeErr error
+	for _, seq := range seqs {
+		if seq < from || seq > through {
+			continue
+		}
+		if err := fs.Remove(metaDeltaPath(metaDir, seq)); err != nil && !os.IsNotExist(err) {
+			removeErr = errors.Join(removeErr, err)
+		}
+	}
+	return removeErr
+}
+
+// mergeMetaCheckpoint folds the delta checkpoints on disk into a new base
+// image. It reads and writes files only, so it runs without metaMu; deltas
+// written meanwhile get later sequence numbers and stay on top of the new
+// base. The replaced base becomes the previous checkpoint, so only the deltas
+// it already contained are removed; the rest let it rebuild the new base.
+func mergeMetaCheckpoint(fs afero.Fs, metaDir string, archive bool) (uint64, error) {
+	meta := newMetadata()
+	fallbacks, err := loadMetaCheckpoint(fs, metaDir, meta)
+	if err != nil {
+		return 0, err
+	}
+	prevSeq := meta.DeltaSeq
+	more, err := loadMetaDeltas(fs, metaDir, meta)
+	if err != nil {
+		return 0, err
+	}
+	if fallbacks = append(fallbacks, more...); len(fallbacks) > 0 {
+		return 0, fmt.Errorf("merge metadata checkpoint: %s", fallbacks[0].Reason)
+	}
+	compactMetadata(meta)
+	meta.dirty = nil
+	if err := saveMetaCheckpoint(fs, metaDir, meta, archive); err != nil {
+		return 0, err
+	}
+	return meta.DeltaSeq, removeMetaDeltas(fs, metaDir, 0, prevSeq)
+}
+
+// saveCheckpointImageLocked persists the in-memory metadata either as a full
+// base image or, once a binary base exists, as a delta holding only the
+// records changed since the previous checkpoint.
+func (s *Store) saveCheckpointImageLocked() error {
+	full, err := s.needsFullCheckpointLocked()
+	if err != nil {
+		return err
+	}
+	if full {
+		compactMetadata(s.meta)
+		if err := saveMetaCheckpoint(s.fs, s.metaDir, s.meta, s.retentionEnabled()); err != nil {
+			return err
+		}
+		s.metaBaseDeltaSeq = s.meta.DeltaSeq
+		s.metaNeedsFullCheckpoint = false
+		s.meta.dirty = nil
+		return nil
+	}
+	if s.meta.dirty.empty() && s.meta.TxID == s.metaCheckpointTxID {
+		return nil
+	}
+	compactDirtyMetadata(s.meta)
+	seq := s.meta.DeltaSeq + 1
+	if err := saveMetaDelta(s.fs, s.metaDir, s.meta, seq); err != nil {
+		return err
+	}
+	s.meta.DeltaSeq = seq
+	s.meta.dirty = nil
+	return nil
+}
+
+func (s *Store) needsFullCheckpointLocked() (bool, error) {
+	if s.metaNeedsFullCheckpoint {
+		return true, nil
+	}
+	if legacy, err := afero.Exists(s.fs, filepath.Join(s.metaDir, metaLegacyCheckpointFile)); err != nil || legacy {
+		return true, err
+	}
+	base, err := afero.Exists(s.fs, filepath.Join(s.metaDir, metaCheckpointFile))
+	return !base, err
+}
+
+// maybeStartMetaMergeLocked starts a background merge once enough deltas have
+// accumulated on top of the base image.
+func (s *Store) maybeStartMetaMergeLocked() {
+	if s.metaMerging || s.meta.DeltaSeq-s.metaBaseDeltaSeq < metaDeltaMergeInterval {
+		return
+	}
+	s.lifeMu.Lock()
+	if s.closing {
+		s.lifeMu.Unlock()
+		return
+	}
+	s.bgWG.Add(1)
+	s.lifeMu.Unlock()
+	s.metaMerging = true
+	archive := s.retentionEnabled()
+	go func() {
+		defer s.bgWG.Done()
+		seq, err := mergeMetaCheckpoint(s.fs, s.metaDir, archive)
+		s.metaMu.Lock()
+		defer s.metaMu.Unlock()
+		s.metaMerging = false
+		if err != nil {
+			s.lastCheckpointErr = err
+			return
+		}
+		if seq > s.metaBaseDeltaSeq {
+			s.metaBaseDeltaSeq = seq
+		}
+	}()
+}
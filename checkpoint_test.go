@@ -0,0 +1,352 @@
+package blobfs
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func checkpointTestStore(t *testing.T, store *Store) {
+	t.Helper()
+	store.metaMu.Lock()
+	err := store.checkpointMetaLocked()
+	store.metaMu.Unlock()
+	if err != nil {
+		t.Fatalf("checkpoint: %v", err)
+	}
+}
+
+func metadataJSON(t *testing.T, meta *metadata) string {
+	t.Helper()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		t.Fatalf("marshal metadata: %v", err)
+	}
+	return string(data)
+}
+
+func TestDeltaCheckpointWritesOnlyChangedRecords(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 64; i++ {
+		putTestBytes(t, store, "tenant-a", "file-"+strconv.Itoa(i), []byte(strings.Repeat("base-"+strconv.Itoa(i), 8)))
+	}
+	checkpointTestStore(t, store)
+	base, err := afero.ReadFile(fsys, "/blobfs/meta/"+metaCheckpointFile)
+	if err != nil {
+		t.Fatalf("read base checkpoint: %v", err)
+	}
+
+	putTestBytes(t, store, "tenant-a", "file-new", []byte("fresh object"))
+	if err := store.DeleteObject(testContext(t), "tenant-a", "file-3"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	after, err := afero.ReadFile(fsys, "/blobfs/meta/"+metaCheckpointFile)
+	if err != nil {
+		t.Fatalf("read base checkpoint: %v", err)
+	}
+	if string(after) != string(base) {
+		t.Fatal("delta checkpoint rewrote the base image")
+	}
+	delta, err := afero.ReadFile(fsys, metaDeltaPath("/blobfs/meta", 1))
+	if err != nil {
+		t.Fatalf("read delta: %v", err)
+	}
+	if len(delta)*4 > len(base) {
+		t.Fatalf("delta %d bytes is not much smaller than base %d bytes", len(delta), len(base))
+	}
+
+	putTestBytes(t, store, "tenant-a", "file-tail", []byte("only in txlog"))
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	store.metaMu.RLock()
+	want := metadataJSON(t, store.meta)
+	store.metaMu.RUnlock()
+	simulateCrashWithoutCheckpoint(t, store)
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if got := metadataJSON(t, reopened.meta); got != want {
+		t.Fatalf("base + delta + txlog did not compose the committed metadata")
+	}
+	if _, err := reopened.StatObject(testContext(t), "tenant-a", "file-3"); err == nil {
+		t.Fatal("deleted object visible after reopen")
+	}
+	if got := readTestBytes(t, reopened, "tenant-a", "file-tail"); string(got) != "only in txlog" {
+		t.Fatalf("tail object = %q", got)
+	}
+}
+
+func TestDeltaCheckpointCompactsOnlyWhatChangedRecordsRelease(t *testing.T) {
+	cfg := testConfig()
+	cfg.GC.SegmentDeleteDelay = time.Hour
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	for _, name := range []string{"keep", "gone"} {
+		putTestBytes(t, store, "tenant-a", name, []byte(strings.Repeat(name, 64)))
+		if err := store.sealActiveSegment(); err != nil {
+			t.Fatalf("seal: %v", err)
+		}
+	}
+	checkpointTestStore(t, store)
+	_, seg := firstChunkSnapshot(t, store, "tenant-a", "gone")
+	store.metaMu.RLock()
+	inode, err := store.resolvePathLocked("tenant-a", "gone")
+	var chunkIDs []string
+	for id := range store.meta.chunksInSegment(seg.SegmentID) {
+		chunkIDs = append(chunkIDs, id)
+	}
+	store.metaMu.RUnlock()
+	if err != nil {
+		t.Fatalf("resolve: %v", err)
+	}
+	// Garbage no op touches is left to the background merge.
+	store.metaMu.Lock()
+	store.meta.Inodes[1<<40] = &inodeRecord{InodeID: 1 << 40, TenantID: "tenant-a", Kind: fileKindFile, State: fileStateDeleted}
+	store.metaMu.Unlock()
+
+	if err := store.DeleteObject(testContext(t), "tenant-a", "gone"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	store.metaMu.RLock()
+	_, inodeKept := store.meta.Inodes[inode.InodeID]
+	_, manifestKept := store.meta.Manifests[inode.ManifestID]
+	_, plantedKept := store.meta.Inodes[1<<40]
+	liveChunks := len(store.meta.chunksInSegment(seg.SegmentID))
+	store.metaMu.RUnlock()
+	if inodeKept || manifestKept {
+		t.Fatalf("deleted file kept: inode %v manifest %v", inodeKept, manifestKept)
+	}
+	if !plantedKept {
+		t.Fatal("delta checkpoint compacted a record no op changed")
+	}
+	if liveChunks != len(chunkIDs) {
+		t.Fatalf("chunks of a live segment compacted: %d of %d left", liveChunks, len(chunkIDs))
+	}
+
+	// Deleting the segment releases its chunks, which are not dirty.
+	store.cfg.GC.SegmentDeleteDelay = -1
+	if result, err := store.RunGC(testContext(t), GCOptions{}); err != nil || result.SegmentsDeleted == 0 {
+		t.Fatalf("gc = %+v, %v", result, err)
+	}
+	checkpointTestStore(t, store)
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	if _, ok := store.meta.Segments[seg.SegmentID]; ok {
+		t.Fatal("deleted segment kept")
+	}
+	for _, id := range chunkIDs {
+		if _, ok := store.meta.Chunks[id]; ok {
+			t.Fatalf("chunk %s of the deleted segment kept", id)
+		}
+	}
+}
+
+func TestDeltaCheckpointsMergeIntoBaseInBackground(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "seed", []byte("seed"))
+	checkpointTestStore(t, store)
+	for i := 0; i < metaDeltaMergeInterval; i++ {
+		putTestBytes(t, store, "tenant-a", "file-"+strconv.Itoa(i), []byte("delta-"+strconv.Itoa(i)))
+		checkpointTestStore(t, store)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.metaMu.RLock()
+		merged := !store.metaMerging && store.metaBaseDeltaSeq == metaDeltaMergeInterval
+		store.metaMu.RUnlock()
+		if merged {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background merge did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if seqs, err := listMetaDeltas(fsys, "/blobfs/meta"); err != nil || len(seqs) != metaDeltaMergeInterval {
+		t.Fatalf("deltas rebuilding the merged base from the previous one: %v, %v", seqs, err)
+	}
+	if exists, _ := afero.Exists(fsys, "/blobfs/meta/"+metaPrevCheckpointFile); !exists {
+		t.Fatal("previous checkpoint not kept after merge")
+	}
+	base := newMetadata()
+	if _, err := loadMetaCheckpoint(fsys, "/blobfs/meta", base); err != nil {
+		t.Fatalf("load merged base: %v", err)
+	}
+	if base.DeltaSeq != metaDeltaMergeInterval {
+		t.Fatalf("merged base delta seq = %d", base.DeltaSeq)
+	}
+	putTestBytes(t, store, "tenant-a", "after-merge", []byte("after"))
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	for _, name := range []string{"seed", "file-0", "file-" + strconv.Itoa(metaDeltaMergeInterval-1), "after-merge"} {
+		if _, err := reopened.StatObject(testContext(t), "tenant-a", name); err != nil {
+			t.Fatalf("stat %s: %v", name, err)
+		}
+	}
+}
+
+func TestLoadMetadataRejectsMissingDelta(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "seed", []byte("seed"))
+	checkpointTestStore(t, store)
+	for i := 0; i < 2; i++ {
+		putTestBytes(t, store, "tenant-a", "file-"+strconv.Itoa(i), []byte("delta"))
+		checkpointTestStore(t, store)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if err := fsys.Remove(metaDeltaPath("/blobfs/meta", 1)); err != nil {
+		t.Fatalf("remove delta: %v", err)
+	}
+	if _, err := OpenFS(fsys, "/blobfs", testConfig()); err == nil || !strings.Contains(err.Error(), "missing") {
+		t.Fatalf("open with missing delta = %v", err)
+	}
+}
+
+func flipMetaFileByte(t *testing.T, fsys afero.Fs, path string) {
+	t.Helper()
+	data, err := afero.ReadFile(fsys, path)
+	if err != nil {
+		t.Fatalf("read %s: %v", path, err)
+	}
+	data[len(data)/2] ^= 0xff
+	if err := afero.WriteFile(fsys, path, data, 0o600); err != nil {
+		t.Fatalf("write %s: %v", path, err)
+	}
+}
+
+func TestCorruptBaseCheckpointFallsBackToPrevious(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "first", []byte("first"))
+	checkpointTestStore(t, store)
+	putTestBytes(t, store, "tenant-a", "second", []byte("second"))
+	store.metaMu.Lock()
+	store.metaNeedsFullCheckpoint = true
+	store.metaMu.Unlock()
+	checkpointTestStore(t, store)
+	putTestBytes(t, store, "tenant-a", "third", []byte("third"))
+	simulateCrashWithoutCheckpoint(t, store)
+	flipMetaFileByte(t, fsys, "/blobfs/meta/"+metaCheckpointFile)
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen with corrupt checkpoint: %v", err)
+	}
+	for _, name := range []string{"first", "second", "third"} {
+		if got := readTestBytes(t, reopened, "tenant-a", name); string(got) != name {
+			t.Fatalf("%s = %q", name, got)
+		}
+	}
+	health, err := reopened.Health(testContext(t))
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	if health.State != HealthDegraded || !hasHealthCheck(health, "checkpoint_load", false) {
+		t.Fatalf("checkpoint fallback was not reported in health: %+v", health)
+	}
+	diagnose, err := reopened.Diagnose(testContext(t), DiagnoseOptions{})
+	if err != nil {
+		t.Fatalf("diagnose: %v", err)
+	}
+	if diagnose.Healthy || !hasIssue(diagnose, IssueCheckpointFallback) {
+		t.Fatalf("checkpoint fallback was not diagnosed: %+v", diagnose)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	clean, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen after rewrite: %v", err)
+	}
+	defer clean.Close()
+	if len(clean.checkpointFallbacks) != 0 {
+		t.Fatalf("checkpoint still falls back after a full rewrite: %+v", clean.checkpointFallbacks)
+	}
+}
+
+func TestCorruptNewestDeltaReplaysPreviousTxlog(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		putTestBytes(t, store, "tenant-a", "file-"+strconv.Itoa(i), []byte("payload"))
+		checkpointTestStore(t, store)
+	}
+	putTestBytes(t, store, "tenant-a", "tail", []byte("tail"))
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	simulateCrashWithoutCheckpoint(t, store)
+	// The rebuilt chain stops at the delta before the damaged one.
+	store.meta.DeltaSeq = 1
+	want := metadataJSON(t, store.meta)
+	flipMetaFileByte(t, fsys, metaDeltaPath("/blobfs/meta", 2))
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen with corrupt delta: %v", err)
+	}
+	if got := metadataJSON(t, reopened.meta); got != want {
+		t.Fatal("previous delta and txlog did not rebuild the committed metadata")
+	}
+	if len(reopened.checkpointFallbacks) != 1 || !strings.Contains(reopened.checkpointFallbacks[0].Reason, "checksum") {
+		t.Fatalf("fallbacks = %+v", reopened.checkpointFallbacks)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	flipMetaFileByte(t, fsys, "/blobfs/meta/"+metaCheckpointFile)
+	if err := fsys.Remove("/blobfs/meta/" + metaPrevCheckpointFile); err != nil {
+		t.Fatalf("remove previous checkpoint: %v", err)
+	}
+	if _, err := OpenFS(fsys, "/blobfs", testConfig()); err == nil || !strings.Contains(err.Error(), "checksum") {
+		t.Fatalf("open with no usable checkpoint = %v", err)
+	}
+}
@@ -0,0 +1,161 @@
+package blobfs
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Codec ids are written to every record header and must never be reused.
+const (
+	compressionNoneID = uint32(0)
+	compressionZstdID = uint32(1)
+	compressionS2ID   = uint32(2)
+)
+
+// codec compresses segment record payloads. Levels run from 1 to maxLevel;
+// 0 selects the codec default.
+type codec struct {
+	id       uint32
+	maxLevel int
+	encode   func(raw []byte, level int) ([]byte, error)
+	decode   func(payload []byte) ([]byte, error)
+}
+
+var codecs = map[CompressionType]codec{
+	CompressionNone: {id: compressionNoneID, encode: storeRaw, decode: loadRaw},
+	CompressionZstd: {id: compressionZstdID, maxLevel: 22, encode: compressZstd, decode: decompressZstd},
+	CompressionS2:   {id: compressionS2ID, maxLevel: 3, encode: compressS2, decode: decompressS2},
+}
+
+func codecByID(id uint32) (CompressionType, codec, bool) {
+	for name, c := range codecs {
+		if c.id == id {
+			return name, c, true
+		}
+	}
+	return "", codec{}, false
+}
+
+// compressionSettings selects how new chunks are compressed.
+type compressionSettings struct {
+	codec      CompressionType
+	level      int
+	minSavings float64
+}
+
+func compressionOf(cfg Config) compressionSettings {
+	return compressionSettings{codec: cfg.Compression, level: cfg.CompressionLevel, minSavings: cfg.CompressionMinSavings}
+}
+
+func validateCompression(name CompressionType, level int, minSavings float64) error {
+	c, ok := codecs[name]
+	if !ok {
+		return fmt.Errorf("unsupported compression %q", name)
+	}
+	if level < 0 || level > c.maxLevel {
+		return fmt.Errorf("compression level %d out of range for %s", level, name)
+	}
+	if minSavings < 0 || minSavings >= 1 {
+		return fmt.Errorf("compression min savings must be within [0, 1)")
+	}
+	return nil
+}
+
+// compressPayload compresses raw as settings select; an empty codec is
+// zstd. With minSavings set, a payload that does not save that fraction of
+// raw is stored uncompressed instead. It returns the codec actually used.
+func compressPayload(settings compressionSettings, raw []byte) ([]byte, CompressionType, error) {
+	name := settings.codec
+	if name == "" {
+		name = CompressionZstd
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unsupported compression %q", name)
+	}
+	payload, err := c.encode(raw, settings.level)
+	if err != nil {
+		return nil, "", err
+	}
+	if name != CompressionNone && settings.minSavings > 0 &&
+		float64(len(raw)-len(payload)) < settings.minSavings*float64(len(raw)) {
+		return raw, CompressionNone, nil
+	}
+	return payload, name, nil
+}
+
+func storeRaw(raw []byte, _ int) ([]byte, error) {
+	return raw, nil
+}
+
+func loadRaw(payload []byte) ([]byte, error) {
+	return payload, nil
+}
+
+// zstdEncoderPools holds one encoder pool per level.
+var zstdEncoderPools sync.Map
+
+func zstdEncoderPool(level int) *sync.Pool {
+	if pool, ok := zstdEncoderPools.Load(level); ok {
+		return pool.(*sync.Pool)
+	}
+	pool, _ := zstdEncoderPools.LoadOrStore(level, &sync.Pool{New: func() any {
+		opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+		if level > 0 {
+			opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		}
+		enc, err := zstd.NewWriter(nil, opts...)
+		if err != nil {
+			return err
+		}
+		return enc
+	}})
+	return pool.(*sync.Pool)
+}
+
+var zstdDecoderPool = sync.Pool{New: func() any {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return err
+	}
+	return dec
+}}
+
+func compressZstd(raw []byte, level int) ([]byte, error) {
+	pool := zstdEncoderPool(level)
+	item := pool.Get()
+	if err, ok := item.(error); ok {
+		return nil, err
+	}
+	enc := item.(*zstd.Encoder)
+	defer pool.Put(enc)
+	return enc.EncodeAll(raw, make([]byte, 0, len(raw))), nil
+}
+
+func decompressZstd(payload []byte) ([]byte, error) {
+	item := zstdDecoderPool.Get()
+	if err, ok := item.(error); ok {
+		return nil, err
+	}
+	dec := item.(*zstd.Decoder)
+	defer zstdDecoderPool.Put(dec)
+	return dec.DecodeAll(payload, nil)
+}
+
+// compressS2 maps levels 1 to 3 to s2's default, better, and best modes.
+func compressS2(raw []byte, level int) ([]byte, error) {
+	switch level {
+	case 2:
+		return s2.EncodeBetter(nil, raw), nil
+	case 3:
+		return s2.EncodeBest(nil, raw), nil
+	}
+	return s2.Encode(nil, raw), nil
+}
+
+func decompressS2(payload []byte) ([]byte, error) {
+	return s2.Decode(nil, payload)
+}
@@ -0,0 +1,121 @@
+package blobfs
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestCodecsAreRecordedPerChunkAndReadBack(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	data := bytes.Repeat([]byte("compressible payload "), 8)
+	settings := []struct {
+		codec CompressionType
+		level int
+	}{
+		{CompressionZstd, 19},
+		{CompressionS2, 3},
+		{CompressionNone, 0},
+		{CompressionS2, 0},
+	}
+	for i, setting := range settings {
+		cfg := testConfig()
+		cfg.Chunking = ChunkingConfig{MinSize: 256, AvgSize: 512, MaxSize: 1024}
+		cfg.Compression = setting.codec
+		cfg.CompressionLevel = setting.level
+		store, err := OpenFS(fsys, "/blobfs", cfg)
+		if err != nil {
+			t.Fatalf("open with %s: %v", setting.codec, err)
+		}
+		name := string(setting.codec) + string(rune('0'+i))
+		putTestBytes(t, store, "tenant-a", name, append(data, byte(i)))
+		chunk := firstChunkRecord(t, store, "tenant-a", name)
+		if chunk.Compression != string(setting.codec) {
+			t.Fatalf("%s chunk compression = %q", name, chunk.Compression)
+		}
+		if setting.codec == CompressionNone && chunk.StoredSize != chunk.RawSize {
+			t.Fatalf("uncompressed chunk stored %d of %d bytes", chunk.StoredSize, chunk.RawSize)
+		}
+		// Chunks written under earlier settings stay readable.
+		for j := 0; j <= i; j++ {
+			prev := string(settings[j].codec) + string(rune('0'+j))
+			if got := readTestBytes(t, store, "tenant-a", prev); !bytes.Equal(got, append(data, byte(j))) {
+				t.Fatalf("%s read back %q", prev, got)
+			}
+		}
+		if err := store.Close(); err != nil {
+			t.Fatalf("close: %v", err)
+		}
+	}
+}
+
+func TestAdaptiveCompressionStoresIncompressibleChunksRaw(t *testing.T) {
+	cfg := testConfig()
+	cfg.Chunking = ChunkingConfig{MinSize: 256, AvgSize: 512, MaxSize: 1024}
+	cfg.CompressionMinSavings = 0.1
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	noise := make([]byte, 200)
+	rand.New(rand.NewSource(1)).Read(noise)
+	putTestBytes(t, store, "tenant-a", "noise", noise)
+	putTestBytes(t, store, "tenant-a", "text", bytes.Repeat([]byte("text"), 50))
+	if chunk := firstChunkRecord(t, store, "tenant-a", "noise"); chunk.Compression != string(CompressionNone) || chunk.StoredSize != chunk.RawSize {
+		t.Fatalf("incompressible chunk = %s, %d of %d bytes", chunk.Compression, chunk.StoredSize, chunk.RawSize)
+	}
+	if chunk := firstChunkRecord(t, store, "tenant-a", "text"); chunk.Compression != string(CompressionZstd) {
+		t.Fatalf("compressible chunk = %s", chunk.Compression)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "noise"); !bytes.Equal(got, noise) {
+		t.Fatal("raw chunk read back differently")
+	}
+}
+
+func TestCompressionSettingsAreValidated(t *testing.T) {
+	for _, edit := range []func(*Config){
+		func(cfg *Config) { cfg.Compression = "lz4" },
+		func(cfg *Config) { cfg.CompressionLevel = 23 },
+		func(cfg *Config) { cfg.Compression = CompressionS2; cfg.CompressionLevel = 4 },
+		func(cfg *Config) { cfg.Compression = CompressionNone; cfg.CompressionLevel = 1 },
+		func(cfg *Config) { cfg.CompressionMinSavings = 1 },
+	} {
+		cfg := testConfig()
+		edit(&cfg)
+		if _, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg); err == nil {
+			t.Fatalf("open accepted %s level %d savings %v", cfg.Compression, cfg.CompressionLevel, cfg.CompressionMinSavings)
+		}
+	}
+	cfg := testConfig()
+	cfg.CompressionLevel = 19
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	if err := store.SetTenantConfig(ctx, "tenant-a", TenantConfig{Compression: CompressionS2}); err != nil {
+		t.Fatalf("s2 override with default level: %v", err)
+	}
+	if err := store.SetTenantConfig(ctx, "tenant-a", TenantConfig{CompressionLevel: 30}); err == nil {
+		t.Fatal("level override out of range accepted")
+	}
+	putTestBytes(t, store, "tenant-a", "a", []byte("tenant codec"))
+	if chunk := firstChunkRecord(t, store, "tenant-a", "a"); chunk.Compression != string(CompressionS2) {
+		t.Fatalf("tenant chunk compression = %s", chunk.Compression)
+	}
+}
+
+func firstChunkRecord(t *testing.T, store *Store, tenantID, path string) chunkRecord {
+	t.Helper()
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	inode, err := store.resolvePathLocked(tenantID, path)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", path, err)
+	}
+	return *store.meta.Chunks[store.meta.Manifests[inode.ManifestID].Chunks[0].ChunkID]
+}
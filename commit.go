@@ -0,0 +1,393 @@
+package blobfs
+
+import (
+	"sync"
+
+	"github.com/spf13/afero"
+)
+
+// metaLock guards Store.meta. Transactions queued for the txlog are applied
+// to meta only while it is write-locked: Lock re-applies those that are not
+// durable yet, so writers build on them, and Unlock takes them out again.
+// Readers holding the read lock therefore see durable state only, without
+// waiting for any sync.
+type metaLock struct {
+	sync.RWMutex
+	store *Store
+}
+
+func (l *metaLock) Lock() {
+	l.RWMutex.Lock()
+	if l.store != nil {
+		l.store.restageMetaLocked()
+	}
+}
+
+func (l *metaLock) Unlock() {
+	if l.store != nil {
+		l.store.unstageMetaLocked()
+	}
+	l.RWMutex.Unlock()
+}
+
+// metaCommitGroup batches metadata transactions from concurrent committers so
+// one leader can write several txlog frames with a single sync. Batches are
+// written in order, so the transactions of a store are always durable up to
+// some point, followed by either pending or failed ones.
+type metaCommitGroup struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	queue   []*pendingMetaTx
+	leading bool
+	failErr error
+}
+
+// pendingMetaTx is a queued transaction that waits for its txlog frame to
+// become durable. Until then it is applied to meta only while metaMu is
+// write-locked, with undo recording how to take it out again.
+type pendingMetaTx struct {
+	tx          metaTx
+	frame       []byte
+	log         afero.File
+	logName     string
+	undo        []func(*metadata)
+	prevTxID    uint64
+	prevUpdated int64
+	events      []WatchEvent
+	done        bool
+	err         error
+	superErr    error
+}
+
+func newMetaCommitGroup() *metaCommitGroup {
+	g := &metaCommitGroup{}
+	g.cond = sync.NewCond(&g.mu)
+	return g
+}
+
+// enqueue adds a transaction to the next batch. Once a batch has failed,
+// later transactions were built on state that is about to be taken out, so
+// they fail immediately instead of reaching the txlog.
+func (g *metaCommitGroup) enqueue(p *pendingMetaTx) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.failErr != nil {
+		p.err = g.failErr
+		p.done = true
+		return
+	}
+	g.queue = append(g.queue, p)
+}
+
+// await blocks until p is durable or failed. The first waiter without an
+// active leader becomes the leader and drains the queue batch by batch.
+func (g *metaCommitGroup) await(s *Store, p *pendingMetaTx) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for !p.done && g.leading {
+		g.cond.Wait()
+	}
+	if p.done {
+		return
+	}
+	g.leading = true
+	for len(g.queue) > 0 {
+		batch := g.queue
+		g.queue = nil
+		g.mu.Unlock()
+		last := batch[len(batch)-1]
+		var superErr error
+		err := s.writeMetaBatch(batch)
+		if err == nil {
+			superErr = saveSuperBlock(s.fs, s.metaDir, last.tx.TxID, last.logName)
+		}
+		g.mu.Lock()
+		if err != nil {
+			batch = append(batch, g.queue...)
+			g.queue = nil
+			g.failErr = err
+		}
+		for _, item := range batch {
+			item.err = err
+			item.superErr = superErr
+			item.done = true
+		}
+		g.cond.Broadcast()
+	}
+	g.leading = false
+	g.cond.Broadcast()
+}
+
+// waitIdle blocks until every queued transaction has been written or failed.
+// It is safe to call with metaMu held because leaders never take metaMu.
+func (g *metaCommitGroup) waitIdle() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for g.leading || len(g.queue) > 0 {
+		g.cond.Wait()
+	}
+}
+
+// durable returns how many transactions at the front of txs are durable and,
+// if the one after them failed, the error that failed it.
+func (g *metaCommitGroup) durable(txs []*pendingMetaTx) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for i, p := range txs {
+		if !p.done || p.err != nil {
+			return i, p.err
+		}
+	}
+	return len(txs), nil
+}
+
+// clearFailure lets new transactions through again once every failed one
+// has been taken out of meta.
+func (g *metaCommitGroup) clearFailure() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.failErr = nil
+}
+
+func (s *Store) writeMetaBatch(batch []*pendingMetaTx) error {
+	frames := make([][]byte, 0, len(batch))
+	for _, item := range batch {
+		frames = append(frames, item.frame)
+	}
+	return writeMetaFrames(batch[0].log, frames)
+}
+
+// stage applies p to meta and records how to take it out again.
+func (p *pendingMetaTx) stage(meta *metadata) {
+	p.undo = captureMetaUndo(meta, p.tx.Ops)
+	p.prevTxID = meta.TxID
+	p.prevUpdated = meta.UpdatedAt
+	applyMetaTx(meta, p.tx)
+}
+
+// unstage takes p, the last transaction applied to meta, out again.
+func (p *pendingMetaTx) unstage(meta *metadata) {
+	for i := len(p.undo) - 1; i >= 0; i-- {
+		p.undo[i](meta)
+	}
+	p.undo = nil
+	meta.TxID = p.prevTxID
+	meta.UpdatedAt = p.prevUpdated
+}
+
+// restageMetaLocked re-applies the queued transactions when metaMu has just
+// been write-locked and settles those that finished meanwhile.
+func (s *Store) restageMetaLocked() {
+	for _, p := range s.metaInflight {
+		p.stage(s.meta)
+	}
+	s.settleMetaLocked()
+}
+
+// unstageMetaLocked settles the queued transactions before metaMu is
+// unlocked and takes the ones that are not durable yet out of meta.
+func (s *Store) unstageMetaLocked() {
+	s.settleMetaLocked()
+	for i := len(s.metaInflight) - 1; i >= 0; i-- {
+		s.metaInflight[i].unstage(s.meta)
+	}
+}
+
+// settleMetaLocked keeps the durable transactions at the front of the queue
+// in meta for good and publishes their watch events. Failed ones are taken
+// out, newest first, together with the pending ones built on them, and the
+// error that failed them is returned. Every queued transaction must be
+// applied to meta.
+func (s *Store) settleMetaLocked() error {
+	n, err := s.metaGroup.durable(s.metaInflight)
+	if n > 0 {
+		s.publishWatchEvents(s.metaInflight[:n])
+		s.metaInflight = append([]*pendingMetaTx(nil), s.metaInflight[n:]...)
+	}
+	if err == nil {
+		return nil
+	}
+	for i := len(s.metaInflight) - 1; i >= 0; i-- {
+		s.metaInflight[i].unstage(s.meta)
+	}
+	s.metaInflight = nil
+	s.metaGroup.clearFailure()
+	return err
+}
+
+// stageMetaLocked applies ops in memory without committing them, so later
+// changes of a batch can build on them, and returns how to undo them.
+func stageMetaLocked(meta *metadata, ops []metaOp) []func(*metadata) {
+	undo := captureMetaUndo(meta, ops)
+	for _, op := range ops {
+		applyMetaOp(meta, op)
+	}
+	return undo
+}
+
+// captureMetaUndo records the state each op is about to overwrite so a queued
+// transaction can be taken out of meta again.
+func captureMetaUndo(meta *metadata, ops []metaOp) []func(*metadata) {
+	undo := make([]func(*metadata), 0, len(ops)+1)
+	if restore := captureUsageUndo(meta, ops); restore != nil {
+		undo = append(undo, restore)
+	}
+	for _, op := range ops {
+		switch op.Type {
+		case "put_tenant", "del_tenant":
+			tenantID := op.TenantID
+			prev, ok := meta.Tenants[tenantID]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Tenants[tenantID] = prev
+				} else {
+					delete(meta.Tenants, tenantID)
+				}
+			})
+		case "put_inode":
+			if op.Inode == nil {
+				continue
+			}
+			id := op.Inode.InodeID
+			prev, ok := meta.Inodes[id]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Inodes[id] = prev
+				} else {
+					delete(meta.Inodes, id)
+				}
+			})
+		case "put_dirent", "delete_dirent":
+			parentID, name := op.ParentID, op.Name
+			prev, ok := meta.DirEntries[parentID][name]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.putListName(parentID, name, prev)
+					if meta.DirEntries[parentID] == nil {
+						meta.DirEntries[parentID] = map[string]uint64{}
+					}
+					meta.DirEntries[parentID][name] = prev
+					return
+				}
+				meta.deleteListName(parentID, name)
+				if entries := meta.DirEntries[parentID]; entries != nil {
+					delete(entries, name)
+					if len(entries) == 0 {
+						delete(meta.DirEntries, parentID)
+					}
+				}
+			})
+		case "put_manifest":
+			if op.Manifest == nil {
+				continue
+			}
+			id := op.Manifest.ManifestID
+			prev, ok := meta.Manifests[id]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Manifests[id] = prev
+				} else {
+					delete(meta.Manifests, id)
+				}
+			})
+		case "put_chunk":
+			if op.Chunk == nil {
+				continue
+			}
+			id := op.Chunk.ChunkID
+			prev, ok := meta.Chunks[id]
+			undo = append(undo, func(meta *metadata) {
+				if ok && prev != nil {
+					setChunkRecord(meta, id, prev)
+				} else {
+					setChunkRecord(meta, id, nil)
+				}
+			})
+		case "put_segment":
+			if op.Segment == nil {
+				continue
+			}
+			id := op.Segment.SegmentID
+			prev, ok := meta.Segments[id]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Segments[id] = prev
+				} else {
+					delete(meta.Segments, id)
+				}
+			})
+		case "put_snapshot", "delete_snapshot":
+			key := snapshotKey(op.TenantID, op.Name)
+			if op.Snapshot != nil {
+				key = snapshotKey(op.Snapshot.TenantID, op.Snapshot.Name)
+			}
+			prev, ok := meta.Snapshots[key]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Snapshots[key] = prev
+				} else {
+					delete(meta.Snapshots, key)
+				}
+			})
+		case "put_tenant_settings", "delete_tenant_settings":
+			tenantID := op.TenantID
+			if op.Settings != nil {
+				tenantID = op.Settings.TenantID
+			}
+			prev, ok := meta.TenantSettings[tenantID]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.TenantSettings[tenantID] = prev
+				} else {
+					delete(meta.TenantSettings, tenantID)
+				}
+			})
+		case "put_versions", "delete_versions":
+			key := versionKey(op.TenantID, op.Name)
+			if op.Versions != nil {
+				key = versionKey(op.Versions.TenantID, op.Versions.Path)
+			}
+			prev, ok := meta.Versions[key]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Versions[key] = prev
+				} else {
+					delete(meta.Versions, key)
+				}
+			})
+		case "put_trash", "delete_trash":
+			id := op.ChildID
+			if op.Trash != nil {
+				id = op.Trash.InodeID
+			}
+			prev, ok := meta.Trash[id]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Trash[id] = prev
+				} else {
+					delete(meta.Trash, id)
+				}
+			})
+		case "put_keyring", "delete_keyring":
+			scope := op.TenantID
+			if op.Keyring != nil {
+				scope = op.Keyring.Scope
+			}
+			prev, ok := meta.Keyrings[scope]
+			undo = append(undo, func(meta *metadata) {
+				if ok {
+					meta.Keyrings[scope] = prev
+				} else {
+					delete(meta.Keyrings, scope)
+				}
+			})
+		case "append_gcrun", "put_gcrun":
+			prev := meta.GC
+			prev.Recent = append([]gcRun(nil), meta.GC.Recent...)
+			undo = append(undo, func(meta *metadata) {
+				meta.GC = prev
+			})
+		}
+	}
+	return undo
+}
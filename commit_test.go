@@ -0,0 +1,304 @@
+package blobfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// syncGateFS lets a test block the next sync of a file whose path contains
+// match, or of the txlog when match is empty.
+type syncGateFS struct {
+	afero.Fs
+	match   string
+	mu      sync.Mutex
+	syncs   int
+	blocked chan struct{}
+	release chan struct{}
+}
+
+func (f *syncGateFS) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	file, err := f.Fs.OpenFile(name, flag, perm)
+	match := f.match
+	if match == "" {
+		match = "/txlog/"
+	}
+	if err != nil || !strings.Contains(filepath.ToSlash(name), match) {
+		return file, err
+	}
+	return &syncGateFile{File: file, fs: f}, nil
+}
+
+func (f *syncGateFS) gateNextSync() {
+	f.mu.Lock()
+	f.blocked = make(chan struct{})
+	f.release = make(chan struct{})
+	f.mu.Unlock()
+}
+
+func (f *syncGateFS) syncCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.syncs
+}
+
+type syncGateFile struct {
+	afero.File
+	fs *syncGateFS
+}
+
+func (f *syncGateFile) Sync() error {
+	f.fs.mu.Lock()
+	f.fs.syncs++
+	blocked, release := f.fs.blocked, f.fs.release
+	f.fs.blocked, f.fs.release = nil, nil
+	f.fs.mu.Unlock()
+	if blocked != nil {
+		close(blocked)
+		<-release
+	}
+	return f.File.Sync()
+}
+
+func queuedMetaTx(store *Store) int {
+	store.metaGroup.mu.Lock()
+	defer store.metaGroup.mu.Unlock()
+	return len(store.metaGroup.queue)
+}
+
+func TestGroupCommitBatchesConcurrentTransactionsIntoOneSync(t *testing.T) {
+	fsys := &syncGateFS{Fs: afero.NewMemMapFs()}
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a", 0o755); err != nil {
+		t.Fatalf("mkdirall: %v", err)
+	}
+	fsys.gateNextSync()
+	blocked := fsys.blocked
+	release := fsys.release
+	leaderErr := make(chan error, 1)
+	go func() {
+		leaderErr <- store.Mkdir("tenant-a/leader", 0o755)
+	}()
+	<-blocked
+	before := fsys.syncCount()
+
+	const followers = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, followers)
+	for i := 0; i < followers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- store.Mkdir("tenant-a/follower-"+strconv.Itoa(i), 0o755)
+		}(i)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for queuedMetaTx(store) < followers {
+		if time.Now().After(deadline) {
+			t.Fatalf("followers did not queue, queued=%d", queuedMetaTx(store))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-leaderErr; err != nil {
+		t.Fatalf("leader mkdir: %v", err)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("follower mkdir: %v", err)
+		}
+	}
+	if got := fsys.syncCount() - before; got != 1 {
+		t.Fatalf("followers used %d txlog syncs, want 1", got)
+	}
+	txid := store.meta.TxID
+	simulateCrashWithoutCheckpoint(t, store)
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if reopened.meta.TxID != txid {
+		t.Fatalf("replayed txid = %d, want %d", reopened.meta.TxID, txid)
+	}
+	for i := 0; i < followers; i++ {
+		if _, err := reopened.Stat("tenant-a/follower-" + strconv.Itoa(i)); err != nil {
+			t.Fatalf("stat follower %d after replay: %v", i, err)
+		}
+	}
+}
+
+func TestGroupCommitFailureRollsBackQueuedTransactions(t *testing.T) {
+	fsys := &faultFS{Fs: afero.NewMemMapFs()}
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	if err := store.MkdirAll("tenant-a", 0o755); err != nil {
+		t.Fatalf("mkdirall: %v", err)
+	}
+	store.metaMu.Lock()
+	txid := store.meta.TxID
+	first := &pendingMetaTx{tx: metaTx{TxID: txid + 1, Ops: []metaOp{{Type: "put_tenant", TenantID: "tenant-b", ChildID: 99}}}}
+	first.stage(store.meta)
+	first.done, first.err = true, errInjectedFSFault
+	store.metaInflight = append(store.metaInflight, first)
+	store.metaGroup.failErr = errInjectedFSFault
+	err = store.commitMetaLocked([]metaOp{{Type: "put_tenant", TenantID: "tenant-c", ChildID: 100}})
+	_, hasB := store.meta.Tenants["tenant-b"]
+	_, hasC := store.meta.Tenants["tenant-c"]
+	gotTxID := store.meta.TxID
+	store.metaMu.Unlock()
+	if !errors.Is(err, errInjectedFSFault) {
+		t.Fatalf("commit after failed batch = %v, want injected fault", err)
+	}
+	if hasB || hasC || gotTxID != txid {
+		t.Fatalf("failed transactions were not rolled back: b=%v c=%v txid=%d want %d", hasB, hasC, gotTxID, txid)
+	}
+	if _, err := store.Put(testContext(t), "tenant-a", "after", bytes.NewReader([]byte("ok")), nil); err != nil {
+		t.Fatalf("put after rollback: %v", err)
+	}
+}
+
+func TestReadersSeeOnlyDurableTransactionsWithoutWaiting(t *testing.T) {
+	fsys := &syncGateFS{Fs: afero.NewMemMapFs()}
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	if err := store.MkdirAll("tenant-a", 0o755); err != nil {
+		t.Fatalf("mkdirall: %v", err)
+	}
+	fsys.gateNextSync()
+	blocked := fsys.blocked
+	release := fsys.release
+	mkdirErr := make(chan error, 1)
+	go func() {
+		mkdirErr <- store.Mkdir("tenant-a/pending", 0o755)
+	}()
+	<-blocked
+
+	// The sync stays blocked: readers neither wait for it nor see the
+	// directory, and a writer still builds on it.
+	if _, err := store.Stat("tenant-a/pending"); !errors.Is(err, fs.ErrNotExist) {
+		close(release)
+		t.Fatalf("stat before the txlog sync = %v, want not exist", err)
+	}
+	innerErr := make(chan error, 1)
+	go func() {
+		innerErr <- store.Mkdir("tenant-a/pending/inner", 0o755)
+	}()
+	deadline := time.Now().Add(5 * time.Second)
+	for queuedMetaTx(store) < 1 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := store.Stat("tenant-a/pending/inner"); !errors.Is(err, fs.ErrNotExist) {
+		close(release)
+		t.Fatalf("stat of the queued child = %v, want not exist", err)
+	}
+	close(release)
+	if err := <-mkdirErr; err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := <-innerErr; err != nil {
+		t.Fatalf("mkdir inner: %v", err)
+	}
+	if _, err := store.Stat("tenant-a/pending/inner"); err != nil {
+		t.Fatalf("stat after sync: %v", err)
+	}
+}
+
+func TestReadersProgressUnderContinuousWriters(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.MkdirAll("tenant-a/dir", 0o755); err != nil {
+		t.Fatalf("mkdirall: %v", err)
+	}
+	stop := make(chan struct{})
+	var writers sync.WaitGroup
+	writeErrs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if err := store.Mkdir("tenant-a/dir/"+strconv.Itoa(w)+"-"+strconv.Itoa(i), 0o755); err != nil {
+					writeErrs <- err
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Every reader finishes its reads while the writers never pause, and
+	// each name it lists resolves.
+	var readers sync.WaitGroup
+	readErrs := make(chan error, 4)
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for i := 0; i < 50; i++ {
+				dir, err := store.Open("tenant-a/dir")
+				if err != nil {
+					readErrs <- err
+					return
+				}
+				names, err := dir.Readdirnames(-1)
+				dir.Close()
+				if err != nil {
+					readErrs <- err
+					return
+				}
+				for _, name := range names {
+					if _, err := store.Stat("tenant-a/dir/" + name); err != nil {
+						readErrs <- err
+						return
+					}
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		readers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(30 * time.Second):
+		t.Error("readers starved by continuous writers")
+	}
+	close(stop)
+	writers.Wait()
+	<-done
+	close(readErrs)
+	close(writeErrs)
+	for err := range readErrs {
+		t.Fatalf("read: %v", err)
+	}
+	for err := range writeErrs {
+		t.Fatalf("write: %v", err)
+	}
+}
@@ -1,10 +1,13 @@
 package blobfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
 	"time"
+
+	"github.com/spf13/afero"
 )
 
 // CompressionType identifies the segment payload compression algorithm.
@@ -17,9 +20,17 @@ type ChecksumType string
 type DedupScope string
 
 const (
-	// CompressionZstd stores segment payloads with zstd compression.
+	// CompressionNone stores segment payloads uncompressed.
+	CompressionNone CompressionType = "none"
+
+	// CompressionZstd stores segment payloads with zstd compression; levels
+	// follow the zstd scale from 1 to 22.
 	CompressionZstd CompressionType = "zstd"
 
+	// CompressionS2 stores segment payloads with S2; levels 1 to 3 select the
+	// default, better, and best modes.
+	CompressionS2 CompressionType = "s2"
+
 	// ChecksumCRC32C validates compressed segment payloads with CRC32C.
 	ChecksumCRC32C ChecksumType = "crc32c"
 
@@ -31,19 +42,65 @@ const (
 )
 
 // Config controls chunking, segment layout, VFS write sessions, and GC behavior.
+// CompressionLevel 0 selects the codec default. A positive
+// CompressionMinSavings stores a chunk uncompressed when compression saves
+// less than that fraction of its size. A KeyProvider, when set, encrypts new
+// chunk payloads. Parity adds erasure-coded parity to sealed segments.
 type Config struct {
-	SegmentSize          int64
-	MaxFileSize          int64
-	MaxTenantLength      int
-	MaxPathLength        int
-	MaxComponentLength   int
-	MaxOpenWriteSessions int
-	AllowExecutableFiles bool
-	Compression          CompressionType
-	Checksum             ChecksumType
-	DedupScope           DedupScope
-	Chunking             ChunkingConfig
-	GC                   GCConfig
+	SegmentSize           int64
+	SegmentIdleTimeout    time.Duration
+	MaxFileSize           int64
+	MaxTenantLength       int
+	MaxPathLength         int
+	MaxComponentLength    int
+	MaxOpenWriteSessions  int
+	AllowExecutableFiles  bool
+	Compression           CompressionType
+	CompressionLevel      int
+	CompressionMinSavings float64
+	Checksum              ChecksumType
+	DedupScope            DedupScope
+	Chunking              ChunkingConfig
+	GC                    GCConfig
+	Retention             RetentionConfig
+	KeyProvider           KeyProvider
+	Parity                ParityConfig
+}
+
+// ParityConfig adds Reed-Solomon parity to segments when they are sealed.
+// Each stripe of a segment is split into DataShards shards that get
+// ParityShards parity shards, so up to ParityShards damaged shards per
+// stripe can be rebuilt. Parity is disabled while ParityShards is zero;
+// DataShards defaults to 10.
+type ParityConfig struct {
+	DataShards   int
+	ParityShards int
+}
+
+// KeyProvider supplies the master keys that wrap the per-scope data keys
+// chunks are encrypted with. Each dedup scope, which is a tenant or the
+// global scope, has its own data keys. Keys are 32-byte AES-256 keys. Key
+// must keep returning every master key still wrapping a data key.
+type KeyProvider interface {
+	// CurrentKey returns the id and key new data keys are wrapped with.
+	CurrentKey(ctx context.Context) (id string, key []byte, err error)
+	// Key returns the master key with the given id.
+	Key(ctx context.Context, id string) ([]byte, error)
+}
+
+// ScopeKeyProvider is a KeyProvider that also keeps one secret key per dedup
+// scope outside the store. Data keys created through it are wrapped under a
+// key derived from both the master key and the scope key, so destroying the
+// scope key makes every copy of them unusable, including those left in
+// checkpoints, txlogs and retained history. Shredding a tenant needs one.
+type ScopeKeyProvider interface {
+	KeyProvider
+	// ScopeKey returns the 32-byte key of scope. With create, a scope that
+	// has none, or whose key was destroyed, gets a new one; without it that
+	// is an error.
+	ScopeKey(ctx context.Context, scope string, create bool) ([]byte, error)
+	// DestroyScopeKey destroys the key of scope for good.
+	DestroyScopeKey(ctx context.Context, scope string) error
 }
 
 // ChunkingConfig controls FastCDC-style content-defined chunking for large files.
@@ -63,6 +120,286 @@ type GCConfig struct {
 	BackgroundGCInterval   time.Duration
 }
 
+// RetentionConfig keeps retired metadata generations so RestoreToTx and
+// RestoreToTime can rebuild earlier states. Retention is disabled when both
+// fields are zero; a generation is kept while either limit still covers it.
+type RetentionConfig struct {
+	Generations int
+	MaxAge      time.Duration
+}
+
+// RestoreOptions controls how RestoreToTx and RestoreToTime open a restore point.
+type RestoreOptions struct {
+	// TargetDir, when set, receives a writable copy of the restored metadata and
+	// every segment it references. Without it the restore point opens read-only.
+	TargetDir string
+	// TargetFS is the filesystem for TargetDir. It defaults to the store's filesystem.
+	TargetFS afero.Fs
+}
+
+// WatchEventType names the namespace change carried by a WatchEvent.
+type WatchEventType string
+
+const (
+	// WatchCreate reports a new file or directory.
+	WatchCreate WatchEventType = "create"
+	// WatchOverwrite reports new content for an existing file.
+	WatchOverwrite WatchEventType = "overwrite"
+	// WatchDelete reports a removed file or directory.
+	WatchDelete WatchEventType = "delete"
+	// WatchRename reports a move from OldPath to Path.
+	WatchRename WatchEventType = "rename"
+	// WatchMetadata reports changed options, mode, owner, or times.
+	WatchMetadata WatchEventType = "metadata"
+	// WatchTenantDelete reports that a whole tenant namespace was deleted.
+	WatchTenantDelete WatchEventType = "tenant_delete"
+)
+
+// WatchFilter limits a watch to one tenant and to paths under a prefix.
+// Empty fields match everything.
+type WatchFilter struct {
+	TenantID   string
+	PathPrefix string
+}
+
+// WatchEvent describes one committed namespace change. Events from the same
+// transaction share a TxID.
+type WatchEvent struct {
+	TxID       uint64
+	Type       WatchEventType
+	TenantID   string
+	Path       string
+	OldPath    string
+	IsDir      bool
+	Generation uint64
+	Time       time.Time
+}
+
+// SnapshotInfo describes a read-only tenant snapshot. TxID is the last
+// transaction the snapshot includes.
+type SnapshotInfo struct {
+	TenantID  string
+	Name      string
+	TxID      uint64
+	CreatedAt time.Time
+	Files     int
+	Dirs      int
+	Bytes     int64
+}
+
+// VersioningConfig controls per-tenant object versioning. While Enabled,
+// overwrites and deletes keep the previous content as a noncurrent version.
+// RunGC expires noncurrent versions beyond MaxVersions per path or older than
+// MaxAge; zero disables the corresponding limit.
+type VersioningConfig struct {
+	Enabled     bool
+	MaxVersions int
+	MaxAge      time.Duration
+}
+
+// ObjectVersion describes one version of a path. VersionID is the Generation
+// the object had while the version was current.
+type ObjectVersion struct {
+	Path         string
+	VersionID    uint64
+	IsLatest     bool
+	DeleteMarker bool
+	Size         int64
+	FileHash     string
+	ModTime      time.Time
+	NoncurrentAt time.Time
+	Options      map[string]string
+}
+
+// TrashConfig controls the per-tenant trash. While Enabled, deleted files,
+// directory trees, and whole tenants move to the trash of their tenant instead
+// of becoming garbage, and can be brought back with Restore. GC reclaims trash
+// entries older than MaxAge; zero keeps them until EmptyTrash.
+type TrashConfig struct {
+	Enabled bool
+	MaxAge  time.Duration
+}
+
+// TrashEntry describes a node in the trash. ID is stable until the entry is
+// restored or reclaimed; an empty Path is a deleted tenant.
+type TrashEntry struct {
+	ID        uint64
+	TenantID  string
+	Path      string
+	IsDir     bool
+	DeletedAt time.Time
+	// ExpiresAt is zero when the entry is kept until EmptyTrash.
+	ExpiresAt time.Time
+}
+
+// TenantConfig overrides store-wide Config settings for one tenant. Zero
+// fields inherit the store value; the merged settings must pass the same
+// validation as Config. DedupScope decides whether the tenant's new writes
+// share chunks with other global tenants; existing data keeps the scope it
+// was written with. Overriding Compression also replaces the store
+// CompressionLevel, with 0 selecting the codec default. SafetyWindow is how
+// long GC keeps unreferenced chunks the tenant wrote first; a negative value
+// keeps none.
+type TenantConfig struct {
+	MaxFileSize      int64
+	Compression      CompressionType
+	CompressionLevel int
+	DedupScope       DedupScope
+	Chunking         ChunkingConfig
+	SafetyWindow     time.Duration
+}
+
+// Quota limits what a tenant may store; zero leaves a dimension unlimited.
+// LogicalBytes counts the sizes of files and their noncurrent versions,
+// PhysicalBytes the compressed chunk bytes the tenant wrote first after
+// dedup, and Objects the files. Trashed files keep counting until reclaimed.
+type Quota struct {
+	LogicalBytes  int64
+	PhysicalBytes int64
+	Objects       int64
+}
+
+// TenantUsage is what a tenant currently stores, measured as in Quota.
+type TenantUsage struct {
+	LogicalBytes  int64
+	PhysicalBytes int64
+	Objects       int64
+}
+
+// LifecycleRule expires data below Prefix, a path matched by whole
+// components; an empty Prefix covers the whole tenant. Zero durations disable
+// the corresponding action. Expired objects are deleted like DeleteObject, so
+// a versioned tenant keeps them as noncurrent versions behind a delete marker.
+type LifecycleRule struct {
+	ID     string
+	Prefix string
+	// ExpireAfter deletes files whose modification time is older than this.
+	ExpireAfter time.Duration
+	// NoncurrentExpireAfter drops versions that have been noncurrent longer
+	// than this.
+	NoncurrentExpireAfter time.Duration
+	// AbortSessionsAfter discards VFS write sessions opened longer ago than
+	// this without being closed.
+	AbortSessionsAfter time.Duration
+}
+
+// LifecycleResult reports what one RunLifecycle pass expired. Expired lists
+// every deleted file and dropped version, Failed the files that were due but
+// could not be deleted.
+type LifecycleResult struct {
+	ObjectsExpired  int
+	VersionsExpired int
+	SessionsAborted int
+	Expired         []ExpiredObject
+	Failed          []LifecycleFailure
+}
+
+// ExpiredObject is a file or version removed by expiry. VersionID is the
+// Generation of a deleted file, which a versioned tenant keeps as a
+// noncurrent version, or the VersionID of a dropped version.
+type ExpiredObject struct {
+	TenantID  string
+	Path      string
+	VersionID uint64
+	// Noncurrent is set for dropped versions and delete markers.
+	Noncurrent bool
+}
+
+// LifecycleFailure is a file RunLifecycle skipped because deleting it failed,
+// for example with ErrObjectLocked.
+type LifecycleFailure struct {
+	ExpiredObject
+	Err error
+}
+
+// Preconditions make a write conditional on the object it replaces. They are
+// checked when the write commits, under the same lock, so two writers with the
+// same precondition cannot both succeed. Zero values disable a check; a failed
+// check returns ErrPreconditionFailed.
+type Preconditions struct {
+	// IfGenerationMatch requires the current file to have this Generation.
+	IfGenerationMatch uint64
+	// IfNoneMatch requires that no file exists at the path (create-only).
+	IfNoneMatch bool
+	// IfETagMatch requires the current file to have this FileHash.
+	IfETagMatch string
+}
+
+// PutOptions carries the user metadata and preconditions of PutWithOptions.
+type PutOptions struct {
+	Options map[string]string
+	Preconditions
+}
+
+// DeleteOptions carries the preconditions of DeleteObjectWithOptions.
+type DeleteOptions struct {
+	Preconditions
+}
+
+// DeleteTenantOptions controls DeleteTenantWithOptions. Shred destroys the
+// data keys of the tenant's dedup scope in the delete transaction and then
+// the scope key they are wrapped under, so its encrypted chunks are
+// unreadable before GC reclaims them, also from restored history. It needs a
+// ScopeKeyProvider and fails with ErrShredUnsupported for data keys created
+// without one. A shredded tenant skips the trash.
+type DeleteTenantOptions struct {
+	Shred bool
+}
+
+// DeleteTenantResult reports the data keys a shredding delete destroyed.
+// ShreddedChunks counts the chunks those keys encrypted; ReadableChunks
+// counts chunks the tenant owns that stay readable because they are
+// plaintext or belong to the global dedup scope.
+type DeleteTenantResult struct {
+	ShreddedKeys   []ShreddedKey
+	ShreddedChunks int
+	ReadableChunks int
+}
+
+// ShreddedKey names a destroyed data key and the master key that wrapped it.
+type ShreddedKey struct {
+	Scope       string
+	Version     uint32
+	MasterKeyID string
+}
+
+// ListOptions selects one page of ListObjects. Paths are listed in byte
+// order. Prefix filters paths by string prefix; the part up to its last "/"
+// names the directory the listing starts in. Without Recursive only entries
+// directly in that directory are listed, and a Delimiter of "/" also reports
+// its subdirectories as CommonPrefixes. Recursive lists every file below and
+// cannot be combined with a Delimiter. Limit caps the objects and prefixes in
+// one page; zero means 1000. ContinuationToken, when set, replaces StartAfter.
+type ListOptions struct {
+	Prefix            string
+	StartAfter        string
+	Delimiter         string
+	Limit             int
+	Recursive         bool
+	ContinuationToken string
+}
+
+// ListPage is one page of ListObjects. NextContinuationToken is empty on the
+// last page.
+type ListPage struct {
+	Objects               []ObjectInfo
+	CommonPrefixes        []string
+	NextContinuationToken string
+}
+
+// KeyRotationOptions controls RotateKeys. DataKeys also gives every dedup
+// scope a new data key for the chunks written from then on.
+type KeyRotationOptions struct {
+	DataKeys bool
+}
+
+// KeyRotationResult reports the work done by RotateKeys.
+type KeyRotationResult struct {
+	MasterKeyID string
+	Rewrapped   int
+	DataKeys    int
+}
+
 // GCOptions overrides selected GC settings for a single run.
 type GCOptions struct {
 	SafetyWindow           time.Duration
@@ -80,6 +417,8 @@ type GCResult struct {
 	SegmentsDeleted   int
 	BytesRewritten    int64
 	BytesMadeGarbage  int64
+	VersionsExpired   int
+	TrashExpired      int
 }
 
 // ScrubOptions controls full-store corruption checks.
@@ -109,23 +448,27 @@ type CheckResult struct {
 	Issues          []CheckIssue
 }
 
-// ScrubResult reports full-store integrity verification.
+// ScrubResult reports full-store integrity verification. ReconstructedChunks
+// lists chunks whose damaged records were rebuilt from segment parity.
 type ScrubResult struct {
-	Healthy         bool
-	CheckedChunks   int
-	CheckedSegments int
-	CheckedFiles    int
-	CheckedBytes    int64
-	CorruptChunks   []string
-	CorruptSegments []string
-	AffectedFiles   []string
-	Issues          []CheckIssue
+	Healthy             bool
+	CheckedChunks       int
+	CheckedSegments     int
+	CheckedFiles        int
+	CheckedBytes        int64
+	ShreddedChunks      int
+	ReconstructedChunks []string
+	CorruptChunks       []string
+	CorruptSegments     []string
+	AffectedFiles       []string
+	Issues              []CheckIssue
 }
 
 // DefaultConfig returns production-oriented defaults for CAS chunk storage.
 func DefaultConfig() Config {
 	return Config{
 		SegmentSize:          256 << 20,
+		SegmentIdleTimeout:   30 * time.Second,
 		MaxFileSize:          1 << 40,
 		MaxTenantLength:      128,
 		MaxPathLength:        4096,
@@ -155,6 +498,11 @@ func normalizeConfig(cfg Config) Config {
 	if cfg.SegmentSize == 0 {
 		cfg.SegmentSize = def.SegmentSize
 	}
+	if cfg.SegmentIdleTimeout == 0 {
+		cfg.SegmentIdleTimeout = def.SegmentIdleTimeout
+	} else if cfg.SegmentIdleTimeout < 0 {
+		cfg.SegmentIdleTimeout = 0
+	}
 	if cfg.MaxFileSize == 0 {
 		cfg.MaxFileSize = def.MaxFileSize
 	}
@@ -191,6 +539,9 @@ func normalizeConfig(cfg Config) Config {
 	if cfg.Chunking.MaxSize == 0 {
 		cfg.Chunking.MaxSize = def.Chunking.MaxSize
 	}
+	if cfg.Parity.ParityShards > 0 && cfg.Parity.DataShards == 0 {
+		cfg.Parity.DataShards = 10
+	}
 	if emptyGC {
 		cfg.GC = def.GC
 		return cfg
@@ -215,8 +566,8 @@ func normalizeConfig(cfg Config) Config {
 }
 
 func validateConfig(cfg Config) error {
-	if cfg.Compression != CompressionZstd {
-		return fmt.Errorf("unsupported compression %q", cfg.Compression)
+	if err := validateCompression(cfg.Compression, cfg.CompressionLevel, cfg.CompressionMinSavings); err != nil {
+		return err
 	}
 	if cfg.Checksum != ChecksumCRC32C {
 		return fmt.Errorf("unsupported checksum %q", cfg.Checksum)
@@ -254,5 +605,14 @@ func validateConfig(cfg Config) error {
 	if cfg.GC.BackgroundGCInterval < 0 {
 		return errors.New("background gc interval must be non-negative")
 	}
+	if cfg.Retention.Generations < 0 || cfg.Retention.MaxAge < 0 {
+		return errors.New("retention limits must be non-negative")
+	}
+	if cfg.Parity.DataShards < 0 || cfg.Parity.ParityShards < 0 {
+		return errors.New("parity shard counts must be non-negative")
+	}
+	if cfg.Parity.ParityShards > 0 && cfg.Parity.DataShards+cfg.Parity.ParityShards > 256 {
+		return errors.New("parity shards must total at most 256")
+	}
 	return nil
 }
@@ -29,6 +29,7 @@ func TestOpenRejectsUnsupportedConfig(t *testing.T) {
 		{name: "chunk sizes", edit: func(cfg *Config) { cfg.Chunking.MinSize = cfg.Chunking.MaxSize + 1 }},
 		{name: "gc cycles", edit: func(cfg *Config) { cfg.GC.CandidateConfirmCycles = -1 }},
 		{name: "compact ratio", edit: func(cfg *Config) { cfg.GC.CompactGarbageRatio = 2 }},
+		{name: "parity shards", edit: func(cfg *Config) { cfg.Parity = ParityConfig{DataShards: 250, ParityShards: 10} }},
 	}
 	for _, tt := range cases {
 		t.Run(tt.name, func(t *testing.T) {
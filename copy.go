@@ -0,0 +1,316 @@
+package blobfs
+
+import (
+	"context"
+	"io/fs"
+)
+
+// checkCrossTenant reports whether files may share manifests between
+// srcTenant and dstTenant. With tenant-scoped dedup every chunk belongs to one
+// tenant, so both tenants must use the global scope.
+func (s *Store) checkCrossTenant(srcTenant, dstTenant string) error {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	if s.tenantConfigLocked(srcTenant).DedupScope != DedupScopeGlobal ||
+		s.tenantConfigLocked(dstTenant).DedupScope != DedupScopeGlobal {
+		return ErrCrossTenant
+	}
+	return nil
+}
+
+// tenantScopedLocked reports whether the content of inode was written under
+// tenant-scoped dedup, which keeps it from moving to another tenant even after
+// its tenant switched to the global scope.
+func (s *Store) tenantScopedLocked(inode *inodeRecord) bool {
+	if inode.Kind != fileKindFile {
+		return false
+	}
+	manifest := s.meta.Manifests[inode.ManifestID]
+	return manifest != nil && manifest.TenantID != ""
+}
+
+// walkSubtreeLocked calls fn for every dirent below rootID, parents before
+// children. A hard-linked file is reported once per dirent.
+func (s *Store) walkSubtreeLocked(rootID uint64, fn func(parentID uint64, name string, inode *inodeRecord)) {
+	pending := []uint64{rootID}
+	for len(pending) > 0 {
+		id := pending[0]
+		pending = pending[1:]
+		entries := s.meta.DirEntries[id]
+		for _, name := range sortedNames(entries) {
+			child := s.activeInodeLocked(entries[name])
+			if child == nil {
+				continue
+			}
+			fn(id, name, child)
+			if child.Kind == fileKindDir {
+				pending = append(pending, child.InodeID)
+			}
+		}
+	}
+}
+
+// putFileContentLocked queues ops that make content the current file at
+// tenantID/path without copying data. content takes a new reference on its
+// manifest; the replaced file, if any, is retired like an overwrite.
+func (s *Store) putFileContentLocked(tenantID, path string, parentID uint64, name string, existing *inodeRecord, content objectVersion, ops *[]metaOp, now int64) (*inodeRecord, error) {
+	manifest := s.meta.Manifests[content.ManifestID]
+	if manifest == nil || manifest.State == manifestStateDeleted {
+		return nil, errManifestNotFound
+	}
+	manifestRecords := map[string]*manifestRecord{manifest.ManifestID: manifest}
+	manifestDeltas := map[string]int{}
+	chunkDeltas := map[string]int{}
+	addManifestRefDelta(manifest, 1, manifestDeltas, chunkDeltas)
+	var inode *inodeRecord
+	if existing != nil {
+		if s.versioningEnabledLocked(tenantID) {
+			s.appendVersionsLocked(tenantID, path, ops, versionFromInode(existing, now))
+		} else if old := s.meta.Manifests[existing.ManifestID]; old != nil {
+			manifestRecords[old.ManifestID] = old
+			addManifestRefDelta(old, -1, manifestDeltas, chunkDeltas)
+		}
+		inode = cloneInode(existing)
+	} else {
+		inode = &inodeRecord{
+			InodeID:             s.nextInodeIDLocked(),
+			TenantID:            tenantID,
+			Kind:                fileKindFile,
+			ParentInode:         parentID,
+			Name:                name,
+			State:               fileStateActive,
+			ContentGeneration:   1,
+			MetadataGeneration:  1,
+			NamespaceGeneration: 1,
+			CreatedAt:           now,
+		}
+		*ops = append(*ops, metaOp{Type: "put_dirent", ParentID: parentID, Name: name, ChildID: inode.InodeID})
+	}
+	appendRefDeltaOpsLocked(s.meta, ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+	inode.Generation = max(inode.Generation, s.versionFloorLocked(tenantID, path))
+	inode.Size = content.Size
+	inode.FileHash = content.FileHash
+	inode.ManifestID = content.ManifestID
+	inode.Options = copyOptions(content.Options)
+	inode.Mode = content.Mode
+	inode.ModTime = content.MTime
+	inode.MTime = content.MTime
+	inode.CTime = now
+	inode.UpdatedAt = now
+	inode.Generation++
+	inode.ContentGeneration++
+	*ops = append(*ops, metaOp{Type: "put_inode", Inode: inode})
+	return inode, nil
+}
+
+// CopyObject makes dstTenant/dstPath a copy of the file at srcTenant/srcPath.
+// The copy shares the source manifest and chunks, so no data is read or
+// written. An existing destination file is replaced. Copies between tenants
+// require DedupScopeGlobal.
+func (s *Store) CopyObject(ctx context.Context, srcTenant, srcPath, dstTenant, dstPath string) (*ObjectInfo, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	srcPath, dstPath, err := s.validateTransfer("copy", srcTenant, srcPath, dstTenant, dstPath)
+	if err != nil {
+		return nil, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	source, err := s.resolvePathLocked(srcTenant, srcPath)
+	if err != nil {
+		return nil, pathError("copy", srcPath, err)
+	}
+	if source.Kind != fileKindFile {
+		return nil, pathError("copy", srcPath, ErrIsDir)
+	}
+	if srcTenant != dstTenant && s.tenantScopedLocked(source) {
+		return nil, pathError("copy", srcPath, ErrCrossTenant)
+	}
+	parentID, name, err := s.resolveParentLocked(dstTenant, dstPath)
+	if err != nil {
+		return nil, pathError("copy", dstPath, err)
+	}
+	existing := s.activeInodeLocked(s.meta.DirEntries[parentID][name])
+	if existing != nil && existing.Kind != fileKindFile {
+		return nil, pathError("copy", dstPath, ErrIsDir)
+	}
+	if existing != nil && existing.InodeID == source.InodeID {
+		info := objectInfoFromInode(source, dstPath)
+		return &info, nil
+	}
+	now := nowUnix()
+	if err := checkObjectLock(existing, now); err != nil {
+		return nil, pathError("copy", dstPath, err)
+	}
+	var ops []metaOp
+	inode, err := s.putFileContentLocked(dstTenant, dstPath, parentID, name, existing, versionFromInode(source, now), &ops, now)
+	if err != nil {
+		return nil, pathError("copy", srcPath, err)
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return nil, pathError("copy", dstPath, err)
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	info := objectInfoFromInode(inode, dstPath)
+	return &info, nil
+}
+
+// CloneTree copies the file or directory tree at srcTenant/srcPath to
+// dstTenant/dstPath in one transaction. Every cloned file shares its manifest
+// with the source. The destination must not exist and its parent must be a
+// directory. Clones between tenants require DedupScopeGlobal.
+func (s *Store) CloneTree(ctx context.Context, srcTenant, srcPath, dstTenant, dstPath string) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	srcPath, dstPath, err := s.validateTransfer("clone", srcTenant, srcPath, dstTenant, dstPath)
+	if err != nil {
+		return err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	source, err := s.lookupPathLocked(srcTenant, srcPath)
+	if err != nil {
+		return pathError("clone", srcPath, err)
+	}
+	parentID, name, err := s.resolveParentLocked(dstTenant, dstPath)
+	if err != nil {
+		return pathError("clone", dstPath, err)
+	}
+	if s.activeInodeLocked(s.meta.DirEntries[parentID][name]) != nil {
+		return exists("clone", dstPath)
+	}
+	if source.Kind == fileKindDir && s.isDescendantLocked(parentID, source.InodeID) {
+		return pathError("clone", dstPath, fs.ErrInvalid)
+	}
+	type dirent struct {
+		parentID uint64
+		name     string
+		inode    *inodeRecord
+	}
+	now := nowUnix()
+	// Directories map to their clones; the source root maps to the
+	// destination parent so its dirent lands there.
+	ids := map[uint64]uint64{}
+	paths := map[uint64]string{}
+	links := map[uint64]uint32{}
+	entries := []dirent{{parentID: 0, name: name, inode: source}}
+	s.walkSubtreeLocked(source.InodeID, func(parentID uint64, name string, inode *inodeRecord) {
+		entries = append(entries, dirent{parentID: parentID, name: name, inode: inode})
+	})
+	for _, entry := range entries {
+		links[entry.inode.InodeID]++
+		if srcTenant != dstTenant && s.tenantScopedLocked(entry.inode) {
+			return pathError("clone", srcPath, ErrCrossTenant)
+		}
+	}
+	var ops []metaOp
+	// The put_inode of a clone is queued before its further links are seen,
+	// so they are added to the record through clones.
+	clones := map[uint64]*inodeRecord{}
+	manifestRecords := map[string]*manifestRecord{}
+	manifestDeltas := map[string]int{}
+	chunkDeltas := map[string]int{}
+	for _, entry := range entries {
+		node := entry.inode
+		newParentID, entryPath := parentID, dstPath
+		if entry.inode != source {
+			newParentID = ids[entry.parentID]
+			entryPath = paths[entry.parentID] + "/" + entry.name
+		}
+		if cloneID, ok := ids[node.InodeID]; ok {
+			// A further hard link to a file cloned earlier.
+			ops = append(ops, metaOp{Type: "put_dirent", ParentID: newParentID, Name: entry.name, ChildID: cloneID})
+			clone := clones[cloneID]
+			clone.OtherLinks = append(clone.OtherLinks, dirLink{ParentID: newParentID, Name: entry.name})
+			continue
+		}
+		next := cloneInode(node)
+		next.InodeID = s.nextInodeIDLocked()
+		next.OtherLinks = nil
+		ids[node.InodeID] = next.InodeID
+		clones[next.InodeID] = next
+		paths[node.InodeID] = entryPath
+		next.TenantID = dstTenant
+		next.ParentInode = newParentID
+		next.Name = entry.name
+		next.Nlink = 0
+		next.RetainUntil = 0
+		next.LegalHold = false
+		if count := links[node.InodeID]; count > 1 {
+			next.Nlink = count
+		}
+		next.Generation = 1
+		next.ContentGeneration = 1
+		next.MetadataGeneration = 1
+		next.NamespaceGeneration = 1
+		next.CreatedAt = now
+		next.UpdatedAt = now
+		next.CTime = now
+		if next.Kind == fileKindFile {
+			next.Generation = max(1, s.versionFloorLocked(dstTenant, entryPath)) + 1
+			if manifest := s.meta.Manifests[next.ManifestID]; manifest != nil {
+				manifestRecords[manifest.ManifestID] = manifest
+				addManifestRefDelta(manifest, 1, manifestDeltas, chunkDeltas)
+			}
+		}
+		ops = append(ops,
+			metaOp{Type: "put_dirent", ParentID: newParentID, Name: entry.name, ChildID: next.InodeID},
+			metaOp{Type: "put_inode", Inode: next},
+		)
+	}
+	appendRefDeltaOpsLocked(s.meta, &ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return pathError("clone", dstPath, err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// Move renames a file or directory tree, also between tenants. A move keeps
+// inode identity and content; moves between tenants require DedupScopeGlobal.
+func (s *Store) Move(ctx context.Context, srcTenant, srcPath, dstTenant, dstPath string) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	srcPath, dstPath, err := s.validateTransfer("move", srcTenant, srcPath, dstTenant, dstPath)
+	if err != nil {
+		return err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.renameLocked(srcTenant, srcPath, dstTenant, dstPath, srcPath, dstPath)
+}
+
+// validateTransfer checks the endpoints of a copy, clone, or move, returns
+// their normalized paths, and makes sure the destination tenant exists.
+func (s *Store) validateTransfer(op, srcTenant, srcPath, dstTenant, dstPath string) (string, string, error) {
+	if err := validateTenantID(srcTenant, s.cfg); err != nil {
+		return "", "", pathError(op, srcTenant, err)
+	}
+	if err := validateTenantID(dstTenant, s.cfg); err != nil {
+		return "", "", pathError(op, dstTenant, err)
+	}
+	srcPath, err := normalizePath(srcPath, s.cfg)
+	if err != nil {
+		return "", "", pathError(op, srcPath, err)
+	}
+	dstPath, err = normalizePath(dstPath, s.cfg)
+	if err != nil {
+		return "", "", pathError(op, dstPath, err)
+	}
+	if srcTenant != dstTenant {
+		if err := s.checkCrossTenant(srcTenant, dstTenant); err != nil {
+			return "", "", pathError(op, dstPath, err)
+		}
+	}
+	if err := s.ensureTenantRoot(dstTenant); err != nil {
+		return "", "", err
+	}
+	return srcPath, dstPath, nil
+}
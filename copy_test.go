@@ -0,0 +1,109 @@
+package blobfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestCopyObjectSharesManifest(t *testing.T) {
+	store := openTestStore(t)
+	data := bytes.Repeat([]byte("copy-me-"), 64)
+	source := putTestBytes(t, store, "tenant-a", "a.txt", data)
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("replaced"))
+	info, err := store.CopyObject(testContext(t), "tenant-a", "a.txt", "tenant-a", "b.txt")
+	if err != nil {
+		t.Fatalf("copy: %v", err)
+	}
+	if info.ManifestID != source.ManifestID || info.FileID == source.FileID {
+		t.Fatalf("copy info = %+v", info)
+	}
+	if err := store.DeleteObject(testContext(t), "tenant-a", "a.txt"); err != nil {
+		t.Fatalf("delete source: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "b.txt"); !bytes.Equal(got, data) {
+		t.Fatalf("copy content = %q", got)
+	}
+	store.metaMu.RLock()
+	refs := store.meta.Manifests[source.ManifestID].RefCount
+	store.metaMu.RUnlock()
+	if refs != 1 {
+		t.Fatalf("manifest refcount = %d, want 1", refs)
+	}
+	if _, err := store.CopyObject(testContext(t), "tenant-a", "b.txt", "tenant-b", "b.txt"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("cross-tenant copy with tenant dedup = %v", err)
+	}
+	if err := store.Rename("tenant-a/b.txt", "tenant-b/b.txt"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("cross-tenant rename with tenant dedup = %v", err)
+	}
+}
+
+func TestCloneTreeAndMoveAcrossTenants(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupScope = DedupScopeGlobal
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	if err := store.MkdirAll("tenant-a/docs/sub", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("alpha"))
+	putTestBytes(t, store, "tenant-a", "docs/sub/b.txt", []byte("beta"))
+
+	if err := store.CloneTree(testContext(t), "tenant-a", "docs", "tenant-a", "docs/sub/loop"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("clone into itself = %v", err)
+	}
+	if err := store.CloneTree(testContext(t), "tenant-a", "docs", "tenant-b", "copy"); err != nil {
+		t.Fatalf("clone tree: %v", err)
+	}
+	if err := store.CloneTree(testContext(t), "tenant-a", "docs", "tenant-b", "copy"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("clone over existing = %v", err)
+	}
+	watcher, err := store.Watch(testContext(t), 0, WatchFilter{TenantID: "tenant-a"})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if err := store.Move(testContext(t), "tenant-a", "docs", "tenant-c", "moved"); err != nil {
+		t.Fatalf("move: %v", err)
+	}
+	if _, err := store.StatObject(testContext(t), "tenant-a", "docs/a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("source after move = %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	for _, tc := range []struct{ tenant, path, want string }{
+		{"tenant-b", "copy/a.txt", "alpha"},
+		{"tenant-b", "copy/sub/b.txt", "beta"},
+		{"tenant-c", "moved/a.txt", "alpha"},
+		{"tenant-c", "moved/sub/b.txt", "beta"},
+	} {
+		if got := readTestBytes(t, store, tc.tenant, tc.path); string(got) != tc.want {
+			t.Fatalf("%s/%s = %q", tc.tenant, tc.path, got)
+		}
+	}
+	info, err := store.StatObject(testContext(t), "tenant-c", "moved/sub/b.txt")
+	if err != nil || info.TenantID != "tenant-c" {
+		t.Fatalf("moved file = %+v, %v", info, err)
+	}
+	// The old tenant's feed reports the move as deletes.
+	var deleted []string
+	for len(deleted) < 4 {
+		event, err := watcher.Next()
+		if err != nil {
+			t.Fatalf("next: %v", err)
+		}
+		if event.Type == WatchDelete {
+			deleted = append(deleted, event.Path)
+		}
+	}
+	if deleted[0] != "docs" {
+		t.Fatalf("deleted paths = %v", deleted)
+	}
+}
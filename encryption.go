@@ -0,0 +1,436 @@
+package blobfs
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+// dataKeySize is the size of data and master keys; both are AES-256 keys.
+const dataKeySize = 32
+
+// dataKeyRef names one version of the data key of a dedup scope.
+type dataKeyRef struct {
+	scope   string
+	version uint32
+}
+
+// chunkCipher encrypts chunk payloads with one data key version.
+type chunkCipher struct {
+	version uint32
+	aead    cipher.AEAD
+}
+
+func cloneKeyring(ring *keyring) *keyring {
+	next := *ring
+	next.Keys = append([]dataKey(nil), ring.Keys...)
+	return &next
+}
+
+func (ring *keyring) key(version uint32) (dataKey, bool) {
+	for _, key := range ring.Keys {
+		if key.Version == version {
+			return key, true
+		}
+	}
+	return dataKey{}, false
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != dataKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", dataKeySize, len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts payload under a random nonce and binds it to chunkID, so a
+// record copied onto another chunk does not decrypt.
+func (c *chunkCipher) seal(chunkID string, payload []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize(), c.aead.NonceSize()+len(payload)+c.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return c.aead.Seal(nonce, nonce, payload, []byte(chunkID)), nil
+}
+
+func openChunkPayload(aead cipher.AEAD, chunkID string, payload []byte) ([]byte, error) {
+	if len(payload) < aead.NonceSize() {
+		return nil, errors.New("encrypted segment payload truncated")
+	}
+	nonce, sealed := payload[:aead.NonceSize()], payload[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, []byte(chunkID))
+	if err != nil {
+		return nil, fmt.Errorf("decrypt chunk %s: %w", chunkID, err)
+	}
+	return plain, nil
+}
+
+// wrapAAD binds a wrapped data key to the scope and version it belongs to.
+func wrapAAD(scope string, version uint32) []byte {
+	return []byte("blobfs-data-key\x00" + scope + "\x00" + strconv.FormatUint(uint64(version), 10))
+}
+
+func wrapDataKey(master, plain []byte, scope string, version uint32) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, wrapAAD(scope, version)), nil
+}
+
+func unwrapDataKey(master []byte, scope string, key dataKey) ([]byte, error) {
+	aead, err := newAEAD(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(key.Wrapped) < aead.NonceSize() {
+		return nil, errors.New("wrapped data key truncated")
+	}
+	nonce, sealed := key.Wrapped[:aead.NonceSize()], key.Wrapped[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, wrapAAD(scope, key.Version))
+	if err != nil {
+		return nil, fmt.Errorf("unwrap data key %d of scope %q with master key %q: %w", key.Version, scope, key.MasterKeyID, err)
+	}
+	return plain, nil
+}
+
+// scopeCipher returns the cipher new chunks of scope are encrypted with, or
+// nil when the store has no KeyProvider. The first chunk of a scope, or the
+// first after its keys were shredded, creates its keyring.
+func (s *Store) scopeCipher(ctx context.Context, scope string) (*chunkCipher, error) {
+	if s.cfg.KeyProvider == nil {
+		return nil, nil
+	}
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	s.metaMu.RLock()
+	ring := s.meta.Keyrings[scope]
+	s.metaMu.RUnlock()
+	if ring == nil || len(ring.Keys) == 0 {
+		return s.createKeyringLocked(ctx, scope, ring)
+	}
+	key, ok := ring.key(ring.Current)
+	if !ok {
+		return nil, fmt.Errorf("%w: scope %q has no data key %d", ErrKeyUnavailable, scope, ring.Current)
+	}
+	aead, err := s.dataKeyLocked(ctx, scope, key)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkCipher{version: key.Version, aead: aead}, nil
+}
+
+// chunkAEAD returns the data key an encrypted chunk was written with.
+func (s *Store) chunkAEAD(ctx context.Context, chunk *chunkRecord) (cipher.AEAD, error) {
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	if aead := s.dataKeys[dataKeyRef{chunk.TenantID, chunk.KeyVersion}]; aead != nil {
+		return aead, nil
+	}
+	s.metaMu.RLock()
+	ring := s.meta.Keyrings[chunk.TenantID]
+	s.metaMu.RUnlock()
+	if ring == nil {
+		return nil, fmt.Errorf("%w: scope %q has no keyring", ErrKeyUnavailable, chunk.TenantID)
+	}
+	key, ok := ring.key(chunk.KeyVersion)
+	if !ok {
+		return nil, fmt.Errorf("%w: scope %q has no data key %d", ErrKeyUnavailable, chunk.TenantID, chunk.KeyVersion)
+	}
+	return s.dataKeyLocked(ctx, chunk.TenantID, key)
+}
+
+// dataKeyLocked unwraps key through the KeyProvider and caches it.
+func (s *Store) dataKeyLocked(ctx context.Context, scope string, key dataKey) (cipher.AEAD, error) {
+	ref := dataKeyRef{scope, key.Version}
+	if aead := s.dataKeys[ref]; aead != nil {
+		return aead, nil
+	}
+	if s.cfg.KeyProvider == nil {
+		return nil, fmt.Errorf("%w: no key provider", ErrKeyUnavailable)
+	}
+	master, err := s.cfg.KeyProvider.Key(ctx, key.MasterKeyID)
+	if err != nil {
+		return nil, fmt.Errorf("%w: master key %q: %v", ErrKeyUnavailable, key.MasterKeyID, err)
+	}
+	wrapping, err := s.wrappingKey(ctx, master, scope, key.Scoped, false)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := unwrapDataKey(wrapping, scope, key)
+	if err != nil {
+		// A scope key created after a shred does not unwrap the keys the
+		// shred destroyed.
+		if key.Scoped {
+			return nil, fmt.Errorf("%w: %v", ErrKeyUnavailable, err)
+		}
+		return nil, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return nil, err
+	}
+	s.dataKeys[ref] = aead
+	return aead, nil
+}
+
+// wrappingKey returns the key a data key of scope is wrapped under: the
+// master key, or for a scoped data key an HMAC-SHA256 of the scope key keyed
+// by the master key, so unwrapping needs both.
+func (s *Store) wrappingKey(ctx context.Context, master []byte, scope string, scoped, create bool) ([]byte, error) {
+	if !scoped {
+		return master, nil
+	}
+	provider, ok := s.cfg.KeyProvider.(ScopeKeyProvider)
+	if !ok {
+		return nil, fmt.Errorf("%w: key provider keeps no scope keys", ErrKeyUnavailable)
+	}
+	scopeKey, err := provider.ScopeKey(ctx, scope, create)
+	if err != nil {
+		return nil, fmt.Errorf("%w: scope key of %q: %v", ErrKeyUnavailable, scope, err)
+	}
+	if len(scopeKey) != dataKeySize {
+		return nil, fmt.Errorf("scope key must be %d bytes, got %d", dataKeySize, len(scopeKey))
+	}
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte("blobfs-scope-key\x00"))
+	mac.Write(scopeKey)
+	return mac.Sum(nil), nil
+}
+
+// newDataKeyLocked generates version of the data key of scope and wraps it
+// with the current master key and, when the KeyProvider keeps scope keys,
+// the scope key.
+func (s *Store) newDataKeyLocked(ctx context.Context, scope string, version uint32) (dataKey, error) {
+	masterID, master, err := s.cfg.KeyProvider.CurrentKey(ctx)
+	if err != nil {
+		return dataKey{}, fmt.Errorf("current master key: %w", err)
+	}
+	_, scoped := s.cfg.KeyProvider.(ScopeKeyProvider)
+	wrapping, err := s.wrappingKey(ctx, master, scope, scoped, true)
+	if err != nil {
+		return dataKey{}, err
+	}
+	plain := make([]byte, dataKeySize)
+	if _, err := rand.Read(plain); err != nil {
+		return dataKey{}, err
+	}
+	wrapped, err := wrapDataKey(wrapping, plain, scope, version)
+	if err != nil {
+		return dataKey{}, err
+	}
+	aead, err := newAEAD(plain)
+	if err != nil {
+		return dataKey{}, err
+	}
+	s.dataKeys[dataKeyRef{scope, version}] = aead
+	return dataKey{Version: version, MasterKeyID: masterID, Wrapped: wrapped, CreatedAt: nowUnix(), Scoped: scoped}, nil
+}
+
+// createKeyringLocked creates the keyring of scope. Its first version follows
+// the versions shredded from prev, if any.
+func (s *Store) createKeyringLocked(ctx context.Context, scope string, prev *keyring) (*chunkCipher, error) {
+	version := uint32(1)
+	if prev != nil {
+		version = prev.Destroyed + 1
+	}
+	key, err := s.newDataKeyLocked(ctx, scope, version)
+	if err != nil {
+		return nil, err
+	}
+	ring := &keyring{Scope: scope, Current: key.Version, Keys: []dataKey{key}, Destroyed: version - 1}
+	s.metaMu.Lock()
+	err = s.commitMetaFinalLocked([]metaOp{{Type: "put_keyring", Keyring: ring}})
+	s.metaMu.Unlock()
+	if err != nil {
+		delete(s.dataKeys, dataKeyRef{scope, key.Version})
+		return nil, err
+	}
+	return &chunkCipher{version: key.Version, aead: s.dataKeys[dataKeyRef{scope, key.Version}]}, nil
+}
+
+// RotateKeys re-wraps every data key that is not wrapped by the current
+// master key of the KeyProvider. Stored chunks are not rewritten. With
+// opts.DataKeys every keyring also gains a new data key, which new writes and
+// compaction use from then on; chunks keep the key they were written with.
+func (s *Store) RotateKeys(ctx context.Context, opts KeyRotationOptions) (*KeyRotationResult, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.cfg.KeyProvider == nil {
+		return nil, ErrEncryptionDisabled
+	}
+	s.keyMu.Lock()
+	defer s.keyMu.Unlock()
+	masterID, master, err := s.cfg.KeyProvider.CurrentKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("current master key: %w", err)
+	}
+	s.metaMu.RLock()
+	rings := make([]*keyring, 0, len(s.meta.Keyrings))
+	for _, ring := range s.meta.Keyrings {
+		rings = append(rings, ring)
+	}
+	s.metaMu.RUnlock()
+	result := &KeyRotationResult{MasterKeyID: masterID}
+	ops := make([]metaOp, 0, len(rings))
+	for _, ring := range rings {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		next := cloneKeyring(ring)
+		changed := false
+		for i := range next.Keys {
+			key := &next.Keys[i]
+			if key.MasterKeyID == masterID {
+				continue
+			}
+			old, err := s.cfg.KeyProvider.Key(ctx, key.MasterKeyID)
+			if err != nil {
+				return nil, fmt.Errorf("%w: master key %q: %v", ErrKeyUnavailable, key.MasterKeyID, err)
+			}
+			oldWrapping, err := s.wrappingKey(ctx, old, ring.Scope, key.Scoped, false)
+			if err != nil {
+				return nil, err
+			}
+			plain, err := unwrapDataKey(oldWrapping, ring.Scope, *key)
+			if err != nil {
+				return nil, err
+			}
+			wrapping, err := s.wrappingKey(ctx, master, ring.Scope, key.Scoped, false)
+			if err != nil {
+				return nil, err
+			}
+			wrapped, err := wrapDataKey(wrapping, plain, ring.Scope, key.Version)
+			if err != nil {
+				return nil, err
+			}
+			key.MasterKeyID = masterID
+			key.Wrapped = wrapped
+			result.Rewrapped++
+			changed = true
+		}
+		// A shredded scope gets keys again only when it writes again.
+		if opts.DataKeys && len(next.Keys) > 0 {
+			version := next.Destroyed
+			for _, key := range next.Keys {
+				version = max(version, key.Version)
+			}
+			key, err := s.newDataKeyLocked(ctx, ring.Scope, version+1)
+			if err != nil {
+				return nil, err
+			}
+			next.Keys = append(next.Keys, key)
+			next.Current = key.Version
+			result.DataKeys++
+			changed = true
+		}
+		if changed {
+			ops = append(ops, metaOp{Type: "put_keyring", Keyring: next})
+		}
+	}
+	if len(ops) == 0 {
+		return result, nil
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// shredTenantOpsLocked queues the destruction of the data keys of tenantID
+// and marks the chunks they encrypted SHREDDED, so nothing reads them or
+// deduplicates against them again. The emptied keyring stays to remember the
+// versions it destroyed. Copies of the keys remain in metadata history, so
+// every key must be scoped; the caller destroys the scope key after the
+// commit.
+func (s *Store) shredTenantOpsLocked(tenantID string, ops *[]metaOp, result *DeleteTenantResult) error {
+	if ring := s.meta.Keyrings[tenantID]; ring != nil && len(ring.Keys) > 0 {
+		if _, ok := s.cfg.KeyProvider.(ScopeKeyProvider); !ok {
+			return fmt.Errorf("%w: key provider keeps no scope keys", ErrShredUnsupported)
+		}
+		next := &keyring{Scope: tenantID, Destroyed: ring.Destroyed}
+		for _, key := range ring.Keys {
+			if !key.Scoped {
+				return fmt.Errorf("%w: data key %d of scope %q was created without a scope key", ErrShredUnsupported, key.Version, tenantID)
+			}
+			result.ShreddedKeys = append(result.ShreddedKeys, ShreddedKey{Scope: tenantID, Version: key.Version, MasterKeyID: key.MasterKeyID})
+			next.Destroyed = max(next.Destroyed, key.Version)
+		}
+		*ops = append(*ops, metaOp{Type: "put_keyring", Keyring: next})
+	}
+	pending := map[string]*chunkRecord{}
+	for i := range *ops {
+		if op := &(*ops)[i]; op.Type == "put_chunk" && op.Chunk != nil {
+			pending[op.Chunk.ChunkID] = op.Chunk
+		}
+	}
+	for id, chunk := range s.meta.Chunks {
+		if next := pending[id]; next != nil {
+			chunk = next
+		}
+		if chunk == nil || chunk.State == chunkStateDeleted {
+			continue
+		}
+		if chunk.TenantID != tenantID || chunk.KeyVersion == 0 {
+			if chunkOwner(chunk) == tenantID {
+				result.ReadableChunks++
+			}
+			continue
+		}
+		result.ShreddedChunks++
+		if next := pending[id]; next != nil {
+			next.State = chunkStateShredded
+			continue
+		}
+		next := *chunk
+		next.State = chunkStateShredded
+		*ops = append(*ops, metaOp{Type: "put_chunk", Chunk: &next})
+	}
+	return nil
+}
+
+// checkChunkKeyLocked returns ErrKeyUnavailable when chunk is encrypted with
+// a data key its scope no longer holds, as when a shredding delete ran while
+// the chunk was being written.
+func (s *Store) checkChunkKeyLocked(chunk *chunkRecord) error {
+	if chunk.KeyVersion == 0 {
+		return nil
+	}
+	if ring := s.meta.Keyrings[chunk.TenantID]; ring != nil {
+		if _, ok := ring.key(chunk.KeyVersion); ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: scope %q no longer has data key %d", ErrKeyUnavailable, chunk.TenantID, chunk.KeyVersion)
+}
+
+// forgetDataKeysLocked drops the cached data keys of scope. The caller holds
+// keyMu.
+func (s *Store) forgetDataKeysLocked(scope string) {
+	for ref := range s.dataKeys {
+		if ref.scope == scope {
+			delete(s.dataKeys, ref)
+		}
+	}
+}
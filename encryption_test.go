@@ -0,0 +1,497 @@
+package blobfs
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+type testKeyProvider struct {
+	mu      sync.Mutex
+	current string
+	keys    map[string][]byte
+	scopes  map[string][]byte
+}
+
+func newTestKeyProvider(ids ...string) *testKeyProvider {
+	p := &testKeyProvider{keys: map[string][]byte{}, scopes: map[string][]byte{}}
+	for _, id := range ids {
+		p.add(id)
+	}
+	return p
+}
+
+// add makes id the current master key.
+func (p *testKeyProvider) add(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.keys[id] = bytes.Repeat([]byte(id[:1]), dataKeySize)
+	p.current = id
+}
+
+func (p *testKeyProvider) drop(id string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.keys, id)
+}
+
+func (p *testKeyProvider) CurrentKey(context.Context) (string, []byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *testKeyProvider) Key(_ context.Context, id string) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown master key %q", id)
+	}
+	return key, nil
+}
+
+func (p *testKeyProvider) ScopeKey(_ context.Context, scope string, create bool) ([]byte, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key, ok := p.scopes[scope]
+	if !ok && create {
+		key = make([]byte, dataKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		p.scopes[scope] = key
+		ok = true
+	}
+	if !ok {
+		return nil, fmt.Errorf("no scope key for %q", scope)
+	}
+	return key, nil
+}
+
+func (p *testKeyProvider) DestroyScopeKey(_ context.Context, scope string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.scopes, scope)
+	return nil
+}
+
+// masterOnlyProvider hides the scope keys of the provider it wraps.
+type masterOnlyProvider struct {
+	KeyProvider
+}
+
+func segmentBytes(t *testing.T, fsys afero.Fs, store *Store) []byte {
+	t.Helper()
+	var all []byte
+	if err := afero.Walk(fsys, store.segmentsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		data, err := afero.ReadFile(fsys, path)
+		all = append(all, data...)
+		return err
+	}); err != nil {
+		t.Fatalf("walk segments: %v", err)
+	}
+	return all
+}
+
+func TestEncryptedChunksNeedTheirScopeKey(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	cfg := testConfig()
+	cfg.Compression = CompressionNone
+	cfg.KeyProvider = newTestKeyProvider("a-master")
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	secret := []byte("tenant secret that must not reach the disk in the clear")
+	putTestBytes(t, store, "tenant-a", "secret", secret)
+	putTestBytes(t, store, "tenant-b", "secret", secret)
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	if bytes.Contains(segmentBytes(t, fsys, store), []byte("must not reach")) {
+		t.Fatal("segment holds plaintext")
+	}
+	store.metaMu.RLock()
+	rings := len(store.meta.Keyrings)
+	store.metaMu.RUnlock()
+	if rings != 2 {
+		t.Fatalf("keyrings = %d, want one per tenant scope", rings)
+	}
+	if chunk := firstChunkRecord(t, store, "tenant-a", "secret"); chunk.KeyVersion != 1 {
+		t.Fatalf("chunk key version = %d", chunk.KeyVersion)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	if got := readTestBytes(t, reopened, "tenant-b", "secret"); !bytes.Equal(got, secret) {
+		t.Fatalf("read back %q", got)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	cfg.KeyProvider = nil
+	plain, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open without keys: %v", err)
+	}
+	defer plain.Close()
+	reader, err := plain.OpenObject(testContext(t), "tenant-a", "secret")
+	if err != nil {
+		t.Fatalf("open object: %v", err)
+	}
+	defer reader.Close()
+	if _, err := reader.Read(make([]byte, 8)); !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("read without keys = %v, want ErrKeyUnavailable", err)
+	}
+	result, err := plain.CheckObject(testContext(t), "tenant-a", "secret")
+	if err == nil || len(result.Issues) == 0 || result.Issues[0].Kind != "key_unavailable" {
+		t.Fatalf("check without keys = %+v, %v", result, err)
+	}
+	if chunk := firstChunkRecord(t, plain, "tenant-a", "secret"); chunk.State != chunkStateActive {
+		t.Fatalf("missing key marked chunk %s", chunk.State)
+	}
+}
+
+func TestGlobalDedupScopeSharesOneKeyring(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupScope = DedupScopeGlobal
+	cfg.KeyProvider = newTestKeyProvider("a-master")
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	putTestBytes(t, store, "tenant-a", "shared", []byte("deduplicated across tenants"))
+	putTestBytes(t, store, "tenant-b", "shared", []byte("deduplicated across tenants"))
+	store.metaMu.RLock()
+	_, global := store.meta.Keyrings[""]
+	rings := len(store.meta.Keyrings)
+	store.metaMu.RUnlock()
+	if !global || rings != 1 {
+		t.Fatalf("keyrings = %d, global %v", rings, global)
+	}
+	if got := readTestBytes(t, store, "tenant-b", "shared"); string(got) != "deduplicated across tenants" {
+		t.Fatalf("read back %q", got)
+	}
+}
+
+func TestRotateKeysRewrapsWithoutRewritingData(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	provider := newTestKeyProvider("a-master")
+	cfg := testConfig()
+	cfg.KeyProvider = provider
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "old", []byte("written under the first master key"))
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	before := segmentBytes(t, fsys, store)
+	provider.add("b-master")
+	result, err := store.RotateKeys(testContext(t), KeyRotationOptions{})
+	if err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if result.MasterKeyID != "b-master" || result.Rewrapped != 1 || result.DataKeys != 0 {
+		t.Fatalf("rotation = %+v", result)
+	}
+	if !bytes.Equal(segmentBytes(t, fsys, store), before) {
+		t.Fatal("rotation rewrote segment data")
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	provider.drop("a-master")
+	store, err = OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if got := readTestBytes(t, store, "tenant-a", "old"); string(got) != "written under the first master key" {
+		t.Fatalf("read after rewrap %q", got)
+	}
+	if result, err = store.RotateKeys(testContext(t), KeyRotationOptions{DataKeys: true}); err != nil || result.DataKeys != 1 || result.Rewrapped != 0 {
+		t.Fatalf("data key rotation = %+v, %v", result, err)
+	}
+	putTestBytes(t, store, "tenant-a", "new", []byte("written under the second data key"))
+	if chunk := firstChunkRecord(t, store, "tenant-a", "new"); chunk.KeyVersion != 2 {
+		t.Fatalf("new chunk key version = %d", chunk.KeyVersion)
+	}
+	if chunk := firstChunkRecord(t, store, "tenant-a", "old"); chunk.KeyVersion != 1 {
+		t.Fatalf("old chunk key version = %d", chunk.KeyVersion)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "old"); string(got) != "written under the first master key" {
+		t.Fatalf("read old after data key rotation %q", got)
+	}
+
+	cfg.KeyProvider = nil
+	plain, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open without keys: %v", err)
+	}
+	defer plain.Close()
+	if _, err := plain.RotateKeys(testContext(t), KeyRotationOptions{}); !errors.Is(err, ErrEncryptionDisabled) {
+		t.Fatalf("rotate without provider = %v", err)
+	}
+}
+
+func TestCompactionReencryptsWithCurrentDataKey(t *testing.T) {
+	cfg := testConfig()
+	cfg.KeyProvider = newTestKeyProvider("a-master")
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	dead := bytes.Repeat([]byte("dead"), 200)
+	putTestBytes(t, store, "tenant-a", "dead", dead)
+	putTestBytes(t, store, "tenant-a", "live", []byte("live and moved"))
+	if _, err := store.RotateKeys(testContext(t), KeyRotationOptions{DataKeys: true}); err != nil {
+		t.Fatalf("rotate: %v", err)
+	}
+	if err := store.DeleteObject(testContext(t), "tenant-a", "dead"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	result, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true})
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if result.SegmentsCompacted == 0 {
+		t.Fatalf("expected compaction, got %+v", result)
+	}
+	if chunk := firstChunkRecord(t, store, "tenant-a", "live"); chunk.KeyVersion != 2 {
+		t.Fatalf("compacted chunk key version = %d", chunk.KeyVersion)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "live"); string(got) != "live and moved" {
+		t.Fatalf("read after compaction %q", got)
+	}
+}
+
+func TestDeleteTenantShredsItsDataKeys(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	cfg := testConfig()
+	cfg.KeyProvider = newTestKeyProvider("a-master")
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := testContext(t)
+	data := []byte("customer data that must become unrecoverable")
+	putTestBytes(t, store, "tenant-a", "doc", data)
+	putTestBytes(t, store, "tenant-b", "doc", data)
+	result, err := store.DeleteTenantWithOptions(ctx, "tenant-a", DeleteTenantOptions{Shred: true})
+	if err != nil {
+		t.Fatalf("shred tenant: %v", err)
+	}
+	want := []ShreddedKey{{Scope: "tenant-a", Version: 1, MasterKeyID: "a-master"}}
+	if !reflect.DeepEqual(result.ShreddedKeys, want) || result.ShreddedChunks == 0 || result.ReadableChunks != 0 {
+		t.Fatalf("shred result = %+v", result)
+	}
+	stats, err := store.Stats(ctx)
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.Chunks.Shredded != result.ShreddedChunks {
+		t.Fatalf("shredded chunks = %d, want %d", stats.Chunks.Shredded, result.ShreddedChunks)
+	}
+	scrub, err := store.Scrub(ctx, ScrubOptions{CheckFiles: true})
+	if err != nil || !scrub.Healthy || scrub.ShreddedChunks != result.ShreddedChunks {
+		t.Fatalf("scrub = %+v, %v", scrub, err)
+	}
+	if got := readTestBytes(t, store, "tenant-b", "doc"); !bytes.Equal(got, data) {
+		t.Fatalf("other tenant read %q", got)
+	}
+	// A recreated tenant writes new chunks instead of reusing shredded ones.
+	putTestBytes(t, store, "tenant-a", "doc", data)
+	if got := readTestBytes(t, store, "tenant-a", "doc"); !bytes.Equal(got, data) {
+		t.Fatalf("recreated tenant read %q", got)
+	}
+	if _, err := store.RunGC(ctx, GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if got := readTestBytes(t, reopened, "tenant-a", "doc"); !bytes.Equal(got, data) {
+		t.Fatalf("read after reopen %q", got)
+	}
+	if _, err := reopened.DeleteTenantWithOptions(ctx, "tenant-b", DeleteTenantOptions{}); err != nil {
+		t.Fatalf("plain delete: %v", err)
+	}
+	reopened.metaMu.RLock()
+	_, kept := reopened.meta.Keyrings["tenant-b"]
+	reopened.metaMu.RUnlock()
+	if !kept {
+		t.Fatal("delete without shred destroyed the keyring")
+	}
+}
+
+// gateReader signals reached on its first read and then waits for release.
+type gateReader struct {
+	data     []byte
+	reached  chan struct{}
+	release  chan struct{}
+	signaled bool
+}
+
+func (r *gateReader) Read(p []byte) (int, error) {
+	if !r.signaled {
+		r.signaled = true
+		close(r.reached)
+		<-r.release
+	}
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestShredRejectsPutsPreparedWithDestroyedKeys(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	cfg := testConfig()
+	cfg.KeyProvider = newTestKeyProvider("a-master")
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	putTestBytes(t, store, "tenant-a", "doc", []byte("first generation"))
+
+	reader := &gateReader{data: []byte("written with a key about to be shredded"), reached: make(chan struct{}), release: make(chan struct{})}
+	stale := make(chan error, 1)
+	go func() {
+		_, err := store.Put(ctx, "tenant-a", "stale", reader, nil)
+		stale <- err
+	}()
+	<-reader.reached
+	if _, err := store.DeleteTenantWithOptions(ctx, "tenant-a", DeleteTenantOptions{Shred: true}); err != nil {
+		t.Fatalf("shred tenant: %v", err)
+	}
+	// The recreated keyring continues after the shredded versions.
+	putTestBytes(t, store, "tenant-a", "doc", []byte("second generation"))
+	store.metaMu.RLock()
+	ring := cloneKeyring(store.meta.Keyrings["tenant-a"])
+	store.metaMu.RUnlock()
+	if ring.Current != 2 || ring.Destroyed != 1 || len(ring.Keys) != 1 {
+		t.Fatalf("recreated keyring = %+v", ring)
+	}
+
+	close(reader.release)
+	if err := <-stale; !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("put prepared before the shred = %v", err)
+	}
+	if _, err := store.Stat("tenant-a/stale"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat stale object = %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	reopened, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	if got := readTestBytes(t, reopened, "tenant-a", "doc"); string(got) != "second generation" {
+		t.Fatalf("read after reopen %q", got)
+	}
+}
+
+func TestShredDefeatsRestoreToPreShredHistory(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	cfg := retentionTestConfig(8)
+	provider := newTestKeyProvider("a-master")
+	cfg.KeyProvider = provider
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	putTestBytes(t, store, "tenant-a", "doc", []byte("erase me everywhere"))
+	checkpointTestStore(t, store)
+	store.metaMu.RLock()
+	before := store.meta.TxID
+	store.metaMu.RUnlock()
+
+	// Before the shred the restore point reads the data.
+	view, err := store.RestoreToTx(ctx, before, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	if got := readTestBytes(t, view, "tenant-a", "doc"); string(got) != "erase me everywhere" {
+		t.Fatalf("restored object = %q", got)
+	}
+	if err := view.Close(); err != nil {
+		t.Fatalf("close view: %v", err)
+	}
+
+	if _, err := store.DeleteTenantWithOptions(ctx, "tenant-a", DeleteTenantOptions{Shred: true}); err != nil {
+		t.Fatalf("shred tenant: %v", err)
+	}
+	// A new tenant of the same name gets a new scope key, which does not
+	// unwrap the destroyed data keys either.
+	putTestBytes(t, store, "tenant-a", "other", []byte("new generation"))
+	view, err = store.RestoreToTx(ctx, before, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("restore after shred: %v", err)
+	}
+	defer view.Close()
+	reader, err := view.OpenObject(ctx, "tenant-a", "doc")
+	if err == nil {
+		_, err = io.ReadAll(reader)
+		reader.Close()
+	}
+	if !errors.Is(err, ErrKeyUnavailable) {
+		t.Fatalf("read of shredded data from pre-shred history = %v, want ErrKeyUnavailable", err)
+	}
+}
+
+func TestShredNeedsScopeKeys(t *testing.T) {
+	cfg := testConfig()
+	cfg.KeyProvider = masterOnlyProvider{newTestKeyProvider("a-master")}
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	putTestBytes(t, store, "tenant-a", "doc", []byte("master key only"))
+	if _, err := store.DeleteTenantWithOptions(ctx, "tenant-a", DeleteTenantOptions{Shred: true}); !errors.Is(err, ErrShredUnsupported) {
+		t.Fatalf("shred without scope keys = %v, want ErrShredUnsupported", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "doc"); string(got) != "master key only" {
+		t.Fatalf("tenant after refused shred read %q", got)
+	}
+}
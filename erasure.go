@@ -0,0 +1,202 @@
+package blobfs
+
+import (
+	"errors"
+	"fmt"
+)
+
+// gfExp and gfLog are the exponent and logarithm tables of GF(2^8) over the
+// polynomial x^8+x^4+x^3+x^2+1. gfExp is doubled so products need no modulo.
+var gfExp, gfLog = gfTables()
+
+// gfMulTable holds every product, so encoding costs one lookup per byte.
+var gfMulTable = gfProducts()
+
+func gfTables() ([510]byte, [256]byte) {
+	var exp [510]byte
+	var log [256]byte
+	x := 1
+	for i := 0; i < 255; i++ {
+		exp[i] = byte(x)
+		exp[i+255] = byte(x)
+		log[x] = byte(i)
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	return exp, log
+}
+
+func gfProducts() *[256][256]byte {
+	table := new([256][256]byte)
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			table[a][b] = gfExp[int(gfLog[a])+int(gfLog[b])]
+		}
+	}
+	return table
+}
+
+func gfMul(a, b byte) byte {
+	return gfMulTable[a][b]
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-int(gfLog[a])]
+}
+
+func gfPow(a byte, n int) byte {
+	if n == 0 {
+		return 1
+	}
+	if a == 0 {
+		return 0
+	}
+	return gfExp[int(gfLog[a])*n%255]
+}
+
+// reedSolomon is a systematic Reed-Solomon code: the first dataShards rows
+// of its matrix are the identity, and any dataShards of the dataShards +
+// parityShards shards rebuild the rest.
+type reedSolomon struct {
+	dataShards   int
+	parityShards int
+	matrix       [][]byte
+}
+
+func newReedSolomon(dataShards, parityShards int) (*reedSolomon, error) {
+	if dataShards <= 0 || parityShards <= 0 || dataShards+parityShards > 256 {
+		return nil, fmt.Errorf("invalid reed-solomon shape %d+%d", dataShards, parityShards)
+	}
+	total := dataShards + parityShards
+	vandermonde := make([][]byte, total)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = gfPow(byte(r), c)
+		}
+	}
+	top, err := gfInvert(vandermonde[:dataShards])
+	if err != nil {
+		return nil, err
+	}
+	return &reedSolomon{dataShards: dataShards, parityShards: parityShards, matrix: gfMatMul(vandermonde, top)}, nil
+}
+
+// encode fills the parity shards that follow the data shards. All shards
+// have the same length.
+func (rs *reedSolomon) encode(shards [][]byte) {
+	for p := 0; p < rs.parityShards; p++ {
+		out := shards[rs.dataShards+p]
+		clear(out)
+		for d := 0; d < rs.dataShards; d++ {
+			gfMulAdd(out, shards[d], rs.matrix[rs.dataShards+p][d])
+		}
+	}
+}
+
+// reconstruct rebuilds the data shards not marked valid from the valid
+// ones. Parity shards are left as they are.
+func (rs *reedSolomon) reconstruct(shards [][]byte, valid []bool) error {
+	rows := make([]int, 0, rs.dataShards)
+	missing := false
+	for i := range shards {
+		if i < rs.dataShards && !valid[i] {
+			missing = true
+		}
+		if valid[i] && len(rows) < rs.dataShards {
+			rows = append(rows, i)
+		}
+	}
+	if !missing {
+		return nil
+	}
+	if len(rows) < rs.dataShards {
+		return errors.New("too many damaged shards to reconstruct")
+	}
+	sub := make([][]byte, len(rows))
+	for i, row := range rows {
+		sub[i] = rs.matrix[row]
+	}
+	decode, err := gfInvert(sub)
+	if err != nil {
+		return err
+	}
+	inputs := make([][]byte, len(rows))
+	for i, row := range rows {
+		inputs[i] = shards[row]
+	}
+	for d := 0; d < rs.dataShards; d++ {
+		if valid[d] {
+			continue
+		}
+		out := make([]byte, len(shards[d]))
+		for i, in := range inputs {
+			gfMulAdd(out, in, decode[d][i])
+		}
+		shards[d] = out
+	}
+	return nil
+}
+
+func gfMulAdd(dst, src []byte, c byte) {
+	if c == 0 {
+		return
+	}
+	row := &gfMulTable[c]
+	for i, b := range src {
+		dst[i] ^= row[b]
+	}
+}
+
+func gfMatMul(a, b [][]byte) [][]byte {
+	out := make([][]byte, len(a))
+	for r := range a {
+		out[r] = make([]byte, len(b[0]))
+		for c := range out[r] {
+			var v byte
+			for i := range b {
+				v ^= gfMul(a[r][i], b[i][c])
+			}
+			out[r][c] = v
+		}
+	}
+	return out
+}
+
+// gfInvert inverts a square matrix with Gauss-Jordan elimination.
+func gfInvert(m [][]byte) ([][]byte, error) {
+	n := len(m)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := 0; c < n; c++ {
+		pivot := c
+		for pivot < n && work[pivot][c] == 0 {
+			pivot++
+		}
+		if pivot == n {
+			return nil, errors.New("singular reed-solomon matrix")
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		if inv := gfInv(work[c][c]); inv != 1 {
+			for i := range work[c] {
+				work[c][i] = gfMul(work[c][i], inv)
+			}
+		}
+		for r := 0; r < n; r++ {
+			if r != c && work[r][c] != 0 {
+				gfMulAdd(work[r], work[c], work[r][c])
+			}
+		}
+	}
+	out := make([][]byte, n)
+	for r := range out {
+		out[r] = work[r][n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,230 @@
+package blobfs
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// refMul multiplies in GF(2^8) bit by bit, without the tables erasure.go
+// uses.
+func refMul(a, b byte) byte {
+	var p byte
+	for b != 0 {
+		if b&1 != 0 {
+			p ^= a
+		}
+		carry := a & 0x80
+		a <<= 1
+		if carry != 0 {
+			a ^= 0x1d
+		}
+		b >>= 1
+	}
+	return p
+}
+
+func refInv(a byte) byte {
+	for b := 1; b < 256; b++ {
+		if refMul(a, byte(b)) == 1 {
+			return byte(b)
+		}
+	}
+	panic("zero has no inverse")
+}
+
+func refPow(a byte, n int) byte {
+	p := byte(1)
+	for range n {
+		p = refMul(p, a)
+	}
+	return p
+}
+
+// refInvert inverts m with textbook Gauss-Jordan elimination.
+func refInvert(m [][]byte) [][]byte {
+	n := len(m)
+	work := make([][]byte, n)
+	for r := range work {
+		work[r] = make([]byte, 2*n)
+		copy(work[r], m[r])
+		work[r][n+r] = 1
+	}
+	for c := range n {
+		pivot := c
+		for work[pivot][c] == 0 {
+			pivot++
+		}
+		work[c], work[pivot] = work[pivot], work[c]
+		inv := refInv(work[c][c])
+		for i := range work[c] {
+			work[c][i] = refMul(work[c][i], inv)
+		}
+		for r := range n {
+			if r == c || work[r][c] == 0 {
+				continue
+			}
+			factor := work[r][c]
+			for i := range work[r] {
+				work[r][i] ^= refMul(factor, work[c][i])
+			}
+		}
+	}
+	out := make([][]byte, n)
+	for r := range out {
+		out[r] = work[r][n:]
+	}
+	return out
+}
+
+// refParity computes the parity shards of data from the definition of the
+// code: the Vandermonde matrix times the inverse of its top square, applied
+// byte by byte.
+func refParity(data [][]byte, parityShards int) [][]byte {
+	dataShards := len(data)
+	vandermonde := make([][]byte, dataShards+parityShards)
+	for r := range vandermonde {
+		vandermonde[r] = make([]byte, dataShards)
+		for c := range vandermonde[r] {
+			vandermonde[r][c] = refPow(byte(r), c)
+		}
+	}
+	top := refInvert(vandermonde[:dataShards])
+	parity := make([][]byte, parityShards)
+	for p := range parity {
+		row := make([]byte, dataShards)
+		for c := range row {
+			for i := range dataShards {
+				row[c] ^= refMul(vandermonde[dataShards+p][i], top[i][c])
+			}
+		}
+		parity[p] = make([]byte, len(data[0]))
+		for b := range parity[p] {
+			for d := range dataShards {
+				parity[p][b] ^= refMul(row[d], data[d][b])
+			}
+		}
+	}
+	return parity
+}
+
+func randomShards(rng *rand.Rand, dataShards, parityShards, size int) [][]byte {
+	shards := make([][]byte, dataShards+parityShards)
+	for i := range shards {
+		shards[i] = make([]byte, size)
+		if i < dataShards {
+			rng.Read(shards[i])
+		}
+	}
+	return shards
+}
+
+// checkReconstruct erases the shards in lost and checks the data shards come
+// back as they were.
+func checkReconstruct(t *testing.T, rs *reedSolomon, shards [][]byte, lost []int) {
+	t.Helper()
+	damaged := make([][]byte, len(shards))
+	valid := make([]bool, len(shards))
+	for i := range shards {
+		damaged[i] = bytes.Clone(shards[i])
+		valid[i] = true
+	}
+	for _, i := range lost {
+		for b := range damaged[i] {
+			damaged[i][b] ^= 0x5a
+		}
+		valid[i] = false
+	}
+	if err := rs.reconstruct(damaged, valid); err != nil {
+		t.Fatalf("%d+%d reconstruct without %v: %v", rs.dataShards, rs.parityShards, lost, err)
+	}
+	for d := range rs.dataShards {
+		if !bytes.Equal(damaged[d], shards[d]) {
+			t.Fatalf("%d+%d shard %d differs after losing %v", rs.dataShards, rs.parityShards, d, lost)
+		}
+	}
+}
+
+// forEachErasure calls visit with every set of at most limit of n shards.
+func forEachErasure(n, limit int, visit func([]int)) {
+	var walk func(start int, lost []int)
+	walk = func(start int, lost []int) {
+		visit(lost)
+		if len(lost) == limit {
+			return
+		}
+		for i := start; i < n; i++ {
+			walk(i+1, append(lost, i))
+		}
+	}
+	walk(0, nil)
+}
+
+func TestReedSolomonRebuildsEveryErasureWithinParity(t *testing.T) {
+	for _, shape := range [][2]int{{1, 1}, {2, 3}, {4, 2}, {5, 3}, {6, 6}, {10, 4}} {
+		dataShards, parityShards := shape[0], shape[1]
+		t.Run(fmt.Sprintf("%d+%d", dataShards, parityShards), func(t *testing.T) {
+			rs, err := newReedSolomon(dataShards, parityShards)
+			if err != nil {
+				t.Fatalf("new reed-solomon: %v", err)
+			}
+			rng := rand.New(rand.NewSource(int64(dataShards*16 + parityShards)))
+			shards := randomShards(rng, dataShards, parityShards, 16)
+			rs.encode(shards)
+			total := dataShards + parityShards
+			erasures := 0
+			forEachErasure(total, parityShards, func(lost []int) {
+				checkReconstruct(t, rs, shards, lost)
+				erasures++
+			})
+			if erasures == 0 {
+				t.Fatal("no erasures checked")
+			}
+			// One shard more than the parity covers cannot be rebuilt when
+			// a data shard is among them.
+			valid := make([]bool, total)
+			for i := parityShards + 1; i < total; i++ {
+				valid[i] = true
+			}
+			if err := rs.reconstruct(shards, valid); err == nil {
+				t.Fatalf("reconstruct without %d shards succeeded", parityShards+1)
+			}
+		})
+	}
+}
+
+func FuzzReedSolomonMatchesReference(f *testing.F) {
+	f.Add([]byte("reed-solomon"), uint8(4), uint8(2), uint64(0b11))
+	f.Add([]byte{0, 0, 0, 0}, uint8(1), uint8(1), uint64(1))
+	f.Add(bytes.Repeat([]byte{0xff, 0x01}, 40), uint8(9), uint8(5), uint64(0x2a51))
+	f.Fuzz(func(t *testing.T, data []byte, dataShards, parityShards uint8, erase uint64) {
+		d := 1 + int(dataShards)%12
+		p := 1 + int(parityShards)%6
+		size := max(1, (len(data)+d-1)/d)
+		shards := make([][]byte, d+p)
+		for i := range shards {
+			shards[i] = make([]byte, size)
+			if i < d {
+				copy(shards[i], data[min(len(data), i*size):])
+			}
+		}
+		rs, err := newReedSolomon(d, p)
+		if err != nil {
+			t.Fatalf("new reed-solomon: %v", err)
+		}
+		rs.encode(shards)
+		for i, want := range refParity(shards[:d], p) {
+			if !bytes.Equal(shards[d+i], want) {
+				t.Fatalf("%d+%d parity shard %d differs from the reference", d, p, i)
+			}
+		}
+		var lost []int
+		for i := range d + p {
+			if erase&(1<<i) != 0 && len(lost) < p {
+				lost = append(lost, i)
+			}
+		}
+		checkReconstruct(t, rs, shards, lost)
+	})
+}
@@ -21,6 +21,18 @@ var (
 	ErrInvalidRange             = errors.New("range offset and length must be non-negative")
 	ErrReaderClosed             = errors.New("reader is closed")
 	ErrInvalidSeek              = errors.New("invalid seek")
+	ErrReadOnly                 = errors.New("store is read-only")
+	ErrRestorePointNotFound     = errors.New("restore point not retained")
+	ErrWatchExpired             = errors.New("watch history not retained")
+	ErrDeleteMarker             = errors.New("version is a delete marker")
+	ErrCrossTenant              = errors.New("cross-tenant sharing requires global dedup scope")
+	ErrSymlinkLoop              = errors.New("too many levels of symbolic links")
+	ErrPreconditionFailed       = errors.New("precondition failed")
+	ErrObjectLocked             = errors.New("object is under retention or legal hold")
+	ErrQuotaExceeded            = errors.New("tenant quota exceeded")
+	ErrEncryptionDisabled       = errors.New("encryption is not configured")
+	ErrKeyUnavailable           = errors.New("encryption key unavailable")
+	ErrShredUnsupported         = errors.New("data keys are not bound to a destroyable scope key")
 )
 
 var (
@@ -481,6 +481,9 @@ func TestRemoveSegmentFilesPartialFailureUpdatesMetadata(t *testing.T) {
 		t.Fatalf("mkdirall: %v", err)
 	}
 	putTestBytes(t, store, "tenant-a", "gc/blob1", bytes.Repeat([]byte("A"), 5*1024))
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 	putTestBytes(t, store, "tenant-a", "gc/blob2", bytes.Repeat([]byte("B"), 5*1024))
 
 	store.metaMu.RLock()
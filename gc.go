@@ -4,7 +4,9 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"maps"
 	"os"
+	"slices"
 	"time"
 )
 
@@ -29,8 +31,16 @@ type segmentGCStats struct {
 	DeadAt        int64
 }
 
-// RunGC marks unreferenced chunks, optionally compacts fragmented segments, and
-// deletes fully dead segments without holding metadata locks during filesystem IO.
+// RunGC runs one garbage collection pass. It first seals the shared open
+// segment if that has been idle for SegmentIdleTimeout or holds garbage this
+// pass can mark. It then drops expired trash entries, releases inodes no
+// tenant reaches any more, recounts hard links, and expires object versions
+// beyond their tenant limits. Finally it marks unreferenced chunks, compacts
+// fragmented segments when opts.Compact is set, and deletes fully dead
+// segments. Each stage commits its metadata before the next starts, and the
+// pass is recorded as a GC run. Lifecycle rules are not applied here:
+// RunLifecycle does that, and the background GC calls it before each pass.
+// No metadata lock is held during filesystem IO.
 func (s *Store) RunGC(ctx context.Context, opts GCOptions) (*GCResult, error) {
 	if err := s.beginOp(ctx); err != nil {
 		return nil, err
@@ -57,26 +67,57 @@ func (s *Store) RunGC(ctx context.Context, opts GCOptions) (*GCResult, error) {
 	if confirmCycles < 1 {
 		confirmCycles = 1
 	}
+	safetyCutoff := nowTime.Add(-safetyWindow).UnixNano()
+	// GC reclaims space only from sealed segments. The open segment is sealed
+	// once it has been idle for SegmentIdleTimeout or holds garbage this run
+	// can mark; a busy segment without garbage stays open.
+	err := s.sealActiveSegmentIf(func(segmentID string, lastAppend time.Time) bool {
+		if idle := s.cfg.SegmentIdleTimeout; idle > 0 && nowTime.Sub(lastAppend) >= idle {
+			return true
+		}
+		s.metaMu.RLock()
+		defer s.metaMu.RUnlock()
+		var tenantCutoffs map[string]int64
+		if opts.SafetyWindow == 0 {
+			tenantCutoffs = s.tenantSafetyCutoffsLocked(nowTime)
+		}
+		return s.segmentHasGarbageLocked(segmentID, safetyCutoff, tenantCutoffs)
+	})
+	if err != nil {
+		return nil, err
+	}
 
 	result := &GCResult{}
 	var removeSegments []segmentRecord
 	var compactCandidates []compactCandidate
 
 	s.metaMu.Lock()
+	segmentDeleteCutoff = s.retainedSegmentCutoffLocked(segmentDeleteCutoff)
 	epoch := s.meta.NextGCEpoch
 	s.meta.NextGCEpoch++
 	result.Epoch = epoch
 	startedAt := now
-	safetyCutoff := nowTime.Add(-safetyWindow).UnixNano()
 	ops := []metaOp{{Type: "append_gcrun", GCRun: &gcRun{Epoch: epoch, State: "STARTED", StartedAt: startedAt, SafetyCutoff: safetyCutoff}}}
-	s.collectUnreachableInodesLocked(now, &ops)
+	s.collectUnreachableInodesLocked(now, result, &ops)
 	if err := s.commitMetaLocked(ops); err != nil {
 		s.metaMu.Unlock()
 		return nil, err
 	}
 
 	ops = ops[:0]
-	s.markUnreferencedChunksLocked(now, nowTime.Add(-safetyWindow).UnixNano(), confirmCycles, result, &ops)
+	result.VersionsExpired += len(s.expireVersionsLocked(now, slices.Collect(maps.Values(s.meta.Versions)), s.tenantVersionLimits, &ops))
+	if err := s.commitMetaLocked(ops); err != nil {
+		s.metaMu.Unlock()
+		return result, errors.Join(err, s.recordGCRun(epoch, "FAILED", startedAt, safetyCutoff, err.Error()))
+	}
+
+	ops = ops[:0]
+	// An explicit window for this run overrides the tenant windows too.
+	var tenantCutoffs map[string]int64
+	if opts.SafetyWindow == 0 {
+		tenantCutoffs = s.tenantSafetyCutoffsLocked(nowTime)
+	}
+	s.markUnreferencedChunksLocked(now, safetyCutoff, tenantCutoffs, confirmCycles, result, &ops)
 	if err := s.commitMetaLocked(ops); err != nil {
 		s.metaMu.Unlock()
 		return result, errors.Join(err, s.recordGCRun(epoch, "FAILED", startedAt, safetyCutoff, err.Error()))
@@ -161,9 +202,30 @@ func (s *Store) recordGCRun(epoch int64, state string, startedAt, safetyCutoff i
 	return s.commitMetaLocked([]metaOp{{Type: "put_gcrun", GCRun: run}})
 }
 
-func (s *Store) markUnreferencedChunksLocked(now, cutoff int64, confirmCycles int, result *GCResult, ops *[]metaOp) {
+// tenantSafetyCutoffsLocked returns the safety cutoff of every tenant whose
+// configuration overrides the GC safety window.
+func (s *Store) tenantSafetyCutoffsLocked(nowTime time.Time) map[string]int64 {
+	cutoffs := map[string]int64{}
+	for tenantID, settings := range s.meta.TenantSettings {
+		if settings.Config != nil && settings.Config.SafetyWindow != 0 {
+			cutoffs[tenantID] = nowTime.Add(-s.tenantConfigLocked(tenantID).GC.SafetyWindow).UnixNano()
+		}
+	}
+	return cutoffs
+}
+
+// markUnreferencedChunksLocked moves unreferenced chunks created before the
+// cutoff of their owner, or before cutoff, toward deletion.
+func (s *Store) markUnreferencedChunksLocked(now, cutoff int64, tenantCutoffs map[string]int64, confirmCycles int, result *GCResult, ops *[]metaOp) {
+	locked := s.lockedChunksLocked(now)
 	for _, chunk := range s.meta.Chunks {
-		if chunk == nil || chunk.State == chunkStateDeleted || chunk.RefCount > 0 || chunk.CreatedAt >= cutoff {
+		chunkCutoff := cutoff
+		if chunk != nil {
+			if tenantCutoff, ok := tenantCutoffs[chunkOwner(chunk)]; ok {
+				chunkCutoff = tenantCutoff
+			}
+		}
+		if chunk == nil || chunk.State == chunkStateDeleted || chunk.RefCount > 0 || chunk.CreatedAt >= chunkCutoff || locked[chunk.ChunkID] {
 			if chunk.RefCount > 0 {
 				result.LiveChunks++
 			}
@@ -198,6 +260,13 @@ func (s *Store) markUnreferencedChunksLocked(now, cutoff int64, confirmCycles in
 				result.CandidatesMarked++
 				changed = true
 			}
+		case chunkStateShredded:
+			// Nothing can read a shredded chunk, so it needs no confirmation.
+			next.State = chunkStateDeleted
+			next.DeletedAt = now
+			result.ChunksDeleted++
+			result.BytesMadeGarbage += chunk.StoredSize
+			changed = true
 		}
 		if changed {
 			*ops = append(*ops, metaOp{Type: "put_chunk", Chunk: &next})
@@ -205,6 +274,30 @@ func (s *Store) markUnreferencedChunksLocked(now, cutoff int64, confirmCycles in
 	}
 }
 
+// segmentHasGarbageLocked reports whether segmentID holds a chunk GC has
+// already marked or would mark with the given cutoffs.
+func (s *Store) segmentHasGarbageLocked(segmentID string, cutoff int64, tenantCutoffs map[string]int64) bool {
+	for _, chunk := range s.meta.Chunks {
+		if chunk == nil || chunk.SegmentID != segmentID {
+			continue
+		}
+		if chunk.State != chunkStateActive {
+			return true
+		}
+		if chunk.RefCount > 0 {
+			continue
+		}
+		chunkCutoff := cutoff
+		if tenantCutoff, ok := tenantCutoffs[chunkOwner(chunk)]; ok {
+			chunkCutoff = tenantCutoff
+		}
+		if chunk.CreatedAt < chunkCutoff {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Store) collectSegmentWorkLocked(segmentDeleteCutoff int64, compact bool) ([]compactCandidate, []segmentRecord) {
 	stats := s.collectSegmentStatsLocked()
 	var candidates []compactCandidate
@@ -218,7 +311,7 @@ func (s *Store) collectSegmentWorkLocked(segmentDeleteCutoff int64, compact bool
 				candidates = append(candidates, compactCandidate{Source: seg, Chunks: stat.LiveChunks})
 			}
 		}
-		if seg.State == segmentStateDeleted || seg.State == segmentStateCorrupt || pinned || stat.BlocksRemoval {
+		if seg.State == segmentStateOpen || seg.State == segmentStateDeleted || seg.State == segmentStateCorrupt || pinned || stat.BlocksRemoval {
 			continue
 		}
 		deadAt := stat.DeadAt
@@ -260,7 +353,7 @@ func (s *Store) collectSegmentStatsLocked() map[string]*segmentGCStats {
 			}
 			continue
 		}
-		if chunk.RefCount == 0 {
+		if chunk.RefCount == 0 || chunk.State == chunkStateShredded {
 			stat.GarbageBytes += chunk.SegmentLength
 			stat.BlocksRemoval = true
 			continue
@@ -286,6 +379,13 @@ func (s *Store) compactCandidates(ctx context.Context, candidates []compactCandi
 				writer.cleanup()
 				return nil, errors.Join(err, s.removeCompactedSegments(results))
 			}
+			// Rewritten chunks take the owner's current compression settings
+			// and the current data key of their scope.
+			writer.compression = compressionOf(s.tenantConfig(chunkOwner(&chunk)))
+			if writer.sealer, err = s.scopeCipher(ctx, chunk.TenantID); err != nil {
+				writer.cleanup()
+				return nil, errors.Join(err, s.removeCompactedSegments(results))
+			}
 			next, err := writer.appendChunk(chunk.TenantID, chunk.ChunkID, raw)
 			if err != nil {
 				writer.cleanup()
@@ -313,6 +413,9 @@ func (s *Store) removeCompactedSegments(results []compactResult) error {
 			if err := s.fs.Remove(path); err != nil && !os.IsNotExist(err) {
 				errs = append(errs, fmt.Errorf("remove compacted segment %s: %w", path, err))
 			}
+			if err := s.removeSegmentParity(seg); err != nil {
+				errs = append(errs, fmt.Errorf("remove parity of compacted segment %s: %w", path, err))
+			}
 		}
 	}
 	return errors.Join(errs...)
@@ -350,7 +453,8 @@ func (s *Store) commitCompactionResults(results []compactResult, gcResult *GCRes
 				current.SegmentOffset != original.SegmentOffset ||
 				current.SegmentLength != original.SegmentLength ||
 				current.State == chunkStateDeleted ||
-				current.RefCount == 0 {
+				current.RefCount == 0 ||
+				s.checkChunkKeyLocked(&moved) != nil {
 				valid = false
 				break
 			}
@@ -361,6 +465,7 @@ func (s *Store) commitCompactionResults(results []compactResult, gcResult *GCRes
 			next.StoredSize = moved.StoredSize
 			next.ChecksumCRC32C = moved.ChecksumCRC32C
 			next.Compression = moved.Compression
+			next.KeyVersion = moved.KeyVersion
 			chunkUpdates = append(chunkUpdates, next)
 		}
 		if !valid {
@@ -423,21 +528,27 @@ func (s *Store) removeSegmentFiles(ctx context.Context, segments []segmentRecord
 		if err := s.fs.Remove(s.segmentPath(&seg)); err != nil && !os.IsNotExist(err) {
 			return deleted, err
 		}
+		if err := s.removeSegmentParity(&seg); err != nil {
+			return deleted, err
+		}
 		deleted = append(deleted, seg)
 	}
 	return deleted, nil
 }
 
-func (s *Store) collectUnreachableInodesLocked(now int64, ops *[]metaOp) {
+func (s *Store) collectUnreachableInodesLocked(now int64, result *GCResult, ops *[]metaOp) {
 	reachable := map[uint64]bool{}
 	for _, rootID := range s.meta.Tenants {
 		s.markReachableLocked(rootID, reachable)
 	}
+	s.markTrashReachableLocked(now, reachable, result, ops)
+	s.fixLinkCountsLocked(reachable, ops, now)
 	manifestRecords := map[string]*manifestRecord{}
 	manifestDeltas := map[string]int{}
 	chunkDeltas := map[string]int{}
 	for _, inode := range s.meta.Inodes {
-		if inode.State != fileStateActive || reachable[inode.InodeID] {
+		// A locked file stays until its lock ends, even when detached.
+		if inode.State != fileStateActive || reachable[inode.InodeID] || objectLocked(inode, now) {
 			continue
 		}
 		next := cloneInode(inode)
@@ -0,0 +1,311 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"time"
+)
+
+// SetLifecycle replaces the lifecycle rules of tenantID. Rules are persisted
+// with the store metadata and evaluated by RunLifecycle, which the background
+// GC loop runs before every collection. An empty rules slice removes them.
+func (s *Store) SetLifecycle(ctx context.Context, tenantID string, rules []LifecycleRule) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("set lifecycle", tenantID, err)
+	}
+	records := make([]lifecycleRule, 0, len(rules))
+	for _, rule := range rules {
+		prefix := rule.Prefix
+		if prefix != "" {
+			normalized, err := normalizePath(prefix, s.cfg)
+			if err != nil {
+				return pathError("set lifecycle", prefix, err)
+			}
+			prefix = normalized
+		}
+		if rule.ExpireAfter < 0 || rule.NoncurrentExpireAfter < 0 || rule.AbortSessionsAfter < 0 {
+			return pathError("set lifecycle", tenantID, errors.New("lifecycle durations must be non-negative"))
+		}
+		records = append(records, lifecycleRule{
+			ID:                    rule.ID,
+			Prefix:                prefix,
+			ExpireAfter:           int64(rule.ExpireAfter),
+			NoncurrentExpireAfter: int64(rule.NoncurrentExpireAfter),
+			AbortSessionsAfter:    int64(rule.AbortSessionsAfter),
+		})
+	}
+	if len(records) == 0 {
+		records = nil
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.updateTenantSettingsLocked(tenantID, func(settings *tenantSettings) {
+		settings.Lifecycle = records
+	})
+}
+
+// Lifecycle returns the lifecycle rules of tenantID.
+func (s *Store) Lifecycle(ctx context.Context, tenantID string) ([]LifecycleRule, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("lifecycle", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil {
+		return nil, nil
+	}
+	rules := make([]LifecycleRule, 0, len(settings.Lifecycle))
+	for _, rule := range settings.Lifecycle {
+		rules = append(rules, LifecycleRule{
+			ID:                    rule.ID,
+			Prefix:                rule.Prefix,
+			ExpireAfter:           time.Duration(rule.ExpireAfter),
+			NoncurrentExpireAfter: time.Duration(rule.NoncurrentExpireAfter),
+			AbortSessionsAfter:    time.Duration(rule.AbortSessionsAfter),
+		})
+	}
+	return rules, nil
+}
+
+// lifecycleBatchSize bounds the files or version histories expired by one
+// lifecycle transaction, so metaMu is released between batches.
+const lifecycleBatchSize = 256
+
+// RunLifecycle applies the lifecycle rules of every tenant once. Expired
+// files become ordinary deletes and dropped versions release their
+// references; each tenant commits them in transactions of at most
+// lifecycleBatchSize files or histories, and the next RunGC reclaims the
+// data. Files that cannot be deleted, such as those under object lock, are
+// skipped and reported in Failed. Stale write sessions are discarded
+// afterwards. If a commit fails the run stops, and the result lists what the
+// earlier transactions expired.
+func (s *Store) RunLifecycle(ctx context.Context) (*LifecycleResult, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	now := nowUnix()
+	result := &LifecycleResult{}
+	s.metaMu.RLock()
+	var tenants []string
+	sessionRules := map[string][]lifecycleRule{}
+	for _, tenantID := range sortedNames(s.meta.Tenants) {
+		settings := s.meta.TenantSettings[tenantID]
+		if settings == nil || len(settings.Lifecycle) == 0 {
+			continue
+		}
+		tenants = append(tenants, tenantID)
+		for _, rule := range settings.Lifecycle {
+			if rule.AbortSessionsAfter > 0 {
+				sessionRules[tenantID] = append(sessionRules[tenantID], rule)
+			}
+		}
+	}
+	histories := map[string][]string{}
+	for key, history := range s.meta.Versions {
+		if settings := s.meta.TenantSettings[history.TenantID]; settings != nil && len(settings.Lifecycle) > 0 {
+			histories[history.TenantID] = append(histories[history.TenantID], key)
+		}
+	}
+	s.metaMu.RUnlock()
+	for _, tenantID := range tenants {
+		if err := contextError(ctx); err != nil {
+			return result, err
+		}
+		if err := s.expireLifecycleFiles(tenantID, now, result); err != nil {
+			return result, err
+		}
+		keys := histories[tenantID]
+		sort.Strings(keys)
+		for len(keys) > 0 {
+			n := min(len(keys), lifecycleBatchSize)
+			if err := s.expireLifecycleVersions(keys[:n], now, result); err != nil {
+				return result, err
+			}
+			keys = keys[n:]
+		}
+	}
+	result.SessionsAborted = s.abortStaleSessions(now, sessionRules)
+	return result, nil
+}
+
+// expireLifecycleFiles deletes the files of tenantID that the lifecycle rules
+// have expired, one batch per transaction. Each file is checked again under
+// the write lock, since it may have changed after the candidates were found.
+func (s *Store) expireLifecycleFiles(tenantID string, now int64, result *LifecycleResult) error {
+	s.metaMu.RLock()
+	var paths []string
+	if settings := s.meta.TenantSettings[tenantID]; settings != nil {
+		paths = s.expiredFilesLocked(tenantID, settings.Lifecycle, now)
+	}
+	s.metaMu.RUnlock()
+	for len(paths) > 0 {
+		n := min(len(paths), lifecycleBatchSize)
+		if err := s.expireLifecycleBatch(tenantID, paths[:n], now, result); err != nil {
+			return err
+		}
+		paths = paths[n:]
+	}
+	return nil
+}
+
+func (s *Store) expireLifecycleBatch(tenantID string, paths []string, now int64, result *LifecycleResult) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil {
+		return nil
+	}
+	var ops []metaOp
+	var undo []func(*metadata)
+	var expired []ExpiredObject
+	for _, path := range paths {
+		inode, err := s.lookupPathLocked(tenantID, path)
+		if err != nil || !lifecycleExpired(inode, path, settings.Lifecycle, now) {
+			continue
+		}
+		object := ExpiredObject{TenantID: tenantID, Path: path, VersionID: inode.Generation}
+		// Each delete is staged so the next one sees its effect on link
+		// counts and manifest references.
+		var deleteOps []metaOp
+		if err := s.deleteObjectLocked(tenantID, path, Preconditions{}, &deleteOps); err != nil {
+			result.Failed = append(result.Failed, LifecycleFailure{ExpiredObject: object, Err: err})
+			continue
+		}
+		undo = append(undo, stageMetaLocked(s.meta, deleteOps)...)
+		ops = append(ops, deleteOps...)
+		expired = append(expired, object)
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i](s.meta)
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return err
+	}
+	result.ObjectsExpired += len(expired)
+	result.Expired = append(result.Expired, expired...)
+	return nil
+}
+
+// expireLifecycleVersions drops the noncurrent versions the lifecycle rules
+// have expired from the version histories with keys, in one transaction.
+func (s *Store) expireLifecycleVersions(keys []string, now int64, result *LifecycleResult) error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	histories := make([]*versionHistory, 0, len(keys))
+	for _, key := range keys {
+		if history := s.meta.Versions[key]; history != nil {
+			histories = append(histories, history)
+		}
+	}
+	var ops []metaOp
+	expired := s.expireVersionsLocked(now, histories, s.lifecycleVersionLimits, &ops)
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return err
+	}
+	result.VersionsExpired += len(expired)
+	result.Expired = append(result.Expired, expired...)
+	return nil
+}
+
+// expiredFilesLocked returns the paths of the files of tenantID that a rule
+// with ExpireAfter has expired, parents before children.
+func (s *Store) expiredFilesLocked(tenantID string, rules []lifecycleRule, now int64) []string {
+	root := s.activeInodeLocked(s.meta.Tenants[tenantID])
+	if root == nil {
+		return nil
+	}
+	paths := map[uint64]string{root.InodeID: ""}
+	var expired []string
+	s.walkSubtreeLocked(root.InodeID, func(parentID uint64, name string, inode *inodeRecord) {
+		path := name
+		if parent := paths[parentID]; parent != "" {
+			path = parent + "/" + name
+		}
+		if inode.Kind == fileKindDir {
+			paths[inode.InodeID] = path
+			return
+		}
+		if lifecycleExpired(inode, path, rules, now) {
+			expired = append(expired, path)
+		}
+	})
+	return expired
+}
+
+// lifecycleExpired reports whether a rule with ExpireAfter has expired the
+// file inode at path.
+func lifecycleExpired(inode *inodeRecord, path string, rules []lifecycleRule, now int64) bool {
+	if inode.Kind != fileKindFile {
+		return false
+	}
+	age := now - fileInfoFromInode(inode).ModTime().UnixNano()
+	for _, rule := range rules {
+		if rule.ExpireAfter > 0 && age > rule.ExpireAfter && lifecycleRuleMatches(rule, path) {
+			return true
+		}
+	}
+	return false
+}
+
+// lifecycleVersionLimits expires noncurrent versions after the shortest
+// NoncurrentExpireAfter of the rules matching their path.
+func (s *Store) lifecycleVersionLimits(history *versionHistory) (int, int64) {
+	settings := s.meta.TenantSettings[history.TenantID]
+	if settings == nil {
+		return 0, 0
+	}
+	var maxAge int64
+	for _, rule := range settings.Lifecycle {
+		if rule.NoncurrentExpireAfter > 0 && lifecycleRuleMatches(rule, history.Path) && (maxAge == 0 || rule.NoncurrentExpireAfter < maxAge) {
+			maxAge = rule.NoncurrentExpireAfter
+		}
+	}
+	return 0, maxAge
+}
+
+// abortStaleSessions discards the VFS write sessions that a rule with
+// AbortSessionsAfter has expired and returns how many it discarded.
+func (s *Store) abortStaleSessions(now int64, rules map[string][]lifecycleRule) int {
+	if len(rules) == 0 {
+		return 0
+	}
+	s.handleMu.Lock()
+	var stale []*blobVFSFile
+	for handle := range s.handles {
+		file, ok := handle.(*blobVFSFile)
+		if !ok {
+			continue
+		}
+		file.mu.Lock()
+		if file.session != nil && !file.closed {
+			age := now - file.openedAt
+			for _, rule := range rules[file.tenantID] {
+				if age > rule.AbortSessionsAfter && lifecycleRuleMatches(rule, file.path) {
+					stale = append(stale, file)
+					break
+				}
+			}
+		}
+		file.mu.Unlock()
+	}
+	s.handleMu.Unlock()
+	for _, file := range stale {
+		_ = file.close(false)
+	}
+	return len(stale)
+}
+
+func lifecycleRuleMatches(rule lifecycleRule, path string) bool {
+	return rule.Prefix == "" || pathHasPrefix(path, rule.Prefix)
+}
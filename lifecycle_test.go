@@ -4,10 +4,12 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -236,9 +238,11 @@ func TestPutRewritesUnreferencedChunkInsteadOfReusingIt(t *testing.T) {
 	store.metaMu.RLock()
 	oldManifest := store.meta.Manifests[first.ManifestID]
 	oldSegmentID := ""
+	oldOffset := int64(0)
 	if oldManifest != nil && len(oldManifest.Chunks) == 1 {
 		if oldChunk := store.meta.Chunks[oldManifest.Chunks[0].ChunkID]; oldChunk != nil {
 			oldSegmentID = oldChunk.SegmentID
+			oldOffset = oldChunk.SegmentOffset
 		}
 	}
 	store.metaMu.RUnlock()
@@ -260,17 +264,19 @@ func TestPutRewritesUnreferencedChunkInsteadOfReusingIt(t *testing.T) {
 	}
 	chunk := store.meta.Chunks[manifest.Chunks[0].ChunkID]
 	segmentID := ""
+	offset := int64(0)
 	refCount := 0
 	if chunk != nil {
 		segmentID = chunk.SegmentID
+		offset = chunk.SegmentOffset
 		refCount = chunk.RefCount
 	}
 	store.metaMu.RUnlock()
 	if refCount != 1 {
 		t.Fatalf("chunk refcount = %d, want 1", refCount)
 	}
-	if oldSegmentID == segmentID {
-		t.Fatalf("unreferenced chunk reused old segment %s", segmentID)
+	if oldSegmentID == segmentID && oldOffset == offset {
+		t.Fatalf("unreferenced chunk reused old record %s@%d", segmentID, offset)
 	}
 }
 
@@ -524,3 +530,185 @@ func (f *blockingOpenFS) Open(name string) (afero.File, error) {
 	}
 	return f.Fs.Open(name)
 }
+
+func TestLifecycleRulesExpireObjectsAndVersions(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := testContext(t)
+	if err := store.SetVersioning(ctx, "tenant-a", VersioningConfig{Enabled: true}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	for _, dir := range []string{"tenant-a/logs", "tenant-a/logsx"} {
+		if err := store.MkdirAll(dir, 0o755); err != nil {
+			t.Fatalf("mkdir %s: %v", dir, err)
+		}
+	}
+	putTestBytes(t, store, "tenant-a", "logs/old.txt", []byte("old"))
+	putTestBytes(t, store, "tenant-a", "logs/new.txt", []byte("new"))
+	putTestBytes(t, store, "tenant-a", "logsx/old.txt", []byte("other prefix"))
+	past := time.Now().Add(-2 * time.Hour)
+	for _, name := range []string{"tenant-a/logs/old.txt", "tenant-a/logsx/old.txt"} {
+		if err := store.Chtimes(name, past, past); err != nil {
+			t.Fatalf("chtimes %s: %v", name, err)
+		}
+	}
+	if err := store.SetLifecycle(ctx, "tenant-a", []LifecycleRule{{Prefix: "logs", ExpireAfter: -time.Hour}}); err == nil {
+		t.Fatal("negative duration accepted")
+	}
+	rules := []LifecycleRule{{ID: "logs", Prefix: "logs", ExpireAfter: time.Hour, NoncurrentExpireAfter: time.Nanosecond}}
+	if err := store.SetLifecycle(ctx, "tenant-a", rules); err != nil {
+		t.Fatalf("set lifecycle: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.Lifecycle(ctx, "tenant-a"); err != nil || len(got) != 1 || got[0] != rules[0] {
+		t.Fatalf("lifecycle after reopen = %+v, %v", got, err)
+	}
+
+	old, err := store.StatObject(ctx, "tenant-a", "logs/old.txt")
+	if err != nil {
+		t.Fatalf("stat old: %v", err)
+	}
+	result, err := store.RunLifecycle(ctx)
+	want := []ExpiredObject{{TenantID: "tenant-a", Path: "logs/old.txt", VersionID: old.Generation}}
+	if err != nil || result.ObjectsExpired != 1 || result.VersionsExpired != 0 || !reflect.DeepEqual(result.Expired, want) || result.Failed != nil {
+		t.Fatalf("first run = %+v, %v", result, err)
+	}
+	if _, err := store.StatObject(ctx, "tenant-a", "logs/old.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired object = %v", err)
+	}
+	for _, path := range []string{"logs/new.txt", "logsx/old.txt"} {
+		if _, err := store.StatObject(ctx, "tenant-a", path); err != nil {
+			t.Fatalf("stat %s: %v", path, err)
+		}
+	}
+	versions, err := store.ListVersions(ctx, "tenant-a", "logs/old.txt")
+	if err != nil || len(versions) != 2 || !versions[0].DeleteMarker {
+		t.Fatalf("versions after expiry = %+v, %v", versions, err)
+	}
+
+	// The retired version and then its orphaned delete marker go next.
+	result, err = store.RunLifecycle(ctx)
+	want = []ExpiredObject{
+		{TenantID: "tenant-a", Path: "logs/old.txt", VersionID: versions[1].VersionID, Noncurrent: true},
+		{TenantID: "tenant-a", Path: "logs/old.txt", VersionID: versions[0].VersionID, Noncurrent: true},
+	}
+	if err != nil || result.ObjectsExpired != 0 || result.VersionsExpired != 2 || !reflect.DeepEqual(result.Expired, want) {
+		t.Fatalf("second run = %+v, %v", result, err)
+	}
+	if versions, err := store.ListVersions(ctx, "tenant-a", "logs/old.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("versions after noncurrent expiry = %+v, %v", versions, err)
+	}
+	if _, err := store.RunGC(ctx, GCOptions{CandidateConfirmCycles: 1, SafetyWindow: -1}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	store.metaMu.RLock()
+	live := 0
+	for _, manifest := range store.meta.Manifests {
+		if manifest.RefCount > 0 {
+			live++
+		}
+	}
+	store.metaMu.RUnlock()
+	if live != 2 {
+		t.Fatalf("referenced manifests = %d, want 2", live)
+	}
+}
+
+func TestLifecycleAbortsStaleWriteSessions(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	if err := store.MkdirAll("tenant-a/uploads", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	stale, err := store.OpenFile("tenant-a/uploads/part", os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open stale: %v", err)
+	}
+	if _, err := stale.Write([]byte("partial")); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	other, err := store.OpenFile("tenant-a/kept", os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open other: %v", err)
+	}
+	if err := store.SetLifecycle(ctx, "tenant-a", []LifecycleRule{{Prefix: "uploads", AbortSessionsAfter: time.Nanosecond}}); err != nil {
+		t.Fatalf("set lifecycle: %v", err)
+	}
+	result, err := store.RunLifecycle(ctx)
+	if err != nil || result.SessionsAborted != 1 || result.ObjectsExpired != 0 || result.Expired != nil {
+		t.Fatalf("run = %+v, %v", result, err)
+	}
+	if got := openWriteSessionCount(store); got != 1 {
+		t.Fatalf("open write sessions = %d, want 1", got)
+	}
+	if _, err := stale.Write([]byte("more")); err == nil {
+		t.Fatal("write to aborted session succeeded")
+	}
+	if _, err := store.Stat("tenant-a/uploads/part"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("aborted upload = %v", err)
+	}
+	if err := other.Close(); err != nil {
+		t.Fatalf("close other: %v", err)
+	}
+}
+
+func TestLifecycleSkipsFilesItCannotDeleteAndCommitsInBatches(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	if err := store.MkdirAll("tenant-a/logs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	files := lifecycleBatchSize + 10
+	past := time.Now().Add(-2 * time.Hour)
+	for i := 0; i < files; i++ {
+		path := fmt.Sprintf("logs/%04d.txt", i)
+		putTestBytes(t, store, "tenant-a", path, []byte(path))
+		if err := store.Chtimes("tenant-a/"+path, past, past); err != nil {
+			t.Fatalf("chtimes %s: %v", path, err)
+		}
+	}
+	held, err := store.SetLegalHold(ctx, "tenant-a", "logs/0003.txt", true)
+	if err != nil {
+		t.Fatalf("legal hold: %v", err)
+	}
+	if err := store.SetLifecycle(ctx, "tenant-a", []LifecycleRule{{Prefix: "logs", ExpireAfter: time.Hour}}); err != nil {
+		t.Fatalf("set lifecycle: %v", err)
+	}
+	store.metaMu.RLock()
+	txid := store.meta.TxID
+	store.metaMu.RUnlock()
+
+	result, err := store.RunLifecycle(ctx)
+	if err != nil {
+		t.Fatalf("run: %v", err)
+	}
+	if result.ObjectsExpired != files-1 || len(result.Expired) != files-1 {
+		t.Fatalf("expired %d objects, listed %d, want %d", result.ObjectsExpired, len(result.Expired), files-1)
+	}
+	if len(result.Failed) != 1 || result.Failed[0].Path != "logs/0003.txt" || result.Failed[0].VersionID != held.Generation || !errors.Is(result.Failed[0].Err, ErrObjectLocked) {
+		t.Fatalf("failed = %+v", result.Failed)
+	}
+	store.metaMu.RLock()
+	commits := store.meta.TxID - txid
+	store.metaMu.RUnlock()
+	if commits != 2 {
+		t.Fatalf("lifecycle used %d transactions, want 2", commits)
+	}
+	if _, err := store.StatObject(ctx, "tenant-a", "logs/0003.txt"); err != nil {
+		t.Fatalf("held file: %v", err)
+	}
+	if _, err := store.StatObject(ctx, "tenant-a", "logs/0004.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expired file = %v", err)
+	}
+}
@@ -0,0 +1,385 @@
+package blobfs
+
+import (
+	"io/fs"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/spf13/afero"
+)
+
+// maxSymlinkHops bounds how many symlinks one lookup follows, like the kernel
+// MAXSYMLINKS limit.
+const maxSymlinkHops = 40
+
+var (
+	_ afero.Symlinker = (*Store)(nil)
+	_ afero.Lstater   = (*Store)(nil)
+)
+
+// linkCount returns the number of dirents that name inode.
+func linkCount(inode *inodeRecord) uint32 {
+	if inode.Nlink == 0 {
+		return 1
+	}
+	return inode.Nlink
+}
+
+// walkPathLocked resolves path under the root of tenantID. Symlinks in
+// directory components are always followed and the final component is
+// followed when followFinal is set. It also returns the canonical path of the
+// result. With allowMissing, a missing final component yields a nil inode and
+// the canonical path it would have.
+func (s *Store) walkPathLocked(tenantID, name string, followFinal, allowMissing bool) (*inodeRecord, string, error) {
+	root := s.activeInodeLocked(s.meta.Tenants[tenantID])
+	if root == nil {
+		return nil, "", fs.ErrNotExist
+	}
+	var parts []string
+	if name != "" {
+		parts = strings.Split(name, "/")
+	}
+	hops := 0
+walk:
+	for {
+		current := root
+		for i, part := range parts {
+			if current.Kind != fileKindDir {
+				return nil, "", ErrNotDir
+			}
+			child := s.activeInodeLocked(s.meta.DirEntries[current.InodeID][part])
+			last := i == len(parts)-1
+			if child == nil {
+				if last && allowMissing {
+					return nil, strings.Join(parts, "/"), nil
+				}
+				return nil, "", fs.ErrNotExist
+			}
+			if child.Kind == fileKindSymlink && (!last || followFinal) {
+				hops++
+				if hops > maxSymlinkHops {
+					return nil, "", ErrSymlinkLoop
+				}
+				parts = symlinkTargetParts(parts[:i], child.Target, parts[i+1:])
+				continue walk
+			}
+			current = child
+		}
+		return current, strings.Join(parts, "/"), nil
+	}
+}
+
+// symlinkTargetParts joins a link target onto the directory holding the link
+// and appends the unresolved rest of the path. Absolute targets start at the
+// tenant root, and ".." never climbs above it.
+func symlinkTargetParts(dir []string, target string, rest []string) []string {
+	base := "/" + strings.Join(dir, "/")
+	if strings.HasPrefix(target, "/") {
+		base = "/"
+	}
+	var parts []string
+	for _, part := range strings.Split(path.Join(base, target), "/") {
+		if part != "" {
+			parts = append(parts, part)
+		}
+	}
+	return append(parts, rest...)
+}
+
+// lookupPathLocked resolves path like resolvePathLocked but returns a symlink
+// in the final component itself, as lstat does.
+func (s *Store) lookupPathLocked(tenantID, name string) (*inodeRecord, error) {
+	inode, _, err := s.walkPathLocked(tenantID, name, false, false)
+	return inode, err
+}
+
+// writePathLocked returns the canonical path a write to name lands on,
+// following a symlink in the final component even when its target does not
+// exist yet.
+func (s *Store) writePathLocked(tenantID, name string) (string, error) {
+	_, canonical, err := s.walkPathLocked(tenantID, name, true, true)
+	if err != nil {
+		return "", err
+	}
+	if canonical == "" {
+		return "", ErrIsDir
+	}
+	return canonical, nil
+}
+
+// liveLinksLocked returns the dirents other than parentID/name that still
+// name inode, primary first. It follows the inode's own back references, so
+// an unlink costs O(links); dirents lost with a removed directory are
+// skipped.
+func (s *Store) liveLinksLocked(inode *inodeRecord, parentID uint64, name string) []dirLink {
+	var links []dirLink
+	for _, link := range append([]dirLink{{ParentID: inode.ParentInode, Name: inode.Name}}, inode.OtherLinks...) {
+		if link.ParentID == parentID && link.Name == name {
+			continue
+		}
+		if s.activeInodeLocked(link.ParentID) == nil || s.meta.DirEntries[link.ParentID][link.Name] != inode.InodeID {
+			continue
+		}
+		links = append(links, link)
+	}
+	return links
+}
+
+// removeLinkLocked removes the dirent parentID/name that names inode. A file
+// with other hard links only loses a link; otherwise the inode is tombstoned
+// and its content retired, leaving a delete marker when deleteMarker is set
+// and the tenant keeps versions.
+func (s *Store) removeLinkLocked(inode *inodeRecord, parentID uint64, name, path string, deleteMarker bool, ops *[]metaOp, now int64) {
+	*ops = append(*ops, metaOp{Type: "delete_dirent", ParentID: parentID, Name: name})
+	next := cloneInode(inode)
+	next.Generation++
+	next.CTime = now
+	next.UpdatedAt = now
+	if linkCount(inode) > 1 {
+		if links := s.liveLinksLocked(inode, parentID, name); len(links) > 0 {
+			next.ParentInode = links[0].ParentID
+			next.Name = links[0].Name
+			next.Nlink = 0
+			next.OtherLinks = nil
+			if len(links) > 1 {
+				next.Nlink = uint32(len(links))
+				next.OtherLinks = links[1:]
+			}
+			*ops = append(*ops, metaOp{Type: "put_inode", Inode: next})
+			return
+		}
+	}
+	next.Nlink = 0
+	next.OtherLinks = nil
+	next.State = fileStateDeleted
+	next.DeletedAt = now
+	*ops = append(*ops, metaOp{Type: "put_inode", Inode: next})
+	if inode.Kind == fileKindFile {
+		s.retireFileLocked(inode, path, deleteMarker, ops, now)
+	}
+}
+
+// SymlinkIfPossible creates newname as a symlink to oldname. The target is
+// stored as given and resolved within the tenant of newname: absolute
+// targets start at the tenant root, also when the link is followed through
+// the tenant-prefixed Store view, so a link never reaches another tenant.
+func (s *Store) SymlinkIfPossible(oldname, newname string) error {
+	if err := s.beginOp(s.ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: err}
+	}
+	if oldname == "" || strings.Contains(oldname, "\x00") || len(oldname) > s.cfg.MaxPathLength {
+		return linkError(fs.ErrInvalid)
+	}
+	tenantID, linkPath, root, err := s.splitVFSPath(newname)
+	if err != nil {
+		return linkError(err)
+	}
+	if root || linkPath == "" {
+		return linkError(fs.ErrInvalid)
+	}
+	if err := s.ensureTenantRoot(tenantID); err != nil {
+		return err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	parentID, base, err := s.resolveParentLocked(tenantID, linkPath)
+	if err != nil {
+		return linkError(err)
+	}
+	if s.activeInodeLocked(s.meta.DirEntries[parentID][base]) != nil {
+		return linkError(fs.ErrExist)
+	}
+	now := nowUnix()
+	inode := &inodeRecord{
+		InodeID:             s.nextInodeIDLocked(),
+		TenantID:            tenantID,
+		Kind:                fileKindSymlink,
+		ParentInode:         parentID,
+		Name:                base,
+		Size:                int64(len(oldname)),
+		State:               fileStateActive,
+		Mode:                uint32(os.ModeSymlink | 0o777),
+		Target:              oldname,
+		Generation:          1,
+		MetadataGeneration:  1,
+		NamespaceGeneration: 1,
+		CreatedAt:           now,
+		UpdatedAt:           now,
+		CTime:               now,
+		MTime:               now,
+		ModTime:             now,
+	}
+	ops := []metaOp{
+		{Type: "put_inode", Inode: inode},
+		{Type: "put_dirent", ParentID: parentID, Name: base, ChildID: inode.InodeID},
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return linkError(err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// ReadlinkIfPossible returns the target of the symlink at name.
+func (s *Store) ReadlinkIfPossible(name string) (string, error) {
+	tenantID, linkPath, root, err := s.splitVFSPath(name)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	if root || linkPath == "" {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	inode, err := s.lookupPathLocked(tenantID, linkPath)
+	if err != nil {
+		return "", pathError("readlink", name, err)
+	}
+	if inode.Kind != fileKindSymlink {
+		return "", pathError("readlink", name, fs.ErrInvalid)
+	}
+	return inode.Target, nil
+}
+
+// LstatIfPossible returns metadata for name without following a symlink in
+// the final component. The boolean is always true.
+func (s *Store) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	tenantID, linkPath, root, err := s.splitVFSPath(name)
+	if err != nil {
+		return nil, true, pathError("lstat", name, err)
+	}
+	if root || linkPath == "" {
+		info, err := s.Stat(name)
+		return info, true, err
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	inode, err := s.lookupPathLocked(tenantID, linkPath)
+	if err != nil {
+		return nil, true, pathError("lstat", name, err)
+	}
+	info := fileInfoFromInode(inode)
+	info.name = pathBase(linkPath)
+	return info, true, nil
+}
+
+// Link creates newname as a hard link to the file at oldname. Both names
+// must be in the same tenant; directories cannot be linked.
+func (s *Store) Link(oldname, newname string) error {
+	if err := s.beginOp(s.ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	linkError := func(err error) error {
+		return &os.LinkError{Op: "link", Old: oldname, New: newname, Err: err}
+	}
+	oldTenant, oldPath, oldRoot, err := s.splitVFSPath(oldname)
+	if err != nil {
+		return linkError(err)
+	}
+	newTenant, newPath, newRoot, err := s.splitVFSPath(newname)
+	if err != nil {
+		return linkError(err)
+	}
+	if oldRoot || newRoot || oldPath == "" || newPath == "" || oldTenant != newTenant {
+		return linkError(fs.ErrInvalid)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	source, err := s.resolvePathLocked(oldTenant, oldPath)
+	if err != nil {
+		return linkError(err)
+	}
+	if source.Kind != fileKindFile {
+		return linkError(ErrIsDir)
+	}
+	parentID, base, err := s.resolveParentLocked(newTenant, newPath)
+	if err != nil {
+		return linkError(err)
+	}
+	if s.activeInodeLocked(s.meta.DirEntries[parentID][base]) != nil {
+		return linkError(fs.ErrExist)
+	}
+	now := nowUnix()
+	next := cloneInode(source)
+	next.Nlink = linkCount(source) + 1
+	next.OtherLinks = append(next.OtherLinks, dirLink{ParentID: parentID, Name: base})
+	next.Generation++
+	next.MetadataGeneration++
+	next.CTime = now
+	next.UpdatedAt = now
+	ops := []metaOp{
+		{Type: "put_dirent", ParentID: parentID, Name: base, ChildID: source.InodeID},
+		{Type: "put_inode", Inode: next},
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return linkError(err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// fixLinkCountsLocked recounts the dirents of hard-linked files reachable
+// from tenant roots and rebuilds their back references. Dirents lost with a
+// detached directory tree are dropped here, and a primary dirent that went
+// away moves to a surviving one.
+func (s *Store) fixLinkCountsLocked(reachable map[uint64]bool, ops *[]metaOp, now int64) {
+	links := map[uint64][]dirLink{}
+	for parentID := range reachable {
+		entries := s.meta.DirEntries[parentID]
+		for _, name := range sortedNames(entries) {
+			child := s.activeInodeLocked(entries[name])
+			if child != nil && child.Kind == fileKindFile && child.Nlink > 1 {
+				links[child.InodeID] = append(links[child.InodeID], dirLink{ParentID: parentID, Name: name})
+			}
+		}
+	}
+	ids := make([]uint64, 0, len(links))
+	for id := range links {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		inode := s.meta.Inodes[id]
+		positions := links[id]
+		sortDirLinks(positions)
+		primary := slices.Index(positions, dirLink{ParentID: inode.ParentInode, Name: inode.Name})
+		others := slices.Delete(slices.Clone(positions), max(primary, 0), max(primary, 0)+1)
+		if len(others) == 0 {
+			others = nil
+		}
+		count := uint32(len(positions))
+		if count == 1 {
+			count = 0
+		}
+		current := slices.Clone(inode.OtherLinks)
+		sortDirLinks(current)
+		if primary >= 0 && count == inode.Nlink && slices.Equal(others, current) {
+			continue
+		}
+		next := cloneInode(inode)
+		next.Nlink = count
+		next.OtherLinks = others
+		if primary < 0 {
+			next.ParentInode = positions[0].ParentID
+			next.Name = positions[0].Name
+		}
+		next.Generation++
+		next.UpdatedAt = now
+		*ops = append(*ops, metaOp{Type: "put_inode", Inode: next})
+	}
+}
+
+func sortDirLinks(links []dirLink) {
+	sort.Slice(links, func(i, j int) bool {
+		if links[i].ParentID != links[j].ParentID {
+			return links[i].ParentID < links[j].ParentID
+		}
+		return links[i].Name < links[j].Name
+	})
+}
@@ -0,0 +1,220 @@
+package blobfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"slices"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSymlinksResolveWithinTenant(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.MkdirAll("tenant-a/docs/sub", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/sub/a.txt", []byte("alpha"))
+	for _, link := range []struct{ target, name string }{
+		{"docs/sub", "tenant-a/dir"},
+		{"../docs/sub/a.txt", "tenant-a/docs/rel"},
+		{"/docs/sub/new.txt", "tenant-a/dangling"},
+		{"loop-b", "tenant-a/loop-a"},
+		{"loop-a", "tenant-a/loop-b"},
+	} {
+		if err := store.SymlinkIfPossible(link.target, link.name); err != nil {
+			t.Fatalf("symlink %s: %v", link.name, err)
+		}
+	}
+	if err := store.SymlinkIfPossible("x", "tenant-a/dir"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("symlink over existing = %v", err)
+	}
+	target, err := store.ReadlinkIfPossible("tenant-a/docs/rel")
+	if err != nil || target != "../docs/sub/a.txt" {
+		t.Fatalf("readlink = %q, %v", target, err)
+	}
+	info, lstat, err := store.LstatIfPossible("tenant-a/dir")
+	if err != nil || !lstat || info.Mode()&os.ModeSymlink == 0 || info.Name() != "dir" {
+		t.Fatalf("lstat = %+v, %v, %v", info, lstat, err)
+	}
+	info, err = store.Stat("tenant-a/dir")
+	if err != nil || !info.IsDir() || info.Name() != "dir" {
+		t.Fatalf("stat through link = %+v, %v", info, err)
+	}
+	for _, name := range []string{"dir/a.txt", "docs/rel"} {
+		if got := readTestBytes(t, store, "tenant-a", name); string(got) != "alpha" {
+			t.Fatalf("read %s = %q", name, got)
+		}
+	}
+	if _, err := store.Stat("tenant-a/loop-a"); !errors.Is(err, ErrSymlinkLoop) {
+		t.Fatalf("stat loop = %v", err)
+	}
+
+	// Writing through a dangling link creates its target.
+	if err := afero.WriteFile(store, "tenant-a/dangling", []byte("new"), 0o644); err != nil {
+		t.Fatalf("write through link: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "docs/sub/new.txt"); string(got) != "new" {
+		t.Fatalf("link target = %q", got)
+	}
+	if err := store.Remove("tenant-a/dir"); err != nil {
+		t.Fatalf("remove link: %v", err)
+	}
+	if _, err := store.Stat("tenant-a/docs/sub/a.txt"); err != nil {
+		t.Fatalf("target after removing link: %v", err)
+	}
+	if _, _, err := store.LstatIfPossible("tenant-a/dir"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("lstat removed link = %v", err)
+	}
+}
+
+func TestHardLinksShareOneInode(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/dir", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	source := putTestBytes(t, store, "tenant-a", "a.txt", []byte("shared"))
+	for _, name := range []string{"tenant-a/b.txt", "tenant-a/dir/c.txt"} {
+		if err := store.Link("tenant-a/a.txt", name); err != nil {
+			t.Fatalf("link %s: %v", name, err)
+		}
+	}
+	if err := store.Link("tenant-a/dir", "tenant-a/d"); !errors.Is(err, ErrIsDir) {
+		t.Fatalf("link directory = %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("rewritten"))
+	if got := readTestBytes(t, store, "tenant-a", "dir/c.txt"); string(got) != "rewritten" {
+		t.Fatalf("linked content = %q", got)
+	}
+	if err := store.DeleteObject(testContext(t), "tenant-a", "a.txt"); err != nil {
+		t.Fatalf("delete primary link: %v", err)
+	}
+	// Detaching the directory drops a link GC has to account for.
+	if err := store.RemoveAll("tenant-a/dir"); err != nil {
+		t.Fatalf("remove dir: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	info, err := reopened.StatObject(testContext(t), "tenant-a", "b.txt")
+	if err != nil || info.FileID != source.FileID {
+		t.Fatalf("remaining link = %+v, %v", info, err)
+	}
+	reopened.metaMu.RLock()
+	inode, err := reopened.resolvePathLocked("tenant-a", "b.txt")
+	reopened.metaMu.RUnlock()
+	if err != nil || inode.Nlink != 0 || inode.Name != "b.txt" {
+		t.Fatalf("inode after unlinks = %+v, %v", inode, err)
+	}
+	if err := reopened.DeleteObject(testContext(t), "tenant-a", "b.txt"); err != nil {
+		t.Fatalf("delete last link: %v", err)
+	}
+	reopened.metaMu.RLock()
+	defer reopened.metaMu.RUnlock()
+	for _, manifest := range reopened.meta.Manifests {
+		if manifest.RefCount != 0 {
+			t.Fatalf("manifest still referenced: %+v", manifest)
+		}
+	}
+}
+
+func TestHardLinkBackReferencesFollowRenamesAndUnlinks(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/dir", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("shared"))
+	for _, name := range []string{"tenant-a/b.txt", "tenant-a/dir/c.txt"} {
+		if err := store.Link("tenant-a/a.txt", name); err != nil {
+			t.Fatalf("link %s: %v", name, err)
+		}
+	}
+	if err := store.Rename("tenant-a/b.txt", "tenant-a/dir/d.txt"); err != nil {
+		t.Fatalf("rename secondary link: %v", err)
+	}
+	if err := store.Remove("tenant-a/a.txt"); err != nil {
+		t.Fatalf("remove primary link: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	reopened.metaMu.RLock()
+	dir, err := reopened.resolvePathLocked("tenant-a", "dir")
+	if err != nil {
+		reopened.metaMu.RUnlock()
+		t.Fatalf("resolve dir: %v", err)
+	}
+	inode, err := reopened.resolvePathLocked("tenant-a", "dir/c.txt")
+	reopened.metaMu.RUnlock()
+	want := []dirLink{{ParentID: dir.InodeID, Name: "c.txt"}}
+	if err != nil || inode.Nlink != 2 || inode.ParentInode != dir.InodeID || inode.Name != "d.txt" || !slices.Equal(inode.OtherLinks, want) {
+		t.Fatalf("inode after rename and unlink = %+v, %v", inode, err)
+	}
+	if got := readTestBytes(t, reopened, "tenant-a", "dir/c.txt"); string(got) != "shared" {
+		t.Fatalf("read remaining link = %q", got)
+	}
+}
+
+func TestWatchReportsHardLinks(t *testing.T) {
+	store := openTestStore(t)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("shared"))
+	watcher, err := store.Watch(testContext(t), watchStartTxID(t, store), WatchFilter{TenantID: "tenant-a"})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if err := store.Link("tenant-a/a.txt", "tenant-a/b.txt"); err != nil {
+		t.Fatalf("link: %v", err)
+	}
+	if err := store.Rename("tenant-a/b.txt", "tenant-a/c.txt"); err != nil {
+		t.Fatalf("rename link: %v", err)
+	}
+	if err := store.Remove("tenant-a/a.txt"); err != nil {
+		t.Fatalf("remove primary: %v", err)
+	}
+	want := []WatchEvent{
+		{Type: WatchCreate, Path: "b.txt"},
+		{Type: WatchRename, OldPath: "b.txt", Path: "c.txt"},
+		{Type: WatchDelete, Path: "a.txt"},
+	}
+	for _, expected := range want {
+		for {
+			event, err := watcher.Next()
+			if err != nil {
+				t.Fatalf("next: %v", err)
+			}
+			if event.Type == WatchMetadata {
+				continue
+			}
+			if event.Type != expected.Type || event.Path != expected.Path || event.OldPath != expected.OldPath {
+				t.Fatalf("event = %+v, want %+v", event, expected)
+			}
+			break
+		}
+	}
+}
@@ -0,0 +1,456 @@
+package blobfs
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io/fs"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const defaultListLimit = 1000
+
+// listEntry is a dirent that ListObjects may return. Directory keys end in
+// "/", which makes a depth-first walk visit paths in byte order.
+type listEntry struct {
+	key   string
+	inode *inodeRecord
+}
+
+type objectLister struct {
+	store *Store
+	ctx   context.Context
+	opts  ListOptions
+	limit int
+	page  *ListPage
+	count int
+	last  string
+}
+
+// ListObjects returns one page of the files of tenantID selected by opts.
+// Each directory on the way is read from its sorted name index, which is
+// built on first listing, kept current by commits and evicted least recently
+// used once all indexes together exceed listIndexMaxEntries entries; larger
+// directories are scanned in batches of one page instead. Symlinks are not
+// listed or followed below the starting directory.
+func (s *Store) ListObjects(ctx context.Context, tenantID string, opts ListOptions) (*ListPage, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("list", tenantID, err)
+	}
+	if opts.Delimiter != "" && (opts.Delimiter != "/" || opts.Recursive) {
+		return nil, pathError("list", opts.Delimiter, fmt.Errorf("%w: unsupported delimiter", fs.ErrInvalid))
+	}
+	if opts.Limit < 0 {
+		return nil, pathError("list", opts.Prefix, fmt.Errorf("%w: negative limit", fs.ErrInvalid))
+	}
+	dirPath, namePrefix, err := splitListPrefix(opts.Prefix, s.cfg)
+	if err != nil {
+		return nil, pathError("list", opts.Prefix, err)
+	}
+	after := opts.StartAfter
+	if opts.ContinuationToken != "" {
+		after = opts.ContinuationToken
+	}
+	lister := &objectLister{store: s, ctx: ctx, opts: opts, limit: opts.Limit, page: &ListPage{}}
+	if lister.limit == 0 {
+		lister.limit = defaultListLimit
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	dir, err := s.resolvePathLocked(tenantID, dirPath)
+	if err != nil || dir.Kind != fileKindDir {
+		// A missing directory is an empty listing, like an unmatched prefix.
+		return lister.page, nil
+	}
+	base := ""
+	if dirPath != "" {
+		base = dirPath + "/"
+	}
+	if _, err := lister.listDir(dir.InodeID, base, namePrefix, after); err != nil {
+		return nil, err
+	}
+	return lister.page, nil
+}
+
+// splitListPrefix splits prefix into the directory to list and the prefix
+// its entry names must have.
+func splitListPrefix(prefix string, cfg Config) (string, string, error) {
+	if strings.Contains(prefix, "\x00") || strings.HasPrefix(prefix, "/") {
+		return "", "", fmt.Errorf("invalid list prefix %q", prefix)
+	}
+	i := strings.LastIndex(prefix, "/")
+	if i < 0 {
+		return "", prefix, nil
+	}
+	dirPath, err := normalizePath(prefix[:i], cfg)
+	if err != nil {
+		return "", "", err
+	}
+	return dirPath, prefix[i+1:], nil
+}
+
+// listDir adds the entries of one directory whose keys sort after after. It
+// reports true once the page is full and a continuation token is set.
+func (l *objectLister) listDir(dirID uint64, base, namePrefix, after string) (bool, error) {
+	last := after
+	for {
+		if err := contextError(l.ctx); err != nil {
+			return false, err
+		}
+		batch := l.store.nextListEntriesLocked(dirID, base, namePrefix, last, l.limit+1)
+		if len(batch) == 0 {
+			return false, nil
+		}
+		for _, entry := range batch {
+			last = entry.key
+			if entry.inode.Kind == fileKindDir {
+				switch {
+				case l.opts.Recursive:
+					if full, err := l.listDir(entry.inode.InodeID, entry.key, "", after); full || err != nil {
+						return full, err
+					}
+				case l.opts.Delimiter != "":
+					if l.add(entry.key, nil) {
+						return true, nil
+					}
+				}
+				continue
+			}
+			if l.add(entry.key, entry.inode) {
+				return true, nil
+			}
+		}
+	}
+}
+
+// add appends one object, or a common prefix when inode is nil. On a full
+// page it sets the continuation token instead and reports true.
+func (l *objectLister) add(key string, inode *inodeRecord) bool {
+	if l.count == l.limit {
+		l.page.NextContinuationToken = l.last
+		return true
+	}
+	l.count++
+	l.last = key
+	if inode == nil {
+		l.page.CommonPrefixes = append(l.page.CommonPrefixes, key)
+	} else {
+		l.page.Objects = append(l.page.Objects, objectInfoFromInode(inode, key))
+	}
+	return false
+}
+
+// listIndexMaxEntries bounds the entries held by all directory list indexes
+// together. Directories with more entries are listed by scanning instead.
+const listIndexMaxEntries = 1 << 21
+
+// listIndexBlock is the largest block of a name index. Inserting into a full
+// block splits it in half, so an update moves at most one block.
+const listIndexBlock = 512
+
+// dirListIndex keeps the entry names of recently listed directories sorted
+// by their list keys. Commits update the indexes of the directories they
+// change and listers build missing ones under the metadata read lock, so mu
+// serializes builds, updates and evictions. Once the indexes hold more than
+// limit entries the least recently listed are evicted.
+type dirListIndex struct {
+	mu    sync.Mutex
+	dirs  map[uint64]*list.Element
+	lru   *list.List
+	total int
+	limit int
+}
+
+// nameIndex is the sorted names of one directory, split into blocks.
+type nameIndex struct {
+	dirID  uint64
+	blocks [][]listName
+}
+
+// listName is a dirent name with its key relative to the directory: the name,
+// with "/" appended for directories.
+type listName struct {
+	name string
+	key  string
+}
+
+// listPos is a position in a nameIndex: entry i of block b.
+type listPos struct {
+	b, i int
+}
+
+func newDirListIndex() *dirListIndex {
+	return &dirListIndex{dirs: map[uint64]*list.Element{}, lru: list.New(), limit: listIndexMaxEntries}
+}
+
+func (meta *metadata) dropListIndex(dirID uint64) {
+	if meta.listIndex == nil {
+		return
+	}
+	meta.listIndex.mu.Lock()
+	defer meta.listIndex.mu.Unlock()
+	if elem, ok := meta.listIndex.dirs[dirID]; ok {
+		meta.listIndex.remove(elem)
+	}
+}
+
+// putListName records that dirID now maps name to childID. A child whose
+// inode is not put yet is keyed as a file; putListInode re-keys it.
+func (meta *metadata) putListName(dirID uint64, name string, childID uint64) {
+	if meta.listIndex == nil {
+		return
+	}
+	index := meta.listIndex
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	elem, ok := index.dirs[dirID]
+	if !ok {
+		return
+	}
+	names := elem.Value.(*nameIndex)
+	index.total -= names.remove(name) + names.remove(name+"/")
+	index.total += names.insert(listName{name: name, key: listKey(name, meta.Inodes[childID])})
+	index.evict()
+}
+
+// putListInode re-keys the dirent of inode when its kind changed from prev,
+// which is nil for a new inode.
+func (meta *metadata) putListInode(prev, inode *inodeRecord) {
+	if prev != nil && prev.Kind == inode.Kind {
+		return
+	}
+	if id, ok := meta.DirEntries[inode.ParentInode][inode.Name]; ok && id == inode.InodeID {
+		meta.putListName(inode.ParentInode, inode.Name, inode.InodeID)
+	}
+}
+
+// deleteListName records that name was removed from dirID.
+func (meta *metadata) deleteListName(dirID uint64, name string) {
+	if meta.listIndex == nil {
+		return
+	}
+	index := meta.listIndex
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if elem, ok := index.dirs[dirID]; ok {
+		names := elem.Value.(*nameIndex)
+		index.total -= names.remove(name) + names.remove(name+"/")
+	}
+}
+
+// listNames returns the sorted names of dirID, building them if needed, or
+// nil when the directory is too large to index. The index must not be used
+// after the metadata read lock is released.
+func (meta *metadata) listNames(dirID uint64) *nameIndex {
+	index := meta.listIndex
+	entries := meta.DirEntries[dirID]
+	if index == nil || len(entries) > index.limit {
+		return nil
+	}
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	if elem, ok := index.dirs[dirID]; ok {
+		index.lru.MoveToFront(elem)
+		return elem.Value.(*nameIndex)
+	}
+	sorted := make([]listName, 0, len(entries))
+	for name, childID := range entries {
+		sorted = append(sorted, listName{name: name, key: listKey(name, meta.Inodes[childID])})
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].key < sorted[j].key })
+	names := &nameIndex{dirID: dirID}
+	for len(sorted) > 0 {
+		n := min(len(sorted), listIndexBlock)
+		names.blocks = append(names.blocks, sorted[:n:n])
+		sorted = sorted[n:]
+	}
+	index.dirs[dirID] = index.lru.PushFront(names)
+	index.total += len(entries)
+	index.evict()
+	return names
+}
+
+func listKey(name string, child *inodeRecord) string {
+	if child != nil && child.Kind == fileKindDir {
+		return name + "/"
+	}
+	return name
+}
+
+// evict drops the least recently listed directories until the indexes fit
+// in their limit. The caller holds index.mu.
+func (index *dirListIndex) evict() {
+	for index.total > index.limit {
+		index.remove(index.lru.Back())
+	}
+}
+
+func (index *dirListIndex) remove(elem *list.Element) {
+	names := index.lru.Remove(elem).(*nameIndex)
+	delete(index.dirs, names.dirID)
+	for _, block := range names.blocks {
+		index.total -= len(block)
+	}
+}
+
+// search returns the position of the first key not less than key.
+func (names *nameIndex) search(key string) listPos {
+	b := sort.Search(len(names.blocks), func(b int) bool {
+		block := names.blocks[b]
+		return block[len(block)-1].key >= key
+	})
+	if b == len(names.blocks) {
+		return listPos{b: b}
+	}
+	block := names.blocks[b]
+	return listPos{b: b, i: sort.Search(len(block), func(i int) bool { return block[i].key >= key })}
+}
+
+func (names *nameIndex) at(pos listPos) (listName, bool) {
+	if pos.b == len(names.blocks) {
+		return listName{}, false
+	}
+	return names.blocks[pos.b][pos.i], true
+}
+
+func (names *nameIndex) next(pos listPos) listPos {
+	if pos.i++; pos.i == len(names.blocks[pos.b]) {
+		return listPos{b: pos.b + 1}
+	}
+	return pos
+}
+
+func (names *nameIndex) prev(pos listPos) (listPos, bool) {
+	if pos.i > 0 {
+		return listPos{b: pos.b, i: pos.i - 1}, true
+	}
+	if pos.b == 0 {
+		return pos, false
+	}
+	return listPos{b: pos.b - 1, i: len(names.blocks[pos.b-1]) - 1}, true
+}
+
+// insert adds entry, which must not be present, and returns 1.
+func (names *nameIndex) insert(entry listName) int {
+	if len(names.blocks) == 0 {
+		names.blocks = [][]listName{{entry}}
+		return 1
+	}
+	pos := names.search(entry.key)
+	if pos.b == len(names.blocks) {
+		pos = listPos{b: pos.b - 1, i: len(names.blocks[pos.b-1])}
+	}
+	block := slices.Insert(names.blocks[pos.b], pos.i, entry)
+	if len(block) <= listIndexBlock {
+		names.blocks[pos.b] = block
+		return 1
+	}
+	half := len(block) / 2
+	names.blocks[pos.b] = slices.Clone(block[:half])
+	names.blocks = slices.Insert(names.blocks, pos.b+1, slices.Clone(block[half:]))
+	return 1
+}
+
+// remove deletes the entry with key and returns how many entries it removed.
+func (names *nameIndex) remove(key string) int {
+	pos := names.search(key)
+	if entry, ok := names.at(pos); !ok || entry.key != key {
+		return 0
+	}
+	block := slices.Delete(names.blocks[pos.b], pos.i, pos.i+1)
+	if len(block) == 0 {
+		names.blocks = slices.Delete(names.blocks, pos.b, pos.b+1)
+	} else {
+		names.blocks[pos.b] = block
+	}
+	return 1
+}
+
+// nextListEntriesLocked returns up to n files and directories of dirID with
+// the smallest keys after after. A directory whose key is a prefix of after
+// is still returned so the walk can resume inside it. The first candidate is
+// found by binary search in the directory's name index, so a page costs
+// O(log d + n) for a directory of d entries; only the first listing of a
+// directory, or of one evicted since, sorts its entries.
+func (s *Store) nextListEntriesLocked(dirID uint64, base, namePrefix, after string, n int) []listEntry {
+	rel, resume := strings.CutPrefix(after, base)
+	if !resume && after > base {
+		return nil
+	}
+	names := s.meta.listNames(dirID)
+	if names == nil {
+		return s.scanListEntriesLocked(dirID, base, namePrefix, after, n)
+	}
+	pos := names.search(namePrefix)
+	if resume {
+		from := names.search(rel)
+		if entry, ok := names.at(from); ok && entry.key == rel {
+			from = names.next(from)
+		}
+		// No other key sorts between a directory and the keys below it.
+		if prev, ok := names.prev(from); ok {
+			if entry, _ := names.at(prev); strings.HasSuffix(entry.key, "/") && entry.key != rel && strings.HasPrefix(rel, entry.key) {
+				from = prev
+			}
+		}
+		if from.b > pos.b || from.b == pos.b && from.i > pos.i {
+			pos = from
+		}
+	}
+	var entries []listEntry
+	for ; len(entries) < n; pos = names.next(pos) {
+		entry, ok := names.at(pos)
+		if !ok || !strings.HasPrefix(entry.key, namePrefix) {
+			break
+		}
+		child := s.activeInodeLocked(s.meta.DirEntries[dirID][entry.name])
+		if child == nil || child.Kind == fileKindSymlink {
+			continue
+		}
+		entries = append(entries, listEntry{key: base + entry.key, inode: child})
+	}
+	return entries
+}
+
+// scanListEntriesLocked is nextListEntriesLocked for directories too large to
+// index. Candidates are trimmed as they accumulate, so the map is scanned
+// without sorting all of it and memory stays bounded by n.
+func (s *Store) scanListEntriesLocked(dirID uint64, base, namePrefix, after string, n int) []listEntry {
+	var entries []listEntry
+	trim := func() {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].key < entries[j].key })
+		if len(entries) > n {
+			entries = entries[:n]
+		}
+	}
+	for name, childID := range s.meta.DirEntries[dirID] {
+		if !strings.HasPrefix(name, namePrefix) {
+			continue
+		}
+		child := s.activeInodeLocked(childID)
+		if child == nil || child.Kind == fileKindSymlink {
+			continue
+		}
+		key := base + listKey(name, child)
+		if child.Kind == fileKindDir {
+			if key == after || (key < after && !strings.HasPrefix(after, key)) {
+				continue
+			}
+		} else if key <= after {
+			continue
+		}
+		entries = append(entries, listEntry{key: key, inode: child})
+		if len(entries) >= 2*n {
+			trim()
+		}
+	}
+	trim()
+	return entries
+}
@@ -0,0 +1,237 @@
+package blobfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"math/rand/v2"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func listAllTestObjects(t *testing.T, store *Store, opts ListOptions) ([]string, []string, int) {
+	t.Helper()
+	var objects, prefixes []string
+	pages := 0
+	for {
+		page, err := store.ListObjects(testContext(t), "tenant-a", opts)
+		if err != nil {
+			t.Fatalf("list %+v: %v", opts, err)
+		}
+		pages++
+		for _, info := range page.Objects {
+			objects = append(objects, info.Path)
+		}
+		prefixes = append(prefixes, page.CommonPrefixes...)
+		if page.NextContinuationToken == "" {
+			return objects, prefixes, pages
+		}
+		opts.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+func TestListObjectsPaginatesInPathOrder(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.MkdirAll("tenant-a/a/y", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/big", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	want := []string{"a-b.txt", "a/x.txt", "a/y/z.txt", "a0.txt", "b.txt"}
+	for i := 0; i < 25; i++ {
+		want = append(want, fmt.Sprintf("big/%02d.txt", i))
+	}
+	for _, name := range want {
+		putTestBytes(t, store, "tenant-a", name, []byte(name))
+	}
+	if err := store.SymlinkIfPossible("a", "tenant-a/link"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	sort.Strings(want)
+
+	objects, _, pages := listAllTestObjects(t, store, ListOptions{Recursive: true, Limit: 4})
+	if !reflect.DeepEqual(objects, want) || pages != 8 {
+		t.Fatalf("recursive listing = %v in %d pages", objects, pages)
+	}
+	objects, prefixes, _ := listAllTestObjects(t, store, ListOptions{Delimiter: "/", Limit: 2})
+	if !reflect.DeepEqual(objects, []string{"a-b.txt", "a0.txt", "b.txt"}) || !reflect.DeepEqual(prefixes, []string{"a/", "big/"}) {
+		t.Fatalf("delimited listing = %v %v", objects, prefixes)
+	}
+	objects, prefixes, _ = listAllTestObjects(t, store, ListOptions{Prefix: "a"})
+	if !reflect.DeepEqual(objects, []string{"a-b.txt", "a0.txt"}) || prefixes != nil {
+		t.Fatalf("flat prefix listing = %v %v", objects, prefixes)
+	}
+	objects, _, _ = listAllTestObjects(t, store, ListOptions{Prefix: "big/1", StartAfter: "big/12.txt", Recursive: true})
+	if !reflect.DeepEqual(objects, []string{"big/13.txt", "big/14.txt", "big/15.txt", "big/16.txt", "big/17.txt", "big/18.txt", "big/19.txt"}) {
+		t.Fatalf("start-after listing = %v", objects)
+	}
+	objects, _, _ = listAllTestObjects(t, store, ListOptions{Prefix: "missing/", Recursive: true})
+	if objects != nil {
+		t.Fatalf("missing prefix listing = %v", objects)
+	}
+	if _, err := store.ListObjects(testContext(t), "tenant-a", ListOptions{Delimiter: "/", Recursive: true}); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("recursive with delimiter = %v", err)
+	}
+}
+
+func TestListObjectsSeesDirectoryChangesBetweenPages(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.MkdirAll("tenant-a/dir", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		putTestBytes(t, store, "tenant-a", fmt.Sprintf("dir/%02d.txt", i), []byte("x"))
+	}
+	page, err := store.ListObjects(testContext(t), "tenant-a", ListOptions{Prefix: "dir/", Limit: 5})
+	if err != nil {
+		t.Fatalf("list: %v", err)
+	}
+	if page.NextContinuationToken != "dir/04.txt" {
+		t.Fatalf("first page token = %q", page.NextContinuationToken)
+	}
+	store.metaMu.RLock()
+	dir, err := store.resolvePathLocked("tenant-a", "dir")
+	store.metaMu.RUnlock()
+	if err != nil {
+		t.Fatalf("resolve dir: %v", err)
+	}
+	indexed := func() []string {
+		store.meta.listIndex.mu.Lock()
+		defer store.meta.listIndex.mu.Unlock()
+		elem, ok := store.meta.listIndex.dirs[dir.InodeID]
+		if !ok {
+			return nil
+		}
+		var keys []string
+		for _, block := range elem.Value.(*nameIndex).blocks {
+			for _, entry := range block {
+				keys = append(keys, entry.key)
+			}
+		}
+		return keys
+	}
+	if len(indexed()) != 20 {
+		t.Fatalf("listing indexed %v", indexed())
+	}
+
+	// Changes after the first page show up in the pages that follow.
+	putTestBytes(t, store, "tenant-a", "dir/05a.txt", []byte("x"))
+	if keys := indexed(); len(keys) != 21 || keys[6] != "05a.txt" {
+		t.Fatalf("put did not update the directory index: %v", keys)
+	}
+	if err := store.Remove("tenant-a/dir/10.txt"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := store.Rename("tenant-a/dir/11.txt", "tenant-a/dir/99.txt"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/dir/12.txt.d", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "dir/12.txt.d/inner.txt", []byte("x"))
+	var want []string
+	for i := 5; i < 20; i++ {
+		switch i {
+		case 10, 11:
+			continue
+		case 5:
+			want = append(want, "dir/05.txt", "dir/05a.txt")
+			continue
+		case 12:
+			want = append(want, "dir/12.txt", "dir/12.txt.d/inner.txt")
+			continue
+		}
+		want = append(want, fmt.Sprintf("dir/%02d.txt", i))
+	}
+	want = append(want, "dir/99.txt")
+	objects, _, _ := listAllTestObjects(t, store, ListOptions{Prefix: "dir/", Recursive: true, Limit: 3, ContinuationToken: page.NextContinuationToken})
+	if !reflect.DeepEqual(objects, want) {
+		t.Fatalf("later pages = %v, want %v", objects, want)
+	}
+
+	if keys := indexed(); len(keys) != 21 || keys[12] != "12.txt.d/" || keys[20] != "99.txt" {
+		t.Fatalf("directory index after changes = %v", keys)
+	}
+
+	// Resuming inside a subdirectory seeks back to it.
+	objects, _, _ = listAllTestObjects(t, store, ListOptions{Prefix: "dir/", Recursive: true, StartAfter: "dir/12.txt.d/a"})
+	if !reflect.DeepEqual(objects, []string{"dir/12.txt.d/inner.txt", "dir/13.txt", "dir/14.txt", "dir/15.txt", "dir/16.txt", "dir/17.txt", "dir/18.txt", "dir/19.txt", "dir/99.txt"}) {
+		t.Fatalf("listing after the subdirectory = %v", objects)
+	}
+}
+
+func TestNameIndexKeepsBlocksSortedAndBounded(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	names := &nameIndex{}
+	present := map[string]bool{}
+	for i := 0; i < 20*listIndexBlock; i++ {
+		key := fmt.Sprintf("%05d", rng.IntN(4*listIndexBlock))
+		if present[key] {
+			if names.remove(key) != 1 {
+				t.Fatalf("remove %s found nothing", key)
+			}
+			delete(present, key)
+			continue
+		}
+		names.insert(listName{name: key, key: key})
+		present[key] = true
+	}
+	var got []string
+	for _, block := range names.blocks {
+		if len(block) == 0 || len(block) > listIndexBlock {
+			t.Fatalf("block of %d entries", len(block))
+		}
+		for _, entry := range block {
+			got = append(got, entry.key)
+		}
+	}
+	want := make([]string, 0, len(present))
+	for key := range present {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("index holds %d keys, want %d sorted", len(got), len(want))
+	}
+	if names.remove("missing") != 0 {
+		t.Fatal("removed a missing key")
+	}
+	for _, key := range want[:3] {
+		if entry, ok := names.at(names.search(key)); !ok || entry.key != key {
+			t.Fatalf("search %s = %v", key, entry)
+		}
+	}
+}
+
+func TestListIndexEvictsLeastRecentlyListed(t *testing.T) {
+	meta := newMetadata()
+	index := meta.listIndex
+	index.limit = 100
+	for dirID := uint64(1); dirID <= 3; dirID++ {
+		meta.DirEntries[dirID] = map[string]uint64{}
+		for i := 0; i < index.limit/2; i++ {
+			meta.DirEntries[dirID][fmt.Sprint(i)] = 0
+		}
+	}
+	meta.listNames(1)
+	meta.listNames(2)
+	meta.listNames(1)
+	meta.listNames(3)
+	if _, ok := index.dirs[2]; ok || len(index.dirs) != 2 || index.total != index.limit {
+		t.Fatalf("indexed dirs %v with %d entries", len(index.dirs), index.total)
+	}
+	meta.deleteListName(1, "0")
+	meta.dropListIndex(3)
+	if index.total != index.limit/2-1 {
+		t.Fatalf("total after updates = %d", index.total)
+	}
+	meta.DirEntries[4] = map[string]uint64{}
+	for i := 0; i <= index.limit; i++ {
+		meta.DirEntries[4][fmt.Sprint(i)] = 0
+	}
+	if meta.listNames(4) != nil {
+		t.Fatal("indexed a directory over the budget")
+	}
+}
@@ -0,0 +1,1680 @@
+package blobfs
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sort"
+)
+
+// Metadata format 3 stores txlog frames and checkpoints with a compact tagged
+// binary encoding. Every field is written as a varint key (tag<<1 | wire type)
+// followed by a varint or a length-prefixed body, zero values are omitted, and
+// readers skip unknown tags so records can gain fields without a new format.
+
+const (
+	metaWireVarint = 0
+	metaWireBytes  = 1
+
+	metaCheckpointMagic      = "BLOBFSMETA3\n"
+	metaDeltaCheckpointMagic = "BLOBFSDELTA3\n"
+
+	// Every checkpoint image ends with a footer holding the txid it
+	// represents and a CRC of everything before the CRC.
+	metaImageFooterMagic = "BFCK"
+	metaImageFooterSize  = 8 + 4 + len(metaImageFooterMagic)
+)
+
+var errMetaCodecTruncated = errors.New("metadata record truncated")
+
+var metaOpCodes = map[string]uint64{
+	"put_tenant":    1,
+	"del_tenant":    2,
+	"put_inode":     3,
+	"put_dirent":    4,
+	"delete_dirent": 5,
+	"put_manifest":  6,
+	"put_chunk":     7,
+	"put_segment":   8,
+	"append_gcrun":  9,
+	"put_gcrun":     10,
+
+	"put_snapshot":    11,
+	"delete_snapshot": 12,
+
+	"put_tenant_settings":    13,
+	"delete_tenant_settings": 14,
+	"put_versions":           15,
+	"delete_versions":        16,
+	"put_trash":              17,
+	"delete_trash":           18,
+	"put_keyring":            19,
+	"delete_keyring":         20,
+	"put_usage":              21,
+}
+
+var metaOpNames = func() map[uint64]string {
+	names := make(map[uint64]string, len(metaOpCodes))
+	for name, code := range metaOpCodes {
+		names[code] = name
+	}
+	return names
+}()
+
+type metaEncoder struct {
+	buf []byte
+}
+
+func (e *metaEncoder) key(tag, wire int) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(tag)<<1|uint64(wire))
+}
+
+func (e *metaEncoder) uint(tag int, v uint64) {
+	if v == 0 {
+		return
+	}
+	e.key(tag, metaWireVarint)
+	e.buf = binary.AppendUvarint(e.buf, v)
+}
+
+func (e *metaEncoder) int(tag int, v int64) {
+	if v == 0 {
+		return
+	}
+	e.key(tag, metaWireVarint)
+	e.buf = binary.AppendVarint(e.buf, v)
+}
+
+func (e *metaEncoder) bytes(tag int, v []byte) {
+	e.key(tag, metaWireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *metaEncoder) str(tag int, v string) {
+	if v == "" {
+		return
+	}
+	e.key(tag, metaWireBytes)
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+// hexID writes lowercase hex identifiers such as chunk ids and hashes as raw
+// bytes, halving their size. Other strings keep their original bytes.
+func (e *metaEncoder) hexID(tag int, v string) {
+	if raw, ok := decodeLowerHex(v); ok {
+		e.bytes(tag, append([]byte{1}, raw...))
+		return
+	}
+	e.bytes(tag, append([]byte{0}, v...))
+}
+
+func (e *metaEncoder) msg(tag int, encode func(*metaEncoder)) {
+	var nested metaEncoder
+	encode(&nested)
+	e.bytes(tag, nested.buf)
+}
+
+func decodeLowerHex(v string) ([]byte, bool) {
+	if v == "" || len(v)%2 != 0 {
+		return nil, false
+	}
+	for i := 0; i < len(v); i++ {
+		c := v[i]
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return nil, false
+		}
+	}
+	raw, err := hex.DecodeString(v)
+	return raw, err == nil
+}
+
+type metaDecoder struct {
+	buf  []byte
+	wire int
+	err  error
+}
+
+func (d *metaDecoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.buf = nil
+}
+
+func (d *metaDecoder) readUvarint() uint64 {
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail(errMetaCodecTruncated)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *metaDecoder) uint() uint64 {
+	if d.wire != metaWireVarint {
+		d.fail(errors.New("metadata field wire type mismatch"))
+		return 0
+	}
+	return d.readUvarint()
+}
+
+func (d *metaDecoder) int() int64 {
+	if d.wire != metaWireVarint {
+		d.fail(errors.New("metadata field wire type mismatch"))
+		return 0
+	}
+	v, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail(errMetaCodecTruncated)
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *metaDecoder) bytes() []byte {
+	if d.wire != metaWireBytes {
+		d.fail(errors.New("metadata field wire type mismatch"))
+		return nil
+	}
+	size := d.readUvarint()
+	if d.err != nil {
+		return nil
+	}
+	if size > uint64(len(d.buf)) {
+		d.fail(errMetaCodecTruncated)
+		return nil
+	}
+	v := d.buf[:size:size]
+	d.buf = d.buf[size:]
+	return v
+}
+
+func (d *metaDecoder) str() string {
+	return string(d.bytes())
+}
+
+func (d *metaDecoder) hexID() string {
+	v := d.bytes()
+	if len(v) == 0 {
+		d.fail(errors.New("invalid metadata identifier"))
+		return ""
+	}
+	if v[0] == 1 {
+		return hex.EncodeToString(v[1:])
+	}
+	return string(v[1:])
+}
+
+func (d *metaDecoder) skip() {
+	switch d.wire {
+	case metaWireVarint:
+		d.readUvarint()
+	case metaWireBytes:
+		d.bytes()
+	default:
+		d.fail(fmt.Errorf("unknown metadata wire type %d", d.wire))
+	}
+}
+
+// decodeMetaMessage walks the fields of one message. field returns false for
+// tags it does not know, which are skipped.
+func decodeMetaMessage(data []byte, field func(d *metaDecoder, tag int) bool) error {
+	d := &metaDecoder{buf: data}
+	for len(d.buf) > 0 && d.err == nil {
+		key := d.readUvarint()
+		if d.err != nil {
+			break
+		}
+		d.wire = int(key & 1)
+		if !field(d, int(key>>1)) {
+			d.skip()
+		}
+	}
+	return d.err
+}
+
+func encodeMetaTxBinary(tx metaTx) []byte {
+	var e metaEncoder
+	e.uint(1, tx.TxID)
+	e.int(3, tx.Time)
+	for _, op := range tx.Ops {
+		op := op
+		e.msg(2, func(e *metaEncoder) { encodeMetaOp(e, op) })
+	}
+	return e.buf
+}
+
+func decodeMetaTxBinary(data []byte) (metaTx, error) {
+	var tx metaTx
+	var opErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			tx.TxID = d.uint()
+		case 3:
+			tx.Time = d.int()
+		case 2:
+			op, err := decodeMetaOp(d.bytes())
+			if err != nil && opErr == nil {
+				opErr = err
+			}
+			tx.Ops = append(tx.Ops, op)
+		default:
+			return false
+		}
+		return true
+	})
+	return tx, errors.Join(err, opErr)
+}
+
+func encodeMetaOp(e *metaEncoder, op metaOp) {
+	if code, ok := metaOpCodes[op.Type]; ok {
+		e.uint(1, code)
+	} else {
+		e.str(2, op.Type)
+	}
+	e.str(3, op.TenantID)
+	e.uint(4, op.ParentID)
+	e.str(5, op.Name)
+	e.uint(6, op.ChildID)
+	if op.Inode != nil {
+		e.msg(7, func(e *metaEncoder) { encodeInodeRecord(e, op.Inode) })
+	}
+	if op.Manifest != nil {
+		e.msg(8, func(e *metaEncoder) { encodeManifestRecord(e, op.Manifest) })
+	}
+	if op.Chunk != nil {
+		e.msg(9, func(e *metaEncoder) { encodeChunkRecord(e, op.Chunk) })
+	}
+	if op.Segment != nil {
+		e.msg(10, func(e *metaEncoder) { encodeSegmentRecord(e, op.Segment) })
+	}
+	if op.GCRun != nil {
+		e.msg(11, func(e *metaEncoder) { encodeGCRun(e, op.GCRun) })
+	}
+	if op.Snapshot != nil {
+		e.msg(12, func(e *metaEncoder) { encodeSnapshotRecord(e, op.Snapshot) })
+	}
+	if op.Settings != nil {
+		e.msg(13, func(e *metaEncoder) { encodeTenantSettings(e, op.Settings) })
+	}
+	if op.Versions != nil {
+		e.msg(14, func(e *metaEncoder) { encodeVersionHistory(e, op.Versions) })
+	}
+	if op.Trash != nil {
+		e.msg(15, func(e *metaEncoder) { encodeTrashEntry(e, op.Trash) })
+	}
+	if op.Keyring != nil {
+		e.msg(16, func(e *metaEncoder) { encodeKeyring(e, op.Keyring) })
+	}
+	if op.Usage != nil {
+		e.msg(17, func(e *metaEncoder) { encodeTenantUsage(e, "", op.Usage) })
+	}
+}
+
+func decodeMetaOp(data []byte) (metaOp, error) {
+	var op metaOp
+	var nestedErr error
+	keep := func(err error) {
+		if err != nil && nestedErr == nil {
+			nestedErr = err
+		}
+	}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			code := d.uint()
+			name, ok := metaOpNames[code]
+			if !ok {
+				keep(fmt.Errorf("unknown metadata op code %d", code))
+			}
+			op.Type = name
+		case 2:
+			op.Type = d.str()
+		case 3:
+			op.TenantID = d.str()
+		case 4:
+			op.ParentID = d.uint()
+		case 5:
+			op.Name = d.str()
+		case 6:
+			op.ChildID = d.uint()
+		case 7:
+			inode, err := decodeInodeRecord(d.bytes())
+			keep(err)
+			op.Inode = inode
+		case 8:
+			manifest, err := decodeManifestRecord(d.bytes())
+			keep(err)
+			op.Manifest = manifest
+		case 9:
+			chunk, err := decodeChunkRecord(d.bytes())
+			keep(err)
+			op.Chunk = chunk
+		case 10:
+			seg, err := decodeSegmentRecord(d.bytes())
+			keep(err)
+			op.Segment = seg
+		case 11:
+			run, err := decodeGCRun(d.bytes())
+			keep(err)
+			op.GCRun = run
+		case 12:
+			snapshot, err := decodeSnapshotRecord(d.bytes())
+			keep(err)
+			op.Snapshot = snapshot
+		case 13:
+			settings, err := decodeTenantSettings(d.bytes())
+			keep(err)
+			op.Settings = settings
+		case 14:
+			history, err := decodeVersionHistory(d.bytes())
+			keep(err)
+			op.Versions = history
+		case 15:
+			entry, err := decodeTrashEntry(d.bytes())
+			keep(err)
+			op.Trash = entry
+		case 16:
+			ring, err := decodeKeyring(d.bytes())
+			keep(err)
+			op.Keyring = ring
+		case 17:
+			_, usage, err := decodeTenantUsage(d.bytes())
+			keep(err)
+			op.Usage = &usage
+		default:
+			return false
+		}
+		return true
+	})
+	return op, errors.Join(err, nestedErr)
+}
+
+func encodeInodeRecord(e *metaEncoder, inode *inodeRecord) {
+	e.uint(1, inode.InodeID)
+	e.str(2, inode.TenantID)
+	e.str(3, inode.Kind)
+	e.uint(4, inode.ParentInode)
+	e.str(5, inode.Name)
+	e.int(6, inode.Size)
+	if inode.FileHash != "" {
+		e.hexID(7, inode.FileHash)
+	}
+	if inode.ManifestID != "" {
+		e.hexID(8, inode.ManifestID)
+	}
+	e.str(9, inode.State)
+	encodeStringMap(e, 10, inode.Options)
+	e.uint(11, uint64(inode.Mode))
+	e.int(12, inode.ModTime)
+	e.int(13, int64(inode.UID))
+	e.int(14, int64(inode.GID))
+	e.uint(15, inode.Generation)
+	e.uint(16, inode.ContentGeneration)
+	e.uint(17, inode.MetadataGeneration)
+	e.uint(18, inode.NamespaceGeneration)
+	e.int(19, inode.CTime)
+	e.int(20, inode.MTime)
+	e.int(21, inode.ATime)
+	e.int(22, inode.CreatedAt)
+	e.int(23, inode.UpdatedAt)
+	e.int(24, inode.DeletedAt)
+	e.str(25, inode.Target)
+	e.uint(26, uint64(inode.Nlink))
+	e.int(27, inode.RetainUntil)
+	if inode.LegalHold {
+		e.uint(28, 1)
+	}
+	for _, link := range inode.OtherLinks {
+		link := link
+		e.msg(29, func(e *metaEncoder) {
+			e.uint(1, link.ParentID)
+			e.str(2, link.Name)
+		})
+	}
+}
+
+func decodeInodeRecord(data []byte) (*inodeRecord, error) {
+	inode := &inodeRecord{}
+	var links [][]byte
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			inode.InodeID = d.uint()
+		case 2:
+			inode.TenantID = d.str()
+		case 3:
+			inode.Kind = d.str()
+		case 4:
+			inode.ParentInode = d.uint()
+		case 5:
+			inode.Name = d.str()
+		case 6:
+			inode.Size = d.int()
+		case 7:
+			inode.FileHash = d.hexID()
+		case 8:
+			inode.ManifestID = d.hexID()
+		case 9:
+			inode.State = d.str()
+		case 10:
+			inode.Options = decodeStringMapEntry(d, inode.Options)
+		case 11:
+			inode.Mode = uint32(d.uint())
+		case 12:
+			inode.ModTime = d.int()
+		case 13:
+			inode.UID = int(d.int())
+		case 14:
+			inode.GID = int(d.int())
+		case 15:
+			inode.Generation = d.uint()
+		case 16:
+			inode.ContentGeneration = d.uint()
+		case 17:
+			inode.MetadataGeneration = d.uint()
+		case 18:
+			inode.NamespaceGeneration = d.uint()
+		case 19:
+			inode.CTime = d.int()
+		case 20:
+			inode.MTime = d.int()
+		case 21:
+			inode.ATime = d.int()
+		case 22:
+			inode.CreatedAt = d.int()
+		case 23:
+			inode.UpdatedAt = d.int()
+		case 24:
+			inode.DeletedAt = d.int()
+		case 25:
+			inode.Target = d.str()
+		case 26:
+			inode.Nlink = uint32(d.uint())
+		case 27:
+			inode.RetainUntil = d.int()
+		case 28:
+			inode.LegalHold = d.uint() != 0
+		case 29:
+			links = append(links, d.bytes())
+		default:
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return inode, err
+	}
+	for _, data := range links {
+		var link dirLink
+		if err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+			switch tag {
+			case 1:
+				link.ParentID = d.uint()
+			case 2:
+				link.Name = d.str()
+			default:
+				return false
+			}
+			return true
+		}); err != nil {
+			return inode, err
+		}
+		inode.OtherLinks = append(inode.OtherLinks, link)
+	}
+	return inode, nil
+}
+
+func encodeManifestRecord(e *metaEncoder, manifest *manifestRecord) {
+	e.hexID(1, manifest.ManifestID)
+	e.str(2, manifest.TenantID)
+	e.int(3, manifest.FileSize)
+	if manifest.FileHash != "" {
+		e.hexID(4, manifest.FileHash)
+	}
+	e.int(5, int64(manifest.ChunkCount))
+	e.str(6, manifest.ChunkingType)
+	e.str(7, manifest.State)
+	e.int(8, int64(manifest.RefCount))
+	for _, ref := range manifest.Chunks {
+		ref := ref
+		e.msg(9, func(e *metaEncoder) {
+			// Refs normally repeat their manifest id; only store it when it differs.
+			if ref.ManifestID != manifest.ManifestID {
+				e.hexID(1, ref.ManifestID)
+			}
+			e.int(2, int64(ref.Index))
+			e.hexID(3, ref.ChunkID)
+			e.int(4, ref.FileOffset)
+			e.int(5, ref.ChunkSize)
+		})
+	}
+	e.int(10, manifest.CreatedAt)
+	e.int(11, manifest.LastLiveAt)
+	e.int(12, manifest.DeletedAt)
+}
+
+func decodeManifestRecord(data []byte) (*manifestRecord, error) {
+	manifest := &manifestRecord{}
+	var refs [][]byte
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			manifest.ManifestID = d.hexID()
+		case 2:
+			manifest.TenantID = d.str()
+		case 3:
+			manifest.FileSize = d.int()
+		case 4:
+			manifest.FileHash = d.hexID()
+		case 5:
+			manifest.ChunkCount = int(d.int())
+		case 6:
+			manifest.ChunkingType = d.str()
+		case 7:
+			manifest.State = d.str()
+		case 8:
+			manifest.RefCount = int(d.int())
+		case 9:
+			refs = append(refs, d.bytes())
+		case 10:
+			manifest.CreatedAt = d.int()
+		case 11:
+			manifest.LastLiveAt = d.int()
+		case 12:
+			manifest.DeletedAt = d.int()
+		default:
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		return manifest, err
+	}
+	for _, data := range refs {
+		ref := manifestChunk{ManifestID: manifest.ManifestID}
+		if err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+			switch tag {
+			case 1:
+				ref.ManifestID = d.hexID()
+			case 2:
+				ref.Index = int(d.int())
+			case 3:
+				ref.ChunkID = d.hexID()
+			case 4:
+				ref.FileOffset = d.int()
+			case 5:
+				ref.ChunkSize = d.int()
+			default:
+				return false
+			}
+			return true
+		}); err != nil {
+			return manifest, err
+		}
+		manifest.Chunks = append(manifest.Chunks, ref)
+	}
+	return manifest, nil
+}
+
+func encodeChunkRecord(e *metaEncoder, chunk *chunkRecord) {
+	e.hexID(1, chunk.ChunkID)
+	e.str(2, chunk.TenantID)
+	e.int(3, chunk.RawSize)
+	e.int(4, chunk.StoredSize)
+	e.int(5, int64(chunk.RefCount))
+	e.str(6, chunk.State)
+	e.str(7, chunk.SegmentID)
+	e.int(8, chunk.SegmentOffset)
+	e.int(9, chunk.SegmentLength)
+	e.uint(10, uint64(chunk.ChecksumCRC32C))
+	e.str(11, chunk.Compression)
+	e.int(12, chunk.CreatedAt)
+	e.int(13, chunk.LastSeenAt)
+	e.int(14, int64(chunk.GarbageSeenCount))
+	e.int(15, chunk.GarbageCandidateAt)
+	e.int(16, chunk.CorruptAt)
+	e.str(17, chunk.CorruptReason)
+	e.int(18, chunk.DeletedAt)
+	e.str(19, chunk.Owner)
+	e.uint(20, uint64(chunk.KeyVersion))
+}
+
+func decodeChunkRecord(data []byte) (*chunkRecord, error) {
+	chunk := &chunkRecord{}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			chunk.ChunkID = d.hexID()
+		case 2:
+			chunk.TenantID = d.str()
+		case 3:
+			chunk.RawSize = d.int()
+		case 4:
+			chunk.StoredSize = d.int()
+		case 5:
+			chunk.RefCount = int(d.int())
+		case 6:
+			chunk.State = d.str()
+		case 7:
+			chunk.SegmentID = d.str()
+		case 8:
+			chunk.SegmentOffset = d.int()
+		case 9:
+			chunk.SegmentLength = d.int()
+		case 10:
+			chunk.ChecksumCRC32C = uint32(d.uint())
+		case 11:
+			chunk.Compression = d.str()
+		case 12:
+			chunk.CreatedAt = d.int()
+		case 13:
+			chunk.LastSeenAt = d.int()
+		case 14:
+			chunk.GarbageSeenCount = int(d.int())
+		case 15:
+			chunk.GarbageCandidateAt = d.int()
+		case 16:
+			chunk.CorruptAt = d.int()
+		case 17:
+			chunk.CorruptReason = d.str()
+		case 18:
+			chunk.DeletedAt = d.int()
+		case 19:
+			chunk.Owner = d.str()
+		case 20:
+			chunk.KeyVersion = uint32(d.uint())
+		default:
+			return false
+		}
+		return true
+	})
+	return chunk, err
+}
+
+func encodeSegmentRecord(e *metaEncoder, seg *segmentRecord) {
+	e.str(1, seg.SegmentID)
+	e.str(2, seg.RelativePath)
+	e.int(3, seg.WriteOffset)
+	e.int(4, seg.TotalBytes)
+	e.str(5, seg.State)
+	e.int(6, seg.CreatedAt)
+	e.int(7, seg.SealedAt)
+	e.int(8, seg.CompactedAt)
+	e.int(9, seg.CorruptAt)
+	e.str(10, seg.CorruptReason)
+	e.int(11, seg.DeletedAt)
+}
+
+func decodeSegmentRecord(data []byte) (*segmentRecord, error) {
+	seg := &segmentRecord{}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			seg.SegmentID = d.str()
+		case 2:
+			seg.RelativePath = d.str()
+		case 3:
+			seg.WriteOffset = d.int()
+		case 4:
+			seg.TotalBytes = d.int()
+		case 5:
+			seg.State = d.str()
+		case 6:
+			seg.CreatedAt = d.int()
+		case 7:
+			seg.SealedAt = d.int()
+		case 8:
+			seg.CompactedAt = d.int()
+		case 9:
+			seg.CorruptAt = d.int()
+		case 10:
+			seg.CorruptReason = d.str()
+		case 11:
+			seg.DeletedAt = d.int()
+		default:
+			return false
+		}
+		return true
+	})
+	return seg, err
+}
+
+func encodeGCRun(e *metaEncoder, run *gcRun) {
+	e.int(1, run.Epoch)
+	e.str(2, run.State)
+	e.int(3, run.StartedAt)
+	e.int(4, run.FinishedAt)
+	e.int(5, run.SafetyCutoff)
+	e.str(6, run.Notes)
+}
+
+func decodeGCRun(data []byte) (*gcRun, error) {
+	run := &gcRun{}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			run.Epoch = d.int()
+		case 2:
+			run.State = d.str()
+		case 3:
+			run.StartedAt = d.int()
+		case 4:
+			run.FinishedAt = d.int()
+		case 5:
+			run.SafetyCutoff = d.int()
+		case 6:
+			run.Notes = d.str()
+		default:
+			return false
+		}
+		return true
+	})
+	return run, err
+}
+
+func encodeSnapshotRecord(e *metaEncoder, snapshot *snapshotRecord) {
+	e.str(1, snapshot.TenantID)
+	e.str(2, snapshot.Name)
+	e.uint(3, snapshot.TxID)
+	e.int(4, snapshot.CreatedAt)
+	for i := range snapshot.Inodes {
+		inode := &snapshot.Inodes[i]
+		e.msg(5, func(e *metaEncoder) { encodeInodeRecord(e, inode) })
+	}
+}
+
+func decodeSnapshotRecord(data []byte) (*snapshotRecord, error) {
+	snapshot := &snapshotRecord{}
+	var inodeErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			snapshot.TenantID = d.str()
+		case 2:
+			snapshot.Name = d.str()
+		case 3:
+			snapshot.TxID = d.uint()
+		case 4:
+			snapshot.CreatedAt = d.int()
+		case 5:
+			inode, err := decodeInodeRecord(d.bytes())
+			if err != nil && inodeErr == nil {
+				inodeErr = err
+			}
+			snapshot.Inodes = append(snapshot.Inodes, *inode)
+		default:
+			return false
+		}
+		return true
+	})
+	return snapshot, errors.Join(err, inodeErr)
+}
+
+func encodeTenantSettings(e *metaEncoder, settings *tenantSettings) {
+	e.str(1, settings.TenantID)
+	if settings.Versioning {
+		e.uint(2, 1)
+	}
+	e.int(3, int64(settings.MaxVersions))
+	e.int(4, settings.VersionMaxAge)
+	if settings.Trash {
+		e.uint(6, 1)
+	}
+	e.int(7, settings.TrashMaxAge)
+	e.int(8, settings.QuotaLogical)
+	e.int(9, settings.QuotaPhysical)
+	e.int(10, settings.QuotaObjects)
+	for i := range settings.Lifecycle {
+		rule := &settings.Lifecycle[i]
+		e.msg(5, func(e *metaEncoder) {
+			e.str(1, rule.ID)
+			e.str(2, rule.Prefix)
+			e.int(3, rule.ExpireAfter)
+			e.int(4, rule.NoncurrentExpireAfter)
+			e.int(5, rule.AbortSessionsAfter)
+		})
+	}
+	if config := settings.Config; config != nil {
+		e.msg(11, func(e *metaEncoder) {
+			e.int(1, config.MaxFileSize)
+			e.str(2, config.Compression)
+			e.str(3, config.DedupScope)
+			e.str(4, config.ChunkAlgorithm)
+			e.int(5, config.ChunkMinSize)
+			e.int(6, config.ChunkAvgSize)
+			e.int(7, config.ChunkMaxSize)
+			e.int(8, config.SafetyWindow)
+			e.int(9, config.CompressionLevel)
+		})
+	}
+}
+
+func encodeTrashEntry(e *metaEncoder, entry *trashEntry) {
+	e.uint(1, entry.InodeID)
+	e.str(2, entry.TenantID)
+	e.str(3, entry.Path)
+	e.int(4, entry.DeletedAt)
+	e.int(5, entry.ExpiresAt)
+}
+
+func decodeTrashEntry(data []byte) (*trashEntry, error) {
+	entry := &trashEntry{}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			entry.InodeID = d.uint()
+		case 2:
+			entry.TenantID = d.str()
+		case 3:
+			entry.Path = d.str()
+		case 4:
+			entry.DeletedAt = d.int()
+		case 5:
+			entry.ExpiresAt = d.int()
+		default:
+			return false
+		}
+		return true
+	})
+	return entry, err
+}
+
+func encodeKeyring(e *metaEncoder, ring *keyring) {
+	e.str(1, ring.Scope)
+	e.uint(2, uint64(ring.Current))
+	for i := range ring.Keys {
+		key := &ring.Keys[i]
+		e.msg(3, func(e *metaEncoder) {
+			e.uint(1, uint64(key.Version))
+			e.str(2, key.MasterKeyID)
+			e.bytes(3, key.Wrapped)
+			e.int(4, key.CreatedAt)
+			if key.Scoped {
+				e.uint(5, 1)
+			}
+		})
+	}
+	e.uint(4, uint64(ring.Destroyed))
+}
+
+func decodeKeyring(data []byte) (*keyring, error) {
+	ring := &keyring{}
+	var nestedErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			ring.Scope = d.str()
+		case 2:
+			ring.Current = uint32(d.uint())
+		case 3:
+			var key dataKey
+			if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					key.Version = uint32(d.uint())
+				case 2:
+					key.MasterKeyID = d.str()
+				case 3:
+					key.Wrapped = append([]byte(nil), d.bytes()...)
+				case 4:
+					key.CreatedAt = d.int()
+				case 5:
+					key.Scoped = d.uint() != 0
+				default:
+					return false
+				}
+				return true
+			}); err != nil && nestedErr == nil {
+				nestedErr = err
+			}
+			ring.Keys = append(ring.Keys, key)
+		case 4:
+			ring.Destroyed = uint32(d.uint())
+		default:
+			return false
+		}
+		return true
+	})
+	return ring, errors.Join(err, nestedErr)
+}
+
+// encodeTenantUsage writes the usage of tenantID. Ops name the tenant in the
+// op itself and pass an empty tenantID.
+func encodeTenantUsage(e *metaEncoder, tenantID string, usage *tenantUsage) {
+	e.str(1, tenantID)
+	e.int(2, usage.LogicalBytes)
+	e.int(3, usage.PhysicalBytes)
+	e.int(4, usage.Objects)
+}
+
+func decodeTenantUsage(data []byte) (string, tenantUsage, error) {
+	var tenantID string
+	var usage tenantUsage
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			tenantID = d.str()
+		case 2:
+			usage.LogicalBytes = d.int()
+		case 3:
+			usage.PhysicalBytes = d.int()
+		case 4:
+			usage.Objects = d.int()
+		default:
+			return false
+		}
+		return true
+	})
+	return tenantID, usage, err
+}
+
+func decodeTenantSettings(data []byte) (*tenantSettings, error) {
+	settings := &tenantSettings{}
+	var nestedErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			settings.TenantID = d.str()
+		case 2:
+			settings.Versioning = d.uint() != 0
+		case 3:
+			settings.MaxVersions = int(d.int())
+		case 4:
+			settings.VersionMaxAge = d.int()
+		case 6:
+			settings.Trash = d.uint() != 0
+		case 7:
+			settings.TrashMaxAge = d.int()
+		case 8:
+			settings.QuotaLogical = d.int()
+		case 9:
+			settings.QuotaPhysical = d.int()
+		case 10:
+			settings.QuotaObjects = d.int()
+		case 5:
+			var rule lifecycleRule
+			if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					rule.ID = d.str()
+				case 2:
+					rule.Prefix = d.str()
+				case 3:
+					rule.ExpireAfter = d.int()
+				case 4:
+					rule.NoncurrentExpireAfter = d.int()
+				case 5:
+					rule.AbortSessionsAfter = d.int()
+				default:
+					return false
+				}
+				return true
+			}); err != nil && nestedErr == nil {
+				nestedErr = err
+			}
+			settings.Lifecycle = append(settings.Lifecycle, rule)
+		case 11:
+			config := &tenantConfig{}
+			if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					config.MaxFileSize = d.int()
+				case 2:
+					config.Compression = d.str()
+				case 3:
+					config.DedupScope = d.str()
+				case 4:
+					config.ChunkAlgorithm = d.str()
+				case 5:
+					config.ChunkMinSize = d.int()
+				case 6:
+					config.ChunkAvgSize = d.int()
+				case 7:
+					config.ChunkMaxSize = d.int()
+				case 8:
+					config.SafetyWindow = d.int()
+				case 9:
+					config.CompressionLevel = d.int()
+				default:
+					return false
+				}
+				return true
+			}); err != nil && nestedErr == nil {
+				nestedErr = err
+			}
+			settings.Config = config
+		default:
+			return false
+		}
+		return true
+	})
+	return settings, errors.Join(err, nestedErr)
+}
+
+func encodeVersionHistory(e *metaEncoder, history *versionHistory) {
+	e.str(1, history.TenantID)
+	e.str(2, history.Path)
+	for i := range history.Versions {
+		version := &history.Versions[i]
+		e.msg(3, func(e *metaEncoder) {
+			e.uint(1, version.VersionID)
+			if version.DeleteMarker {
+				e.uint(2, 1)
+			}
+			e.int(3, version.Size)
+			if version.FileHash != "" {
+				e.hexID(4, version.FileHash)
+			}
+			if version.ManifestID != "" {
+				e.hexID(5, version.ManifestID)
+			}
+			encodeStringMap(e, 6, version.Options)
+			e.uint(7, uint64(version.Mode))
+			e.int(8, version.MTime)
+			e.int(9, version.NoncurrentAt)
+		})
+	}
+}
+
+func decodeVersionHistory(data []byte) (*versionHistory, error) {
+	history := &versionHistory{}
+	var versionErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			history.TenantID = d.str()
+		case 2:
+			history.Path = d.str()
+		case 3:
+			var version objectVersion
+			if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					version.VersionID = d.uint()
+				case 2:
+					version.DeleteMarker = d.uint() != 0
+				case 3:
+					version.Size = d.int()
+				case 4:
+					version.FileHash = d.hexID()
+				case 5:
+					version.ManifestID = d.hexID()
+				case 6:
+					version.Options = decodeStringMapEntry(d, version.Options)
+				case 7:
+					version.Mode = uint32(d.uint())
+				case 8:
+					version.MTime = d.int()
+				case 9:
+					version.NoncurrentAt = d.int()
+				default:
+					return false
+				}
+				return true
+			}); err != nil && versionErr == nil {
+				versionErr = err
+			}
+			history.Versions = append(history.Versions, version)
+		default:
+			return false
+		}
+		return true
+	})
+	return history, errors.Join(err, versionErr)
+}
+
+func encodeStringMap(e *metaEncoder, tag int, values map[string]string) {
+	for _, key := range sortedOptionKeys(values) {
+		key, value := key, values[key]
+		e.msg(tag, func(e *metaEncoder) {
+			e.bytes(1, []byte(key))
+			e.str(2, value)
+		})
+	}
+}
+
+func decodeStringMapEntry(d *metaDecoder, values map[string]string) map[string]string {
+	var key, value string
+	if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case 1:
+			key = d.str()
+		case 2:
+			value = d.str()
+		default:
+			return false
+		}
+		return true
+	}); err != nil {
+		d.fail(err)
+		return values
+	}
+	if values == nil {
+		values = map[string]string{}
+	}
+	values[key] = value
+	return values
+}
+
+// Top-level tags shared by full and delta checkpoint images. Tombstone tags
+// only appear in deltas and remove records dropped since the previous image.
+const (
+	metaImageVersion         = 1
+	metaImageTxID            = 2
+	metaImageNextInodeID     = 3
+	metaImageNextSegmentSeq  = 4
+	metaImageNextGCEpoch     = 5
+	metaImageTenant          = 6
+	metaImageInode           = 7
+	metaImageDirEntries      = 8
+	metaImageManifest        = 9
+	metaImageChunk           = 10
+	metaImageSegment         = 11
+	metaImageGC              = 12
+	metaImageDeltaSeq        = 13
+	metaImageDeletedTenant   = 14
+	metaImageDeletedInode    = 15
+	metaImageDeletedDirEntry = 16
+	metaImageDeletedManifest = 17
+	metaImageDeletedChunk    = 18
+	metaImageDeletedSegment  = 19
+	metaImageUpdatedAt       = 20
+	metaImageSnapshot        = 21
+	metaImageDeletedSnapshot = 22
+	metaImageSettings        = 23
+	metaImageDeletedSettings = 24
+	metaImageVersions        = 25
+	metaImageDeletedVersions = 26
+	metaImageTrash           = 27
+	metaImageDeletedTrash    = 28
+	metaImageKeyring         = 29
+	metaImageDeletedKeyring  = 30
+	metaImageUsage           = 31
+	metaImageDeletedUsage    = 32
+	// metaImageUsageCounted marks a full image that persists usage. Images
+	// without it predate persisted usage, which is recounted at load.
+	metaImageUsageCounted = 33
+
+	metaImageDirEntryName     = 1
+	metaImageDirEntryChildID  = 2
+	metaImageDirEntriesParent = 1
+	metaImageDirEntriesEntry  = 2
+)
+
+func encodeMetaImageHeader(e *metaEncoder, meta *metadata) {
+	e.int(metaImageVersion, int64(meta.Version))
+	e.uint(metaImageTxID, meta.TxID)
+	e.uint(metaImageNextInodeID, meta.NextInodeID)
+	e.int(metaImageNextSegmentSeq, meta.NextSegmentSeq)
+	e.int(metaImageNextGCEpoch, meta.NextGCEpoch)
+	e.uint(metaImageDeltaSeq, meta.DeltaSeq)
+	e.int(metaImageUpdatedAt, meta.UpdatedAt)
+	e.msg(metaImageGC, func(e *metaEncoder) {
+		e.int(1, meta.GC.TotalRuns)
+		e.int(2, meta.GC.LastEpoch)
+		for i := range meta.GC.Recent {
+			run := &meta.GC.Recent[i]
+			e.msg(3, func(e *metaEncoder) { encodeGCRun(e, run) })
+		}
+	})
+}
+
+func encodeMetaImageTenant(e *metaEncoder, tenantID string, rootID uint64) {
+	e.msg(metaImageTenant, func(e *metaEncoder) {
+		e.bytes(1, []byte(tenantID))
+		e.uint(2, rootID)
+	})
+}
+
+func encodeMetaImageDirEntries(e *metaEncoder, parentID uint64, entries map[string]uint64, names []string) {
+	e.msg(metaImageDirEntries, func(e *metaEncoder) {
+		e.uint(metaImageDirEntriesParent, parentID)
+		for _, name := range names {
+			name, childID := name, entries[name]
+			e.msg(metaImageDirEntriesEntry, func(e *metaEncoder) {
+				e.bytes(metaImageDirEntryName, []byte(name))
+				e.uint(metaImageDirEntryChildID, childID)
+			})
+		}
+	})
+}
+
+// encodeMetaCheckpoint writes the whole metadata image as a sequence of
+// top-level records after the checkpoint magic.
+func encodeMetaCheckpoint(meta *metadata) []byte {
+	e := metaEncoder{buf: []byte(metaCheckpointMagic)}
+	encodeMetaImageHeader(&e, meta)
+	for _, tenantID := range sortedNames(meta.Tenants) {
+		encodeMetaImageTenant(&e, tenantID, meta.Tenants[tenantID])
+	}
+	for _, inode := range meta.Inodes {
+		if inode != nil {
+			e.msg(metaImageInode, func(e *metaEncoder) { encodeInodeRecord(e, inode) })
+		}
+	}
+	for parentID, entries := range meta.DirEntries {
+		encodeMetaImageDirEntries(&e, parentID, entries, sortedNames(entries))
+	}
+	for _, manifest := range meta.Manifests {
+		if manifest != nil {
+			e.msg(metaImageManifest, func(e *metaEncoder) { encodeManifestRecord(e, manifest) })
+		}
+	}
+	for _, chunk := range meta.Chunks {
+		if chunk != nil {
+			e.msg(metaImageChunk, func(e *metaEncoder) { encodeChunkRecord(e, chunk) })
+		}
+	}
+	for _, seg := range meta.Segments {
+		if seg != nil {
+			e.msg(metaImageSegment, func(e *metaEncoder) { encodeSegmentRecord(e, seg) })
+		}
+	}
+	for _, snapshot := range meta.Snapshots {
+		if snapshot != nil {
+			e.msg(metaImageSnapshot, func(e *metaEncoder) { encodeSnapshotRecord(e, snapshot) })
+		}
+	}
+	for _, settings := range meta.TenantSettings {
+		if settings != nil {
+			e.msg(metaImageSettings, func(e *metaEncoder) { encodeTenantSettings(e, settings) })
+		}
+	}
+	for _, history := range meta.Versions {
+		if history != nil {
+			e.msg(metaImageVersions, func(e *metaEncoder) { encodeVersionHistory(e, history) })
+		}
+	}
+	for _, entry := range meta.Trash {
+		if entry != nil {
+			e.msg(metaImageTrash, func(e *metaEncoder) { encodeTrashEntry(e, entry) })
+		}
+	}
+	for _, ring := range meta.Keyrings {
+		if ring != nil {
+			e.msg(metaImageKeyring, func(e *metaEncoder) { encodeKeyring(e, ring) })
+		}
+	}
+	if !meta.usageStale {
+		e.uint(metaImageUsageCounted, 1)
+		for tenantID, usage := range meta.Usage {
+			e.msg(metaImageUsage, func(e *metaEncoder) { encodeTenantUsage(e, tenantID, &usage) })
+		}
+	}
+	return appendMetaImageFooter(e.buf, meta.TxID)
+}
+
+// encodeMetaDelta writes the records named by dirty at their current state,
+// or a tombstone when the record no longer exists. The header carries seq as
+// the delta sequence number.
+func encodeMetaDelta(meta *metadata, dirty *metaDirty, seq uint64) []byte {
+	e := metaEncoder{buf: []byte(metaDeltaCheckpointMagic)}
+	header := *meta
+	header.DeltaSeq = seq
+	encodeMetaImageHeader(&e, &header)
+	if dirty == nil {
+		return appendMetaImageFooter(e.buf, meta.TxID)
+	}
+	for tenantID := range dirty.tenants {
+		if rootID, ok := meta.Tenants[tenantID]; ok {
+			encodeMetaImageTenant(&e, tenantID, rootID)
+		} else {
+			e.bytes(metaImageDeletedTenant, []byte(tenantID))
+		}
+	}
+	for id := range dirty.inodes {
+		if inode := meta.Inodes[id]; inode != nil {
+			e.msg(metaImageInode, func(e *metaEncoder) { encodeInodeRecord(e, inode) })
+		} else {
+			e.key(metaImageDeletedInode, metaWireVarint)
+			e.buf = binary.AppendUvarint(e.buf, id)
+		}
+	}
+	for parentID, names := range dirty.dirents {
+		entries := meta.DirEntries[parentID]
+		var live []string
+		for name := range names {
+			if _, ok := entries[name]; ok {
+				live = append(live, name)
+				continue
+			}
+			e.msg(metaImageDeletedDirEntry, func(e *metaEncoder) {
+				e.uint(1, parentID)
+				e.bytes(2, []byte(name))
+			})
+		}
+		if len(live) > 0 {
+			sort.Strings(live)
+			encodeMetaImageDirEntries(&e, parentID, entries, live)
+		}
+	}
+	for id := range dirty.manifests {
+		if manifest := meta.Manifests[id]; manifest != nil {
+			e.msg(metaImageManifest, func(e *metaEncoder) { encodeManifestRecord(e, manifest) })
+		} else {
+			e.hexID(metaImageDeletedManifest, id)
+		}
+	}
+	for id := range dirty.chunks {
+		if chunk := meta.Chunks[id]; chunk != nil {
+			e.msg(metaImageChunk, func(e *metaEncoder) { encodeChunkRecord(e, chunk) })
+		} else {
+			e.hexID(metaImageDeletedChunk, id)
+		}
+	}
+	for id := range dirty.segments {
+		if seg := meta.Segments[id]; seg != nil {
+			e.msg(metaImageSegment, func(e *metaEncoder) { encodeSegmentRecord(e, seg) })
+		} else {
+			e.bytes(metaImageDeletedSegment, []byte(id))
+		}
+	}
+	for key := range dirty.snapshots {
+		if snapshot := meta.Snapshots[key]; snapshot != nil {
+			e.msg(metaImageSnapshot, func(e *metaEncoder) { encodeSnapshotRecord(e, snapshot) })
+		} else {
+			e.bytes(metaImageDeletedSnapshot, []byte(key))
+		}
+	}
+	for tenantID := range dirty.settings {
+		if settings := meta.TenantSettings[tenantID]; settings != nil {
+			e.msg(metaImageSettings, func(e *metaEncoder) { encodeTenantSettings(e, settings) })
+		} else {
+			e.bytes(metaImageDeletedSettings, []byte(tenantID))
+		}
+	}
+	for key := range dirty.versions {
+		if history := meta.Versions[key]; history != nil {
+			e.msg(metaImageVersions, func(e *metaEncoder) { encodeVersionHistory(e, history) })
+		} else {
+			e.bytes(metaImageDeletedVersions, []byte(key))
+		}
+	}
+	for id := range dirty.trash {
+		if entry := meta.Trash[id]; entry != nil {
+			e.msg(metaImageTrash, func(e *metaEncoder) { encodeTrashEntry(e, entry) })
+		} else {
+			e.key(metaImageDeletedTrash, metaWireVarint)
+			e.buf = binary.AppendUvarint(e.buf, id)
+		}
+	}
+	for scope := range dirty.keyrings {
+		if ring := meta.Keyrings[scope]; ring != nil {
+			e.msg(metaImageKeyring, func(e *metaEncoder) { encodeKeyring(e, ring) })
+		} else {
+			e.bytes(metaImageDeletedKeyring, []byte(scope))
+		}
+	}
+	for tenantID := range dirty.usage {
+		if usage, ok := meta.Usage[tenantID]; ok {
+			e.msg(metaImageUsage, func(e *metaEncoder) { encodeTenantUsage(e, tenantID, &usage) })
+		} else {
+			e.bytes(metaImageDeletedUsage, []byte(tenantID))
+		}
+	}
+	return appendMetaImageFooter(e.buf, meta.TxID)
+}
+
+func appendMetaImageFooter(data []byte, txid uint64) []byte {
+	data = binary.LittleEndian.AppendUint64(data, txid)
+	data = binary.LittleEndian.AppendUint32(data, crc32.ChecksumIEEE(data))
+	return append(data, metaImageFooterMagic...)
+}
+
+// verifyMetaImage checks the footer of a checkpoint image and returns the
+// image without it, together with the txid the footer records.
+func verifyMetaImage(data []byte, magic string) ([]byte, uint64, error) {
+	if len(data) < len(magic) || string(data[:len(magic)]) != magic {
+		return nil, 0, errors.New("invalid metadata checkpoint magic")
+	}
+	if len(data) < len(magic)+metaImageFooterSize || string(data[len(data)-len(metaImageFooterMagic):]) != metaImageFooterMagic {
+		return nil, 0, errors.New("metadata checkpoint footer missing")
+	}
+	crcAt := len(data) - len(metaImageFooterMagic) - 4
+	if crc32.ChecksumIEEE(data[:crcAt]) != binary.LittleEndian.Uint32(data[crcAt:]) {
+		return nil, 0, errors.New("metadata checkpoint checksum mismatch")
+	}
+	txid := binary.LittleEndian.Uint64(data[crcAt-8:])
+	return data[len(magic) : crcAt-8], txid, nil
+}
+
+func decodeVerifiedMetaImage(data []byte, magic string, meta *metadata) error {
+	body, txid, err := verifyMetaImage(data, magic)
+	if err != nil {
+		return err
+	}
+	if err := decodeMetaImage(body, meta); err != nil {
+		return err
+	}
+	if meta.TxID != txid {
+		return fmt.Errorf("metadata checkpoint holds tx %d but its footer records tx %d", meta.TxID, txid)
+	}
+	return nil
+}
+
+func decodeMetaCheckpoint(data []byte, meta *metadata) error {
+	meta.usageStale = true
+	return decodeVerifiedMetaImage(data, metaCheckpointMagic, meta)
+}
+
+// decodeMetaDelta applies a delta image on top of meta.
+func decodeMetaDelta(data []byte, meta *metadata) error {
+	return decodeVerifiedMetaImage(data, metaDeltaCheckpointMagic, meta)
+}
+
+func decodeMetaImage(data []byte, meta *metadata) error {
+	ensureMetaMaps(meta)
+	var recordErr error
+	keep := func(err error) {
+		if err != nil && recordErr == nil {
+			recordErr = err
+		}
+	}
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case metaImageVersion:
+			meta.Version = int(d.int())
+		case metaImageTxID:
+			meta.TxID = d.uint()
+		case metaImageNextInodeID:
+			meta.NextInodeID = d.uint()
+		case metaImageNextSegmentSeq:
+			meta.NextSegmentSeq = d.int()
+		case metaImageNextGCEpoch:
+			meta.NextGCEpoch = d.int()
+		case metaImageDeltaSeq:
+			meta.DeltaSeq = d.uint()
+		case metaImageUpdatedAt:
+			meta.UpdatedAt = d.int()
+		case metaImageTenant:
+			var tenantID string
+			var rootID uint64
+			keep(decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					tenantID = d.str()
+				case 2:
+					rootID = d.uint()
+				default:
+					return false
+				}
+				return true
+			}))
+			meta.Tenants[tenantID] = rootID
+		case metaImageInode:
+			inode, err := decodeInodeRecord(d.bytes())
+			keep(err)
+			meta.Inodes[inode.InodeID] = inode
+		case metaImageDirEntries:
+			keep(decodeDirEntries(d.bytes(), meta))
+		case metaImageManifest:
+			manifest, err := decodeManifestRecord(d.bytes())
+			keep(err)
+			meta.Manifests[manifest.ManifestID] = manifest
+		case metaImageChunk:
+			chunk, err := decodeChunkRecord(d.bytes())
+			keep(err)
+			setChunkRecord(meta, chunk.ChunkID, chunk)
+		case metaImageSegment:
+			seg, err := decodeSegmentRecord(d.bytes())
+			keep(err)
+			meta.Segments[seg.SegmentID] = seg
+		case metaImageSnapshot:
+			snapshot, err := decodeSnapshotRecord(d.bytes())
+			keep(err)
+			meta.Snapshots[snapshotKey(snapshot.TenantID, snapshot.Name)] = snapshot
+		case metaImageSettings:
+			settings, err := decodeTenantSettings(d.bytes())
+			keep(err)
+			meta.TenantSettings[settings.TenantID] = settings
+		case metaImageVersions:
+			history, err := decodeVersionHistory(d.bytes())
+			keep(err)
+			meta.Versions[versionKey(history.TenantID, history.Path)] = history
+		case metaImageTrash:
+			entry, err := decodeTrashEntry(d.bytes())
+			keep(err)
+			meta.Trash[entry.InodeID] = entry
+		case metaImageKeyring:
+			ring, err := decodeKeyring(d.bytes())
+			keep(err)
+			meta.Keyrings[ring.Scope] = ring
+		case metaImageUsage:
+			tenantID, usage, err := decodeTenantUsage(d.bytes())
+			keep(err)
+			meta.Usage[tenantID] = usage
+		case metaImageUsageCounted:
+			d.uint()
+			meta.usageStale = false
+		case metaImageGC:
+			meta.GC = gcMetadata{}
+			keep(decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					meta.GC.TotalRuns = d.int()
+				case 2:
+					meta.GC.LastEpoch = d.int()
+				case 3:
+					run, err := decodeGCRun(d.bytes())
+					keep(err)
+					meta.GC.Recent = append(meta.GC.Recent, *run)
+				default:
+					return false
+				}
+				return true
+			}))
+		case metaImageDeletedTenant:
+			delete(meta.Tenants, d.str())
+		case metaImageDeletedInode:
+			delete(meta.Inodes, d.uint())
+		case metaImageDeletedDirEntry:
+			var parentID uint64
+			var name string
+			keep(decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case 1:
+					parentID = d.uint()
+				case 2:
+					name = d.str()
+				default:
+					return false
+				}
+				return true
+			}))
+			meta.dropListIndex(parentID)
+			if entries := meta.DirEntries[parentID]; entries != nil {
+				delete(entries, name)
+				if len(entries) == 0 {
+					delete(meta.DirEntries, parentID)
+				}
+			}
+		case metaImageDeletedManifest:
+			delete(meta.Manifests, d.hexID())
+		case metaImageDeletedChunk:
+			setChunkRecord(meta, d.hexID(), nil)
+		case metaImageDeletedSegment:
+			delete(meta.Segments, d.str())
+		case metaImageDeletedSnapshot:
+			delete(meta.Snapshots, d.str())
+		case metaImageDeletedSettings:
+			delete(meta.TenantSettings, d.str())
+		case metaImageDeletedVersions:
+			delete(meta.Versions, d.str())
+		case metaImageDeletedTrash:
+			delete(meta.Trash, d.uint())
+		case metaImageDeletedKeyring:
+			delete(meta.Keyrings, d.str())
+		case metaImageDeletedUsage:
+			delete(meta.Usage, d.str())
+		default:
+			return false
+		}
+		return true
+	})
+	return errors.Join(err, recordErr)
+}
+
+// decodeDirEntries merges one directory's entries into meta. A full image
+// lists each directory once; a delta lists only the entries that changed.
+func decodeDirEntries(data []byte, meta *metadata) error {
+	var parentID uint64
+	entries := map[string]uint64{}
+	var entryErr error
+	err := decodeMetaMessage(data, func(d *metaDecoder, tag int) bool {
+		switch tag {
+		case metaImageDirEntriesParent:
+			parentID = d.uint()
+		case metaImageDirEntriesEntry:
+			var name string
+			var childID uint64
+			if err := decodeMetaMessage(d.bytes(), func(d *metaDecoder, tag int) bool {
+				switch tag {
+				case metaImageDirEntryName:
+					name = d.str()
+				case metaImageDirEntryChildID:
+					childID = d.uint()
+				default:
+					return false
+				}
+				return true
+			}); err != nil && entryErr == nil {
+				entryErr = err
+			}
+			entries[name] = childID
+		default:
+			return false
+		}
+		return true
+	})
+	if err != nil || entryErr != nil {
+		return errors.Join(err, entryErr)
+	}
+	if len(entries) == 0 {
+		return nil
+	}
+	meta.dropListIndex(parentID)
+	if meta.DirEntries[parentID] == nil {
+		meta.DirEntries[parentID] = make(map[string]uint64, len(entries))
+	}
+	for name, childID := range entries {
+		meta.DirEntries[parentID][name] = childID
+	}
+	return nil
+}
+
+func sortedOptionKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,221 @@
+package blobfs
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+// fillMetaRecord sets every field of a record to a distinct non-zero value so
+// round-trip tests notice fields the binary codec forgets.
+func fillMetaRecord(t *testing.T, v reflect.Value, seed *int) {
+	t.Helper()
+	*seed++
+	switch v.Kind() {
+	case reflect.Pointer:
+		v.Set(reflect.New(v.Type().Elem()))
+		fillMetaRecord(t, v.Elem(), seed)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			fillMetaRecord(t, v.Field(i), seed)
+		}
+	case reflect.String:
+		if *seed%2 == 0 {
+			v.SetString(fmt.Sprintf("%04x", *seed))
+		} else {
+			v.SetString(fmt.Sprintf("Value-%d", *seed))
+		}
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int64:
+		v.SetInt(-int64(*seed))
+	case reflect.Uint8, reflect.Uint32, reflect.Uint64:
+		v.SetUint(uint64(*seed))
+	case reflect.Slice:
+		slice := reflect.MakeSlice(v.Type(), 2, 2)
+		for i := 0; i < slice.Len(); i++ {
+			fillMetaRecord(t, slice.Index(i), seed)
+		}
+		v.Set(slice)
+	case reflect.Map:
+		m := reflect.MakeMap(v.Type())
+		key := reflect.New(v.Type().Key()).Elem()
+		value := reflect.New(v.Type().Elem()).Elem()
+		fillMetaRecord(t, key, seed)
+		fillMetaRecord(t, value, seed)
+		m.SetMapIndex(key, value)
+		v.Set(m)
+	default:
+		t.Fatalf("fillMetaRecord: unsupported kind %s", v.Kind())
+	}
+}
+
+func TestMetaTxBinaryRoundTripsEveryRecordField(t *testing.T) {
+	seed := 0
+	var ops []metaOp
+	for opType := range metaOpCodes {
+		var op metaOp
+		fillMetaRecord(t, reflect.ValueOf(&op).Elem(), &seed)
+		op.Type = opType
+		ops = append(ops, op)
+	}
+	ops = append(ops, metaOp{Type: "future_op", TenantID: "tenant-a"})
+	tx := metaTx{TxID: 42, Ops: ops}
+	got, err := decodeMetaTxBinary(encodeMetaTxBinary(tx))
+	if err != nil {
+		t.Fatalf("decode tx: %v", err)
+	}
+	if !reflect.DeepEqual(got, tx) {
+		t.Fatalf("tx did not round-trip:\n got %+v\nwant %+v", got, tx)
+	}
+}
+
+func TestMetaCheckpointBinaryRoundTripsAndIsSmallerThanJSON(t *testing.T) {
+	store := openTestStore(t)
+	for i := 0; i < 32; i++ {
+		putTestBytes(t, store, "tenant-a", fmt.Sprintf("file-%02d.txt", i), []byte(strings.Repeat(fmt.Sprintf("payload-%d;", i), 64)))
+	}
+	store.metaMu.RLock()
+	meta := store.meta
+	encoded := encodeMetaCheckpoint(meta)
+	legacy, err := json.Marshal(meta)
+	store.metaMu.RUnlock()
+	if err != nil {
+		t.Fatalf("marshal json: %v", err)
+	}
+	decoded := &metadata{}
+	if err := decodeMetaCheckpoint(encoded, decoded); err != nil {
+		t.Fatalf("decode checkpoint: %v", err)
+	}
+	// Compare through JSON so empty and nil maps count as the same value.
+	roundTrip, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("marshal decoded: %v", err)
+	}
+	if string(roundTrip) != string(legacy) {
+		t.Fatal("binary checkpoint did not round-trip metadata")
+	}
+	if len(encoded)*2 > len(legacy) {
+		t.Fatalf("binary checkpoint %d bytes, json %d bytes", len(encoded), len(legacy))
+	}
+	if err := decodeMetaCheckpoint(encoded[:len(encoded)-3], &metadata{}); err == nil {
+		t.Fatal("truncated checkpoint should fail to decode")
+	}
+}
+
+func writeLegacyMetaFrame(t *testing.T, file afero.File, tx metaTx) {
+	t.Helper()
+	payload, err := json.Marshal(tx)
+	if err != nil {
+		t.Fatalf("marshal legacy tx: %v", err)
+	}
+	var header [12]byte
+	binary.LittleEndian.PutUint32(header[0:4], metaLegacyFrameMagic)
+	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(payload))
+	if _, err := file.Write(append(header[:], payload...)); err != nil {
+		t.Fatalf("write legacy frame: %v", err)
+	}
+}
+
+func writeLegacySuperBlock(t *testing.T, fsys afero.Fs, metaDir string, txid uint64, logFile string) {
+	t.Helper()
+	super := metaSuperBlock{FormatVersion: metaLegacyFormatVersion, CheckpointTxID: txid, LogFile: logFile}
+	payload, err := json.Marshal(super)
+	if err != nil {
+		t.Fatalf("marshal superblock: %v", err)
+	}
+	super.CRC = crc32.ChecksumIEEE(payload)
+	if payload, err = json.Marshal(super); err != nil {
+		t.Fatalf("marshal superblock: %v", err)
+	}
+	if err := afero.WriteFile(fsys, filepath.Join(metaDir, "SUPER0"), payload, 0o600); err != nil {
+		t.Fatalf("write superblock: %v", err)
+	}
+}
+
+func TestOpenUpgradesLegacyJSONMetadataOnCheckpoint(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	metaDir := "/blobfs/meta"
+	if err := fsys.MkdirAll(metaTxLogDir(metaDir), 0o755); err != nil {
+		t.Fatalf("mkdir txlog: %v", err)
+	}
+	now := nowUnix()
+	base := newMetadata()
+	base.Version = metaLegacyFormatVersion
+	applyMetaTx(base, metaTx{TxID: 1, Ops: []metaOp{
+		{Type: "put_tenant", TenantID: "tenant-a", ChildID: 1},
+		{Type: "put_inode", Inode: &inodeRecord{InodeID: 1, TenantID: "tenant-a", Kind: fileKindDir, State: fileStateActive, Mode: 0o755, CreatedAt: now, UpdatedAt: now}},
+	}})
+	data, err := json.Marshal(base)
+	if err != nil {
+		t.Fatalf("marshal legacy checkpoint: %v", err)
+	}
+	if err := afero.WriteFile(fsys, filepath.Join(metaDir, metaLegacyCheckpointFile), data, 0o600); err != nil {
+		t.Fatalf("write legacy checkpoint: %v", err)
+	}
+	log, err := fsys.OpenFile(filepath.Join(metaTxLogDir(metaDir), metaLogFile), os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		t.Fatalf("open legacy log: %v", err)
+	}
+	writeLegacyMetaFrame(t, log, metaTx{TxID: 2, Ops: []metaOp{
+		{Type: "put_inode", Inode: &inodeRecord{InodeID: 2, TenantID: "tenant-a", Kind: fileKindDir, ParentInode: 1, Name: "docs", State: fileStateActive, Mode: 0o755, CreatedAt: now, UpdatedAt: now}},
+		{Type: "put_dirent", ParentID: 1, Name: "docs", ChildID: 2},
+	}})
+	_ = log.Close()
+	writeLegacySuperBlock(t, fsys, metaDir, 1, metaLogFile)
+
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open legacy store: %v", err)
+	}
+	if _, err := store.Stat("tenant-a/docs"); err != nil {
+		t.Fatalf("stat replayed legacy dir: %v", err)
+	}
+	// The open log still holds a JSON frame; new binary frames follow it.
+	if err := store.Mkdir("tenant-a/new", 0o755); err != nil {
+		t.Fatalf("mkdir after upgrade: %v", err)
+	}
+	simulateCrashWithoutCheckpoint(t, store)
+
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen mixed log: %v", err)
+	}
+	for _, name := range []string{"tenant-a/docs", "tenant-a/new"} {
+		if _, err := store.Stat(name); err != nil {
+			t.Fatalf("stat %s from mixed log: %v", name, err)
+		}
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if exists, _ := afero.Exists(fsys, filepath.Join(metaDir, metaLegacyCheckpointFile)); exists {
+		t.Fatal("legacy checkpoint should be removed after upgrade")
+	}
+	data, err = afero.ReadFile(fsys, filepath.Join(metaDir, metaCheckpointFile))
+	if err != nil || !strings.HasPrefix(string(data), metaCheckpointMagic) {
+		t.Fatalf("binary checkpoint missing: %v", err)
+	}
+	super, err := loadMetaSuperBlock(fsys, metaDir)
+	if err != nil || super.FormatVersion != metaFormatVersion {
+		t.Fatalf("superblock = %+v, %v", super, err)
+	}
+
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen upgraded store: %v", err)
+	}
+	defer store.Close()
+	if _, err := store.Stat("tenant-a/new"); err != nil {
+		t.Fatalf("stat after upgrade: %v", err)
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -27,7 +28,9 @@ const (
 	chunkStateCorrupt          = "CORRUPT"
 	chunkStateGarbageCandidate = "GARBAGE_CANDIDATE"
 	chunkStateDeleted          = "DELETED"
+	chunkStateShredded         = "SHREDDED"
 
+	segmentStateOpen       = "OPEN"
 	segmentStateSealed     = "SEALED"
 	segmentStateCorrupt    = "CORRUPT"
 	segmentStateCompacting = "COMPACTING"
@@ -36,17 +39,25 @@ const (
 	chunkingSingle  = "SINGLE"
 	chunkingFastCDC = "FASTCDC"
 
-	fileKindFile = "FILE"
-	fileKindDir  = "DIR"
+	fileKindFile    = "FILE"
+	fileKindDir     = "DIR"
+	fileKindSymlink = "SYMLINK"
 )
 
 const (
-	metaFormatVersion      = 2
+	metaFormatVersion      = 3
 	metaLogFile            = "000001.log"
-	metaCheckpointFile     = "checkpoint.json"
+	metaCheckpointFile     = "checkpoint.bin"
+	metaPrevCheckpointFile = "checkpoint.prev.bin"
 	metaCheckpointInterval = 128
-	metaFrameMagic         = uint32(0x324d4642)
-	maxRecentGCRuns        = 1024
+	metaFrameMagic         = uint32(0x334d4642)
+
+	// Format 2 stored frames and checkpoints as JSON. It is still read so
+	// existing stores open, and is rewritten as format 3 on the next checkpoint.
+	metaLegacyFormatVersion  = 2
+	metaLegacyCheckpointFile = "checkpoint.json"
+	metaLegacyFrameMagic     = uint32(0x324d4642)
+	maxRecentGCRuns          = 1024
 )
 
 type inodeRecord struct {
@@ -74,6 +85,23 @@ type inodeRecord struct {
 	CreatedAt           int64             `json:"created_at"`
 	UpdatedAt           int64             `json:"updated_at"`
 	DeletedAt           int64             `json:"deleted_at,omitempty"`
+	// Target is the link text of a SYMLINK inode.
+	Target string `json:"target,omitempty"`
+	// Nlink counts the dirents of a hard-linked file; zero means one.
+	Nlink uint32 `json:"nlink,omitempty"`
+	// OtherLinks are the dirents of a hard-linked file besides ParentInode
+	// and Name, so an unlink finds a surviving one without a scan.
+	OtherLinks []dirLink `json:"other_links,omitempty"`
+	// RetainUntil protects a file from changes and deletion until this
+	// time; LegalHold protects it until the hold is released.
+	RetainUntil int64 `json:"retain_until,omitempty"`
+	LegalHold   bool  `json:"legal_hold,omitempty"`
+}
+
+// dirLink is a dirent naming an inode.
+type dirLink struct {
+	ParentID uint64 `json:"parent_id"`
+	Name     string `json:"name"`
 }
 
 type manifestRecord struct {
@@ -102,6 +130,7 @@ type manifestChunk struct {
 type chunkRecord struct {
 	ChunkID            string `json:"chunk_id"`
 	TenantID           string `json:"tenant_id"`
+	Owner              string `json:"owner,omitempty"`
 	RawSize            int64  `json:"raw_size"`
 	StoredSize         int64  `json:"stored_size"`
 	RefCount           int    `json:"ref_count"`
@@ -118,6 +147,7 @@ type chunkRecord struct {
 	CorruptAt          int64  `json:"corrupt_at,omitempty"`
 	CorruptReason      string `json:"corrupt_reason,omitempty"`
 	DeletedAt          int64  `json:"deleted_at,omitempty"`
+	KeyVersion         uint32 `json:"key_version,omitempty"`
 }
 
 type segmentRecord struct {
@@ -143,6 +173,121 @@ type gcRun struct {
 	Notes        string `json:"notes,omitempty"`
 }
 
+// snapshotRecord freezes the active inode tree of a tenant. Every file inode
+// in it holds one manifest reference, so GC keeps the snapshot's chunks until
+// the snapshot is deleted.
+type snapshotRecord struct {
+	TenantID  string        `json:"tenant_id"`
+	Name      string        `json:"name"`
+	TxID      uint64        `json:"txid"`
+	CreatedAt int64         `json:"created_at"`
+	Inodes    []inodeRecord `json:"inodes,omitempty"`
+}
+
+// trashEntry records a deleted node kept in the trash of its tenant. The node
+// and its subtree stay active but detached from the namespace, and GC treats
+// them as reachable until the entry is restored, emptied, or expires. An empty
+// Path marks a deleted tenant root.
+type trashEntry struct {
+	InodeID   uint64 `json:"inode_id"`
+	TenantID  string `json:"tenant_id"`
+	Path      string `json:"path,omitempty"`
+	DeletedAt int64  `json:"deleted_at"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+}
+
+// tenantSettings holds persisted per-tenant options.
+type tenantSettings struct {
+	TenantID      string          `json:"tenant_id"`
+	Versioning    bool            `json:"versioning,omitempty"`
+	MaxVersions   int             `json:"max_versions,omitempty"`
+	VersionMaxAge int64           `json:"version_max_age,omitempty"`
+	Lifecycle     []lifecycleRule `json:"lifecycle,omitempty"`
+	Trash         bool            `json:"trash,omitempty"`
+	TrashMaxAge   int64           `json:"trash_max_age,omitempty"`
+	QuotaLogical  int64           `json:"quota_logical,omitempty"`
+	QuotaPhysical int64           `json:"quota_physical,omitempty"`
+	QuotaObjects  int64           `json:"quota_objects,omitempty"`
+	Config        *tenantConfig   `json:"config,omitempty"`
+}
+
+// tenantConfig is the persisted form of TenantConfig. Durations are in
+// nanoseconds.
+type tenantConfig struct {
+	MaxFileSize      int64  `json:"max_file_size,omitempty"`
+	Compression      string `json:"compression,omitempty"`
+	DedupScope       string `json:"dedup_scope,omitempty"`
+	CompressionLevel int64  `json:"compression_level,omitempty"`
+	ChunkAlgorithm   string `json:"chunk_algorithm,omitempty"`
+	ChunkMinSize     int64  `json:"chunk_min_size,omitempty"`
+	ChunkAvgSize     int64  `json:"chunk_avg_size,omitempty"`
+	ChunkMaxSize     int64  `json:"chunk_max_size,omitempty"`
+	SafetyWindow     int64  `json:"safety_window,omitempty"`
+}
+
+// keyring holds the data keys of one dedup scope, each wrapped by a master
+// key of the KeyProvider. Chunks record the version they were encrypted with;
+// Current is the version new chunks use. A shredding delete empties Keys and
+// records the highest version it destroyed in Destroyed, so a keyring the
+// scope gets later never reuses a version.
+type keyring struct {
+	Scope     string    `json:"scope"`
+	Current   uint32    `json:"current"`
+	Keys      []dataKey `json:"keys"`
+	Destroyed uint32    `json:"destroyed,omitempty"`
+}
+
+type dataKey struct {
+	Version     uint32 `json:"version"`
+	MasterKeyID string `json:"master_key_id"`
+	Wrapped     []byte `json:"wrapped"`
+	CreatedAt   int64  `json:"created_at"`
+	// Scoped marks a key wrapped under the scope key of its scope as well as
+	// the master key, from the moment it was created.
+	Scoped bool `json:"scoped,omitempty"`
+}
+
+// tenantUsage is what a tenant stores. It is derived from the records it
+// counts and kept current by applyMetaOp, so replaying the txlog keeps it
+// current too; checkpoint images persist it so loading needs no recount.
+type tenantUsage struct {
+	LogicalBytes  int64 `json:"logical_bytes,omitempty"`
+	PhysicalBytes int64 `json:"physical_bytes,omitempty"`
+	Objects       int64 `json:"objects,omitempty"`
+}
+
+// lifecycleRule is the persisted form of LifecycleRule. Durations are in
+// nanoseconds.
+type lifecycleRule struct {
+	ID                    string `json:"id,omitempty"`
+	Prefix                string `json:"prefix,omitempty"`
+	ExpireAfter           int64  `json:"expire_after,omitempty"`
+	NoncurrentExpireAfter int64  `json:"noncurrent_expire_after,omitempty"`
+	AbortSessionsAfter    int64  `json:"abort_sessions_after,omitempty"`
+}
+
+// versionHistory lists the noncurrent versions and delete markers of one
+// path, oldest first. The current version is the live inode at the path.
+type versionHistory struct {
+	TenantID string          `json:"tenant_id"`
+	Path     string          `json:"path"`
+	Versions []objectVersion `json:"versions,omitempty"`
+}
+
+// objectVersion is a replaced file or a delete marker. A version that is not a
+// delete marker holds one reference on its manifest.
+type objectVersion struct {
+	VersionID    uint64            `json:"version_id"`
+	DeleteMarker bool              `json:"delete_marker,omitempty"`
+	Size         int64             `json:"size,omitempty"`
+	FileHash     string            `json:"file_hash,omitempty"`
+	ManifestID   string            `json:"manifest_id,omitempty"`
+	Options      map[string]string `json:"options,omitempty"`
+	Mode         uint32            `json:"mode,omitempty"`
+	MTime        int64             `json:"mtime,omitempty"`
+	NoncurrentAt int64             `json:"noncurrent_at"`
+}
+
 type gcMetadata struct {
 	TotalRuns int64   `json:"total_runs"`
 	LastEpoch int64   `json:"last_epoch"`
@@ -161,11 +306,30 @@ type metadata struct {
 	Manifests      map[string]*manifestRecord   `json:"manifests"`
 	Chunks         map[string]*chunkRecord      `json:"chunks"`
 	Segments       map[string]*segmentRecord    `json:"segments"`
+	Snapshots      map[string]*snapshotRecord   `json:"snapshots,omitempty"`
+	TenantSettings map[string]*tenantSettings   `json:"tenant_settings,omitempty"`
+	Versions       map[string]*versionHistory   `json:"versions,omitempty"`
+	Trash          map[uint64]*trashEntry       `json:"trash,omitempty"`
+	Keyrings       map[string]*keyring          `json:"keyrings,omitempty"`
+	Usage          map[string]tenantUsage       `json:"-"`
 	GC             gcMetadata                   `json:"gc,omitempty"`
+	DeltaSeq       uint64                       `json:"delta_seq,omitempty"`
+	UpdatedAt      int64                        `json:"updated_at,omitempty"`
+
+	dirty *metaDirty
+	// usageStale marks Usage as uncounted because the checkpoint image it
+	// was loaded from predates persisted usage.
+	usageStale bool
+	// listIndex caches directory entries in list order for ListObjects.
+	listIndex *dirListIndex
+	// segmentChunks indexes chunk ids by segment so a delta checkpoint can
+	// compact a deleted segment's chunks. It is built on first use.
+	segmentChunks map[string]map[string]struct{}
 }
 
 type metaTx struct {
 	TxID uint64   `json:"txid"`
+	Time int64    `json:"time,omitempty"`
 	Ops  []metaOp `json:"ops"`
 }
 
@@ -180,10 +344,34 @@ type metaOp struct {
 	Chunk    *chunkRecord    `json:"chunk,omitempty"`
 	Segment  *segmentRecord  `json:"segment,omitempty"`
 	GCRun    *gcRun          `json:"gc_run,omitempty"`
+	Snapshot *snapshotRecord `json:"snapshot,omitempty"`
+	Settings *tenantSettings `json:"settings,omitempty"`
+	Versions *versionHistory `json:"versions,omitempty"`
+	Trash    *trashEntry     `json:"trash,omitempty"`
+	Keyring  *keyring        `json:"keyring,omitempty"`
+	Usage    *tenantUsage    `json:"usage,omitempty"`
 }
 
 type metadataLoadReport struct {
 	ReplayWarnings []metadataReplayWarning
+	BaseDeltaSeq   uint64
+	CheckpointTxID uint64
+	LogStartTxID   uint64
+	LogEndTxID     uint64
+	PrevLogs       []retainedLog
+	WatchEvents    []WatchEvent
+
+	CheckpointFallbacks []metadataCheckpointFallback
+	// UsageRecounted is set when usage had to be recounted because the
+	// checkpoint image did not persist it.
+	UsageRecounted bool
+}
+
+// metadataCheckpointFallback records a checkpoint image that could not be used
+// at load, so metadata was rebuilt from an older image and a longer replay.
+type metadataCheckpointFallback struct {
+	Path   string
+	Reason string
 }
 
 type metadataReplayWarning struct {
@@ -212,6 +400,13 @@ func newMetadata() *metadata {
 		Manifests:      map[string]*manifestRecord{},
 		Chunks:         map[string]*chunkRecord{},
 		Segments:       map[string]*segmentRecord{},
+		Snapshots:      map[string]*snapshotRecord{},
+		TenantSettings: map[string]*tenantSettings{},
+		Versions:       map[string]*versionHistory{},
+		Trash:          map[uint64]*trashEntry{},
+		Keyrings:       map[string]*keyring{},
+		Usage:          map[string]tenantUsage{},
+		listIndex:      newDirListIndex(),
 	}
 }
 
@@ -224,9 +419,19 @@ func loadMetadata(fs afero.Fs, metaDir string) (*metadata, string, metadataLoadR
 	if err := fs.MkdirAll(metaTxLogDir(metaDir), 0o755); err != nil {
 		return nil, "", metadataLoadReport{}, err
 	}
-	if err := loadMetaCheckpoint(fs, filepath.Join(metaDir, metaCheckpointFile), meta); err != nil {
+	var report metadataLoadReport
+	fallbacks, err := loadMetaCheckpoint(fs, metaDir, meta)
+	if err != nil {
+		return nil, "", metadataLoadReport{}, err
+	}
+	report.CheckpointFallbacks = fallbacks
+	baseDeltaSeq := meta.DeltaSeq
+	fallbacks, err = loadMetaDeltas(fs, metaDir, meta)
+	if err != nil {
 		return nil, "", metadataLoadReport{}, err
 	}
+	report.CheckpointFallbacks = append(report.CheckpointFallbacks, fallbacks...)
+	checkpointTxID := meta.TxID
 	super, err := loadMetaSuperBlock(fs, metaDir)
 	if err != nil {
 		return nil, "", metadataLoadReport{}, err
@@ -235,17 +440,119 @@ func loadMetadata(fs afero.Fs, metaDir string) (*metadata, string, metadataLoadR
 	if logFile == "" {
 		logFile = metaLogFile
 	}
-	report, err := replayMetaLog(fs, filepath.Join(metaTxLogDir(metaDir), logFile), meta)
+	generations, err := listMetaLogGenerations(fs, metaDir, logFile)
 	if err != nil {
 		return nil, "", metadataLoadReport{}, err
 	}
+	for _, name := range generations {
+		replay, err := replayMetaLog(fs, filepath.Join(metaTxLogDir(metaDir), name), meta)
+		if err != nil {
+			return nil, "", metadataLoadReport{}, checkpointFallbackError(report.CheckpointFallbacks, err)
+		}
+		report.ReplayWarnings = append(report.ReplayWarnings, replay.ReplayWarnings...)
+		report.WatchEvents = append(report.WatchEvents, replay.WatchEvents...)
+		if name == logFile {
+			report.LogStartTxID = replay.LogStartTxID
+		} else {
+			report.PrevLogs = append(report.PrevLogs, retainedLog{name: name, start: replay.LogStartTxID, end: replay.LogEndTxID})
+		}
+	}
+	if len(report.CheckpointFallbacks) > 0 && meta.TxID < super.CheckpointTxID {
+		return nil, "", metadataLoadReport{}, checkpointFallbackError(report.CheckpointFallbacks,
+			fmt.Errorf("metadata recovers only to tx %d of %d", meta.TxID, super.CheckpointTxID))
+	}
 	recoverInProgressMetadata(meta)
+	report.UsageRecounted = meta.usageStale
 	recomputeMetaCounters(meta)
+	report.BaseDeltaSeq = baseDeltaSeq
+	report.CheckpointTxID = checkpointTxID
 	return meta, logFile, report, nil
 }
 
-func loadMetaCheckpoint(fs afero.Fs, path string, meta *metadata) error {
+func checkpointFallbackError(fallbacks []metadataCheckpointFallback, err error) error {
+	if len(fallbacks) == 0 {
+		return err
+	}
+	return fmt.Errorf("%w after checkpoint fallback: %s", err, fallbacks[0].Reason)
+}
+
+// listMetaLogGenerations returns the txlog generations up to and including
+// the active one, oldest first. The generation before the active one is kept
+// until the next checkpoint so a damaged newest checkpoint can be rebuilt
+// from the previous one.
+func listMetaLogGenerations(fs afero.Fs, metaDir, active string) ([]string, error) {
+	entries, err := afero.ReadDir(fs, metaTxLogDir(metaDir))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	activeSeq := metaLogSeq(active)
+	var names []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || name == active {
+			continue
+		}
+		if seq := metaLogSeq(name); seq > 0 && seq < activeSeq {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool { return metaLogSeq(names[i]) < metaLogSeq(names[j]) })
+	return append(names, active), nil
+}
+
+func metaLogSeq(name string) int {
+	if !strings.HasSuffix(name, ".log") {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(name, ".log"))
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// loadMetaCheckpoint prefers the binary checkpoint and falls back to a
+// format 2 JSON checkpoint left by an older store. A binary checkpoint that
+// is unreadable or fails verification is replaced by the previous one, and
+// the fallback is returned for reporting.
+func loadMetaCheckpoint(fs afero.Fs, metaDir string, meta *metadata) ([]metadataCheckpointFallback, error) {
+	path := filepath.Join(metaDir, metaCheckpointFile)
 	data, err := afero.ReadFile(fs, path)
+	if err == nil {
+		if err = decodeMetaCheckpoint(data, meta); err == nil {
+			return nil, nil
+		}
+		err = fmt.Errorf("%s: %w", metaCheckpointFile, err)
+	}
+	var reason string
+	prevExists, _ := afero.Exists(fs, filepath.Join(metaDir, metaPrevCheckpointFile))
+	switch {
+	case !os.IsNotExist(err):
+		reason = err.Error()
+	case prevExists:
+		// The process stopped while the checkpoint was being replaced.
+		reason = metaCheckpointFile + " missing"
+		err = nil
+	default:
+		return nil, loadLegacyMetaCheckpoint(fs, metaDir, meta)
+	}
+	prevData, prevErr := afero.ReadFile(fs, filepath.Join(metaDir, metaPrevCheckpointFile))
+	prev := newMetadata()
+	if prevErr == nil {
+		prevErr = decodeMetaCheckpoint(prevData, prev)
+	}
+	if prevErr != nil {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%s: %w", metaPrevCheckpointFile, prevErr)
+	}
+	*meta = *prev
+	return []metadataCheckpointFallback{{Path: path, Reason: reason + "; loaded " + metaPrevCheckpointFile}}, nil
+}
+
+func loadLegacyMetaCheckpoint(fs afero.Fs, metaDir string, meta *metadata) error {
+	data, err := afero.ReadFile(fs, filepath.Join(metaDir, metaLegacyCheckpointFile))
 	if os.IsNotExist(err) {
 		return nil
 	}
@@ -256,10 +563,50 @@ func loadMetaCheckpoint(fs afero.Fs, path string, meta *metadata) error {
 		return err
 	}
 	ensureMetaMaps(meta)
+	meta.usageStale = true
 	return nil
 }
 
 func replayMetaLog(fs afero.Fs, path string, meta *metadata) (metadataLoadReport, error) {
+	start := meta.TxID
+	end := uint64(0)
+	first := true
+	var events []WatchEvent
+	report, err := scanMetaLog(fs, path, func(tx metaTx) (bool, error) {
+		if first {
+			first = false
+			if tx.TxID > 0 && tx.TxID-1 < start {
+				start = tx.TxID - 1
+			}
+		}
+		end = tx.TxID
+		if tx.TxID > meta.TxID+1 {
+			return false, fmt.Errorf("metadata log %s skips from tx %d to tx %d", filepath.Base(path), meta.TxID, tx.TxID)
+		}
+		if tx.TxID > meta.TxID {
+			events = append(events, applyMetaTxWatched(meta, tx)...)
+			if len(events) > 2*watchHistoryLimit {
+				events, _ = trimWatchHistory(events, 0)
+			}
+		}
+		return true, nil
+	})
+	if first {
+		start = meta.TxID
+	}
+	if end < start {
+		end = start
+	}
+	report.LogStartTxID = start
+	report.LogEndTxID = end
+	report.WatchEvents = events
+	return report, err
+}
+
+// scanMetaLog decodes complete frames from one txlog generation in order and
+// passes them to visit until it returns false. A torn tail is reported as a
+// warning, matching crash recovery.
+func scanMetaLog(fs afero.Fs, path string, visit func(tx metaTx) (bool, error)) (metadataLoadReport, error) {
 	var report metadataLoadReport
 	file, err := fs.Open(path)
 	if os.IsNotExist(err) {
@@ -288,7 +635,8 @@ func replayMetaLog(fs afero.Fs, path string, meta *metadata) (metadataLoadReport
 			}
 			return report, err
 		}
-		if binary.LittleEndian.Uint32(header[0:4]) != metaFrameMagic {
+		magic := binary.LittleEndian.Uint32(header[0:4])
+		if magic != metaFrameMagic && magic != metaLegacyFrameMagic {
 			return report, errors.New("invalid metadata log frame magic")
 		}
 		size := binary.LittleEndian.Uint32(header[4:8])
@@ -314,35 +662,65 @@ func replayMetaLog(fs afero.Fs, path string, meta *metadata) (metadataLoadReport
 		if crc32.ChecksumIEEE(payload) != wantCRC {
 			return report, errors.New("metadata log frame checksum mismatch")
 		}
-		var tx metaTx
-		if err := json.Unmarshal(payload, &tx); err != nil {
+		tx, err := decodeMetaFramePayload(magic, payload)
+		if err != nil {
 			return report, err
 		}
-		if tx.TxID <= meta.TxID {
-			offset += int64(size)
-			continue
+		more, err := visit(tx)
+		if err != nil || !more {
+			return report, err
 		}
-		applyMetaTx(meta, tx)
 		offset += int64(size)
 	}
 }
 
 func writeMetaTx(file afero.File, tx metaTx) error {
+	frame, err := encodeMetaFrame(tx)
+	if err != nil {
+		return err
+	}
+	return writeMetaFrames(file, [][]byte{frame})
+}
+
+func encodeMetaFrame(tx metaTx) ([]byte, error) {
+	payload := encodeMetaTxBinary(tx)
+	if len(payload) == 0 {
+		return nil, errors.New("empty metadata transaction")
+	}
+	frame := make([]byte, 12+len(payload))
+	binary.LittleEndian.PutUint32(frame[0:4], metaFrameMagic)
+	binary.LittleEndian.PutUint32(frame[4:8], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(frame[8:12], crc32.ChecksumIEEE(payload))
+	copy(frame[12:], payload)
+	return frame, nil
+}
+
+// decodeMetaFramePayload decodes a frame written by either format. A log that
+// was open during an upgrade holds JSON frames followed by binary ones.
+func decodeMetaFramePayload(magic uint32, payload []byte) (metaTx, error) {
+	if magic == metaLegacyFrameMagic {
+		var tx metaTx
+		err := json.Unmarshal(payload, &tx)
+		return tx, err
+	}
+	return decodeMetaTxBinary(payload)
+}
+
+// writeMetaFrames appends already encoded transaction frames and makes them
+// durable with one sync. Each frame stays a separate transaction on replay.
+func writeMetaFrames(file afero.File, frames [][]byte) error {
 	if file == nil {
 		return errMetadataLogClosed
 	}
-	payload, err := json.Marshal(tx)
-	if err != nil {
-		return err
+	size := 0
+	for _, frame := range frames {
+		size += len(frame)
 	}
-	var header [12]byte
-	binary.LittleEndian.PutUint32(header[0:4], metaFrameMagic)
-	binary.LittleEndian.PutUint32(header[4:8], uint32(len(payload)))
-	binary.LittleEndian.PutUint32(header[8:12], crc32.ChecksumIEEE(payload))
-	if _, err := file.Write(header[:]); err != nil {
-		return err
+	buf := make([]byte, 0, size)
+	for _, frame := range frames {
+		buf = append(buf, frame...)
 	}
-	if _, err := file.Write(payload); err != nil {
+	if _, err := file.Write(buf); err != nil {
 		return err
 	}
 	return file.Sync()
@@ -355,9 +733,13 @@ func applyMetaTx(meta *metadata, tx metaTx) {
 	if tx.TxID > meta.TxID {
 		meta.TxID = tx.TxID
 	}
+	if tx.Time > meta.UpdatedAt {
+		meta.UpdatedAt = tx.Time
+	}
 }
 
 func applyMetaOp(meta *metadata, op metaOp) {
+	markMetaOpDirty(meta, op)
 	switch op.Type {
 	case "put_tenant":
 		meta.Tenants[op.TenantID] = op.ChildID
@@ -367,14 +749,20 @@ func applyMetaOp(meta *metadata, op metaOp) {
 		if op.Inode != nil {
 			inode := *op.Inode
 			inode.Options = copyOptions(inode.Options)
+			prev := meta.Inodes[inode.InodeID]
+			addUsage(meta, prev, -1)
 			meta.Inodes[inode.InodeID] = &inode
+			addUsage(meta, &inode, 1)
+			meta.putListInode(prev, &inode)
 		}
 	case "put_dirent":
+		meta.putListName(op.ParentID, op.Name, op.ChildID)
 		if meta.DirEntries[op.ParentID] == nil {
 			meta.DirEntries[op.ParentID] = map[string]uint64{}
 		}
 		meta.DirEntries[op.ParentID][op.Name] = op.ChildID
 	case "delete_dirent":
+		meta.deleteListName(op.ParentID, op.Name)
 		if entries := meta.DirEntries[op.ParentID]; entries != nil {
 			delete(entries, op.Name)
 			if len(entries) == 0 {
@@ -390,13 +778,59 @@ func applyMetaOp(meta *metadata, op metaOp) {
 	case "put_chunk":
 		if op.Chunk != nil {
 			chunk := *op.Chunk
-			meta.Chunks[chunk.ChunkID] = &chunk
+			addUsage(meta, meta.Chunks[chunk.ChunkID], -1)
+			setChunkRecord(meta, chunk.ChunkID, &chunk)
+			addUsage(meta, &chunk, 1)
 		}
 	case "put_segment":
 		if op.Segment != nil {
 			seg := *op.Segment
 			meta.Segments[seg.SegmentID] = &seg
 		}
+	case "put_snapshot":
+		if op.Snapshot != nil {
+			meta.Snapshots[snapshotKey(op.Snapshot.TenantID, op.Snapshot.Name)] = cloneSnapshot(op.Snapshot)
+		}
+	case "delete_snapshot":
+		delete(meta.Snapshots, snapshotKey(op.TenantID, op.Name))
+	case "put_tenant_settings":
+		if op.Settings != nil {
+			meta.TenantSettings[op.Settings.TenantID] = cloneTenantSettings(op.Settings.TenantID, op.Settings)
+		}
+	case "delete_tenant_settings":
+		delete(meta.TenantSettings, op.TenantID)
+	case "put_versions":
+		if op.Versions != nil {
+			key := versionKey(op.Versions.TenantID, op.Versions.Path)
+			addUsage(meta, meta.Versions[key], -1)
+			meta.Versions[key] = cloneVersionHistory(op.Versions)
+			addUsage(meta, meta.Versions[key], 1)
+		}
+	case "delete_versions":
+		key := versionKey(op.TenantID, op.Name)
+		addUsage(meta, meta.Versions[key], -1)
+		delete(meta.Versions, key)
+	case "put_trash":
+		if op.Trash != nil {
+			entry := *op.Trash
+			meta.Trash[entry.InodeID] = &entry
+		}
+	case "delete_trash":
+		delete(meta.Trash, op.ChildID)
+	case "put_keyring":
+		if op.Keyring != nil {
+			meta.Keyrings[op.Keyring.Scope] = cloneKeyring(op.Keyring)
+		}
+	case "delete_keyring":
+		delete(meta.Keyrings, op.TenantID)
+	case "put_usage":
+		if op.Usage != nil {
+			if *op.Usage == (tenantUsage{}) {
+				delete(meta.Usage, op.TenantID)
+			} else {
+				meta.Usage[op.TenantID] = *op.Usage
+			}
+		}
 	case "append_gcrun":
 		if op.GCRun != nil {
 			meta.GC.TotalRuns++
@@ -468,6 +902,9 @@ func recomputeMetaCounters(meta *metadata) {
 		meta.NextGCEpoch = meta.GC.LastEpoch + 1
 	}
 	trimRecentGCRuns(meta)
+	if meta.usageStale {
+		rebuildUsage(meta)
+	}
 }
 
 func ensureMetaMaps(meta *metadata) {
@@ -480,6 +917,9 @@ func ensureMetaMaps(meta *metadata) {
 	if meta.DirEntries == nil {
 		meta.DirEntries = map[uint64]map[string]uint64{}
 	}
+	if meta.listIndex == nil {
+		meta.listIndex = newDirListIndex()
+	}
 	if meta.Manifests == nil {
 		meta.Manifests = map[string]*manifestRecord{}
 	}
@@ -489,6 +929,24 @@ func ensureMetaMaps(meta *metadata) {
 	if meta.Segments == nil {
 		meta.Segments = map[string]*segmentRecord{}
 	}
+	if meta.Snapshots == nil {
+		meta.Snapshots = map[string]*snapshotRecord{}
+	}
+	if meta.TenantSettings == nil {
+		meta.TenantSettings = map[string]*tenantSettings{}
+	}
+	if meta.Versions == nil {
+		meta.Versions = map[string]*versionHistory{}
+	}
+	if meta.Trash == nil {
+		meta.Trash = map[uint64]*trashEntry{}
+	}
+	if meta.Keyrings == nil {
+		meta.Keyrings = map[string]*keyring{}
+	}
+	if meta.Usage == nil {
+		meta.Usage = map[string]tenantUsage{}
+	}
 }
 
 func recoverInProgressMetadata(meta *metadata) {
@@ -499,12 +957,63 @@ func recoverInProgressMetadata(meta *metadata) {
 	}
 }
 
-func saveMetaCheckpoint(fs afero.Fs, metaDir string, meta *metadata) error {
-	data, err := json.Marshal(meta)
+// saveMetaCheckpoint writes a full base image. With archive set the image is
+// also kept as a retained restore point.
+// saveMetaCheckpoint writes a new base image and keeps the one it replaces
+// as the previous checkpoint. The new image is read back and verified before
+// the current one moves aside; a current image that fails verification is
+// overwritten rather than replacing a good previous checkpoint.
+func saveMetaCheckpoint(fs afero.Fs, metaDir string, meta *metadata, archive bool) error {
+	data := encodeMetaCheckpoint(meta)
+	if archive {
+		path := metaRetainedPath(metaDir, retainedImageName(meta.TxID, meta.UpdatedAt))
+		if err := writeFileAtomicSync(fs, path, data, 0o600); err != nil {
+			return err
+		}
+	}
+	path := filepath.Join(metaDir, metaCheckpointFile)
+	next := path + ".next"
+	if err := writeMetaImageVerified(fs, next, data, metaCheckpointMagic); err != nil {
+		return err
+	}
+	current, err := afero.ReadFile(fs, path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		if _, _, verifyErr := verifyMetaImage(current, metaCheckpointMagic); verifyErr == nil {
+			if err := fs.Rename(path, filepath.Join(metaDir, metaPrevCheckpointFile)); err != nil {
+				return err
+			}
+		}
+	}
+	return fs.Rename(next, path)
+}
+
+// writeMetaImageVerified writes a checkpoint image and reads it back to check
+// its footer before anything depends on it.
+func writeMetaImageVerified(fs afero.Fs, path string, data []byte, magic string) error {
+	if err := writeFileAtomicSync(fs, path, data, 0o600); err != nil {
+		return err
+	}
+	written, err := afero.ReadFile(fs, path)
 	if err != nil {
 		return err
 	}
-	return writeFileAtomicSync(fs, filepath.Join(metaDir, metaCheckpointFile), data, 0o600)
+	if _, _, err := verifyMetaImage(written, magic); err != nil {
+		return fmt.Errorf("verify %s: %w", filepath.Base(path), err)
+	}
+	return nil
+}
+
+// removeLegacyMetaCheckpoint drops a format 2 checkpoint once a binary
+// checkpoint and a superblock pointing past it are durable.
+func removeLegacyMetaCheckpoint(fs afero.Fs, metaDir string) error {
+	err := fs.Remove(filepath.Join(metaDir, metaLegacyCheckpointFile))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
 }
 
 func loadMetaSuperBlock(fs afero.Fs, metaDir string) (metaSuperBlock, error) {
@@ -545,7 +1054,7 @@ func decodeMetaSuperBlock(data []byte) (metaSuperBlock, error) {
 	if err := json.Unmarshal(data, &super); err != nil {
 		return metaSuperBlock{}, err
 	}
-	if super.FormatVersion != metaFormatVersion {
+	if super.FormatVersion != metaFormatVersion && super.FormatVersion != metaLegacyFormatVersion {
 		return metaSuperBlock{}, errors.New("unsupported metadata superblock version")
 	}
 	if super.LogFile == "" || filepath.Base(super.LogFile) != super.LogFile || !strings.HasSuffix(super.LogFile, ".log") {
@@ -607,11 +1116,18 @@ func trimRecentGCRuns(meta *metadata) {
 	}
 }
 
+// compactMetadata drops every record that reached the end of its life. It
+// scans the whole namespace, so it runs only for full base images and the
+// background merge; delta checkpoints use compactDirtyMetadata.
 func compactMetadata(meta *metadata) {
 	ensureMetaMaps(meta)
 	for parentID := range meta.DirEntries {
 		inode := meta.Inodes[parentID]
 		if inode == nil || inode.State != fileStateActive || inode.Kind != fileKindDir {
+			for name := range meta.DirEntries[parentID] {
+				meta.dirtySet().markDirEntry(parentID, name)
+			}
+			meta.dropListIndex(parentID)
 			delete(meta.DirEntries, parentID)
 		}
 	}
@@ -631,6 +1147,7 @@ func compactMetadata(meta *metadata) {
 	}
 	for id, inode := range meta.Inodes {
 		if inode == nil || (inode.State == fileStateDeleted && !referencedInodes[id]) {
+			meta.dirtySet().inodes[id] = struct{}{}
 			delete(meta.Inodes, id)
 		}
 	}
@@ -643,19 +1160,22 @@ func compactMetadata(meta *metadata) {
 	}
 	for id, manifest := range meta.Manifests {
 		if manifest == nil || (manifest.State == manifestStateDeleted && manifest.RefCount <= 0 && !activeManifestRefs[id]) {
+			meta.dirtySet().manifests[id] = struct{}{}
 			delete(meta.Manifests, id)
 		}
 	}
 
 	for id, chunk := range meta.Chunks {
 		if chunk == nil {
-			delete(meta.Chunks, id)
+			meta.dirtySet().chunks[id] = struct{}{}
+			setChunkRecord(meta, id, nil)
 			continue
 		}
 		if chunk.State == chunkStateDeleted && chunk.RefCount <= 0 {
 			seg := meta.Segments[chunk.SegmentID]
 			if seg == nil || seg.State == segmentStateDeleted {
-				delete(meta.Chunks, id)
+				meta.dirtySet().chunks[id] = struct{}{}
+				setChunkRecord(meta, id, nil)
 			}
 		}
 	}
@@ -667,12 +1187,175 @@ func compactMetadata(meta *metadata) {
 	}
 	for id, seg := range meta.Segments {
 		if seg == nil || (seg.State == segmentStateDeleted && !segmentRefs[id]) {
+			meta.dirtySet().segments[id] = struct{}{}
 			delete(meta.Segments, id)
 		}
 	}
 	trimRecentGCRuns(meta)
 }
 
+// compactDirtyMetadata drops the records compactMetadata would drop among
+// those changed since the last checkpoint and the records they release: the
+// entries of a removed directory, the manifest of a dropped inode and the
+// chunks of a deleted segment. It costs time proportional to the change set.
+// A record whose release no dirty record reveals, such as a deleted inode
+// whose dirent is removed in a later checkpoint, stays until the background
+// merge compacts the base image and the store is reopened from it.
+func compactDirtyMetadata(meta *metadata) {
+	dirty := meta.dirty
+	if dirty == nil {
+		return
+	}
+	ensureMetaMaps(meta)
+	inodes := make(map[uint64]struct{}, len(dirty.inodes))
+	parents := make(map[uint64]struct{}, len(dirty.inodes)+len(dirty.dirents))
+	for id := range dirty.inodes {
+		inodes[id] = struct{}{}
+		parents[id] = struct{}{}
+	}
+	for id := range dirty.dirents {
+		parents[id] = struct{}{}
+	}
+	for parentID := range parents {
+		entries := meta.DirEntries[parentID]
+		if entries == nil {
+			continue
+		}
+		if inode := meta.Inodes[parentID]; inode != nil && inode.State == fileStateActive && inode.Kind == fileKindDir {
+			continue
+		}
+		for name, childID := range entries {
+			dirty.markDirEntry(parentID, name)
+			inodes[childID] = struct{}{}
+		}
+		meta.dropListIndex(parentID)
+		delete(meta.DirEntries, parentID)
+	}
+
+	manifests := make(map[string]struct{}, len(dirty.manifests))
+	for id := range dirty.manifests {
+		manifests[id] = struct{}{}
+	}
+	for id := range inodes {
+		inode, ok := meta.Inodes[id]
+		if !ok || (inode != nil && (inode.State != fileStateDeleted || inodeReferenced(meta, inode))) {
+			continue
+		}
+		if inode != nil && inode.ManifestID != "" {
+			manifests[inode.ManifestID] = struct{}{}
+		}
+		dirty.inodes[id] = struct{}{}
+		delete(meta.Inodes, id)
+	}
+	// RefCount counts every file and version holding a manifest, so a
+	// deleted manifest at zero has no readers left.
+	for id := range manifests {
+		manifest, ok := meta.Manifests[id]
+		if !ok || (manifest != nil && (manifest.State != manifestStateDeleted || manifest.RefCount > 0)) {
+			continue
+		}
+		dirty.manifests[id] = struct{}{}
+		delete(meta.Manifests, id)
+	}
+
+	chunks := make(map[string]struct{}, len(dirty.chunks))
+	for id := range dirty.chunks {
+		chunks[id] = struct{}{}
+	}
+	segments := make(map[string]struct{}, len(dirty.segments))
+	for id := range dirty.segments {
+		segments[id] = struct{}{}
+		if seg := meta.Segments[id]; seg == nil || seg.State == segmentStateDeleted {
+			for chunkID := range meta.chunksInSegment(id) {
+				chunks[chunkID] = struct{}{}
+			}
+		}
+	}
+	for id := range chunks {
+		chunk, ok := meta.Chunks[id]
+		if !ok {
+			continue
+		}
+		if chunk != nil {
+			if chunk.State != chunkStateDeleted || chunk.RefCount > 0 {
+				continue
+			}
+			if seg := meta.Segments[chunk.SegmentID]; seg != nil && seg.State != segmentStateDeleted {
+				continue
+			}
+			segments[chunk.SegmentID] = struct{}{}
+		}
+		dirty.chunks[id] = struct{}{}
+		setChunkRecord(meta, id, nil)
+	}
+	for id := range segments {
+		seg, ok := meta.Segments[id]
+		if !ok || (seg != nil && (seg.State != segmentStateDeleted || len(meta.chunksInSegment(id)) > 0)) {
+			continue
+		}
+		dirty.segments[id] = struct{}{}
+		delete(meta.Segments, id)
+	}
+	trimRecentGCRuns(meta)
+}
+
+// inodeReferenced reports whether a tenant root or a dirent may still name
+// inode. A hard-linked inode may sit under other parents too, so it counts as
+// referenced and is left to the full compaction.
+func inodeReferenced(meta *metadata, inode *inodeRecord) bool {
+	if meta.Tenants[inode.TenantID] == inode.InodeID {
+		return true
+	}
+	if meta.DirEntries[inode.ParentInode][inode.Name] == inode.InodeID {
+		return true
+	}
+	return inode.Nlink > 1
+}
+
+// setChunkRecord stores chunk under id, or removes id when chunk is nil, and
+// keeps the segment index in step.
+func setChunkRecord(meta *metadata, id string, chunk *chunkRecord) {
+	if meta.segmentChunks != nil {
+		if prev := meta.Chunks[id]; prev != nil {
+			if ids := meta.segmentChunks[prev.SegmentID]; ids != nil {
+				delete(ids, id)
+				if len(ids) == 0 {
+					delete(meta.segmentChunks, prev.SegmentID)
+				}
+			}
+		}
+		if chunk != nil {
+			if meta.segmentChunks[chunk.SegmentID] == nil {
+				meta.segmentChunks[chunk.SegmentID] = map[string]struct{}{}
+			}
+			meta.segmentChunks[chunk.SegmentID][id] = struct{}{}
+		}
+	}
+	if chunk == nil {
+		delete(meta.Chunks, id)
+		return
+	}
+	meta.Chunks[id] = chunk
+}
+
+// chunksInSegment returns the ids of the chunks stored in segmentID. The
+// returned set is live and must not be modified.
+func (meta *metadata) chunksInSegment(segmentID string) map[string]struct{} {
+	if meta.segmentChunks == nil {
+		meta.segmentChunks = map[string]map[string]struct{}{}
+		for id, chunk := range meta.Chunks {
+			if chunk == nil {
+				continue
+			}
+			if meta.segmentChunks[chunk.SegmentID] == nil {
+				meta.segmentChunks[chunk.SegmentID] = map[string]struct{}{}
+			}
+			meta.segmentChunks[chunk.SegmentID][id] = struct{}{}
+		}
+	}
+	return meta.segmentChunks[segmentID]
+}
+
 func writeFileSync(fs afero.Fs, path string, data []byte, perm os.FileMode) error {
 	if err := fs.MkdirAll(filepath.Dir(path), 0o755); err != nil {
 		return err
@@ -0,0 +1,530 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+// openSegment is the store-wide segment Puts append their chunks to. It is
+// written in data/staging and published under data/segments by the first
+// sync that makes records in it durable, so no commit can reference it
+// before it is in place. Metadata tracks it as OPEN with WriteOffset
+// covering only the records of committed Puts. Once full, idle, or at Close
+// it is retired, and once the last Put writing to it is done it is sealed
+// by the background sealer, or removed when no commit references it.
+type openSegment struct {
+	record     segmentRecord
+	file       afero.File
+	syncMu     sync.Mutex
+	synced     int64
+	syncErr    error
+	published  bool
+	keep       bool
+	writers    int
+	retired    bool
+	lastAppend time.Time
+	idle       *time.Timer
+}
+
+// appendOpenSegment writes raw as a record of the open segment and leases
+// the segment to prepared until releaseOpenSegments.
+func (s *Store) appendOpenSegment(prepared *preparedObject, compression compressionSettings, sealer *chunkCipher, scopeID, chunkID string, raw []byte) (chunkRecord, error) {
+	record, chunk, err := buildChunkRecord(compression, sealer, scopeID, chunkID, raw)
+	if err != nil {
+		return chunkRecord{}, err
+	}
+	recordLen := int64(len(record))
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	seg := s.openSeg
+	if seg != nil && seg.record.WriteOffset > int64(len(segmentHeaderMagic)) && seg.record.WriteOffset+recordLen > s.cfg.SegmentSize {
+		s.queueSealLocked(s.retireOpenSegmentLocked())
+		seg = nil
+	}
+	if seg == nil {
+		if seg, err = s.createOpenSegmentLocked(); err != nil {
+			return chunkRecord{}, err
+		}
+	}
+	if !slices.Contains(prepared.open, seg) {
+		seg.writers++
+		prepared.open = append(prepared.open, seg)
+	}
+	if _, err := seg.file.Write(record); err != nil {
+		// A partial record would misplace every later one.
+		s.retireOpenSegmentLocked()
+		return chunkRecord{}, err
+	}
+	chunk.SegmentID = seg.record.SegmentID
+	chunk.SegmentOffset = seg.record.WriteOffset
+	seg.record.WriteOffset += recordLen
+	seg.record.TotalBytes += recordLen
+	seg.lastAppend = time.Now()
+	return chunk, nil
+}
+
+// createOpenSegmentLocked starts a new open segment in data/staging.
+func (s *Store) createOpenSegmentLocked() (*openSegment, error) {
+	record := s.newSegmentRecord()
+	record.State = segmentStateOpen
+	stagingPath := s.stagingSegmentPath(record)
+	if err := s.fs.MkdirAll(filepath.Dir(stagingPath), 0o700); err != nil {
+		return nil, err
+	}
+	file, err := s.fs.OpenFile(stagingPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := file.Write([]byte(segmentHeaderMagic)); err != nil {
+		return nil, errors.Join(err, file.Close(), s.fs.Remove(stagingPath))
+	}
+	seg := &openSegment{record: *record, file: file, lastAppend: time.Now()}
+	if timeout := s.cfg.SegmentIdleTimeout; timeout > 0 {
+		seg.idle = time.AfterFunc(timeout, func() { s.sealIdleSegment(seg) })
+	}
+	s.openSeg = seg
+	s.openPaths[s.segmentPath(record)] = true
+	return seg, nil
+}
+
+// retireOpenSegmentLocked stops appends to the open segment. It returns the
+// segment when no Put writes to it any more, in which case the caller hands
+// it on for sealing.
+func (s *Store) retireOpenSegmentLocked() *openSegment {
+	seg := s.openSeg
+	if seg == nil {
+		return nil
+	}
+	s.openSeg = nil
+	seg.retired = true
+	if seg.idle != nil {
+		seg.idle.Stop()
+	}
+	if seg.writers > 0 {
+		return nil
+	}
+	return seg
+}
+
+func (s *Store) sealIdleSegment(seg *openSegment) {
+	if s.beginOp(context.Background()) != nil {
+		return
+	}
+	defer s.endOp()
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if s.openSeg != seg {
+		return
+	}
+	if wait := s.cfg.SegmentIdleTimeout - time.Since(seg.lastAppend); wait > 0 {
+		seg.idle.Reset(wait)
+		return
+	}
+	s.queueSealLocked(s.retireOpenSegmentLocked())
+}
+
+// syncOpenSegments makes the records prepared appended durable and
+// publishes the segments holding them.
+func (s *Store) syncOpenSegments(prepared *preparedObject) error {
+	for _, seg := range prepared.open {
+		if err := s.syncOpenSegment(seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncOpenSegment makes every record appended to seg so far durable and, the
+// first time, renames seg from data/staging into data/segments. syncMu
+// serializes syncs of seg without holding openMu, so Puts keep appending
+// meanwhile and one sync covers every Put that appended before it. After a
+// failed sync nothing unsynced in the segment can be trusted, so every later
+// sync of it fails.
+func (s *Store) syncOpenSegment(seg *openSegment) error {
+	seg.syncMu.Lock()
+	defer seg.syncMu.Unlock()
+	s.openMu.Lock()
+	end, synced, published, err := seg.record.WriteOffset, seg.synced, seg.published, seg.syncErr
+	s.openMu.Unlock()
+	if err != nil {
+		return err
+	}
+	if synced >= end && published {
+		return nil
+	}
+	err = seg.file.Sync()
+	if err == nil && !published {
+		err = s.publishOpenSegment(seg)
+	}
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	if err != nil {
+		seg.syncErr = err
+		if s.openSeg == seg {
+			s.retireOpenSegmentLocked()
+		}
+		return err
+	}
+	seg.synced = end
+	return nil
+}
+
+// publishOpenSegment moves a synced open segment from data/staging to its
+// final path. The directory entry is durable before it returns.
+func (s *Store) publishOpenSegment(seg *openSegment) error {
+	final := s.segmentPath(&seg.record)
+	if err := s.fs.MkdirAll(filepath.Dir(final), 0o755); err != nil {
+		return err
+	}
+	if err := s.fs.Rename(s.stagingSegmentPath(&seg.record), final); err != nil {
+		return err
+	}
+	s.openMu.Lock()
+	seg.published = true
+	s.openMu.Unlock()
+	return syncDir(s.fs, filepath.Dir(final))
+}
+
+// releaseOpenSegments drops the leases of prepared once it has committed or
+// its commit failed, handing retired segments nobody writes to any more to
+// the sealer. Errors are recorded for Health and Close.
+func (s *Store) releaseOpenSegments(prepared *preparedObject) {
+	if err := s.finishRetiredSegments(s.dropOpenLeases(prepared)); err != nil {
+		s.recordSealErr(err)
+	}
+}
+
+// abandonOpenSegments drops the leases of a Put that failed before
+// committing. Leased segments no commit references are retired so they are
+// removed instead of lingering; a removal that can happen now happens before
+// it returns, and its error is returned.
+func (s *Store) abandonOpenSegments(prepared *preparedObject) error {
+	var unreferenced []*openSegment
+	for _, seg := range prepared.open {
+		if !s.openSegmentReferenced(seg) {
+			unreferenced = append(unreferenced, seg)
+		}
+	}
+	s.openMu.Lock()
+	for _, seg := range unreferenced {
+		if s.openSeg == seg {
+			s.retireOpenSegmentLocked()
+		}
+	}
+	s.openMu.Unlock()
+	return s.finishRetiredSegments(s.dropOpenLeases(prepared))
+}
+
+// keepOpenSegments marks the segments prepared wrote to as possibly
+// referenced by a txlog frame whose commit failed ambiguously, so their
+// files are left for the next open to keep or remove.
+func (s *Store) keepOpenSegments(prepared *preparedObject) {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	for _, seg := range prepared.open {
+		seg.keep = true
+	}
+}
+
+// dropOpenLeases drops the leases of prepared and returns the retired
+// segments nobody writes to any more.
+func (s *Store) dropOpenLeases(prepared *preparedObject) []*openSegment {
+	var done []*openSegment
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	for _, seg := range prepared.open {
+		seg.writers--
+		if seg.writers == 0 && seg.retired {
+			done = append(done, seg)
+		}
+	}
+	prepared.open = nil
+	return done
+}
+
+// finishRetiredSegments queues retired segments a commit references for
+// sealing and removes the others.
+func (s *Store) finishRetiredSegments(segs []*openSegment) error {
+	var errs []error
+	for _, seg := range segs {
+		if s.openSegmentReferenced(seg) {
+			s.openMu.Lock()
+			s.queueSealLocked(seg)
+			s.openMu.Unlock()
+			continue
+		}
+		errs = append(errs, s.discardOpenSegment(seg))
+	}
+	return errors.Join(errs...)
+}
+
+func (s *Store) openSegmentReferenced(seg *openSegment) bool {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	return s.meta.Segments[seg.record.SegmentID] != nil
+}
+
+// discardOpenSegment closes a retired segment no commit references and
+// removes its file, wherever it is, unless keepOpenSegments kept it.
+func (s *Store) discardOpenSegment(seg *openSegment) error {
+	err := seg.file.Close()
+	final := s.segmentPath(&seg.record)
+	path := s.stagingSegmentPath(&seg.record)
+	if seg.published {
+		path = final
+	}
+	if !seg.keep {
+		if removeErr := s.fs.Remove(path); removeErr != nil && !errors.Is(removeErr, fs.ErrNotExist) {
+			err = errors.Join(err, fmt.Errorf("remove unpublished segment %s: %w", path, removeErr))
+		}
+	}
+	s.openMu.Lock()
+	delete(s.openPaths, final)
+	s.openMu.Unlock()
+	return err
+}
+
+// queueSealLocked hands a retired segment nobody writes to to the background
+// sealer, starting it when idle. While the store closes the segment waits in
+// the queue for Close.
+func (s *Store) queueSealLocked(seg *openSegment) {
+	if seg == nil {
+		return
+	}
+	s.sealQueue = append(s.sealQueue, seg)
+	if s.sealDone != nil {
+		return
+	}
+	s.lifeMu.Lock()
+	defer s.lifeMu.Unlock()
+	if s.closing {
+		return
+	}
+	s.bgWG.Add(1)
+	done := make(chan struct{})
+	s.sealDone = done
+	go func() {
+		defer s.bgWG.Done()
+		if err := s.drainSealQueue(done); err != nil {
+			s.recordSealErr(err)
+		}
+	}()
+}
+
+// drainSealQueue seals queued segments until the queue is empty, then closes
+// done to wake those waiting for the sealer.
+func (s *Store) drainSealQueue(done chan struct{}) error {
+	var errs []error
+	for {
+		s.openMu.Lock()
+		if len(s.sealQueue) == 0 {
+			s.sealDone = nil
+			close(done)
+			s.openMu.Unlock()
+			return errors.Join(errs...)
+		}
+		seg := s.sealQueue[0]
+		s.sealQueue = s.sealQueue[1:]
+		s.openMu.Unlock()
+		if err := s.sealOpenSegment(seg); err != nil {
+			errs = append(errs, err)
+		}
+	}
+}
+
+// recordSealErr keeps a failed seal for Health and Close. The segment stays
+// OPEN until the next open recovers it.
+func (s *Store) recordSealErr(err error) {
+	s.openMu.Lock()
+	s.lastSealErr = err
+	s.openMu.Unlock()
+}
+
+func (s *Store) sealErr() error {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	return s.lastSealErr
+}
+
+// sealActiveSegment retires the open segment and, before returning, seals it
+// and every other queued segment, waiting for the background sealer first.
+// A segment a Put still writes to is sealed once that Put is done.
+func (s *Store) sealActiveSegment() error {
+	return s.sealActiveSegmentIf(func(string, time.Time) bool { return true })
+}
+
+// sealActiveSegmentIf is sealActiveSegment, except that the open segment is
+// retired only when seal, called with its ID and last append time and
+// without openMu held, reports true. Queued segments are sealed either way.
+func (s *Store) sealActiveSegmentIf(seal func(segmentID string, lastAppend time.Time) bool) error {
+	s.openMu.Lock()
+	seg := s.openSeg
+	var segmentID string
+	var lastAppend time.Time
+	if seg != nil {
+		segmentID, lastAppend = seg.record.SegmentID, seg.lastAppend
+	}
+	s.openMu.Unlock()
+	retire := seg != nil && seal(segmentID, lastAppend)
+	s.openMu.Lock()
+	if retire && s.openSeg == seg {
+		if seg := s.retireOpenSegmentLocked(); seg != nil {
+			s.sealQueue = append(s.sealQueue, seg)
+		}
+	}
+	for s.sealDone != nil {
+		done := s.sealDone
+		s.openMu.Unlock()
+		<-done
+		s.openMu.Lock()
+	}
+	done := make(chan struct{})
+	s.sealDone = done
+	s.openMu.Unlock()
+	return s.drainSealQueue(done)
+}
+
+// sealOpenSegment seals a retired segment nobody writes to. The file is cut
+// back to the records commits published; a segment no commit references is
+// removed.
+func (s *Store) sealOpenSegment(seg *openSegment) error {
+	s.metaMu.RLock()
+	current := s.meta.Segments[seg.record.SegmentID]
+	published := int64(0)
+	if current != nil {
+		published = current.WriteOffset
+	}
+	s.metaMu.RUnlock()
+	if current == nil {
+		return s.discardOpenSegment(seg)
+	}
+	closeErr := seg.file.Close()
+	path := s.segmentPath(&seg.record)
+	defer func() {
+		s.openMu.Lock()
+		delete(s.openPaths, path)
+		s.openMu.Unlock()
+	}()
+	if err := truncateSegmentFile(s.fs, path, published); err != nil {
+		return errors.Join(closeErr, err)
+	}
+	// Parity is written before the seal commits, so every SEALED segment
+	// has it. A segment whose parity fails stays OPEN and is sealed again,
+	// parity first, when the store next opens.
+	if err := s.writeSegmentParity(&seg.record); err != nil {
+		return errors.Join(closeErr, err)
+	}
+	s.metaMu.Lock()
+	current = s.meta.Segments[seg.record.SegmentID]
+	if current == nil || current.State != segmentStateOpen {
+		s.metaMu.Unlock()
+		return closeErr
+	}
+	next := *current
+	next.State = segmentStateSealed
+	next.SealedAt = nowUnix()
+	err := s.commitMetaFinalLocked([]metaOp{{Type: "put_segment", Segment: &next}})
+	s.metaMu.Unlock()
+	return errors.Join(closeErr, err)
+}
+
+// isOpenSegmentPath reports whether path belongs to a segment Puts may still
+// publish records in, which metadata may not reference yet.
+func (s *Store) isOpenSegmentPath(path string) bool {
+	s.openMu.Lock()
+	defer s.openMu.Unlock()
+	return s.openPaths[path]
+}
+
+// openSegmentOpsLocked publishes the records prepared wrote to open
+// segments by raising their WriteOffset, taking earlier ops of the same
+// transaction into account.
+func (s *Store) openSegmentOpsLocked(prepared *preparedObject, ops []metaOp) []metaOp {
+	var added []metaOp
+	for _, seg := range prepared.open {
+		end := int64(0)
+		for chunkID, chunk := range prepared.chunks {
+			if !prepared.reusedChunks[chunkID] && chunk.SegmentID == seg.record.SegmentID {
+				end = max(end, chunk.SegmentOffset+chunk.SegmentLength)
+			}
+		}
+		current := s.meta.Segments[seg.record.SegmentID]
+		for _, op := range slices.Concat(ops, added) {
+			if op.Type == "put_segment" && op.Segment.SegmentID == seg.record.SegmentID {
+				current = op.Segment
+			}
+		}
+		if current != nil && current.WriteOffset >= end {
+			continue
+		}
+		next := segmentRecord{
+			SegmentID:    seg.record.SegmentID,
+			RelativePath: seg.record.RelativePath,
+			State:        segmentStateOpen,
+			CreatedAt:    seg.record.CreatedAt,
+		}
+		if current != nil {
+			next = *current
+		}
+		next.WriteOffset = end
+		next.TotalBytes = end - int64(len(segmentHeaderMagic))
+		added = append(added, metaOp{Type: "put_segment", Segment: &next})
+	}
+	return added
+}
+
+// sealRecoveredSegments seals the segments a crash left open, cutting off
+// the records no commit published.
+func (s *Store) sealRecoveredSegments() error {
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	ids := make([]string, 0)
+	for id, seg := range s.meta.Segments {
+		if seg != nil && seg.State == segmentStateOpen {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	now := nowUnix()
+	ops := make([]metaOp, 0, len(ids))
+	for _, id := range ids {
+		next := *s.meta.Segments[id]
+		if err := truncateSegmentFile(s.fs, s.segmentPath(&next), next.WriteOffset); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		if err := s.writeSegmentParity(&next); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		next.State = segmentStateSealed
+		next.SealedAt = now
+		ops = append(ops, metaOp{Type: "put_segment", Segment: &next})
+	}
+	return s.commitMetaLocked(ops)
+}
+
+// truncateSegmentFile shortens the file at path to size. A file that is
+// already no longer is left alone so missing data stays detectable.
+func truncateSegmentFile(fsys afero.Fs, path string, size int64) error {
+	info, err := fsys.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() <= size {
+		return nil
+	}
+	file, err := fsys.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	return errors.Join(file.Truncate(size), file.Sync(), file.Close())
+}
@@ -0,0 +1,266 @@
+package blobfs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestConcurrentPutsShareOpenSegment(t *testing.T) {
+	cfg := testConfig()
+	cfg.SegmentSize = 64 << 10
+	cfg.SegmentIdleTimeout = -1
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if _, err := store.Put(testContext(t), "tenant-a", fmt.Sprintf("f%02d", i), bytes.NewReader([]byte(fmt.Sprintf("small object %02d", i))), nil); err != nil {
+				t.Errorf("put %d: %v", i, err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	stats, err := store.Stats(testContext(t))
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.Segments.Open != 1 || stats.Segments.Sealed != 0 {
+		t.Fatalf("segments = %+v, want one open segment", stats.Segments)
+	}
+	for i := 0; i < 16; i++ {
+		if got := readTestBytes(t, store, "tenant-a", fmt.Sprintf("f%02d", i)); string(got) != fmt.Sprintf("small object %02d", i) {
+			t.Fatalf("f%02d = %q", i, got)
+		}
+	}
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	stats, err = store.Stats(testContext(t))
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	if stats.Segments.Open != 0 || stats.Segments.Sealed != 1 {
+		t.Fatalf("segments after seal = %+v", stats.Segments)
+	}
+}
+
+func TestOpenSegmentSealsWhenFullOrIdle(t *testing.T) {
+	cfg := testConfig()
+	cfg.SegmentSize = 400
+	cfg.SegmentIdleTimeout = 20 * time.Millisecond
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	for i := 0; i < 4; i++ {
+		putTestBytes(t, store, "tenant-a", fmt.Sprintf("f%d", i), bytes.Repeat([]byte{byte('a' + i)}, 24))
+	}
+	// Full segments are sealed in the background, the last one once idle.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats, err := store.Stats(testContext(t))
+		if err != nil {
+			t.Fatalf("stats: %v", err)
+		}
+		if stats.Segments.Open == 0 {
+			if stats.Segments.Sealed < 2 {
+				t.Fatalf("full segment was not rotated: %+v", stats.Segments)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("segments were not sealed: %+v", stats.Segments)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i := 0; i < 4; i++ {
+		if got := readTestBytes(t, store, "tenant-a", fmt.Sprintf("f%d", i)); !bytes.Equal(got, bytes.Repeat([]byte{byte('a' + i)}, 24)) {
+			t.Fatalf("f%d = %q", i, got)
+		}
+	}
+}
+
+func TestGCSealsOpenSegmentOnlyWhenItHoldsGarbage(t *testing.T) {
+	cfg := testConfig()
+	cfg.SegmentSize = 64 << 10
+	cfg.SegmentIdleTimeout = -1
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	segments := func() SegmentStats {
+		t.Helper()
+		stats, err := store.Stats(testContext(t))
+		if err != nil {
+			t.Fatalf("stats: %v", err)
+		}
+		return stats.Segments
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("first version of a"))
+	if _, err := store.RunGC(testContext(t), GCOptions{Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if got := segments(); got.Open != 1 || got.Sealed != 0 {
+		t.Fatalf("segments after gc without garbage = %+v", got)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("second version of a"))
+	if _, err := store.RunGC(testContext(t), GCOptions{Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if got := segments(); got.Open != 0 || got.Sealed != 1 {
+		t.Fatalf("segments after gc with garbage = %+v", got)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "a.txt"); string(got) != "second version of a" {
+		t.Fatalf("a.txt = %q", got)
+	}
+}
+
+func TestReopenTruncatesUnpublishedOpenSegmentTail(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	cfg := testConfig()
+	cfg.SegmentIdleTimeout = -1
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "kept", []byte("published before the crash"))
+	store.openMu.Lock()
+	seg := store.openSeg
+	path := store.segmentPath(&seg.record)
+	store.openMu.Unlock()
+	// Records of a Put that never committed.
+	if _, err := seg.file.Write(bytes.Repeat([]byte{0xee}, 300)); err != nil {
+		t.Fatalf("write tail: %v", err)
+	}
+	store.metaMu.RLock()
+	published := store.meta.Segments[seg.record.SegmentID].WriteOffset
+	store.metaMu.RUnlock()
+	simulateCrashWithoutCheckpoint(t, store)
+
+	reopened, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	info, err := fsys.Stat(path)
+	if err != nil {
+		t.Fatalf("stat segment: %v", err)
+	}
+	if info.Size() != published {
+		t.Fatalf("segment size = %d, want published %d", info.Size(), published)
+	}
+	reopened.metaMu.RLock()
+	state := reopened.meta.Segments[seg.record.SegmentID].State
+	reopened.metaMu.RUnlock()
+	if state != segmentStateSealed {
+		t.Fatalf("recovered segment state = %s", state)
+	}
+	if got := readTestBytes(t, reopened, "tenant-a", "kept"); string(got) != "published before the crash" {
+		t.Fatalf("kept = %q", got)
+	}
+}
+
+func TestPutsAppendWhileAnOpenSegmentSyncs(t *testing.T) {
+	fsys := &syncGateFS{Fs: afero.NewMemMapFs(), match: "/data/staging/"}
+	cfg := testConfig()
+	cfg.SegmentIdleTimeout = -1
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	fsys.gateNextSync()
+	blocked, release := fsys.blocked, fsys.release
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := store.Put(testContext(t), "tenant-a", "first", bytes.NewReader([]byte("first object")), nil)
+		firstErr <- err
+	}()
+	<-blocked
+	store.openMu.Lock()
+	seg := store.openSeg
+	before := seg.record.WriteOffset
+	store.openMu.Unlock()
+
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := store.Put(testContext(t), "tenant-a", "second", bytes.NewReader([]byte("second object")), nil)
+		secondErr <- err
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		store.openMu.Lock()
+		offset := seg.record.WriteOffset
+		store.openMu.Unlock()
+		if offset > before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("second put could not append while the segment synced")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	if err := <-firstErr; err != nil {
+		t.Fatalf("first put: %v", err)
+	}
+	if err := <-secondErr; err != nil {
+		t.Fatalf("second put: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "second"); string(got) != "second object" {
+		t.Fatalf("second = %q", got)
+	}
+	if files := countRegularFiles(t, fsys, "/blobfs/data/staging"); files != 0 {
+		t.Fatalf("published open segment left %d staging files", files)
+	}
+}
+
+func TestFailedBackgroundSealIsReportedByHealthAndClose(t *testing.T) {
+	fsys := &faultFS{Fs: afero.NewMemMapFs()}
+	cfg := testConfig()
+	cfg.SegmentIdleTimeout = 10 * time.Millisecond
+	cfg.Parity = ParityConfig{DataShards: 4, ParityShards: 2}
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	fsys.failRenamesContaining(filepath.Join("data", "parity"), 1)
+	putTestBytes(t, store, "tenant-a", "blob", []byte("sealed in the background"))
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		health, err := store.Health(testContext(t))
+		if err != nil {
+			t.Fatalf("health: %v", err)
+		}
+		if slices.ContainsFunc(health.Checks, func(check HealthCheck) bool {
+			return check.Name == "segment_seal" && !check.OK
+		}) {
+			if health.State != HealthDegraded {
+				t.Fatalf("health state = %s, want degraded", health.State)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("failed seal was not reported: %+v", health.Checks)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := store.Close(); !errors.Is(err, errInjectedFSFault) {
+		t.Fatalf("close = %v, want the seal fault", err)
+	}
+}
@@ -0,0 +1,347 @@
+package blobfs
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+const (
+	parityHeaderMagic  = "BLOBFSPAR1\n"
+	parityHeaderSize   = len(parityHeaderMagic) + 24
+	parityFileSuffix   = ".parity"
+	parityMaxShardSize = 64 << 10
+)
+
+// parityLayout describes a parity file. The segment is cut into stripes of
+// dataShards shards of shardSize bytes, the last one zero-padded; each
+// stripe has an entry with the CRC32C of every data and parity shard
+// followed by the parity shards.
+type parityLayout struct {
+	dataShards   int
+	parityShards int
+	shardSize    int64
+	segmentSize  int64
+}
+
+// shardRepair is a rebuilt data shard and where it belongs in the segment.
+type shardRepair struct {
+	offset int64
+	data   []byte
+}
+
+func newParityLayout(dataShards, parityShards int, segmentSize int64) parityLayout {
+	shardSize := (segmentSize + int64(dataShards) - 1) / int64(dataShards)
+	return parityLayout{
+		dataShards:   dataShards,
+		parityShards: parityShards,
+		shardSize:    min(max(shardSize, 1), parityMaxShardSize),
+		segmentSize:  segmentSize,
+	}
+}
+
+func (l parityLayout) stripeSize() int64 {
+	return int64(l.dataShards) * l.shardSize
+}
+
+func (l parityLayout) entrySize() int64 {
+	return int64(4*(l.dataShards+l.parityShards)) + int64(l.parityShards)*l.shardSize
+}
+
+func (l parityLayout) stripes() int64 {
+	return (l.segmentSize + l.stripeSize() - 1) / l.stripeSize()
+}
+
+func (l parityLayout) entryOffset(stripe int64) int64 {
+	return int64(parityHeaderSize) + stripe*l.entrySize()
+}
+
+func encodeParityHeader(l parityLayout) []byte {
+	header := make([]byte, parityHeaderSize)
+	n := copy(header, parityHeaderMagic)
+	binary.LittleEndian.PutUint32(header[n:], uint32(l.dataShards))
+	binary.LittleEndian.PutUint32(header[n+4:], uint32(l.parityShards))
+	binary.LittleEndian.PutUint32(header[n+8:], uint32(l.shardSize))
+	binary.LittleEndian.PutUint64(header[n+12:], uint64(l.segmentSize))
+	binary.LittleEndian.PutUint32(header[n+20:], crc32.Checksum(header[:n+20], crc32cTable))
+	return header
+}
+
+func readParityLayout(file io.ReaderAt) (parityLayout, error) {
+	header := make([]byte, parityHeaderSize)
+	if _, err := file.ReadAt(header, 0); err != nil {
+		return parityLayout{}, err
+	}
+	n := len(parityHeaderMagic)
+	if string(header[:n]) != parityHeaderMagic {
+		return parityLayout{}, errors.New("invalid parity file magic")
+	}
+	if crc32.Checksum(header[:n+20], crc32cTable) != binary.LittleEndian.Uint32(header[n+20:]) {
+		return parityLayout{}, errors.New("parity header crc32c mismatch")
+	}
+	l := parityLayout{
+		dataShards:   int(binary.LittleEndian.Uint32(header[n:])),
+		parityShards: int(binary.LittleEndian.Uint32(header[n+4:])),
+		shardSize:    int64(binary.LittleEndian.Uint32(header[n+8:])),
+		segmentSize:  int64(binary.LittleEndian.Uint64(header[n+12:])),
+	}
+	if l.dataShards <= 0 || l.parityShards <= 0 || l.dataShards+l.parityShards > 256 || l.shardSize <= 0 || l.segmentSize < 0 {
+		return parityLayout{}, errors.New("invalid parity layout")
+	}
+	return l, nil
+}
+
+func (s *Store) parityPath(seg *segmentRecord) string {
+	return filepath.Join(s.parityDir, seg.RelativePath+parityFileSuffix)
+}
+
+// paritySegmentPath returns the path of the segment a parity file, or a
+// parity file still being written, belongs to.
+func (s *Store) paritySegmentPath(path string) string {
+	rel, err := filepath.Rel(s.parityDir, path)
+	if err != nil {
+		return ""
+	}
+	rel = strings.TrimSuffix(strings.TrimSuffix(rel, ".tmp"), parityFileSuffix)
+	return filepath.Join(s.segmentsDir, rel)
+}
+
+// readShard reads data shard index of stripe into buf. Bytes past the end
+// of the segment, including those a truncated file lost, read as zeros.
+func readShard(file io.ReaderAt, l parityLayout, stripe int64, index int, buf []byte) error {
+	clear(buf)
+	start := stripe*l.stripeSize() + int64(index)*l.shardSize
+	if start >= l.segmentSize {
+		return nil
+	}
+	n := min(l.shardSize, l.segmentSize-start)
+	if _, err := file.ReadAt(buf[:n], start); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	return nil
+}
+
+// writeSegmentParity writes the parity file of a sealed segment when parity
+// is enabled. The file is written aside and renamed into place, so a parity
+// file is either complete or absent.
+func (s *Store) writeSegmentParity(seg *segmentRecord) error {
+	if s.cfg.Parity.ParityShards == 0 {
+		return nil
+	}
+	rs, err := newReedSolomon(s.cfg.Parity.DataShards, s.cfg.Parity.ParityShards)
+	if err != nil {
+		return err
+	}
+	src, err := s.fs.Open(s.segmentPath(seg))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return err
+	}
+	layout := newParityLayout(rs.dataShards, rs.parityShards, info.Size())
+	final := s.parityPath(seg)
+	tmp := final + ".tmp"
+	if err := s.fs.MkdirAll(filepath.Dir(final), 0o755); err != nil {
+		return err
+	}
+	dst, err := s.fs.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	fail := func(err error) error {
+		return errors.Join(err, dst.Close(), s.fs.Remove(tmp))
+	}
+	w := bufio.NewWriter(dst)
+	if _, err := w.Write(encodeParityHeader(layout)); err != nil {
+		return fail(err)
+	}
+	shards := make([][]byte, rs.dataShards+rs.parityShards)
+	for i := range shards {
+		shards[i] = make([]byte, layout.shardSize)
+	}
+	crcs := make([]byte, 4*len(shards))
+	for stripe := int64(0); stripe < layout.stripes(); stripe++ {
+		for d := 0; d < rs.dataShards; d++ {
+			if err := readShard(src, layout, stripe, d, shards[d]); err != nil {
+				return fail(err)
+			}
+		}
+		rs.encode(shards)
+		for i, shard := range shards {
+			binary.LittleEndian.PutUint32(crcs[4*i:], crc32.Checksum(shard, crc32cTable))
+		}
+		if _, err := w.Write(crcs); err != nil {
+			return fail(err)
+		}
+		for _, shard := range shards[rs.dataShards:] {
+			if _, err := w.Write(shard); err != nil {
+				return fail(err)
+			}
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return fail(err)
+	}
+	if err := errors.Join(dst.Sync(), dst.Close()); err != nil {
+		return errors.Join(err, s.fs.Remove(tmp))
+	}
+	if err := s.fs.Rename(tmp, final); err != nil {
+		return errors.Join(err, s.fs.Remove(tmp))
+	}
+	return syncDir(s.fs, filepath.Dir(final))
+}
+
+// removeSegmentParity removes the parity file of a segment, if it has one.
+func (s *Store) removeSegmentParity(seg *segmentRecord) error {
+	if err := s.fs.Remove(s.parityPath(seg)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// rebuildSegmentRange rebuilds the stripes covering length bytes at offset
+// of seg from its parity file. It returns the rebuilt range and the data
+// shards that were damaged; a damaged shard is one whose CRC32C no longer
+// matches the one recorded when the segment was sealed.
+func (s *Store) rebuildSegmentRange(seg segmentRecord, offset, length int64) ([]byte, []shardRepair, error) {
+	pf, err := s.fs.Open(s.parityPath(&seg))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer pf.Close()
+	layout, err := readParityLayout(pf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset < 0 || length <= 0 || offset+length > layout.segmentSize {
+		return nil, nil, errors.New("record lies outside the parity of its segment")
+	}
+	rs, err := newReedSolomon(layout.dataShards, layout.parityShards)
+	if err != nil {
+		return nil, nil, err
+	}
+	src, err := s.fs.Open(s.segmentPath(&seg))
+	if err != nil {
+		return nil, nil, err
+	}
+	defer src.Close()
+	first := offset / layout.stripeSize()
+	last := (offset + length - 1) / layout.stripeSize()
+	out := make([]byte, 0, (last-first+1)*layout.stripeSize())
+	var repairs []shardRepair
+	total := rs.dataShards + rs.parityShards
+	for stripe := first; stripe <= last; stripe++ {
+		entry := make([]byte, layout.entrySize())
+		if _, err := pf.ReadAt(entry, layout.entryOffset(stripe)); err != nil {
+			return nil, nil, fmt.Errorf("read parity of stripe %d: %w", stripe, err)
+		}
+		shards := make([][]byte, total)
+		valid := make([]bool, total)
+		for i := range shards {
+			if i < rs.dataShards {
+				shards[i] = make([]byte, layout.shardSize)
+				if err := readShard(src, layout, stripe, i, shards[i]); err != nil {
+					return nil, nil, err
+				}
+			} else {
+				start := int64(4*total) + int64(i-rs.dataShards)*layout.shardSize
+				shards[i] = entry[start : start+layout.shardSize]
+			}
+			valid[i] = crc32.Checksum(shards[i], crc32cTable) == binary.LittleEndian.Uint32(entry[4*i:])
+		}
+		if err := rs.reconstruct(shards, valid); err != nil {
+			return nil, nil, fmt.Errorf("stripe %d of segment %s: %w", stripe, seg.SegmentID, err)
+		}
+		for d := 0; d < rs.dataShards; d++ {
+			if valid[d] {
+				continue
+			}
+			if crc32.Checksum(shards[d], crc32cTable) != binary.LittleEndian.Uint32(entry[4*d:]) {
+				return nil, nil, fmt.Errorf("stripe %d of segment %s: rebuilt shard crc32c mismatch", stripe, seg.SegmentID)
+			}
+			start := stripe*layout.stripeSize() + int64(d)*layout.shardSize
+			if start < layout.segmentSize {
+				repairs = append(repairs, shardRepair{offset: start, data: shards[d][:min(layout.shardSize, layout.segmentSize-start)]})
+			}
+		}
+		for _, shard := range shards[:rs.dataShards] {
+			out = append(out, shard...)
+		}
+	}
+	start := offset - first*layout.stripeSize()
+	return out[start : start+length], repairs, nil
+}
+
+// reconstructChunk rebuilds the record of chunk from the parity of seg and
+// verifies it. It fails when the segment has no parity, when parity finds
+// no damage, or when too many shards are damaged.
+func (s *Store) reconstructChunk(seg segmentRecord, chunk chunkRecord) ([]byte, []shardRepair, error) {
+	record, repairs, err := s.rebuildSegmentRange(seg, chunk.SegmentOffset, chunk.SegmentLength)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(repairs) == 0 {
+		return nil, nil, errors.New("parity found no damaged shard")
+	}
+	raw, err := s.decodeChunkRecord(record, chunk)
+	if err != nil {
+		return nil, nil, err
+	}
+	return raw, repairs, nil
+}
+
+// errSegmentChanged reports that a segment left the states a repair may
+// write it in before the repair ran.
+var errSegmentChanged = errors.New("segment changed state before its repair")
+
+// healSegment writes the shards rebuilt from parity back into seg. The
+// segment is pinned and metaMu held shared while writing, and the write only
+// happens while metadata still records seg at its path in one of states, so
+// GC and compaction never see the file change underneath them.
+func (s *Store) healSegment(seg segmentRecord, repairs []shardRepair, states ...string) error {
+	s.pinSegment(seg.SegmentID)
+	defer s.unpinSegment(seg.SegmentID)
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	current := s.meta.Segments[seg.SegmentID]
+	if current == nil || current.RelativePath != seg.RelativePath || !slices.Contains(states, current.State) {
+		return fmt.Errorf("%w: %s", errSegmentChanged, seg.SegmentID)
+	}
+	return s.applyShardRepairs(seg, repairs)
+}
+
+// recordReadRepair keeps the outcome of the latest write-back of a read that
+// was rebuilt from parity, for Health.
+func (s *Store) recordReadRepair(seg segmentRecord, err error) {
+	if err != nil {
+		err = fmt.Errorf("write back rebuilt shards of segment %s: %w", seg.SegmentID, err)
+	}
+	s.backgroundMu.Lock()
+	s.lastReadRepairErr = err
+	s.backgroundMu.Unlock()
+}
+
+// applyShardRepairs writes rebuilt shards back into the segment file.
+func (s *Store) applyShardRepairs(seg segmentRecord, repairs []shardRepair) error {
+	file, err := s.fs.OpenFile(s.segmentPath(&seg), os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	for _, repair := range repairs {
+		if _, err := file.WriteAt(repair.data, repair.offset); err != nil {
+			return errors.Join(err, file.Close())
+		}
+	}
+	return errors.Join(file.Sync(), file.Close())
+}
@@ -0,0 +1,375 @@
+package blobfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func openParityTestStore(t *testing.T, parity ParityConfig) *Store {
+	t.Helper()
+	cfg := testConfig()
+	cfg.Compression = CompressionNone
+	cfg.Parity = parity
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open store: %v", err)
+	}
+	t.Cleanup(func() {
+		_ = store.Close()
+	})
+	return store
+}
+
+func putParityTestObject(t *testing.T, store *Store) []byte {
+	t.Helper()
+	data := make([]byte, 1500)
+	rand.New(rand.NewSource(25)).Read(data)
+	putTestBytes(t, store, "tenant-a", "blob", data)
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
+	return data
+}
+
+func parityFiles(t *testing.T, store *Store) []string {
+	t.Helper()
+	var files []string
+	if err := store.walkFiles(testContext(t), store.parityDir, func(path string) error {
+		files = append(files, path)
+		return nil
+	}); err != nil {
+		t.Fatalf("walk parity: %v", err)
+	}
+	return files
+}
+
+func TestReedSolomonRebuildsLostShards(t *testing.T) {
+	rs, err := newReedSolomon(5, 3)
+	if err != nil {
+		t.Fatalf("new reed-solomon: %v", err)
+	}
+	rng := rand.New(rand.NewSource(1))
+	shards := make([][]byte, 8)
+	for i := range shards {
+		shards[i] = make([]byte, 64)
+		if i < 5 {
+			rng.Read(shards[i])
+		}
+	}
+	rs.encode(shards)
+	want := make([][]byte, 5)
+	for i := range want {
+		want[i] = bytes.Clone(shards[i])
+	}
+	for _, lost := range [][]int{{0, 1, 2}, {4, 5, 7}, {1, 3, 6}} {
+		damaged := slices.Clone(shards)
+		valid := slices.Repeat([]bool{true}, 8)
+		for _, i := range lost {
+			damaged[i] = make([]byte, 64)
+			valid[i] = false
+		}
+		if err := rs.reconstruct(damaged, valid); err != nil {
+			t.Fatalf("reconstruct without %v: %v", lost, err)
+		}
+		for i := range want {
+			if !bytes.Equal(damaged[i], want[i]) {
+				t.Fatalf("shard %d differs after losing %v", i, lost)
+			}
+		}
+	}
+	valid := []bool{false, false, true, true, false, true, false, true}
+	if err := rs.reconstruct(slices.Clone(shards), valid); err == nil {
+		t.Fatal("reconstruct with four lost shards succeeded")
+	}
+}
+
+func TestCorruptRecordIsRebuiltFromParityOnRead(t *testing.T) {
+	store := openParityTestStore(t, ParityConfig{DataShards: 4, ParityShards: 2})
+	data := putParityTestObject(t, store)
+	_, seg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	if _, err := store.fs.Stat(store.parityPath(&seg)); err != nil {
+		t.Fatalf("sealed segment has no parity: %v", err)
+	}
+	sealed, err := afero.ReadFile(store.fs, store.segmentPath(&seg))
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+
+	corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	if got := readTestBytes(t, store, "tenant-a", "blob"); !bytes.Equal(got, data) {
+		t.Fatal("read of a damaged record returned wrong data")
+	}
+	healed, err := afero.ReadFile(store.fs, store.segmentPath(&seg))
+	if err != nil {
+		t.Fatalf("read healed segment: %v", err)
+	}
+	if !bytes.Equal(healed, sealed) {
+		t.Fatal("read did not repair the segment file")
+	}
+
+	chunk, _ := corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	result, err := store.Scrub(testContext(t), ScrubOptions{CheckFiles: true})
+	if err != nil {
+		t.Fatalf("scrub: %v, result=%+v", err, result)
+	}
+	if !slices.Contains(result.ReconstructedChunks, chunk.ChunkID) {
+		t.Fatalf("scrub did not report the rebuilt chunk: %+v", result)
+	}
+
+	if err := store.DeleteObject(testContext(t), "tenant-a", "blob"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	for range 2 {
+		if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1}); err != nil {
+			t.Fatalf("gc: %v", err)
+		}
+	}
+	if files := parityFiles(t, store); len(files) != 0 {
+		t.Fatalf("parity files left after gc: %v", files)
+	}
+}
+
+func TestRepairReconstructsChunksMarkedCorrupt(t *testing.T) {
+	store := openParityTestStore(t, ParityConfig{DataShards: 4, ParityShards: 2})
+	data := putParityTestObject(t, store)
+	_, seg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	parity := store.parityPath(&seg)
+	if err := store.fs.Rename(parity, parity+".away"); err != nil {
+		t.Fatalf("hide parity: %v", err)
+	}
+	chunk, _ := corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	if _, err := store.Scrub(testContext(t), ScrubOptions{}); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("scrub without parity err = %v", err)
+	}
+	if err := store.fs.Rename(parity+".away", parity); err != nil {
+		t.Fatalf("restore parity: %v", err)
+	}
+
+	plan, err := store.Repair(testContext(t), RepairOptions{Reconstruct: true})
+	if err != nil {
+		t.Fatalf("repair plan: %v", err)
+	}
+	if !slices.ContainsFunc(plan.Actions, func(action RepairAction) bool {
+		return action.Type == RepairReconstruct && action.Target == chunk.ChunkID && !action.Applied
+	}) {
+		t.Fatalf("repair plan does not rebuild %s: %+v", chunk.ChunkID, plan.Actions)
+	}
+	if current, _ := firstChunkSnapshot(t, store, "tenant-a", "blob"); current.State != chunkStateCorrupt {
+		t.Fatalf("dry run changed chunk state to %s", current.State)
+	}
+
+	report, err := store.Repair(testContext(t), RepairOptions{Apply: true, Reconstruct: true})
+	if err != nil {
+		t.Fatalf("repair: %v", err)
+	}
+	if !slices.ContainsFunc(report.Actions, func(action RepairAction) bool {
+		return action.Type == RepairReconstruct && action.Target == seg.SegmentID && action.Applied
+	}) {
+		t.Fatalf("repair did not restore segment %s: %+v", seg.SegmentID, report.Actions)
+	}
+	current, currentSeg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	if current.State != chunkStateActive || currentSeg.State != segmentStateSealed {
+		t.Fatalf("after repair chunk=%s segment=%s", current.State, currentSeg.State)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "blob"); !bytes.Equal(got, data) {
+		t.Fatal("read after repair returned wrong data")
+	}
+	if result, err := store.Scrub(testContext(t), ScrubOptions{CheckFiles: true}); err != nil || len(result.ReconstructedChunks) != 0 {
+		t.Fatalf("scrub after repair: %v, result=%+v", err, result)
+	}
+}
+
+func TestParityCannotRebuildTooManyDamagedShards(t *testing.T) {
+	store := openParityTestStore(t, ParityConfig{DataShards: 4, ParityShards: 1})
+	putParityTestObject(t, store)
+	chunk, seg := corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	pf, err := store.fs.Open(store.parityPath(&seg))
+	if err != nil {
+		t.Fatalf("open parity: %v", err)
+	}
+	layout, err := readParityLayout(pf)
+	_ = pf.Close()
+	if err != nil {
+		t.Fatalf("read parity layout: %v", err)
+	}
+	// Damage a second shard of the same stripe.
+	offset := chunk.SegmentOffset + recordHeaderSize + layout.shardSize
+	if offset/layout.stripeSize() != (chunk.SegmentOffset+recordHeaderSize)/layout.stripeSize() {
+		offset -= 2 * layout.shardSize
+	}
+	file, err := store.fs.OpenFile(store.segmentPath(&seg), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatalf("open segment: %v", err)
+	}
+	b := []byte{0}
+	if _, err := file.ReadAt(b, offset); err != nil && !errors.Is(err, io.EOF) {
+		t.Fatalf("read segment: %v", err)
+	}
+	if _, err := file.WriteAt([]byte{b[0] ^ 0xff}, offset); err != nil {
+		t.Fatalf("corrupt segment: %v", err)
+	}
+	_ = file.Close()
+
+	if _, err := store.readChunkPayloadAt(seg, chunk); err == nil {
+		t.Fatal("read with two damaged shards and one parity shard succeeded")
+	}
+	result, err := store.Scrub(testContext(t), ScrubOptions{})
+	if !errors.Is(err, ErrCorrupt) || !slices.Contains(result.CorruptChunks, chunk.ChunkID) {
+		t.Fatalf("scrub err = %v, result=%+v", err, result)
+	}
+}
+
+func TestCompactionWritesParityForItsSegments(t *testing.T) {
+	store := openParityTestStore(t, ParityConfig{DataShards: 4, ParityShards: 2})
+	data := putParityTestObject(t, store)
+	_, oldSeg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	// live shares the leading chunks of blob, so deleting blob leaves its
+	// first segment partially dead.
+	live := data[:200]
+	putTestBytes(t, store, "tenant-a", "live", live)
+	if err := store.DeleteObject(testContext(t), "tenant-a", "blob"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	result, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true})
+	if err != nil {
+		t.Fatalf("compact gc: %v", err)
+	}
+	if result.SegmentsCompacted == 0 {
+		t.Fatalf("expected compaction, got %+v", result)
+	}
+	chunk, seg := firstChunkSnapshot(t, store, "tenant-a", "live")
+	if seg.SegmentID == oldSeg.SegmentID {
+		t.Fatalf("chunk %s was not moved off compacted segment", chunk.ChunkID)
+	}
+	if _, err := store.fs.Stat(store.parityPath(&seg)); err != nil {
+		t.Fatalf("compacted segment has no parity: %v", err)
+	}
+	if _, err := store.fs.Stat(store.parityPath(&oldSeg)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("parity of removed segment stat err = %v", err)
+	}
+	corruptFirstChunkPayloadByte(t, store, "tenant-a", "live")
+	if got := readTestBytes(t, store, "tenant-a", "live"); !bytes.Equal(got, live) {
+		t.Fatal("read of a damaged compacted record returned wrong data")
+	}
+}
+
+func readRepairCheck(t *testing.T, store *Store) HealthCheck {
+	t.Helper()
+	health, err := store.Health(testContext(t))
+	if err != nil {
+		t.Fatalf("health: %v", err)
+	}
+	for _, check := range health.Checks {
+		if check.Name == "read_repair" {
+			return check
+		}
+	}
+	t.Fatalf("health has no read_repair check: %+v", health.Checks)
+	return HealthCheck{}
+}
+
+func TestReadRepairWritesBackOnlySealedSegmentsAndReportsFailures(t *testing.T) {
+	fsys := &faultFS{Fs: afero.NewMemMapFs()}
+	cfg := testConfig()
+	cfg.Compression = CompressionNone
+	cfg.Parity = ParityConfig{DataShards: 4, ParityShards: 2}
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	data := putParityTestObject(t, store)
+	_, seg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	segPath := store.segmentPath(&seg)
+	sealed, err := afero.ReadFile(fsys, segPath)
+	if err != nil {
+		t.Fatalf("read segment: %v", err)
+	}
+
+	corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	fsys.failSyncsTo(segPath, 1)
+	if got := readTestBytes(t, store, "tenant-a", "blob"); !bytes.Equal(got, data) {
+		t.Fatal("read with a failing write-back returned wrong data")
+	}
+	if check := readRepairCheck(t, store); check.OK {
+		t.Fatalf("failed write-back not reported: %+v", check)
+	}
+	corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	if got := readTestBytes(t, store, "tenant-a", "blob"); !bytes.Equal(got, data) {
+		t.Fatal("second read returned wrong data")
+	}
+	if check := readRepairCheck(t, store); !check.OK {
+		t.Fatalf("successful write-back still reported: %+v", check)
+	}
+
+	// A segment compaction has taken over is read but not written.
+	corruptFirstChunkPayloadByte(t, store, "tenant-a", "blob")
+	damaged, err := afero.ReadFile(fsys, segPath)
+	if err != nil {
+		t.Fatalf("read damaged segment: %v", err)
+	}
+	if bytes.Equal(damaged, sealed) {
+		t.Fatal("segment was not damaged")
+	}
+	store.metaMu.Lock()
+	store.meta.Segments[seg.SegmentID].State = segmentStateCompacting
+	store.metaMu.Unlock()
+	if got := readTestBytes(t, store, "tenant-a", "blob"); !bytes.Equal(got, data) {
+		t.Fatal("read of a compacting segment returned wrong data")
+	}
+	after, err := afero.ReadFile(fsys, segPath)
+	if err != nil {
+		t.Fatalf("read segment after read: %v", err)
+	}
+	if !bytes.Equal(after, damaged) {
+		t.Fatal("read wrote back into a segment that is not sealed")
+	}
+	store.metaMu.Lock()
+	store.meta.Segments[seg.SegmentID].State = segmentStateSealed
+	store.metaMu.Unlock()
+}
+
+func TestSegmentIsSealedOnlyAfterItsParityIsWritten(t *testing.T) {
+	fsys := &faultFS{Fs: afero.NewMemMapFs()}
+	cfg := testConfig()
+	cfg.Compression = CompressionNone
+	cfg.Parity = ParityConfig{DataShards: 4, ParityShards: 2}
+	store, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "blob", []byte("sealed only with parity"))
+	fsys.failRenamesContaining(filepath.Join("data", "parity"), 1)
+	if err := store.sealActiveSegment(); !errors.Is(err, errInjectedFSFault) {
+		t.Fatalf("seal = %v, want the parity fault", err)
+	}
+	_, seg := firstChunkSnapshot(t, store, "tenant-a", "blob")
+	if seg.State != segmentStateOpen {
+		t.Fatalf("segment without parity is %s", seg.State)
+	}
+	// The segment is left for the next open to seal, not retried on close.
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", cfg)
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	_, seg = firstChunkSnapshot(t, reopened, "tenant-a", "blob")
+	if seg.State != segmentStateSealed {
+		t.Fatalf("recovered segment is %s", seg.State)
+	}
+	if _, err := fsys.Stat(reopened.parityPath(&seg)); err != nil {
+		t.Fatalf("recovered segment has no parity: %v", err)
+	}
+}
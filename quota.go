@@ -0,0 +1,273 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+)
+
+// usageRecord is a metadata record that counts toward the usage of a tenant.
+type usageRecord interface {
+	usage() (string, tenantUsage)
+}
+
+// usage charges an active file to its tenant as one object of its size.
+func (inode *inodeRecord) usage() (string, tenantUsage) {
+	if inode == nil || inode.State != fileStateActive || inode.Kind != fileKindFile {
+		return "", tenantUsage{}
+	}
+	return inode.TenantID, tenantUsage{LogicalBytes: inode.Size, Objects: 1}
+}
+
+// usage charges the stored bytes of a chunk to the tenant that wrote it
+// first, so tenants sharing it under global dedup pay for it once.
+func (chunk *chunkRecord) usage() (string, tenantUsage) {
+	if chunk == nil || chunk.State == chunkStateDeleted {
+		return "", tenantUsage{}
+	}
+	return chunkOwner(chunk), tenantUsage{PhysicalBytes: chunk.StoredSize}
+}
+
+// usage charges the noncurrent versions of a path as logical bytes; they are
+// not objects of their own.
+func (history *versionHistory) usage() (string, tenantUsage) {
+	if history == nil {
+		return "", tenantUsage{}
+	}
+	var usage tenantUsage
+	for _, version := range history.Versions {
+		if !version.DeleteMarker {
+			usage.LogicalBytes += version.Size
+		}
+	}
+	return history.TenantID, usage
+}
+
+// chunkOwner returns the tenant charged for chunk. Chunks written before
+// owners were recorded fall back to their dedup scope.
+func chunkOwner(chunk *chunkRecord) string {
+	if chunk.Owner != "" {
+		return chunk.Owner
+	}
+	return chunk.TenantID
+}
+
+// addUsage adds the usage of record, times sign, to its tenant.
+func addUsage(meta *metadata, record usageRecord, sign int64) {
+	tenantID, delta := record.usage()
+	if tenantID == "" || delta == (tenantUsage{}) {
+		return
+	}
+	if meta.Usage == nil {
+		meta.Usage = map[string]tenantUsage{}
+	}
+	usage := meta.Usage[tenantID]
+	usage.LogicalBytes += sign * delta.LogicalBytes
+	usage.PhysicalBytes += sign * delta.PhysicalBytes
+	usage.Objects += sign * delta.Objects
+	if usage == (tenantUsage{}) {
+		delete(meta.Usage, tenantID)
+		return
+	}
+	meta.Usage[tenantID] = usage
+}
+
+// countUsage recounts the usage of every tenant from the records. It scans
+// all of them, so it only runs to verify or repair the persisted counters and
+// to count them for images written before they were persisted.
+func countUsage(meta *metadata) map[string]tenantUsage {
+	counted := &metadata{Usage: map[string]tenantUsage{}}
+	for _, inode := range meta.Inodes {
+		addUsage(counted, inode, 1)
+	}
+	for _, chunk := range meta.Chunks {
+		addUsage(counted, chunk, 1)
+	}
+	for _, history := range meta.Versions {
+		addUsage(counted, history, 1)
+	}
+	return counted.Usage
+}
+
+// rebuildUsage replaces the usage of every tenant with a recount.
+func rebuildUsage(meta *metadata) {
+	meta.Usage = countUsage(meta)
+	meta.usageStale = false
+}
+
+// usageDrift returns the ops that set every tenant whose persisted usage
+// differs from a recount to the recounted figure, in tenant order.
+func usageDrift(meta *metadata) []metaOp {
+	counted := countUsage(meta)
+	var tenants []string
+	for tenantID := range counted {
+		tenants = append(tenants, tenantID)
+	}
+	for tenantID := range meta.Usage {
+		if _, ok := counted[tenantID]; !ok {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	sort.Strings(tenants)
+	var ops []metaOp
+	for _, tenantID := range tenants {
+		if usage := counted[tenantID]; usage != meta.Usage[tenantID] {
+			ops = append(ops, metaOp{Type: "put_usage", TenantID: tenantID, Usage: &usage})
+		}
+	}
+	return ops
+}
+
+// usageTenants returns the tenants whose usage op may change.
+func usageTenants(meta *metadata, op metaOp) []string {
+	var records []usageRecord
+	switch op.Type {
+	case "put_inode":
+		if op.Inode != nil {
+			records = append(records, op.Inode, meta.Inodes[op.Inode.InodeID])
+		}
+	case "put_chunk":
+		if op.Chunk != nil {
+			records = append(records, op.Chunk, meta.Chunks[op.Chunk.ChunkID])
+		}
+	case "put_versions":
+		if op.Versions != nil {
+			return []string{op.Versions.TenantID}
+		}
+	case "delete_versions", "put_usage":
+		return []string{op.TenantID}
+	}
+	var tenants []string
+	for _, record := range records {
+		if tenantID, _ := record.usage(); tenantID != "" {
+			tenants = append(tenants, tenantID)
+		}
+	}
+	return tenants
+}
+
+// hasQuota reports whether settings limit any usage dimension.
+func (settings *tenantSettings) hasQuota() bool {
+	return settings != nil && (settings.QuotaLogical > 0 || settings.QuotaPhysical > 0 || settings.QuotaObjects > 0)
+}
+
+// checkQuotaLocked returns ErrQuotaExceeded when ops would grow a tenant past
+// one of its quotas. Usage that only shrinks, or that grows while still
+// within the quota, passes, so a tenant over a lowered quota can still delete.
+func (s *Store) checkQuotaLocked(ops []metaOp) error {
+	before := map[string]tenantUsage{}
+	for _, op := range ops {
+		for _, tenantID := range usageTenants(s.meta, op) {
+			if _, ok := before[tenantID]; !ok && s.meta.TenantSettings[tenantID].hasQuota() {
+				before[tenantID] = s.meta.Usage[tenantID]
+			}
+		}
+	}
+	if len(before) == 0 {
+		return nil
+	}
+	undo := stageMetaLocked(s.meta, ops)
+	var err error
+	for tenantID, prev := range before {
+		settings := s.meta.TenantSettings[tenantID]
+		next := s.meta.Usage[tenantID]
+		if overQuota(prev.LogicalBytes, next.LogicalBytes, settings.QuotaLogical) ||
+			overQuota(prev.PhysicalBytes, next.PhysicalBytes, settings.QuotaPhysical) ||
+			overQuota(prev.Objects, next.Objects, settings.QuotaObjects) {
+			err = ErrQuotaExceeded
+			break
+		}
+	}
+	for i := len(undo) - 1; i >= 0; i-- {
+		undo[i](s.meta)
+	}
+	return err
+}
+
+func overQuota(prev, next, quota int64) bool {
+	return quota > 0 && next > prev && next > quota
+}
+
+// SetQuota changes the quota of tenantID. A zero limit is unlimited. Lowering
+// a quota below the current usage refuses further growth but keeps the data.
+func (s *Store) SetQuota(ctx context.Context, tenantID string, quota Quota) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("set quota", tenantID, err)
+	}
+	if quota.LogicalBytes < 0 || quota.PhysicalBytes < 0 || quota.Objects < 0 {
+		return pathError("set quota", tenantID, errors.New("quota limits must be non-negative"))
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.updateTenantSettingsLocked(tenantID, func(settings *tenantSettings) {
+		settings.QuotaLogical = quota.LogicalBytes
+		settings.QuotaPhysical = quota.PhysicalBytes
+		settings.QuotaObjects = quota.Objects
+	})
+}
+
+// Quota returns the quota of tenantID.
+func (s *Store) Quota(ctx context.Context, tenantID string) (Quota, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return Quota{}, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return Quota{}, pathError("quota", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil {
+		return Quota{}, nil
+	}
+	return Quota{LogicalBytes: settings.QuotaLogical, PhysicalBytes: settings.QuotaPhysical, Objects: settings.QuotaObjects}, nil
+}
+
+// Usage returns what tenantID currently stores, as counted against its quota.
+func (s *Store) Usage(ctx context.Context, tenantID string) (TenantUsage, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return TenantUsage{}, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return TenantUsage{}, pathError("usage", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	usage := s.meta.Usage[tenantID]
+	return TenantUsage{LogicalBytes: usage.LogicalBytes, PhysicalBytes: usage.PhysicalBytes, Objects: usage.Objects}, nil
+}
+
+// captureUsageUndo returns a func that restores the usage of the tenants ops
+// touch, or nil when they touch none. Usage restores as a whole rather than
+// per op because one tenant's figure sums many records.
+func captureUsageUndo(meta *metadata, ops []metaOp) func(*metadata) {
+	prev := map[string]tenantUsage{}
+	for _, op := range ops {
+		for _, tenantID := range usageTenants(meta, op) {
+			if _, ok := prev[tenantID]; !ok {
+				prev[tenantID] = meta.Usage[tenantID]
+			}
+		}
+	}
+	if len(prev) == 0 {
+		return nil
+	}
+	return func(meta *metadata) {
+		if meta.Usage == nil {
+			meta.Usage = map[string]tenantUsage{}
+		}
+		for tenantID, usage := range prev {
+			if usage == (tenantUsage{}) {
+				delete(meta.Usage, tenantID)
+			} else {
+				meta.Usage[tenantID] = usage
+			}
+		}
+	}
+}
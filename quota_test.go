@@ -0,0 +1,257 @@
+package blobfs
+
+import (
+	"errors"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestQuotaRefusesGrowthPastLimits(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := testContext(t)
+	if err := store.SetQuota(ctx, "tenant-a", Quota{LogicalBytes: 20, Objects: 2}); err != nil {
+		t.Fatalf("set quota: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("0123456789"))
+	if _, err := store.Put(ctx, "tenant-a", "big.txt", strings.NewReader("0123456789abc"), nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("put past logical quota = %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("short"))
+	if _, err := store.CopyObject(ctx, "tenant-a", "b.txt", "tenant-a", "c.txt"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("copy past object quota = %v", err)
+	}
+	batch := store.NewBatch()
+	batch.Delete("tenant-a", "b.txt", DeleteOptions{})
+	batch.Put("tenant-a", "c.txt", strings.NewReader("0123456789abcdef"), PutOptions{})
+	if _, err := batch.Commit(ctx); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("batch past logical quota = %v", err)
+	}
+
+	file, err := store.OpenFile("tenant-a/b.txt", os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("0123456789abcdef"), 5); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := file.Sync(); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("sync past logical quota = %v", err)
+	}
+	if err := file.Truncate(3); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("close after shrinking: %v", err)
+	}
+
+	usage, err := store.Usage(ctx, "tenant-a")
+	if err != nil || usage.LogicalBytes != 13 || usage.Objects != 2 || usage.PhysicalBytes <= 0 {
+		t.Fatalf("usage = %+v, %v", usage, err)
+	}
+	if err := store.SetQuota(ctx, "tenant-a", Quota{Objects: 1}); err != nil {
+		t.Fatalf("lower quota: %v", err)
+	}
+	if err := store.DeleteObject(ctx, "tenant-a", "b.txt"); err != nil {
+		t.Fatalf("delete over quota: %v", err)
+	}
+	if _, err := store.Put(ctx, "tenant-a", "d.txt", strings.NewReader("d"), nil); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("put at object quota = %v", err)
+	}
+	putTestBytes(t, store, "tenant-b", "d.txt", []byte("other tenant"))
+
+	checkpointTestStore(t, store)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("replaced"))
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if quota, err := store.Quota(ctx, "tenant-a"); err != nil || quota != (Quota{Objects: 1}) {
+		t.Fatalf("quota after reopen = %+v, %v", quota, err)
+	}
+	usage, err = store.Usage(ctx, "tenant-a")
+	if err != nil || usage.LogicalBytes != 8 || usage.Objects != 1 {
+		t.Fatalf("usage after reopen = %+v, %v", usage, err)
+	}
+}
+
+func TestQuotaCoversRestoresAndMoves(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupScope = DedupScopeGlobal
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	if err := store.SetVersioning(ctx, "tenant-a", VersioningConfig{Enabled: true}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	first := putTestBytes(t, store, "tenant-a", "a.txt", []byte("0123456789"))
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("abc"))
+	if _, err := store.CreateSnapshot(ctx, "tenant-a", "snap"); err != nil {
+		t.Fatalf("snapshot: %v", err)
+	}
+	putTestBytes(t, store, "tenant-b", "b.txt", []byte("moved into tenant-a"))
+	if err := store.SetQuota(ctx, "tenant-a", Quota{LogicalBytes: 15}); err != nil {
+		t.Fatalf("set quota: %v", err)
+	}
+
+	if _, err := store.RestoreVersion(ctx, "tenant-a", "a.txt", first.Generation); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("restore version past quota = %v", err)
+	}
+	if err := store.RestoreSnapshot(ctx, "tenant-a", "snap"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("restore snapshot past quota = %v", err)
+	}
+	if err := store.Move(ctx, "tenant-b", "b.txt", "tenant-a", "b.txt"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("move past quota = %v", err)
+	}
+	if err := store.Rename("tenant-b/b.txt", "tenant-a/b.txt"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("rename past quota = %v", err)
+	}
+	if usage, err := store.Usage(ctx, "tenant-a"); err != nil || usage.LogicalBytes != 13 {
+		t.Fatalf("usage after refused writes = %+v, %v", usage, err)
+	}
+}
+
+func TestUsageTracksRecordsIncrementally(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupScope = DedupScopeGlobal
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	if err := store.SetVersioning(ctx, "tenant-a", VersioningConfig{Enabled: true}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	shared := []byte("content shared between tenants through global dedup")
+	putTestBytes(t, store, "tenant-a", "a.txt", shared)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("second version"))
+	putTestBytes(t, store, "tenant-b", "b.txt", shared)
+	if err := store.CloneTree(ctx, "tenant-b", "b.txt", "tenant-b", "clone.txt"); err != nil {
+		t.Fatalf("clone: %v", err)
+	}
+	if err := store.DeleteObject(ctx, "tenant-b", "b.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(ctx, GCOptions{CandidateConfirmCycles: 1, SafetyWindow: -1}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+
+	usageA, err := store.Usage(ctx, "tenant-a")
+	if err != nil || usageA.Objects != 1 || usageA.LogicalBytes != int64(len(shared)+len("second version")) {
+		t.Fatalf("tenant-a usage = %+v, %v", usageA, err)
+	}
+	usageB, err := store.Usage(ctx, "tenant-b")
+	if err != nil || usageB.Objects != 1 || usageB.LogicalBytes != int64(len(shared)) || usageB.PhysicalBytes != 0 {
+		t.Fatalf("tenant-b usage = %+v, %v", usageB, err)
+	}
+
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	rebuilt := &metadata{Inodes: store.meta.Inodes, Chunks: store.meta.Chunks, Versions: store.meta.Versions}
+	rebuildUsage(rebuilt)
+	if !reflect.DeepEqual(store.meta.Usage, rebuilt.Usage) {
+		t.Fatalf("incremental usage = %+v, rebuilt = %+v", store.meta.Usage, rebuilt.Usage)
+	}
+}
+
+func TestUsageIsPersistedAndRecountedOnlyOnRepair(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	reopen := func(store *Store) *Store {
+		t.Helper()
+		if store != nil {
+			if err := store.Close(); err != nil {
+				t.Fatalf("close: %v", err)
+			}
+		}
+		store, err := OpenFS(fsys, "/blobfs", testConfig())
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		return store
+	}
+	usageOf := func(store *Store) TenantUsage {
+		t.Helper()
+		usage, err := store.Usage(testContext(t), "tenant-a")
+		if err != nil {
+			t.Fatalf("usage: %v", err)
+		}
+		return usage
+	}
+	drift := func(store *Store) {
+		store.metaMu.Lock()
+		store.meta.Usage["tenant-a"] = tenantUsage{Objects: 99}
+		store.meta.dirtySet().usage["tenant-a"] = struct{}{}
+		store.metaMu.Unlock()
+		checkpointTestStore(t, store)
+	}
+	ctx := testContext(t)
+	store := reopen(nil)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("first"))
+	checkpointTestStore(t, store)
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("second"))
+	want := usageOf(store)
+
+	// Loading takes usage from the checkpoint, so drift written there
+	// survives a reopen until a scrub finds it and a repair recounts it.
+	drift(store)
+	store = reopen(store)
+	if got := usageOf(store); got.Objects != 99 {
+		t.Fatalf("usage after reopen = %+v, want the persisted drift", got)
+	}
+	result, err := store.Scrub(ctx, ScrubOptions{})
+	if !errors.Is(err, ErrCorrupt) || len(result.Issues) != 1 || result.Issues[0].Kind != "usage_mismatch" {
+		t.Fatalf("scrub = %v, %+v", err, result)
+	}
+	plan, err := store.Repair(ctx, RepairOptions{RecountUsage: true})
+	if err != nil || len(plan.Actions) != 1 || plan.Actions[0].Type != RepairRecountUsage || plan.Actions[0].Applied {
+		t.Fatalf("repair plan = %+v, %v", plan, err)
+	}
+	report, err := store.Repair(ctx, RepairOptions{Apply: true, RecountUsage: true})
+	if err != nil || len(report.Actions) != 1 || !report.Actions[0].Applied {
+		t.Fatalf("repair = %+v, %v", report, err)
+	}
+	if got := usageOf(store); got != want {
+		t.Fatalf("usage after repair = %+v, want %+v", got, want)
+	}
+	store = reopen(store)
+	if got := usageOf(store); got != want {
+		t.Fatalf("repaired usage after reopen = %+v, want %+v", got, want)
+	}
+	if result, err := store.Scrub(ctx, ScrubOptions{}); err != nil {
+		t.Fatalf("scrub after repair = %v, %+v", err, result)
+	}
+
+	// An image written before usage was persisted is recounted at load and
+	// replaced by a full image at the next checkpoint.
+	store.metaMu.Lock()
+	store.meta.usageStale = true
+	store.metaNeedsFullCheckpoint = true
+	store.metaMu.Unlock()
+	drift(store)
+	store = reopen(store)
+	defer store.Close()
+	if got := usageOf(store); got != want {
+		t.Fatalf("usage recounted from an old image = %+v, want %+v", got, want)
+	}
+	store.metaMu.RLock()
+	needsFull := store.metaNeedsFullCheckpoint
+	store.metaMu.RUnlock()
+	if !needsFull {
+		t.Fatal("recounted usage does not force a full checkpoint")
+	}
+}
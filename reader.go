@@ -47,6 +47,13 @@ func (s *Store) openReader(tenantID, path string, rangeOffset, rangeLength int64
 	if inode.Kind != fileKindFile {
 		return nil, pathError("open", path, ErrIsDir)
 	}
+	return s.openInodeReaderLocked(inode, path, rangeOffset, rangeLength)
+}
+
+// openInodeReaderLocked opens a reader over the content of a file inode. The
+// inode does not have to be linked into the live namespace, which lets
+// snapshots read files through the manifests they hold.
+func (s *Store) openInodeReaderLocked(inode *inodeRecord, path string, rangeOffset, rangeLength int64) (*ObjectReader, error) {
 	manifest := s.meta.Manifests[inode.ManifestID]
 	if manifest == nil || manifest.State == manifestStateDeleted {
 		return nil, errManifestNotFound
@@ -58,7 +65,7 @@ func (s *Store) openReader(tenantID, path string, rangeOffset, rangeLength int64
 	snapshots := make([]chunkSnapshot, 0, len(refs))
 	for _, ref := range refs {
 		chunk := s.meta.Chunks[ref.ChunkID]
-		if chunk == nil || chunk.State == chunkStateDeleted || chunk.State == chunkStateCorrupt {
+		if chunk == nil || chunk.State == chunkStateDeleted || chunk.State == chunkStateCorrupt || chunk.State == chunkStateShredded {
 			return nil, errChunkNotReadable
 		}
 		seg := s.meta.Segments[chunk.SegmentID]
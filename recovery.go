@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"time"
 
 	"github.com/spf13/afero"
@@ -56,10 +57,12 @@ type ChunkStats struct {
 	GarbageCandidate int
 	Deleted          int
 	Corrupt          int
+	Shredded         int
 }
 
 // SegmentStats groups segment counts by state.
 type SegmentStats struct {
+	Open       int
 	Sealed     int
 	Compacting int
 	Deleted    int
@@ -85,6 +88,9 @@ type GCStats struct {
 	LastBackgroundEpoch int64
 	// LastBackgroundError is the latest background GC error message, if any.
 	LastBackgroundError string
+	// LastBackgroundLifecycle is what the lifecycle pass before the latest
+	// background GC run expired.
+	LastBackgroundLifecycle LifecycleResult
 }
 
 // StatsSnapshot is a point-in-time metadata-only statistics snapshot.
@@ -139,6 +145,8 @@ const (
 	IssueSegmentWithoutChunks IssueKind = "segment_without_chunks"
 	// IssueMetadataLogTornTail is a crash-torn metadata log tail ignored during replay.
 	IssueMetadataLogTornTail IssueKind = "metadata_log_torn_tail"
+	// IssueCheckpointFallback is a checkpoint image skipped at open in favor of an older one.
+	IssueCheckpointFallback IssueKind = "checkpoint_fallback"
 )
 
 // IssueSeverity is the severity of a diagnostic issue.
@@ -173,7 +181,13 @@ type RepairOptions struct {
 	CleanOrphans       bool
 	ResetCompacting    bool
 	MarkMissingCorrupt bool
-	MaxActions         int
+	// Reconstruct rebuilds chunks marked corrupt from segment parity and
+	// marks them, and their segments, usable again.
+	Reconstruct bool
+	// RecountUsage recounts the usage of every tenant from its records and
+	// corrects the persisted counters that drifted.
+	RecountUsage bool
+	MaxActions   int
 }
 
 // RepairReport lists planned or applied repair actions.
@@ -195,6 +209,10 @@ const (
 	RepairResetCompacting RepairActionType = "reset_compacting"
 	// RepairMarkCorrupt marks metadata that references a missing segment as corrupt.
 	RepairMarkCorrupt RepairActionType = "mark_corrupt"
+	// RepairReconstruct rebuilds a corrupt chunk from segment parity.
+	RepairReconstruct RepairActionType = "reconstruct"
+	// RepairRecountUsage corrects the persisted usage of a tenant.
+	RepairRecountUsage RepairActionType = "recount_usage"
 )
 
 // RepairAction is one planned or applied repair operation.
@@ -251,6 +269,7 @@ func (s *Store) Health(ctx context.Context) (*HealthReport, error) {
 		checkpointMessage = s.lastCheckpointErr.Error()
 	}
 	replayWarnings := append([]metadataReplayWarning(nil), s.recoveryWarnings...)
+	fallbacks := append([]metadataCheckpointFallback(nil), s.checkpointFallbacks...)
 	hasCorruptChunks := false
 	hasCorruptSegments := false
 	hasCompactingSegments := false
@@ -279,6 +298,7 @@ func (s *Store) Health(ctx context.Context) (*HealthReport, error) {
 	s.metaMu.RUnlock()
 	s.backgroundMu.Lock()
 	backgroundErr := s.lastBackgroundGCErr
+	readRepairErr := s.lastReadRepairErr
 	s.backgroundMu.Unlock()
 	report.Checks = append(report.Checks, HealthCheck{Name: "metadata_loaded", OK: metaLoaded, Message: healthMessage(metaLoaded, "metadata loaded", "metadata is nil")})
 	report.Checks = append(report.Checks, HealthCheck{Name: "txlog_available", OK: txlogOK, Message: healthMessage(txlogOK, "metadata log is open", "metadata log is unavailable")})
@@ -289,11 +309,29 @@ func (s *Store) Health(ctx context.Context) (*HealthReport, error) {
 		backgroundMessage = backgroundErr.Error()
 	}
 	report.Checks = append(report.Checks, HealthCheck{Name: "background_gc", OK: backgroundOK, Message: backgroundMessage})
+	sealErr := s.sealErr()
+	sealOK := sealErr == nil
+	sealMessage := "open segments seal cleanly"
+	if sealErr != nil {
+		sealMessage = sealErr.Error()
+	}
+	report.Checks = append(report.Checks, HealthCheck{Name: "segment_seal", OK: sealOK, Message: sealMessage})
+	readRepairOK := readRepairErr == nil
+	readRepairMessage := "shards rebuilt on read are written back"
+	if readRepairErr != nil {
+		readRepairMessage = readRepairErr.Error()
+	}
+	report.Checks = append(report.Checks, HealthCheck{Name: "read_repair", OK: readRepairOK, Message: readRepairMessage})
 	report.Checks = append(report.Checks, HealthCheck{
 		Name:    "metadata_log_replay",
 		OK:      len(replayWarnings) == 0,
 		Message: healthMessage(len(replayWarnings) == 0, "metadata log replay was clean", metadataReplayWarningMessage(replayWarnings)),
 	})
+	report.Checks = append(report.Checks, HealthCheck{
+		Name:    "checkpoint_load",
+		OK:      len(fallbacks) == 0,
+		Message: healthMessage(len(fallbacks) == 0, "latest checkpoint loaded", checkpointFallbackMessage(fallbacks)),
+	})
 	txlogDirOK := s.pathAccessible(metaTxLogDir(s.metaDir))
 	report.Checks = append(report.Checks, HealthCheck{Name: "txlog_dir_available", OK: txlogDirOK, Message: healthMessage(txlogDirOK, "metadata log directory is accessible", "metadata log directory is not accessible")})
 	segmentsOK := s.pathAccessible(s.segmentsDir)
@@ -322,7 +360,7 @@ func (s *Store) Health(ctx context.Context) (*HealthReport, error) {
 		report.Writable = false
 		return report, nil
 	}
-	if !checkpointOK || !backgroundOK || hasCompactingSegments || len(replayWarnings) > 0 {
+	if !checkpointOK || !backgroundOK || !sealOK || !readRepairOK || hasCompactingSegments || len(replayWarnings) > 0 || len(fallbacks) > 0 {
 		report.State = HealthDegraded
 	}
 	return report, nil
@@ -369,6 +407,8 @@ func (s *Store) Stats(ctx context.Context) (*StatsSnapshot, error) {
 			continue
 		case chunkStateCorrupt:
 			stats.Chunks.Corrupt++
+		case chunkStateShredded:
+			stats.Chunks.Shredded++
 		default:
 			stats.Chunks.Active++
 		}
@@ -380,6 +420,8 @@ func (s *Store) Stats(ctx context.Context) (*StatsSnapshot, error) {
 			continue
 		}
 		switch seg.State {
+		case segmentStateOpen:
+			stats.Segments.Open++
 		case segmentStateCompacting:
 			stats.Segments.Compacting++
 		case segmentStateDeleted:
@@ -400,6 +442,9 @@ func (s *Store) Stats(ctx context.Context) (*StatsSnapshot, error) {
 	if s.lastBackgroundGC != nil {
 		stats.GC.LastBackgroundEpoch = s.lastBackgroundGC.Epoch
 	}
+	if s.lastLifecycle != nil {
+		stats.GC.LastBackgroundLifecycle = *s.lastLifecycle
+	}
 	if s.lastBackgroundGCErr != nil {
 		stats.GC.LastBackgroundError = s.lastBackgroundGCErr.Error()
 	}
@@ -436,6 +481,15 @@ func (s *Store) Diagnose(ctx context.Context, opts DiagnoseOptions) (*DiagnoseRe
 			Repairable: false,
 		})
 	}
+	for _, fallback := range s.checkpointFallbacks {
+		addIssue(Issue{
+			Kind:       IssueCheckpointFallback,
+			Severity:   SeverityWarn,
+			Path:       fallback.Path,
+			Message:    fallback.Reason,
+			Repairable: false,
+		})
+	}
 	referencedPaths := s.referencedSegmentPathsLocked()
 	chunksBySegment := map[string]int{}
 	segments := make([]segmentRecord, 0, len(s.meta.Segments))
@@ -500,13 +554,21 @@ func (s *Store) Diagnose(ctx context.Context, opts DiagnoseOptions) (*DiagnoseRe
 	}
 	if opts.CheckOrphans {
 		if err := s.walkFiles(ctx, s.segmentsDir, func(path string) error {
-			if !referencedPaths[path] {
+			if !referencedPaths[path] && !s.isOpenSegmentPath(path) {
 				addIssue(Issue{Kind: IssueOrphanSegment, Severity: SeverityWarn, Path: path, Message: "segment file is not referenced by metadata", Repairable: true})
 			}
 			return nil
 		}); err != nil {
 			return report, err
 		}
+		if err := s.walkFiles(ctx, s.parityDir, func(path string) error {
+			if segPath := s.paritySegmentPath(path); !referencedPaths[segPath] && !s.isOpenSegmentPath(segPath) {
+				addIssue(Issue{Kind: IssueOrphanSegment, Severity: SeverityWarn, Path: path, Message: "parity file belongs to no referenced segment", Repairable: true})
+			}
+			return nil
+		}); err != nil {
+			return report, err
+		}
 	}
 	return report, nil
 }
@@ -526,6 +588,17 @@ func metadataReplayWarningMessage(warnings []metadataReplayWarning) string {
 	return msg
 }
 
+func checkpointFallbackMessage(fallbacks []metadataCheckpointFallback) string {
+	if len(fallbacks) == 0 {
+		return ""
+	}
+	msg := "checkpoint fallback: " + fallbacks[0].Reason
+	if len(fallbacks) > 1 {
+		msg = fmt.Sprintf("%s; %d total fallbacks", msg, len(fallbacks))
+	}
+	return msg
+}
+
 // Repair applies or previews low-risk recovery actions selected by RepairOptions.
 func (s *Store) Repair(ctx context.Context, opts RepairOptions) (*RepairReport, error) {
 	if err := s.beginOp(ctx); err != nil {
@@ -560,7 +633,7 @@ func (s *Store) Repair(ctx context.Context, opts RepairOptions) (*RepairReport,
 		referencedPaths := s.referencedSegmentPathsLocked()
 		s.metaMu.RUnlock()
 		if err := s.walkFiles(ctx, s.segmentsDir, func(path string) error {
-			if referencedPaths[path] {
+			if referencedPaths[path] || s.isOpenSegmentPath(path) {
 				return nil
 			}
 			if !addAction(RepairAction{Type: RepairCleanOrphanSegment, Target: path, Message: "remove orphan segment file"}) {
@@ -573,6 +646,20 @@ func (s *Store) Repair(ctx context.Context, opts RepairOptions) (*RepairReport,
 		}); err != nil {
 			return report, err
 		}
+		if err := s.walkFiles(ctx, s.parityDir, func(path string) error {
+			if segPath := s.paritySegmentPath(path); referencedPaths[segPath] || s.isOpenSegmentPath(segPath) {
+				return nil
+			}
+			if !addAction(RepairAction{Type: RepairCleanOrphanSegment, Target: path, Message: "remove orphan parity file"}) {
+				return nil
+			}
+			if !dryRun {
+				return s.fs.Remove(path)
+			}
+			return nil
+		}); err != nil {
+			return report, err
+		}
 	}
 	if opts.ResetCompacting {
 		if err := s.repairCompactingSegments(ctx, dryRun, addAction); err != nil {
@@ -584,6 +671,16 @@ func (s *Store) Repair(ctx context.Context, opts RepairOptions) (*RepairReport,
 			return report, err
 		}
 	}
+	if opts.Reconstruct {
+		if err := s.repairReconstruct(ctx, dryRun, addAction); err != nil {
+			return report, err
+		}
+	}
+	if opts.RecountUsage {
+		if err := s.repairUsage(ctx, dryRun, addAction); err != nil {
+			return report, err
+		}
+	}
 	return report, nil
 }
 
@@ -618,6 +715,14 @@ func (s *Store) referencedSegmentPathsLocked() map[string]bool {
 			referenced[s.segmentPath(seg)] = true
 		}
 	}
+	// Segments holding data of locked files are never orphans.
+	for chunkID := range s.lockedChunksLocked(nowUnix()) {
+		if chunk := s.meta.Chunks[chunkID]; chunk != nil {
+			if seg := s.meta.Segments[chunk.SegmentID]; seg != nil {
+				referenced[s.segmentPath(seg)] = true
+			}
+		}
+	}
 	return referenced
 }
 
@@ -671,6 +776,28 @@ func (s *Store) repairCompactingSegments(ctx context.Context, dryRun bool, addAc
 	return s.commitMetaLocked(ops)
 }
 
+func (s *Store) repairUsage(ctx context.Context, dryRun bool, addAction func(RepairAction) bool) error {
+	if err := contextError(ctx); err != nil {
+		return err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	var ops []metaOp
+	for _, op := range usageDrift(s.meta) {
+		prev := s.meta.Usage[op.TenantID]
+		message := fmt.Sprintf("usage %d/%d/%d recounts as %d/%d/%d logical/physical/objects",
+			prev.LogicalBytes, prev.PhysicalBytes, prev.Objects, op.Usage.LogicalBytes, op.Usage.PhysicalBytes, op.Usage.Objects)
+		if !addAction(RepairAction{Type: RepairRecountUsage, Target: op.TenantID, Message: message}) {
+			break
+		}
+		ops = append(ops, op)
+	}
+	if dryRun || len(ops) == 0 {
+		return nil
+	}
+	return s.commitMetaLocked(ops)
+}
+
 func (s *Store) repairMissingSegments(ctx context.Context, dryRun bool, addAction func(RepairAction) bool) error {
 	s.metaMu.RLock()
 	segments := make([]segmentRecord, 0, len(s.meta.Segments))
@@ -728,3 +855,122 @@ func (s *Store) repairMissingSegments(ctx context.Context, dryRun bool, addActio
 	}
 	return s.commitMetaLocked(ops)
 }
+
+// repairReconstruct rebuilds chunks marked corrupt, or stored in a corrupt
+// segment, from segment parity. A chunk that verifies afterwards becomes
+// active again, and a corrupt segment is sealed again once none of its
+// chunks is corrupt.
+func (s *Store) repairReconstruct(ctx context.Context, dryRun bool, addAction func(RepairAction) bool) error {
+	type candidate struct {
+		chunk chunkRecord
+		seg   segmentRecord
+	}
+	s.metaMu.RLock()
+	var candidates []candidate
+	seenPins := map[string]bool{}
+	for _, chunk := range s.meta.Chunks {
+		if chunk == nil || chunk.State == chunkStateDeleted || chunk.State == chunkStateShredded {
+			continue
+		}
+		seg := s.meta.Segments[chunk.SegmentID]
+		if seg == nil || seg.State == segmentStateDeleted {
+			continue
+		}
+		if chunk.State != chunkStateCorrupt && seg.State != segmentStateCorrupt {
+			continue
+		}
+		candidates = append(candidates, candidate{chunk: *chunk, seg: *seg})
+		if !seenPins[seg.SegmentID] {
+			seenPins[seg.SegmentID] = true
+			s.pinSegment(seg.SegmentID)
+		}
+	}
+	s.metaMu.RUnlock()
+	defer func() {
+		for segmentID := range seenPins {
+			s.unpinSegment(segmentID)
+		}
+	}()
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].chunk.ChunkID < candidates[j].chunk.ChunkID
+	})
+	usable := map[string]bool{}
+	failed := map[string]bool{}
+	for _, c := range candidates {
+		if err := contextError(ctx); err != nil {
+			return err
+		}
+		_, repairs, err := s.reconstructChunk(c.seg, c.chunk)
+		if err != nil {
+			// Parity finds nothing to rebuild when the record is intact,
+			// for example after a neighbouring chunk repaired its stripe.
+			if _, readErr := s.readChunkRecord(c.seg, c.chunk); readErr != nil {
+				failed[c.seg.SegmentID] = true
+				continue
+			}
+			if c.chunk.State == chunkStateCorrupt && !addAction(RepairAction{Type: RepairReconstruct, Target: c.chunk.ChunkID, Message: "chunk verifies intact; mark it active"}) {
+				failed[c.seg.SegmentID] = true
+				break
+			}
+		} else {
+			if !addAction(RepairAction{Type: RepairReconstruct, Target: c.chunk.ChunkID, Message: fmt.Sprintf("rebuild %d damaged shards of segment %s from parity", len(repairs), c.seg.SegmentID)}) {
+				failed[c.seg.SegmentID] = true
+				break
+			}
+			if !dryRun {
+				if err := s.healSegment(c.seg, repairs, segmentStateSealed, segmentStateCorrupt); err != nil {
+					return err
+				}
+			}
+		}
+		usable[c.chunk.ChunkID] = true
+	}
+	if len(usable) == 0 {
+		return nil
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	ops := []metaOp{}
+	segments := map[string]bool{}
+	for _, c := range candidates {
+		if !usable[c.chunk.ChunkID] {
+			continue
+		}
+		segments[c.seg.SegmentID] = true
+		if chunk := s.meta.Chunks[c.chunk.ChunkID]; chunk != nil && chunk.State == chunkStateCorrupt {
+			next := *chunk
+			next.State = chunkStateActive
+			next.CorruptAt = 0
+			next.CorruptReason = ""
+			ops = append(ops, metaOp{Type: "put_chunk", Chunk: &next})
+		}
+	}
+	for _, chunk := range s.meta.Chunks {
+		if chunk != nil && chunk.State == chunkStateCorrupt && !usable[chunk.ChunkID] {
+			failed[chunk.SegmentID] = true
+		}
+	}
+	ids := make([]string, 0, len(segments))
+	for segmentID := range segments {
+		ids = append(ids, segmentID)
+	}
+	sort.Strings(ids)
+	for _, segmentID := range ids {
+		seg := s.meta.Segments[segmentID]
+		if failed[segmentID] || seg == nil || seg.State != segmentStateCorrupt {
+			continue
+		}
+		if !addAction(RepairAction{Type: RepairReconstruct, Target: segmentID, Message: "mark segment sealed after its chunks verified"}) {
+			break
+		}
+		next := *seg
+		next.State = segmentStateSealed
+		next.CorruptAt = 0
+		next.CorruptReason = ""
+		ops = append(ops, metaOp{Type: "put_segment", Segment: &next})
+	}
+	if dryRun || len(ops) == 0 {
+		return nil
+	}
+	return s.commitMetaLocked(ops)
+}
@@ -20,6 +20,9 @@ func TestStatsAndHealthReportsMetadata(t *testing.T) {
 	}
 	data := bytes.Repeat([]byte("observed"), 32)
 	putTestBytes(t, store, "tenant-a", "observed/blob", data)
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 	stats, err := store.Stats(testContext(t))
 	if err != nil {
 		t.Fatalf("stats: %v", err)
@@ -184,6 +184,9 @@ func TestGCSkipsCorruptUnreferencedChunksWithoutNoopTransaction(t *testing.T) {
 	if err := store.DeleteObject(testContext(t), "tenant-a", "gc/corrupt"); err != nil {
 		t.Fatalf("delete: %v", err)
 	}
+	if err := store.sealActiveSegment(); err != nil {
+		t.Fatalf("seal: %v", err)
+	}
 	store.metaMu.Lock()
 	var ops []metaOp
 	for _, chunk := range store.meta.Chunks {
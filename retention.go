@@ -0,0 +1,444 @@
+package blobfs
+
+import (
+	"context"
+	"crypto/cipher"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+const metaRetainedDir = "retained"
+
+// retainedLog is a retired txlog generation holding transactions in
+// (start, end].
+type retainedLog struct {
+	name    string
+	start   uint64
+	end     uint64
+	modTime time.Time
+}
+
+// retainedImage is an archived base image of the metadata at txid.
+type retainedImage struct {
+	name string
+	txid uint64
+	time int64
+}
+
+type restoreTarget struct {
+	txid   uint64
+	time   int64
+	byTime bool
+}
+
+func (t restoreTarget) includes(tx metaTx) bool {
+	if t.byTime {
+		return tx.Time <= t.time
+	}
+	return tx.TxID <= t.txid
+}
+
+func (t restoreTarget) includesImage(image retainedImage) bool {
+	if t.byTime {
+		return image.time <= t.time
+	}
+	return image.txid <= t.txid
+}
+
+func metaRetainedPath(metaDir, name string) string {
+	return filepath.Join(metaDir, metaRetainedDir, name)
+}
+
+func retainedLogName(start, end uint64) string {
+	return fmt.Sprintf("log-%020d-%020d.log", start, end)
+}
+
+func retainedImageName(txid uint64, updatedAt int64) string {
+	return fmt.Sprintf("image-%020d-%020d.bin", txid, updatedAt)
+}
+
+func (s *Store) retentionEnabled() bool {
+	return s.cfg.Retention.Generations > 0 || s.cfg.Retention.MaxAge > 0
+}
+
+// listRetained returns retired log generations ordered by their last txid and
+// archived images ordered by txid.
+func listRetained(fsys afero.Fs, metaDir string) ([]retainedLog, []retainedImage, error) {
+	entries, err := afero.ReadDir(fsys, filepath.Join(metaDir, metaRetainedDir))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	var logs []retainedLog
+	var images []retainedImage
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+		switch {
+		case strings.HasPrefix(name, "log-") && strings.HasSuffix(name, ".log"):
+			parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "log-"), ".log"), "-")
+			if len(parts) != 2 {
+				continue
+			}
+			start, err1 := strconv.ParseUint(parts[0], 10, 64)
+			end, err2 := strconv.ParseUint(parts[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			logs = append(logs, retainedLog{name: name, start: start, end: end, modTime: entry.ModTime()})
+		case strings.HasPrefix(name, "image-") && strings.HasSuffix(name, ".bin"):
+			parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(name, "image-"), ".bin"), "-")
+			if len(parts) != 2 {
+				continue
+			}
+			txid, err1 := strconv.ParseUint(parts[0], 10, 64)
+			updatedAt, err2 := strconv.ParseInt(parts[1], 10, 64)
+			if err1 != nil || err2 != nil {
+				continue
+			}
+			images = append(images, retainedImage{name: name, txid: txid, time: updatedAt})
+		}
+	}
+	sort.Slice(logs, func(i, j int) bool { return logs[i].end < logs[j].end })
+	sort.Slice(images, func(i, j int) bool { return images[i].txid < images[j].txid })
+	return logs, images, nil
+}
+
+// retireMetaLogLocked disposes of a txlog generation replaced by a checkpoint.
+// With retention enabled it moves to the retained directory instead of being
+// deleted.
+func (s *Store) retireMetaLogLocked(name string, start, end uint64) error {
+	path := filepath.Join(metaTxLogDir(s.metaDir), name)
+	if !s.retentionEnabled() {
+		if err := s.fs.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := s.fs.MkdirAll(filepath.Join(s.metaDir, metaRetainedDir), 0o755); err != nil {
+		return err
+	}
+	return s.fs.Rename(path, metaRetainedPath(s.metaDir, retainedLogName(start, end)))
+}
+
+// pruneRetainedLocked drops retained generations outside the retention policy
+// and records the oldest restorable time, which bounds segment deletion.
+//
+// A restore point needs an image at or before it plus every log after that
+// image, so logs are only dropped once a newer image can anchor the oldest
+// generation the policy keeps.
+func (s *Store) pruneRetainedLocked(now time.Time) error {
+	if !s.retentionEnabled() {
+		s.retentionFloor = math.MaxInt64
+		err := s.fs.RemoveAll(filepath.Join(s.metaDir, metaRetainedDir))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	logs, images, err := listRetained(s.fs, s.metaDir)
+	if err != nil {
+		return err
+	}
+	keepFrom := s.metaLogStartTxID
+	if len(s.metaPrevLogs) > 0 {
+		keepFrom = s.metaPrevLogs[0].start
+	}
+	for i, log := range logs {
+		kept := len(logs)-i <= s.cfg.Retention.Generations ||
+			(s.cfg.Retention.MaxAge > 0 && now.Sub(log.modTime) <= s.cfg.Retention.MaxAge)
+		if kept {
+			keepFrom = log.start
+			break
+		}
+	}
+	oldestStart := keepFrom
+	if len(logs) > 0 {
+		oldestStart = logs[0].start
+	} else if len(s.metaPrevLogs) > 0 {
+		oldestStart = s.metaPrevLogs[0].start
+	}
+	anchorTxID, anchorTime, ok := uint64(0), int64(0), oldestStart == 0
+	for _, image := range images {
+		if image.txid <= keepFrom {
+			anchorTxID, anchorTime, ok = image.txid, image.time, true
+		}
+	}
+	if !ok {
+		s.retentionFloor = math.MaxInt64
+		if len(images) > 0 {
+			s.retentionFloor = images[0].time
+		}
+		return nil
+	}
+	var removeErr error
+	for _, log := range logs {
+		if log.end <= anchorTxID {
+			removeErr = errors.Join(removeErr, s.fs.Remove(metaRetainedPath(s.metaDir, log.name)))
+		}
+	}
+	for _, image := range images {
+		if image.txid < anchorTxID {
+			removeErr = errors.Join(removeErr, s.fs.Remove(metaRetainedPath(s.metaDir, image.name)))
+		}
+	}
+	s.retentionFloor = anchorTime
+	return removeErr
+}
+
+// retainedSegmentCutoffLocked lowers a GC segment deletion cutoff so segments
+// that died after the oldest retained restore point keep their files.
+func (s *Store) retainedSegmentCutoffLocked(cutoff int64) int64 {
+	if !s.retentionEnabled() || s.retentionFloor == math.MaxInt64 {
+		return cutoff
+	}
+	if floor := s.retentionFloor - 1; floor < cutoff {
+		return floor
+	}
+	return cutoff
+}
+
+// RestoreToTx opens the store as it was right after transaction txid
+// committed. The result is read-only unless opts.TargetDir asks for a
+// writable copy.
+func (s *Store) RestoreToTx(ctx context.Context, txid uint64, opts RestoreOptions) (*Store, error) {
+	return s.restore(ctx, restoreTarget{txid: txid}, opts)
+}
+
+// RestoreToTime opens the store as it was at t, after the last transaction
+// committed at or before t.
+func (s *Store) RestoreToTime(ctx context.Context, t time.Time, opts RestoreOptions) (*Store, error) {
+	return s.restore(ctx, restoreTarget{time: t.UnixNano(), byTime: true}, opts)
+}
+
+func (s *Store) restore(ctx context.Context, target restoreTarget, opts RestoreOptions) (*Store, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	s.metaMu.RLock()
+	meta, err := s.restoreMetadataLocked(target)
+	var pinned []string
+	if err == nil && opts.TargetDir != "" {
+		for id, seg := range meta.Segments {
+			if seg != nil && seg.State != segmentStateDeleted {
+				s.pinSegment(id)
+				pinned = append(pinned, id)
+			}
+		}
+	}
+	s.metaMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	if opts.TargetDir == "" {
+		return s.openRestoredView(meta), nil
+	}
+	defer func() {
+		for _, id := range pinned {
+			s.unpinSegment(id)
+		}
+	}()
+	return s.copyRestorePoint(ctx, meta, opts)
+}
+
+// restoreMetadataLocked rebuilds metadata from the newest retained image that
+// precedes the target and the log generations after it, stopping at the
+// target.
+func (s *Store) restoreMetadataLocked(target restoreTarget) (*metadata, error) {
+	logs, images, err := listRetained(s.fs, s.metaDir)
+	if err != nil {
+		return nil, err
+	}
+	meta := newMetadata()
+	var anchor *retainedImage
+	for i := range images {
+		if target.includesImage(images[i]) {
+			anchor = &images[i]
+		}
+	}
+	if anchor == nil && (len(logs) == 0 || logs[0].start != 0) {
+		return nil, ErrRestorePointNotFound
+	}
+	if anchor != nil {
+		data, err := afero.ReadFile(s.fs, metaRetainedPath(s.metaDir, anchor.name))
+		if err != nil {
+			return nil, err
+		}
+		if err := decodeMetaCheckpoint(data, meta); err != nil {
+			return nil, err
+		}
+	}
+	err = s.scanRetainedLogsLocked(meta.TxID, func(tx metaTx) (bool, error) {
+		if tx.TxID <= meta.TxID {
+			return true, nil
+		}
+		if !target.includes(tx) {
+			return false, nil
+		}
+		if tx.TxID != meta.TxID+1 {
+			return false, fmt.Errorf("%w: txlog gap before tx %d", ErrRestorePointNotFound, tx.TxID)
+		}
+		applyMetaTx(meta, tx)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !target.byTime && meta.TxID != target.txid {
+		return nil, ErrRestorePointNotFound
+	}
+	recoverInProgressMetadata(meta)
+	recomputeMetaCounters(meta)
+	meta.DeltaSeq = 0
+	meta.dirty = nil
+	return meta, nil
+}
+
+// scanRetainedLogsLocked visits transactions from the retained generations
+// that end after afterTxID, then the generations not yet retired and the
+// active txlog, in order, until visit returns false.
+func (s *Store) scanRetainedLogsLocked(afterTxID uint64, visit func(tx metaTx) (bool, error)) error {
+	logs, _, err := listRetained(s.fs, s.metaDir)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for _, log := range logs {
+		if log.end > afterTxID {
+			paths = append(paths, metaRetainedPath(s.metaDir, log.name))
+		}
+	}
+	for _, log := range s.metaPrevLogs {
+		paths = append(paths, filepath.Join(metaTxLogDir(s.metaDir), log.name))
+	}
+	paths = append(paths, filepath.Join(metaTxLogDir(s.metaDir), s.metaLogName))
+	for _, path := range paths {
+		stopped := false
+		_, err := scanMetaLog(s.fs, path, func(tx metaTx) (bool, error) {
+			more, err := visit(tx)
+			stopped = !more
+			return more, err
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// openRestoredView wraps restored metadata in a read-only store that reads
+// segments from this store's data directory.
+func (s *Store) openRestoredView(meta *metadata) *Store {
+	viewCtx, cancel := context.WithCancel(context.Background())
+	return &Store{
+		fs:          s.fs,
+		baseDir:     s.baseDir,
+		metaDir:     s.metaDir,
+		segmentsDir: s.segmentsDir,
+		parityDir:   s.parityDir,
+		stagingDir:  s.stagingDir,
+		cfg:         s.cfg,
+		meta:        meta,
+		metaGroup:   newMetaCommitGroup(),
+		readOnly:    true,
+		watchFloor:  meta.TxID,
+		pins:        map[string]int{},
+		dataKeys:    map[dataKeyRef]cipher.AEAD{},
+		handles:     map[storeHandle]struct{}{},
+		ctx:         viewCtx,
+		cancel:      cancel,
+		closed:      make(chan struct{}),
+	}
+}
+
+// copyRestorePoint writes restored metadata and the segments it references to
+// a new store directory and opens it.
+func (s *Store) copyRestorePoint(ctx context.Context, meta *metadata, opts RestoreOptions) (*Store, error) {
+	targetFS := opts.TargetFS
+	if targetFS == nil {
+		targetFS = s.fs
+	}
+	targetDir := filepath.Clean(opts.TargetDir)
+	metaDir := filepath.Join(targetDir, "meta")
+	if exists, err := afero.Exists(targetFS, metaDir); err != nil {
+		return nil, err
+	} else if exists {
+		return nil, pathError("restore", targetDir, fs.ErrExist)
+	}
+	segmentsDir := filepath.Join(targetDir, "data", "segments")
+	parityDir := filepath.Join(targetDir, "data", "parity")
+	ids := make([]string, 0, len(meta.Segments))
+	for id, seg := range meta.Segments {
+		if seg != nil && seg.State != segmentStateDeleted {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		if err := contextError(ctx); err != nil {
+			return nil, err
+		}
+		seg := meta.Segments[id]
+		if err := copyFileSync(s.fs, s.segmentPath(seg), targetFS, filepath.Join(segmentsDir, seg.RelativePath)); err != nil {
+			return nil, fmt.Errorf("restore segment %s: %w", id, err)
+		}
+		// Parity is optional, so a segment without it is copied alone.
+		err := copyFileSync(s.fs, s.parityPath(seg), targetFS, filepath.Join(parityDir, seg.RelativePath+parityFileSuffix))
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("restore parity of segment %s: %w", id, err)
+		}
+	}
+	if err := saveMetaCheckpoint(targetFS, metaDir, meta, false); err != nil {
+		return nil, err
+	}
+	if err := saveSuperBlock(targetFS, metaDir, meta.TxID, metaLogFile); err != nil {
+		return nil, err
+	}
+	return OpenFS(targetFS, targetDir, s.cfg)
+}
+
+func copyFileSync(srcFS afero.Fs, src string, dstFS afero.Fs, dst string) error {
+	in, err := srcFS.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	if err := dstFS.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	out, err := dstFS.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
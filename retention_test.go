@@ -0,0 +1,188 @@
+package blobfs
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func retentionTestConfig(generations int) Config {
+	cfg := testConfig()
+	cfg.Retention.Generations = generations
+	return cfg
+}
+
+func TestRestoreToTxRecoversDeletedTenantReadOnly(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", retentionTestConfig(4))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	putTestBytes(t, store, "tenant-a", "report.txt", []byte("quarterly numbers"))
+	checkpointTestStore(t, store)
+	store.metaMu.RLock()
+	before := store.meta.TxID
+	store.metaMu.RUnlock()
+
+	if err := store.DeleteTenant(testContext(t), "tenant-a"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := store.RunGC(testContext(t), GCOptions{Compact: true}); err != nil {
+			t.Fatalf("gc: %v", err)
+		}
+		checkpointTestStore(t, store)
+	}
+
+	view, err := store.RestoreToTx(testContext(t), before, RestoreOptions{})
+	if err != nil {
+		t.Fatalf("restore: %v", err)
+	}
+	defer view.Close()
+	if got := readTestBytes(t, view, "tenant-a", "report.txt"); string(got) != "quarterly numbers" {
+		t.Fatalf("restored object = %q", got)
+	}
+	if _, err := view.Put(testContext(t), "tenant-a", "new.txt", nil, nil); err == nil {
+		t.Fatal("put with nil reader should fail")
+	}
+	if err := view.Mkdir("tenant-a/dir", 0o755); !errors.Is(err, ErrReadOnly) {
+		t.Fatalf("mkdir on restore view = %v, want ErrReadOnly", err)
+	}
+	if _, err := store.StatObject(testContext(t), "tenant-a", "report.txt"); err == nil {
+		t.Fatal("restore must not change the live store")
+	}
+	if _, err := store.RestoreToTx(testContext(t), before+1000, RestoreOptions{}); !errors.Is(err, ErrRestorePointNotFound) {
+		t.Fatalf("restore beyond head = %v", err)
+	}
+}
+
+func TestRestoreToTimeCreatesWritableCopy(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", retentionTestConfig(4))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("version one"))
+	checkpointTestStore(t, store)
+	point := time.Now()
+	time.Sleep(2 * time.Millisecond)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("version two"))
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("later"))
+
+	copied, err := store.RestoreToTime(testContext(t), point, RestoreOptions{TargetDir: "/copy"})
+	if err != nil {
+		t.Fatalf("restore to time: %v", err)
+	}
+	if got := readTestBytes(t, copied, "tenant-a", "a.txt"); string(got) != "version one" {
+		t.Fatalf("restored a.txt = %q", got)
+	}
+	if _, err := copied.StatObject(testContext(t), "tenant-a", "b.txt"); err == nil {
+		t.Fatal("object written after the restore point is visible")
+	}
+	putTestBytes(t, copied, "tenant-a", "c.txt", []byte("copy only"))
+	if err := copied.Close(); err != nil {
+		t.Fatalf("close copy: %v", err)
+	}
+	if _, err := store.StatObject(testContext(t), "tenant-a", "c.txt"); err == nil {
+		t.Fatal("write to the copy reached the source store")
+	}
+
+	reopened, err := OpenFS(fsys, "/copy", testConfig())
+	if err != nil {
+		t.Fatalf("reopen copy: %v", err)
+	}
+	defer reopened.Close()
+	if got := readTestBytes(t, reopened, "tenant-a", "c.txt"); string(got) != "copy only" {
+		t.Fatalf("copy c.txt = %q", got)
+	}
+	if _, err := store.RestoreToTime(testContext(t), point, RestoreOptions{TargetDir: "/copy"}); err == nil {
+		t.Fatal("restore into an existing store should fail")
+	}
+}
+
+func TestRestoreWithoutRetentionIsUnavailable(t *testing.T) {
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("data"))
+	checkpointTestStore(t, store)
+	if _, err := store.RestoreToTx(testContext(t), 1, RestoreOptions{}); !errors.Is(err, ErrRestorePointNotFound) {
+		t.Fatalf("restore without retention = %v", err)
+	}
+}
+
+func TestRetentionPrunesGenerationsAndReleasesSegments(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", retentionTestConfig(1))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	putTestBytes(t, store, "tenant-a", "old.txt", []byte("soon deleted"))
+	checkpointTestStore(t, store)
+	if err := store.DeleteObject(testContext(t), "tenant-a", "old.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	store.metaMu.RLock()
+	cutoff := store.retainedSegmentCutoffLocked(time.Now().UnixNano())
+	store.metaMu.RUnlock()
+	if cutoff >= 0 {
+		t.Fatalf("history back to tx 0 is retained, cutoff = %d", cutoff)
+	}
+
+	for i := 0; i < 2*metaDeltaMergeInterval+2; i++ {
+		putTestBytes(t, store, "tenant-a", "file-"+strconv.Itoa(i), []byte("payload-"+strconv.Itoa(i)))
+		checkpointTestStore(t, store)
+	}
+	waitMetaMerge(t, store)
+	checkpointTestStore(t, store)
+	putTestBytes(t, store, "tenant-a", "after-merge", []byte("after"))
+	checkpointTestStore(t, store)
+	logs, images, err := listRetained(fsys, "/blobfs/meta")
+	if err != nil {
+		t.Fatalf("list retained: %v", err)
+	}
+	if len(images) == 0 || len(logs) > metaDeltaMergeInterval+1 {
+		t.Fatalf("retained logs=%d images=%d", len(logs), len(images))
+	}
+	if (len(logs) > 0 && logs[0].start == 0) || images[0].txid == 0 {
+		t.Fatal("oldest generation should be pruned once an image anchors newer ones")
+	}
+	store.metaMu.RLock()
+	floor := store.retentionFloor
+	cutoff = store.retainedSegmentCutoffLocked(time.Now().UnixNano())
+	store.metaMu.RUnlock()
+	if floor <= 0 || cutoff != floor-1 {
+		t.Fatalf("retention floor = %d, cutoff = %d", floor, cutoff)
+	}
+	if _, err := store.RestoreToTx(testContext(t), 1, RestoreOptions{}); !errors.Is(err, ErrRestorePointNotFound) {
+		t.Fatalf("restore before pruned history = %v", err)
+	}
+}
+
+func waitMetaMerge(t *testing.T, store *Store) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store.metaMu.RLock()
+		merging := store.metaMerging
+		store.metaMu.RUnlock()
+		if !merging {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("background merge did not finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -10,9 +10,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
-	"sync"
 
-	"github.com/klauspost/compress/zstd"
 	"github.com/spf13/afero"
 )
 
@@ -22,32 +20,22 @@ const (
 	recordVersion      = uint16(2)
 	recordHeaderSize   = 104
 
-	compressionZstdID = uint32(1)
-	segmentFanout     = int64(1024)
+	// Record kinds; an encrypted record holds nonce || AES-GCM ciphertext of
+	// the compressed payload.
+	recordKindPlain     = uint16(1)
+	recordKindEncrypted = uint16(2)
+
+	segmentFanout = int64(1024)
 )
 
 var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
 
-var zstdEncoderPool = sync.Pool{New: func() any {
-	enc, err := zstd.NewWriter(nil, zstd.WithEncoderConcurrency(1))
-	if err != nil {
-		return err
-	}
-	return enc
-}}
-
-var zstdDecoderPool = sync.Pool{New: func() any {
-	dec, err := zstd.NewReader(nil)
-	if err != nil {
-		return err
-	}
-	return dec
-}}
-
 type segmentBatchWriter struct {
-	store    *Store
-	current  *preparedSegment
-	segments []*segmentRecord
+	store       *Store
+	compression compressionSettings
+	sealer      *chunkCipher
+	current     *preparedSegment
+	segments    []*segmentRecord
 }
 
 type preparedSegment struct {
@@ -80,40 +68,56 @@ func (s *Store) newSegmentRecord() *segmentRecord {
 }
 
 func (w *segmentBatchWriter) appendChunk(scopeID, chunkID string, raw []byte) (chunkRecord, error) {
-	payload, err := compressZstd(raw)
+	record, chunk, err := buildChunkRecord(w.compression, w.sealer, scopeID, chunkID, raw)
 	if err != nil {
 		return chunkRecord{}, err
 	}
-	recordLen := int64(recordHeaderSize + len(payload))
+	recordLen := int64(len(record))
 	if w.current == nil || (w.current.record.WriteOffset > int64(len(segmentHeaderMagic)) && w.current.record.WriteOffset+recordLen > w.store.cfg.SegmentSize) {
 		if err := w.rotate(); err != nil {
 			return chunkRecord{}, err
 		}
 	}
 	seg := w.current.record
-	offset := seg.WriteOffset
-	checksum := crc32.Checksum(payload, crc32cTable)
-	header := makeRecordHeader(chunkID, int64(len(raw)), int64(len(payload)), checksum)
-	if _, err := w.current.file.Write(header); err != nil {
-		return chunkRecord{}, err
-	}
-	if _, err := w.current.file.Write(payload); err != nil {
+	if _, err := w.current.file.Write(record); err != nil {
 		return chunkRecord{}, err
 	}
+	chunk.SegmentID = seg.SegmentID
+	chunk.SegmentOffset = seg.WriteOffset
 	seg.WriteOffset += recordLen
 	seg.TotalBytes += recordLen
+	return chunk, nil
+}
+
+// buildChunkRecord compresses raw into a segment record, encrypting it when
+// sealer is set, and describes it as a chunk; the caller fills in where the
+// record was written.
+func buildChunkRecord(compression compressionSettings, sealer *chunkCipher, scopeID, chunkID string, raw []byte) ([]byte, chunkRecord, error) {
+	payload, used, err := compressPayload(compression, raw)
+	if err != nil {
+		return nil, chunkRecord{}, err
+	}
+	kind, keyVersion := recordKindPlain, uint32(0)
+	if sealer != nil {
+		if payload, err = sealer.seal(chunkID, payload); err != nil {
+			return nil, chunkRecord{}, err
+		}
+		kind, keyVersion = recordKindEncrypted, sealer.version
+	}
+	checksum := crc32.Checksum(payload, crc32cTable)
+	record := makeRecordHeader(chunkID, kind, int64(len(raw)), int64(len(payload)), codecs[used].id, checksum)
+	record = append(record, payload...)
 	now := nowUnix()
-	return chunkRecord{
+	return record, chunkRecord{
 		ChunkID:        chunkID,
 		TenantID:       scopeID,
 		RawSize:        int64(len(raw)),
 		StoredSize:     int64(len(payload)),
 		State:          chunkStateActive,
-		SegmentID:      seg.SegmentID,
-		SegmentOffset:  offset,
-		SegmentLength:  recordLen,
+		SegmentLength:  int64(len(record)),
 		ChecksumCRC32C: checksum,
-		Compression:    string(CompressionZstd),
+		Compression:    string(used),
+		KeyVersion:     keyVersion,
 		CreatedAt:      now,
 		LastSeenAt:     now,
 	}, nil
@@ -168,6 +172,9 @@ func (w *segmentBatchWriter) finish() error {
 		if err := syncDir(w.store.fs, filepath.Dir(final)); err != nil {
 			return errors.Join(err, w.removePublished(published))
 		}
+		if err := w.store.writeSegmentParity(seg); err != nil {
+			return errors.Join(err, w.removePublished(published))
+		}
 	}
 	return nil
 }
@@ -188,6 +195,9 @@ func (w *segmentBatchWriter) removePublished(segments []*segmentRecord) error {
 		if err := w.store.fs.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
 			errs = append(errs, fmt.Errorf("remove published segment %s: %w", path, err))
 		}
+		if err := w.store.removeSegmentParity(seg); err != nil {
+			errs = append(errs, fmt.Errorf("remove parity of published segment %s: %w", path, err))
+		}
 	}
 	return errors.Join(errs...)
 }
@@ -221,15 +231,15 @@ func sscanfSegmentID(id string, seq *int64) (int, error) {
 	return fmt.Sscanf(id, "%d", seq)
 }
 
-func makeRecordHeader(chunkID string, rawSize, storedSize int64, checksum uint32) []byte {
+func makeRecordHeader(chunkID string, kind uint16, rawSize, storedSize int64, compression, checksum uint32) []byte {
 	header := make([]byte, recordHeaderSize)
 	binary.LittleEndian.PutUint32(header[0:4], recordMagic)
 	binary.LittleEndian.PutUint16(header[4:6], recordVersion)
-	binary.LittleEndian.PutUint16(header[6:8], 1)
+	binary.LittleEndian.PutUint16(header[6:8], kind)
 	copy(header[8:72], []byte(chunkID))
 	binary.LittleEndian.PutUint64(header[72:80], uint64(rawSize))
 	binary.LittleEndian.PutUint64(header[80:88], uint64(storedSize))
-	binary.LittleEndian.PutUint32(header[88:92], compressionZstdID)
+	binary.LittleEndian.PutUint32(header[88:92], compression)
 	binary.LittleEndian.PutUint32(header[92:96], checksum)
 	binary.LittleEndian.PutUint64(header[96:104], uint64(storedSize))
 	return header
@@ -273,15 +283,52 @@ func parseRecordHeader(header []byte) (
 }
 
 func (s *Store) readChunkPayloadAt(seg segmentRecord, chunk chunkRecord) ([]byte, error) {
+	raw, _, err := s.readChunkPayload(seg, chunk)
+	return raw, err
+}
+
+// readChunkPayload reads and verifies the record of chunk. A damaged record
+// is rebuilt from the parity of its segment and the damaged shards are
+// rewritten in place; reconstructed reports whether that was needed.
+func (s *Store) readChunkPayload(seg segmentRecord, chunk chunkRecord) (raw []byte, reconstructed bool, err error) {
+	raw, err = s.readChunkRecord(seg, chunk)
+	if err == nil || errors.Is(err, ErrKeyUnavailable) {
+		return raw, false, err
+	}
+	raw, repairs, rebuildErr := s.reconstructChunk(seg, chunk)
+	if rebuildErr != nil {
+		return nil, false, err
+	}
+	// The rebuilt record is already verified, so a failed write-back does not
+	// fail the read; Health reports it and the next read rebuilds the record
+	// again. A segment that is no longer SEALED is left to whatever changed
+	// it, such as compaction rewriting its chunks.
+	if err := s.healSegment(seg, repairs, segmentStateSealed); !errors.Is(err, errSegmentChanged) {
+		s.recordReadRepair(seg, err)
+	}
+	return raw, true, nil
+}
+
+func (s *Store) readChunkRecord(seg segmentRecord, chunk chunkRecord) ([]byte, error) {
+	if chunk.SegmentLength < recordHeaderSize {
+		return nil, errors.New("segment record length mismatch")
+	}
 	file, err := s.fs.Open(s.segmentPath(&seg))
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
-	header := make([]byte, recordHeaderSize)
-	if _, err = file.ReadAt(header, chunk.SegmentOffset); err != nil {
+	record := make([]byte, chunk.SegmentLength)
+	if _, err = file.ReadAt(record, chunk.SegmentOffset); err != nil {
 		return nil, err
 	}
+	return s.decodeChunkRecord(record, chunk)
+}
+
+// decodeChunkRecord verifies a whole segment record against the metadata of
+// its chunk and returns the raw chunk bytes.
+func (s *Store) decodeChunkRecord(record []byte, chunk chunkRecord) ([]byte, error) {
+	header := record[:recordHeaderSize]
 	recordChunkID, rawSize, storedSize, compression, checksum, payloadLen, err := parseRecordHeader(header)
 	if err != nil {
 		return nil, err
@@ -290,23 +337,37 @@ func (s *Store) readChunkPayloadAt(seg segmentRecord, chunk chunkRecord) ([]byte
 		return nil, fmt.Errorf("segment record chunk mismatch: want %s got %s", chunk.ChunkID, recordChunkID)
 	}
 	expectedPayloadLen := chunk.SegmentLength - recordHeaderSize
-	if expectedPayloadLen < 0 || payloadLen != expectedPayloadLen || storedSize != chunk.StoredSize {
+	if payloadLen != expectedPayloadLen || storedSize != chunk.StoredSize {
 		return nil, errors.New("segment record length mismatch")
 	}
-	payload := make([]byte, payloadLen)
-	if _, err = file.ReadAt(payload, chunk.SegmentOffset+recordHeaderSize); err != nil {
-		return nil, err
-	}
+	payload := record[recordHeaderSize:]
 	if crc32.Checksum(payload, crc32cTable) != checksum {
 		return nil, errors.New("segment payload crc32c mismatch")
 	}
 	if checksum != chunk.ChecksumCRC32C {
 		return nil, errors.New("chunk metadata checksum mismatch")
 	}
-	if compression != compressionZstdID {
+	codecName, codec, ok := codecByID(compression)
+	if !ok {
 		return nil, errors.New("unsupported compression")
 	}
-	raw, err := decompressZstd(payload)
+	if chunk.Compression != "" && chunk.Compression != string(codecName) {
+		return nil, errors.New("chunk metadata compression mismatch")
+	}
+	encrypted := binary.LittleEndian.Uint16(header[6:8]) == recordKindEncrypted
+	if encrypted != (chunk.KeyVersion != 0) {
+		return nil, errors.New("chunk metadata encryption mismatch")
+	}
+	if encrypted {
+		aead, err := s.chunkAEAD(s.ctx, &chunk)
+		if err != nil {
+			return nil, err
+		}
+		if payload, err = openChunkPayload(aead, chunk.ChunkID, payload); err != nil {
+			return nil, err
+		}
+	}
+	raw, err := codec.decode(payload)
 	if err != nil {
 		return nil, err
 	}
@@ -322,23 +383,3 @@ func (s *Store) readChunkPayloadAt(seg segmentRecord, chunk chunkRecord) ([]byte
 	}
 	return raw, nil
 }
-
-func compressZstd(raw []byte) ([]byte, error) {
-	item := zstdEncoderPool.Get()
-	if err, ok := item.(error); ok {
-		return nil, err
-	}
-	enc := item.(*zstd.Encoder)
-	defer zstdEncoderPool.Put(enc)
-	return enc.EncodeAll(raw, make([]byte, 0, len(raw))), nil
-}
-
-func decompressZstd(payload []byte) ([]byte, error) {
-	item := zstdDecoderPool.Get()
-	if err, ok := item.(error); ok {
-		return nil, err
-	}
-	dec := item.(*zstd.Decoder)
-	defer zstdDecoderPool.Put(dec)
-	return dec.DecodeAll(payload, nil)
-}
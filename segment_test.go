@@ -16,7 +16,7 @@ import (
 )
 
 func TestParseRecordHeaderRejectsInvalidHeaders(t *testing.T) {
-	header := makeRecordHeader("chunk-id", 10, 5, 123)
+	header := makeRecordHeader("chunk-id", recordKindPlain, 10, 5, compressionZstdID, 123)
 	chunkID, rawSize, storedSize, compression, checksum, payloadLen, err := parseRecordHeader(header)
 	if err != nil {
 		t.Fatalf("parse valid header: %v", err)
@@ -122,12 +122,12 @@ func TestReadPathRejectsChunkHashMismatch(t *testing.T) {
 	store.metaMu.RUnlock()
 
 	badRaw := bytes.Repeat([]byte("B"), int(chunk.RawSize))
-	payload, err := compressZstd(badRaw)
+	payload, err := compressZstd(badRaw, 0)
 	if err != nil {
 		t.Fatalf("compress bad raw: %v", err)
 	}
 	checksum := crc32.Checksum(payload, crc32cTable)
-	header := makeRecordHeader(chunk.ChunkID, int64(len(badRaw)), int64(len(payload)), checksum)
+	header := makeRecordHeader(chunk.ChunkID, recordKindPlain, int64(len(badRaw)), int64(len(payload)), compressionZstdID, checksum)
 	file, err := store.fs.OpenFile(store.segmentPath(&segment), os.O_RDWR, 0)
 	if err != nil {
 		t.Fatalf("open segment: %v", err)
@@ -188,7 +188,20 @@ func TestStagingSegmentDirectoriesArePrivate(t *testing.T) {
 	if err := store.MkdirAll("tenant-a/perms", 0o755); err != nil {
 		t.Fatalf("mkdirall: %v", err)
 	}
-	putTestBytes(t, store, "tenant-a", "perms/blob", bytes.Repeat([]byte("p"), 128))
+	data := make([]byte, 768)
+	for i := range data {
+		data[i] = byte(i*7 + i/3)
+	}
+	putTestBytes(t, store, "tenant-a", "perms/source", data)
+	livePayload, _ := firstChunkPayload(t, store, "tenant-a", "perms/source")
+	putTestBytes(t, store, "tenant-a", "perms/live", livePayload)
+	if err := store.DeleteObject(testContext(t), "tenant-a", "perms/source"); err != nil {
+		t.Fatalf("delete source: %v", err)
+	}
+	candidates, _ := markCompactionCandidatesForTest(t, store)
+	if _, err := store.compactCandidates(testContext(t), candidates); err != nil {
+		t.Fatalf("compact candidates: %v", err)
+	}
 	info, err := store.fs.Stat(filepath.Join(store.stagingDir, "0000", "0000"))
 	if err != nil {
 		t.Fatalf("stat staging segment dir: %v", err)
@@ -199,7 +212,7 @@ func TestStagingSegmentDirectoriesArePrivate(t *testing.T) {
 }
 
 func TestParseRecordHeaderRawSizeOverflow(t *testing.T) {
-	header := makeRecordHeader("chunk-id", 10, 5, 123)
+	header := makeRecordHeader("chunk-id", recordKindPlain, 10, 5, compressionZstdID, 123)
 	// Overwrite rawSize bytes [72:80] with uint64 > math.MaxInt64
 	binary.LittleEndian.PutUint64(header[72:80], math.MaxUint64)
 	// Leave storedSize and payloadLen at valid equal values
@@ -211,7 +224,7 @@ func TestParseRecordHeaderRawSizeOverflow(t *testing.T) {
 }
 
 func TestParseRecordHeaderSizeOverflow(t *testing.T) {
-	header := makeRecordHeader("chunk-id", 10, 5, 123)
+	header := makeRecordHeader("chunk-id", recordKindPlain, 10, 5, compressionZstdID, 123)
 	binary.LittleEndian.PutUint64(header[80:88], math.MaxUint64)
 	binary.LittleEndian.PutUint64(header[96:104], math.MaxUint64)
 
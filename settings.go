@@ -0,0 +1,37 @@
+package blobfs
+
+// cloneTenantSettings returns a copy of settings that shares no slices with
+// it, or empty settings for tenantID when settings is nil.
+func cloneTenantSettings(tenantID string, settings *tenantSettings) *tenantSettings {
+	if settings == nil {
+		return &tenantSettings{TenantID: tenantID}
+	}
+	next := *settings
+	next.Lifecycle = append([]lifecycleRule(nil), settings.Lifecycle...)
+	if settings.Config != nil {
+		config := *settings.Config
+		next.Config = &config
+	}
+	return &next
+}
+
+// emptyTenantSettings reports whether settings holds nothing but its tenant.
+func emptyTenantSettings(settings *tenantSettings) bool {
+	return !settings.Versioning && settings.MaxVersions == 0 && settings.VersionMaxAge == 0 &&
+		len(settings.Lifecycle) == 0 && !settings.Trash && settings.TrashMaxAge == 0 && !settings.hasQuota() && settings.Config == nil
+}
+
+// updateTenantSettingsLocked commits the settings of tenantID after update
+// has changed a copy of them. Settings left empty are deleted.
+func (s *Store) updateTenantSettingsLocked(tenantID string, update func(*tenantSettings)) error {
+	current := s.meta.TenantSettings[tenantID]
+	next := cloneTenantSettings(tenantID, current)
+	update(next)
+	if emptyTenantSettings(next) {
+		if current == nil {
+			return nil
+		}
+		return s.commitMetaFinalLocked([]metaOp{{Type: "delete_tenant_settings", TenantID: tenantID}})
+	}
+	return s.commitMetaFinalLocked([]metaOp{{Type: "put_tenant_settings", Settings: next}})
+}
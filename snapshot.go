@@ -0,0 +1,431 @@
+package blobfs
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	_ fs.FS        = (*snapshotFS)(nil)
+	_ fs.StatFS    = (*snapshotFS)(nil)
+	_ fs.ReadDirFS = (*snapshotFS)(nil)
+)
+
+func snapshotKey(tenantID, name string) string {
+	return tenantID + "/" + name
+}
+
+func validateSnapshotName(name string, cfg Config) error {
+	if err := validateTenantID(name, cfg); err != nil {
+		return fmt.Errorf("invalid snapshot name %q", name)
+	}
+	return nil
+}
+
+func cloneSnapshot(snapshot *snapshotRecord) *snapshotRecord {
+	next := *snapshot
+	next.Inodes = make([]inodeRecord, len(snapshot.Inodes))
+	for i := range snapshot.Inodes {
+		next.Inodes[i] = snapshot.Inodes[i]
+		next.Inodes[i].Options = copyOptions(snapshot.Inodes[i].Options)
+	}
+	return &next
+}
+
+func snapshotInfoFromRecord(snapshot *snapshotRecord) SnapshotInfo {
+	info := SnapshotInfo{
+		TenantID:  snapshot.TenantID,
+		Name:      snapshot.Name,
+		TxID:      snapshot.TxID,
+		CreatedAt: time.Unix(0, snapshot.CreatedAt),
+	}
+	seen := map[uint64]bool{}
+	for i := range snapshot.Inodes {
+		inode := &snapshot.Inodes[i]
+		if seen[inode.InodeID] {
+			continue
+		}
+		seen[inode.InodeID] = true
+		switch {
+		case inode.Kind == fileKindFile:
+			info.Files++
+			info.Bytes += inode.Size
+		case inode.Kind == fileKindDir && inode.ParentInode != 0:
+			info.Dirs++
+		}
+	}
+	return info
+}
+
+// CreateSnapshot records the current tree of tenantID as a read-only snapshot.
+// No data is copied: the snapshot takes a reference on every file manifest, so
+// GC keeps its chunks until DeleteSnapshot releases them.
+func (s *Store) CreateSnapshot(ctx context.Context, tenantID, name string) (*SnapshotInfo, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("snapshot", tenantID, err)
+	}
+	if err := validateSnapshotName(name, s.cfg); err != nil {
+		return nil, pathError("snapshot", name, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	root := s.activeInodeLocked(s.meta.Tenants[tenantID])
+	if root == nil {
+		return nil, notExist("snapshot", tenantID)
+	}
+	if s.meta.Snapshots[snapshotKey(tenantID, name)] != nil {
+		return nil, exists("snapshot", name)
+	}
+	now := nowUnix()
+	snapshot := &snapshotRecord{TenantID: tenantID, Name: name, TxID: s.meta.TxID, CreatedAt: now}
+	// One record per dirent: a hard-linked file appears once for every
+	// name, each copy placed at that name, so back references are dropped.
+	snapshot.Inodes = append(snapshot.Inodes, *cloneInode(root))
+	s.walkSubtreeLocked(root.InodeID, func(parentID uint64, name string, inode *inodeRecord) {
+		entry := cloneInode(inode)
+		entry.ParentInode = parentID
+		entry.Name = name
+		entry.OtherLinks = nil
+		snapshot.Inodes = append(snapshot.Inodes, *entry)
+	})
+	ops := []metaOp{{Type: "put_snapshot", Snapshot: snapshot}}
+	s.appendSnapshotRefOpsLocked(snapshot, 1, &ops, now)
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	info := snapshotInfoFromRecord(snapshot)
+	return &info, nil
+}
+
+// ListSnapshots returns the snapshots of tenantID ordered by TxID.
+func (s *Store) ListSnapshots(ctx context.Context, tenantID string) ([]SnapshotInfo, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("list snapshots", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	var infos []SnapshotInfo
+	for _, snapshot := range s.meta.Snapshots {
+		if snapshot.TenantID == tenantID {
+			infos = append(infos, snapshotInfoFromRecord(snapshot))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if infos[i].TxID != infos[j].TxID {
+			return infos[i].TxID < infos[j].TxID
+		}
+		return infos[i].Name < infos[j].Name
+	})
+	return infos, nil
+}
+
+// DeleteSnapshot removes a snapshot and releases its manifest references.
+func (s *Store) DeleteSnapshot(ctx context.Context, tenantID, name string) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("delete snapshot", tenantID, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	snapshot := s.meta.Snapshots[snapshotKey(tenantID, name)]
+	if snapshot == nil {
+		return notExist("delete snapshot", name)
+	}
+	ops := []metaOp{{Type: "delete_snapshot", TenantID: tenantID, Name: name}}
+	s.appendSnapshotRefOpsLocked(snapshot, -1, &ops, nowUnix())
+	return s.commitMetaFinalLocked(ops)
+}
+
+// RestoreSnapshot replaces the tree of tenantID with the snapshot in one
+// transaction. The snapshot is kept. The replaced tree is detached like
+// DeleteTenant and reclaimed by GC; watchers see a tenant_delete event
+// followed by a create event for every restored path.
+func (s *Store) RestoreSnapshot(ctx context.Context, tenantID, name string) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("restore snapshot", tenantID, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	snapshot := s.meta.Snapshots[snapshotKey(tenantID, name)]
+	if snapshot == nil {
+		return notExist("restore snapshot", name)
+	}
+	now := nowUnix()
+	var ops []metaOp
+	if root := s.activeInodeLocked(s.meta.Tenants[tenantID]); root != nil {
+		if err := s.checkSubtreeLockLocked("restore snapshot", root.InodeID, "", now); err != nil {
+			return err
+		}
+		next := cloneInode(root)
+		next.State = fileStateDeleted
+		next.DeletedAt = now
+		next.UpdatedAt = now
+		next.Generation++
+		ops = append(ops, metaOp{Type: "del_tenant", TenantID: tenantID}, metaOp{Type: "put_inode", Inode: next})
+	}
+	ids := make(map[uint64]uint64, len(snapshot.Inodes))
+	for i := range snapshot.Inodes {
+		if _, ok := ids[snapshot.Inodes[i].InodeID]; !ok {
+			ids[snapshot.Inodes[i].InodeID] = s.nextInodeIDLocked()
+		}
+	}
+	restored := map[uint64]*inodeRecord{}
+	for i := range snapshot.Inodes {
+		next := cloneInode(&snapshot.Inodes[i])
+		next.InodeID = ids[next.InodeID]
+		if primary := restored[next.InodeID]; primary != nil {
+			// A further hard link; the first record is the primary.
+			link := dirLink{ParentID: ids[next.ParentInode], Name: next.Name}
+			ops = append(ops, metaOp{Type: "put_dirent", ParentID: link.ParentID, Name: link.Name, ChildID: next.InodeID})
+			primary.OtherLinks = append(primary.OtherLinks, link)
+			continue
+		}
+		next.OtherLinks = nil
+		restored[next.InodeID] = next
+		next.State = fileStateActive
+		next.UpdatedAt = now
+		next.CTime = now
+		next.DeletedAt = 0
+		if next.ParentInode == 0 {
+			ops = append(ops, metaOp{Type: "put_tenant", TenantID: tenantID, ChildID: next.InodeID})
+		} else {
+			next.ParentInode = ids[next.ParentInode]
+			ops = append(ops, metaOp{Type: "put_dirent", ParentID: next.ParentInode, Name: next.Name, ChildID: next.InodeID})
+		}
+		ops = append(ops, metaOp{Type: "put_inode", Inode: next})
+	}
+	s.appendSnapshotRefOpsLocked(snapshot, 1, &ops, now)
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return pathError("restore snapshot", name, err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// appendSnapshotRefOpsLocked adds delta references to the manifest of every
+// file in snapshot, the same way one live file inode holds one reference
+// however many hard links name it.
+func (s *Store) appendSnapshotRefOpsLocked(snapshot *snapshotRecord, delta int, ops *[]metaOp, now int64) {
+	manifestRecords := map[string]*manifestRecord{}
+	manifestDeltas := map[string]int{}
+	chunkDeltas := map[string]int{}
+	s.addSnapshotRefDeltasLocked(snapshot, delta, manifestRecords, manifestDeltas, chunkDeltas)
+	appendRefDeltaOpsLocked(s.meta, ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+}
+
+func (s *Store) addSnapshotRefDeltasLocked(snapshot *snapshotRecord, delta int, manifestRecords map[string]*manifestRecord, manifestDeltas, chunkDeltas map[string]int) {
+	seen := map[uint64]bool{}
+	for i := range snapshot.Inodes {
+		inode := &snapshot.Inodes[i]
+		if inode.Kind != fileKindFile || seen[inode.InodeID] {
+			continue
+		}
+		seen[inode.InodeID] = true
+		if manifest := s.meta.Manifests[inode.ManifestID]; manifest != nil {
+			manifestRecords[manifest.ManifestID] = manifest
+			addManifestRefDelta(manifest, delta, manifestDeltas, chunkDeltas)
+		}
+	}
+}
+
+type snapshotFS struct {
+	store    *Store
+	snapshot *snapshotRecord
+	nodes    map[string]*inodeRecord
+	children map[string][]string
+}
+
+// OpenSnapshotFS returns a read-only io/fs view of a tenant snapshot. Files
+// read the chunks the snapshot keeps referenced; after DeleteSnapshot the view
+// reports fs.ErrNotExist.
+func (s *Store) OpenSnapshotFS(tenantID, name string) (fs.FS, error) {
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("open snapshot", tenantID, err)
+	}
+	s.metaMu.RLock()
+	snapshot := s.meta.Snapshots[snapshotKey(tenantID, name)]
+	s.metaMu.RUnlock()
+	if snapshot == nil {
+		return nil, notExist("open snapshot", name)
+	}
+	// Records are replaced rather than modified, so the view can index this
+	// one without holding metaMu.
+	view := &snapshotFS{
+		store:    s,
+		snapshot: snapshot,
+		nodes:    make(map[string]*inodeRecord, len(snapshot.Inodes)),
+		children: map[string][]string{},
+	}
+	paths := make(map[uint64]string, len(snapshot.Inodes))
+	for i := range snapshot.Inodes {
+		inode := &snapshot.Inodes[i]
+		if inode.ParentInode == 0 {
+			paths[inode.InodeID] = "."
+			view.nodes["."] = inode
+			continue
+		}
+		parent, ok := paths[inode.ParentInode]
+		if !ok {
+			continue
+		}
+		p := inode.Name
+		if parent != "." {
+			p = parent + "/" + inode.Name
+		}
+		if inode.Kind == fileKindDir {
+			paths[inode.InodeID] = p
+		}
+		view.nodes[p] = inode
+		view.children[parent] = append(view.children[parent], inode.Name)
+	}
+	return view, nil
+}
+
+func (v *snapshotFS) Open(name string) (fs.File, error) {
+	if err := v.store.beginOp(v.store.ctx); err != nil {
+		return nil, err
+	}
+	defer v.store.endOp()
+	node, err := v.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	info := snapshotFileInfo(node, name)
+	if node.Kind == fileKindDir {
+		entries, err := v.readDir("open", name)
+		if err != nil {
+			return nil, err
+		}
+		file := &blobVFSFile{store: v.store, name: name, mode: info.mode, modTime: info.modTime, isDir: true, entries: entries}
+		if err := v.store.registerHandle(file); err != nil {
+			_ = file.close(false)
+			return nil, err
+		}
+		return file, nil
+	}
+	v.store.metaMu.RLock()
+	reader, err := v.store.openInodeReaderLocked(node, name, 0, -1)
+	v.store.metaMu.RUnlock()
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	file := &blobVFSFile{store: v.store, name: name, reader: reader, size: node.Size, mode: info.mode, modTime: info.modTime}
+	if err := v.store.registerHandle(file); err != nil {
+		_ = file.close(false)
+		return nil, err
+	}
+	return file, nil
+}
+
+func (v *snapshotFS) Stat(name string) (fs.FileInfo, error) {
+	node, err := v.lookup("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return snapshotFileInfo(node, name), nil
+}
+
+func (v *snapshotFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	infos, err := v.readDir("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		entries = append(entries, fs.FileInfoToDirEntry(info))
+	}
+	return entries, nil
+}
+
+// lookup resolves name in the snapshot, following symlinks within it, and
+// fails once the snapshot is gone.
+func (v *snapshotFS) lookup(op, name string) (*inodeRecord, error) {
+	if !fs.ValidPath(name) {
+		return nil, invalidPath(op, name)
+	}
+	v.store.metaMu.RLock()
+	live := v.store.meta.Snapshots[snapshotKey(v.snapshot.TenantID, v.snapshot.Name)] == v.snapshot
+	v.store.metaMu.RUnlock()
+	if !live {
+		return nil, notExist(op, name)
+	}
+	var parts []string
+	if name != "." {
+		parts = strings.Split(name, "/")
+	}
+	hops := 0
+walk:
+	for {
+		current := "."
+		for i, part := range parts {
+			if current != "." {
+				part = current + "/" + part
+			}
+			node := v.nodes[part]
+			if node == nil {
+				return nil, notExist(op, name)
+			}
+			if node.Kind == fileKindSymlink {
+				hops++
+				if hops > maxSymlinkHops {
+					return nil, pathError(op, name, ErrSymlinkLoop)
+				}
+				parts = symlinkTargetParts(parts[:i], node.Target, parts[i+1:])
+				continue walk
+			}
+			current = part
+		}
+		return v.nodes[current], nil
+	}
+}
+
+func (v *snapshotFS) readDir(op, name string) ([]os.FileInfo, error) {
+	node, err := v.lookup(op, name)
+	if err != nil {
+		return nil, err
+	}
+	if node.Kind != fileKindDir {
+		return nil, pathError(op, name, ErrNotDir)
+	}
+	names := append([]string(nil), v.children[name]...)
+	sort.Strings(names)
+	infos := make([]os.FileInfo, 0, len(names))
+	for _, childName := range names {
+		childPath := childName
+		if name != "." {
+			childPath = name + "/" + childName
+		}
+		infos = append(infos, snapshotFileInfo(v.nodes[childPath], childPath))
+	}
+	return infos, nil
+}
+
+// snapshotFileInfo matches what blobVFSFile.Stat reports for the same node.
+func snapshotFileInfo(inode *inodeRecord, name string) blobFileInfo {
+	info := fileInfoFromInode(inode)
+	info.name = path.Base(name)
+	if inode.Kind == fileKindFile {
+		info.mode = info.mode.Perm()
+	}
+	return info
+}
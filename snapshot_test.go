@@ -0,0 +1,167 @@
+package blobfs
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+)
+
+func TestSnapshotKeepsContentAfterDeleteAndGC(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/docs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	old := bytes.Repeat([]byte("old-content-"), 64)
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", old)
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("bee"))
+	info, err := store.CreateSnapshot(testContext(t), "tenant-a", "daily")
+	if err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+	if info.Files != 2 || info.Dirs != 1 || info.Bytes != int64(len(old)+3) {
+		t.Fatalf("snapshot info = %+v", info)
+	}
+	if _, err := store.CreateSnapshot(testContext(t), "tenant-a", "daily"); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("duplicate snapshot = %v", err)
+	}
+	if _, err := store.CreateSnapshot(testContext(t), "tenant-a", "bad/name"); err == nil {
+		t.Fatal("snapshot name with a slash should be rejected")
+	}
+
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("new content"))
+	if err := store.DeleteObject(testContext(t), "tenant-a", "b.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	view, err := reopened.OpenSnapshotFS("tenant-a", "daily")
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	if err := fstest.TestFS(view, "docs/a.txt", "b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := fs.ReadFile(view, "docs/a.txt"); err != nil || !bytes.Equal(got, old) {
+		t.Fatalf("snapshot read = %q, %v", got, err)
+	}
+	snapshots, err := reopened.ListSnapshots(testContext(t), "tenant-a")
+	if err != nil || len(snapshots) != 1 || snapshots[0].Name != "daily" {
+		t.Fatalf("list snapshots = %+v, %v", snapshots, err)
+	}
+
+	if err := reopened.DeleteSnapshot(testContext(t), "tenant-a", "daily"); err != nil {
+		t.Fatalf("delete snapshot: %v", err)
+	}
+	if _, err := fs.Stat(view, "b.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat after delete = %v", err)
+	}
+	if _, err := reopened.OpenSnapshotFS("tenant-a", "daily"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open deleted snapshot = %v", err)
+	}
+	reopened.metaMu.RLock()
+	defer reopened.metaMu.RUnlock()
+	for _, manifest := range reopened.meta.Manifests {
+		if manifest.FileSize == int64(len(old)) && manifest.RefCount != 0 {
+			t.Fatalf("snapshot manifest still referenced: %+v", manifest)
+		}
+	}
+}
+
+func TestRestoreSnapshotReplacesTenantTree(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/docs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("v1"))
+	putTestBytes(t, store, "tenant-a", "keep.txt", []byte("keep"))
+	if _, err := store.CreateSnapshot(testContext(t), "tenant-a", "release-1"); err != nil {
+		t.Fatalf("create snapshot: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("v2"))
+	putTestBytes(t, store, "tenant-a", "added.txt", []byte("added"))
+	if err := store.DeleteObject(testContext(t), "tenant-a", "keep.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+
+	if err := store.RestoreSnapshot(testContext(t), "tenant-a", "release-1"); err != nil {
+		t.Fatalf("restore snapshot: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	tenant := reopened.TenantFS("tenant-a")
+	if got := readTestBytes(t, reopened, "tenant-a", "keep.txt"); string(got) != "keep" {
+		t.Fatalf("restored deleted file = %q", got)
+	}
+	if got := readTestBytes(t, reopened, "tenant-a", "docs/a.txt"); string(got) != "v1" {
+		t.Fatalf("restored content = %q", got)
+	}
+	if _, err := fs.Stat(tenant, "added.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("file added after the snapshot survived restore: %v", err)
+	}
+	// The restored tree is writable and the snapshot stays usable.
+	putTestBytes(t, reopened, "tenant-a", "docs/a.txt", []byte("v3"))
+	view, err := reopened.OpenSnapshotFS("tenant-a", "release-1")
+	if err != nil {
+		t.Fatalf("open snapshot: %v", err)
+	}
+	if got, err := fs.ReadFile(view, "docs/a.txt"); err != nil || string(got) != "v1" {
+		t.Fatalf("snapshot read = %q, %v", got, err)
+	}
+}
+
+func TestDeleteTenantReleasesSnapshots(t *testing.T) {
+	store := openTestStore(t)
+	data := bytes.Repeat([]byte("shared-"), 64)
+	result := putTestBytes(t, store, "tenant-a", "a.txt", data)
+	for _, name := range []string{"one", "two"} {
+		if _, err := store.CreateSnapshot(testContext(t), "tenant-a", name); err != nil {
+			t.Fatalf("create snapshot %s: %v", name, err)
+		}
+	}
+	if err := store.DeleteTenant(testContext(t), "tenant-a"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	if len(store.meta.Snapshots) != 0 {
+		t.Fatalf("snapshots survived tenant delete: %d", len(store.meta.Snapshots))
+	}
+	if manifest := store.meta.Manifests[result.ManifestID]; manifest != nil && manifest.RefCount != 0 {
+		t.Fatalf("manifest refcount = %d, want 0", manifest.RefCount)
+	}
+}
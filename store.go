@@ -2,12 +2,14 @@ package blobfs
 
 import (
 	"context"
+	"crypto/cipher"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"hash"
 	"io"
 	"io/fs"
+	"math"
 	"os"
 	"path/filepath"
 	"sort"
@@ -24,22 +26,49 @@ type Store struct {
 	baseDir     string
 	metaDir     string
 	segmentsDir string
+	parityDir   string
 	stagingDir  string
 	lockPath    string
 	lockFile    afero.File
 	cfg         Config
 
-	metaMu                 sync.RWMutex
-	meta                   *metadata
-	metaLog                afero.File
-	metaLogName            string
-	commitsSinceCheckpoint int
-	lastCheckpointErr      error
-	recoveryWarnings       []metadataReplayWarning
+	metaMu                  metaLock
+	meta                    *metadata
+	metaLog                 afero.File
+	metaLogName             string
+	metaGroup               *metaCommitGroup
+	metaInflight            []*pendingMetaTx
+	commitsSinceCheckpoint  int
+	metaCheckpointTxID      uint64
+	metaBaseDeltaSeq        uint64
+	metaMerging             bool
+	metaLogStartTxID        uint64
+	metaPrevLogs            []retainedLog
+	metaNeedsFullCheckpoint bool
+	retentionFloor          int64
+	readOnly                bool
+	lastCheckpointErr       error
+	recoveryWarnings        []metadataReplayWarning
+	checkpointFallbacks     []metadataCheckpointFallback
+
+	watchMu     sync.Mutex
+	watchEvents []WatchEvent
+	watchFloor  uint64
+	watchWake   chan struct{}
 
 	pinMu sync.Mutex
 	pins  map[string]int
 
+	openMu      sync.Mutex
+	openSeg     *openSegment
+	openPaths   map[string]bool
+	sealQueue   []*openSegment
+	sealDone    chan struct{}
+	lastSealErr error
+
+	keyMu    sync.Mutex
+	dataKeys map[dataKeyRef]cipher.AEAD
+
 	writeSessionMu    sync.Mutex
 	openWriteSessions int
 
@@ -47,6 +76,8 @@ type Store struct {
 	lastBackgroundGCAt  time.Time
 	lastBackgroundGC    *GCResult
 	lastBackgroundGCErr error
+	lastReadRepairErr   error
+	lastLifecycle       *LifecycleResult
 	bgTicker            *time.Ticker
 
 	handleMu sync.Mutex
@@ -89,6 +120,9 @@ type ObjectInfo struct {
 	CreatedAt  time.Time
 	UpdatedAt  time.Time
 	Options    map[string]string
+	// RetainUntil is zero unless SetRetention protected the file.
+	RetainUntil time.Time
+	LegalHold   bool
 }
 
 type preparedObject struct {
@@ -100,7 +134,7 @@ type preparedObject struct {
 	chunkingType string
 	refs         []manifestChunk
 	chunks       map[string]*chunkRecord
-	segments     []*segmentRecord
+	open         []*openSegment
 	pinned       []string
 	reusedChunks map[string]bool
 	manifest     *manifestRecord
@@ -109,6 +143,7 @@ type preparedObject struct {
 type putCommitOptions struct {
 	baseGeneration  uint64
 	checkGeneration bool
+	preconditions   Preconditions
 	mode            os.FileMode
 	modTime         int64
 	options         map[string]string
@@ -151,15 +186,20 @@ func OpenFS(fs afero.Fs, baseDir string, cfg Config) (*Store, error) {
 		baseDir:     baseDir,
 		metaDir:     filepath.Join(baseDir, "meta"),
 		segmentsDir: filepath.Join(baseDir, "data", "segments"),
+		parityDir:   filepath.Join(baseDir, "data", "parity"),
 		stagingDir:  filepath.Join(baseDir, "data", "staging"),
 		lockPath:    filepath.Join(baseDir, "meta", "LOCK"),
 		cfg:         cfg,
+		metaGroup:   newMetaCommitGroup(),
 		pins:        map[string]int{},
+		openPaths:   map[string]bool{},
+		dataKeys:    map[dataKeyRef]cipher.AEAD{},
 		handles:     map[storeHandle]struct{}{},
 		ctx:         storeCtx,
 		cancel:      cancel,
 		closed:      make(chan struct{}),
 	}
+	store.metaMu.store = store
 	if err := fs.MkdirAll(store.metaDir, 0o755); err != nil {
 		return nil, err
 	}
@@ -172,6 +212,10 @@ func OpenFS(fs afero.Fs, baseDir string, cfg Config) (*Store, error) {
 		_ = store.Close()
 		return nil, err
 	}
+	if err := fs.MkdirAll(store.parityDir, 0o755); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
 	if err := fs.MkdirAll(store.stagingDir, 0o700); err != nil {
 		_ = store.Close()
 		return nil, err
@@ -183,6 +227,23 @@ func OpenFS(fs afero.Fs, baseDir string, cfg Config) (*Store, error) {
 		return nil, err
 	}
 	store.recoveryWarnings = append([]metadataReplayWarning(nil), loadReport.ReplayWarnings...)
+	store.metaBaseDeltaSeq = loadReport.BaseDeltaSeq
+	store.metaCheckpointTxID = loadReport.CheckpointTxID
+	store.metaLogStartTxID = loadReport.LogStartTxID
+	store.metaPrevLogs = loadReport.PrevLogs
+	store.checkpointFallbacks = append([]metadataCheckpointFallback(nil), loadReport.CheckpointFallbacks...)
+	// A base image without usage would make every later load recount it.
+	store.metaNeedsFullCheckpoint = loadReport.UsageRecounted
+	if len(store.checkpointFallbacks) > 0 {
+		// Deltas past the point the chain stopped belong to the damaged
+		// history and would otherwise be loaded on top of new deltas.
+		store.metaNeedsFullCheckpoint = true
+		if err := removeMetaDeltas(fs, store.metaDir, store.meta.DeltaSeq+1, math.MaxUint64); err != nil {
+			_ = store.Close()
+			return nil, err
+		}
+	}
+	store.watchEvents, store.watchFloor = trimWatchHistory(loadReport.WatchEvents, loadReport.LogStartTxID)
 	if err := store.cleanupStagingAndOrphans(); err != nil {
 		_ = store.Close()
 		return nil, err
@@ -203,6 +264,14 @@ func OpenFS(fs afero.Fs, baseDir string, cfg Config) (*Store, error) {
 		_ = store.Close()
 		return nil, err
 	}
+	if err := store.sealRecoveredSegments(); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
+	if err := store.pruneRetainedLocked(time.Now()); err != nil {
+		_ = store.Close()
+		return nil, err
+	}
 	if store.cfg.GC.BackgroundGCInterval > 0 {
 		store.startBackgroundGC()
 	}
@@ -230,16 +299,19 @@ func (s *Store) startBackgroundGC() {
 			case <-s.closed:
 				return
 			case <-s.bgTicker.C:
+				// Lifecycle runs first so GC reclaims what it expired.
+				lifecycle, lifecycleErr := s.RunLifecycle(s.ctx)
 				result, err := s.RunGC(s.ctx, GCOptions{Compact: true})
 				s.backgroundMu.Lock()
 				s.lastBackgroundGCAt = time.Now()
+				s.lastLifecycle = lifecycle
 				if result != nil {
 					copyResult := *result
 					s.lastBackgroundGC = &copyResult
 				} else {
 					s.lastBackgroundGC = nil
 				}
-				s.lastBackgroundGCErr = err
+				s.lastBackgroundGCErr = errors.Join(lifecycleErr, err)
 				s.backgroundMu.Unlock()
 			}
 		}
@@ -311,6 +383,29 @@ func (s *Store) Put(ctx context.Context, tenantID, path string, input io.Reader,
 	return s.putObject(ctx, tenantID, path, input, putCommitOptions{options: copyOptions(options)})
 }
 
+// PutWithOptions stores or replaces a file like Put once opts.Preconditions
+// hold for the file it replaces.
+func (s *Store) PutWithOptions(ctx context.Context, tenantID, path string, input io.Reader, opts PutOptions) (*PutResult, error) {
+	return s.putObject(ctx, tenantID, path, input, putCommitOptions{options: copyOptions(opts.Options), preconditions: opts.Preconditions})
+}
+
+// checkPreconditions reports whether cond holds for current, the file a
+// write would replace, or nil when the path names no file.
+func checkPreconditions(current *inodeRecord, cond Preconditions) error {
+	if current == nil {
+		if cond.IfGenerationMatch != 0 || cond.IfETagMatch != "" {
+			return ErrPreconditionFailed
+		}
+		return nil
+	}
+	if cond.IfNoneMatch ||
+		(cond.IfGenerationMatch != 0 && current.Generation != cond.IfGenerationMatch) ||
+		(cond.IfETagMatch != "" && current.FileHash != cond.IfETagMatch) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
 func (s *Store) putObject(ctx context.Context, tenantID, path string, input io.Reader, opts putCommitOptions) (*PutResult, error) {
 	if err := s.beginOp(ctx); err != nil {
 		return nil, err
@@ -319,6 +414,9 @@ func (s *Store) putObject(ctx context.Context, tenantID, path string, input io.R
 	if input == nil {
 		return nil, ErrNilReader
 	}
+	if s.readOnly {
+		return nil, pathError("put", path, ErrReadOnly)
+	}
 	if err := validateTenantID(tenantID, s.cfg); err != nil {
 		return nil, pathError("put", tenantID, err)
 	}
@@ -334,10 +432,10 @@ func (s *Store) putObject(ctx context.Context, tenantID, path string, input io.R
 	result, err := s.commitPreparedObject(ctx, prepared, opts)
 	if err != nil {
 		var commitErr metadataCommitError
-		if !errors.As(err, &commitErr) {
-			if cleanupErr := s.removePreparedSegments(prepared); cleanupErr != nil {
-				return nil, errors.Join(err, cleanupErr)
-			}
+		if errors.As(err, &commitErr) {
+			s.keepOpenSegments(prepared)
+		} else if cleanupErr := s.abandonOpenSegments(prepared); cleanupErr != nil {
+			return nil, errors.Join(err, cleanupErr)
 		}
 		return nil, err
 	}
@@ -345,9 +443,14 @@ func (s *Store) putObject(ctx context.Context, tenantID, path string, input io.R
 }
 
 func (s *Store) prepareObject(ctx context.Context, tenantID, path string, input io.Reader) (*preparedObject, error) {
-	scopeID := s.dedupScopeID(tenantID)
+	cfg := s.tenantConfig(tenantID)
+	scopeID := dedupScopeID(cfg, tenantID)
 	scoped := scopeID != ""
 	fileHasher := scopedHasher(scopeID, scoped)
+	sealer, err := s.scopeCipher(ctx, scopeID)
+	if err != nil {
+		return nil, err
+	}
 	prepared := &preparedObject{
 		tenantID:     tenantID,
 		path:         path,
@@ -361,10 +464,8 @@ func (s *Store) prepareObject(ctx context.Context, tenantID, path string, input
 			s.releasePreparedPins(prepared)
 		}
 	}()
-	writer := &segmentBatchWriter{store: s}
-	defer writer.cleanup()
-	if err := s.streamChunks(ctx, input, fileHasher, func(offset int64, raw []byte) error {
-		if int64(len(raw))+prepared.size > s.cfg.MaxFileSize {
+	if err := s.streamChunks(ctx, input, fileHasher, cfg.Chunking, func(offset int64, raw []byte) error {
+		if int64(len(raw))+prepared.size > cfg.MaxFileSize {
 			return ErrTooLarge
 		}
 		chunkID := hashBytes(scopeID, scoped, raw)
@@ -381,7 +482,7 @@ func (s *Store) prepareObject(ctx context.Context, tenantID, path string, input
 			prepared.size += int64(len(raw))
 			return nil
 		}
-		chunk, err := writer.appendChunk(scopeID, chunkID, raw)
+		chunk, err := s.appendOpenSegment(prepared, compressionOf(cfg), sealer, scopeID, chunkID, raw)
 		if err != nil {
 			return err
 		}
@@ -390,13 +491,11 @@ func (s *Store) prepareObject(ctx context.Context, tenantID, path string, input
 		prepared.size += int64(len(raw))
 		return nil
 	}); err != nil {
-		return nil, err
+		return nil, errors.Join(err, s.abandonOpenSegments(prepared))
 	}
-	if err := writer.finish(); err != nil {
-		return nil, err
+	if err := s.syncOpenSegments(prepared); err != nil {
+		return nil, errors.Join(err, s.abandonOpenSegments(prepared))
 	}
-	writer.current = nil
-	prepared.segments = writer.segments
 	prepared.fileHash = hex.EncodeToString(fileHasher.Sum(nil))
 	prepared.chunkingType = chunkingSingle
 	if len(prepared.refs) > 1 {
@@ -423,16 +522,16 @@ func (s *Store) prepareObject(ctx context.Context, tenantID, path string, input
 	return prepared, nil
 }
 
-func (s *Store) streamChunks(ctx context.Context, input io.Reader, fileHasher hash.Hash, emit func(offset int64, raw []byte) error) error {
-	maxChunk := s.cfg.Chunking.MaxSize
+func (s *Store) streamChunks(ctx context.Context, input io.Reader, fileHasher hash.Hash, chunking ChunkingConfig, emit func(offset int64, raw []byte) error) error {
+	maxChunk := chunking.MaxSize
 	if maxChunk <= 0 {
 		maxChunk = DefaultConfig().Chunking.MaxSize
 	}
-	minChunk := s.cfg.Chunking.MinSize
+	minChunk := chunking.MinSize
 	if minChunk <= 0 || minChunk > maxChunk {
 		minChunk = maxChunk
 	}
-	mask := uint64(nextPowerOfTwo(s.cfg.Chunking.AvgSize) - 1)
+	mask := uint64(nextPowerOfTwo(chunking.AvgSize) - 1)
 	pending := make([]byte, 0, maxChunk+128*1024)
 	readBuf := make([]byte, 128*1024)
 	var offset int64
@@ -495,18 +594,39 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 	if err := contextError(ctx); err != nil {
 		return nil, err
 	}
+	if err := s.ensureTenantRoot(prepared.tenantID); err != nil {
+		return nil, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	var ops []metaOp
+	result, err := s.putPreparedLocked(prepared, opts, &ops)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return nil, pathError("put", prepared.path, err)
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, metadataCommitError{err: err}
+	}
+	return result, nil
+}
+
+// putPreparedLocked queues the ops that publish prepared at its path.
+func (s *Store) putPreparedLocked(prepared *preparedObject, opts putCommitOptions, ops *[]metaOp) (*PutResult, error) {
 	if opts.modTime == 0 {
 		opts.modTime = nowUnix()
 	}
 	if opts.options == nil {
 		opts.options = map[string]string{}
 	}
-	if err := s.ensureTenantRoot(prepared.tenantID); err != nil {
-		return nil, err
+	// Writes through a symlink land on its target.
+	path, err := s.writePathLocked(prepared.tenantID, prepared.path)
+	if err != nil {
+		return nil, pathError("put", prepared.path, err)
 	}
-	s.metaMu.Lock()
-	defer s.metaMu.Unlock()
-	parentID, name, err := s.resolveParentLocked(prepared.tenantID, prepared.path)
+	parentID, name, err := s.resolveParentLocked(prepared.tenantID, path)
 	if err != nil {
 		return nil, pathError("put", prepared.path, err)
 	}
@@ -517,6 +637,12 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 	if existing != nil && existing.Kind != fileKindFile {
 		return nil, pathError("put", prepared.path, ErrIsDir)
 	}
+	if err := checkPreconditions(existing, opts.preconditions); err != nil {
+		return nil, pathError("put", prepared.path, err)
+	}
+	if err := checkObjectLock(existing, nowUnix()); err != nil {
+		return nil, pathError("put", prepared.path, err)
+	}
 	if opts.checkGeneration {
 		if opts.baseGeneration == 0 && existing != nil {
 			return nil, pathError("put", prepared.path, ErrConflict)
@@ -540,11 +666,7 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 			return nil, errChunkNotReadable
 		}
 	}
-	ops := make([]metaOp, 0, len(prepared.segments)+len(prepared.chunks)+4)
-	for _, seg := range prepared.segments {
-		segCopy := *seg
-		ops = append(ops, metaOp{Type: "put_segment", Segment: &segCopy})
-	}
+	*ops = append(*ops, s.openSegmentOpsLocked(prepared, *ops)...)
 	newChunkRef := map[string]bool{}
 	for _, ref := range prepared.refs {
 		newChunkRef[ref.ChunkID] = true
@@ -554,14 +676,20 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 		if current != nil && current.State == chunkStateActive && current.RefCount > 0 {
 			continue
 		}
+		if err := s.checkChunkKeyLocked(chunk); err != nil {
+			return nil, pathError("put", prepared.path, err)
+		}
 		chunkCopy := *chunk
+		if chunkCopy.Owner == "" {
+			chunkCopy.Owner = prepared.tenantID
+		}
 		if newChunkRef[chunkCopy.ChunkID] {
 			chunkCopy.RefCount = 0
-			if current != nil && current.State == chunkStateCorrupt {
+			if current != nil && (current.State == chunkStateCorrupt || current.State == chunkStateShredded) {
 				chunkCopy.RefCount = current.RefCount
 			}
 		}
-		ops = append(ops, metaOp{Type: "put_chunk", Chunk: &chunkCopy})
+		*ops = append(*ops, metaOp{Type: "put_chunk", Chunk: &chunkCopy})
 	}
 	manifest := prepared.manifest
 	if current := s.meta.Manifests[prepared.manifest.ManifestID]; current != nil {
@@ -570,21 +698,26 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 		manifest.DeletedAt = 0
 		manifest.LastLiveAt = now
 	}
-	addManifestRef := existing == nil || existing.ManifestID != manifest.ManifestID
+	// A versioned overwrite keeps the old manifest referenced by its history,
+	// so the new inode always takes a reference of its own.
+	versioned := existing != nil && s.versioningEnabledLocked(prepared.tenantID)
+	addManifestRef := existing == nil || existing.ManifestID != manifest.ManifestID || versioned
 	manifestDeltas := map[string]int{}
 	chunkDeltas := map[string]int{}
 	manifestRecords := map[string]*manifestRecord{manifest.ManifestID: manifest}
 	if addManifestRef {
 		addManifestRefDelta(manifest, 1, manifestDeltas, chunkDeltas)
 	}
-	if existing != nil && existing.ManifestID != "" && existing.ManifestID != manifest.ManifestID {
+	if versioned {
+		s.appendVersionsLocked(prepared.tenantID, path, ops, versionFromInode(existing, now))
+	} else if existing != nil && existing.ManifestID != "" && existing.ManifestID != manifest.ManifestID {
 		oldManifest := s.meta.Manifests[existing.ManifestID]
 		if oldManifest != nil {
 			manifestRecords[oldManifest.ManifestID] = oldManifest
 			addManifestRefDelta(oldManifest, -1, manifestDeltas, chunkDeltas)
 		}
 	}
-	appendRefDeltaOpsLocked(s.meta, &ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+	appendRefDeltaOpsLocked(s.meta, ops, manifestRecords, manifestDeltas, chunkDeltas, now)
 	var inode *inodeRecord
 	if existing == nil {
 		inode = &inodeRecord{
@@ -594,13 +727,13 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 			ParentInode:         parentID,
 			Name:                name,
 			State:               fileStateActive,
-			Generation:          1,
+			Generation:          max(1, s.versionFloorLocked(prepared.tenantID, path)),
 			ContentGeneration:   1,
 			MetadataGeneration:  1,
 			NamespaceGeneration: 1,
 			CreatedAt:           now,
 		}
-		ops = append(ops, metaOp{Type: "put_dirent", ParentID: parentID, Name: name, ChildID: inode.InodeID})
+		*ops = append(*ops, metaOp{Type: "put_dirent", ParentID: parentID, Name: name, ChildID: inode.InodeID})
 	} else {
 		inode = cloneInode(existing)
 	}
@@ -617,10 +750,7 @@ func (s *Store) commitPreparedObject(ctx context.Context, prepared *preparedObje
 	inode.UpdatedAt = now
 	inode.Generation++
 	inode.ContentGeneration++
-	ops = append(ops, metaOp{Type: "put_inode", Inode: inode})
-	if err := s.commitMetaLocked(ops); err != nil {
-		return nil, metadataCommitError{err: err}
-	}
+	*ops = append(*ops, metaOp{Type: "put_inode", Inode: inode})
 	return &PutResult{
 		FileID:       inodeFileID(inode.InodeID),
 		TenantID:     prepared.tenantID,
@@ -685,6 +815,12 @@ func (s *Store) StatObject(ctx context.Context, tenantID, path string) (*ObjectI
 
 // UpdateMetadata replaces user options on an active file without changing its content.
 func (s *Store) UpdateMetadata(ctx context.Context, tenantID, path string, options map[string]string) (*ObjectInfo, error) {
+	return s.UpdateMetadataWithOptions(ctx, tenantID, path, options, Preconditions{})
+}
+
+// UpdateMetadataWithOptions replaces user options like UpdateMetadata once
+// cond holds for the file.
+func (s *Store) UpdateMetadataWithOptions(ctx context.Context, tenantID, path string, options map[string]string, cond Preconditions) (*ObjectInfo, error) {
 	if err := s.beginOp(ctx); err != nil {
 		return nil, err
 	}
@@ -698,6 +834,20 @@ func (s *Store) UpdateMetadata(ctx context.Context, tenantID, path string, optio
 	}
 	s.metaMu.Lock()
 	defer s.metaMu.Unlock()
+	var ops []metaOp
+	info, err := s.updateMetadataLocked(tenantID, path, options, cond, &ops)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// updateMetadataLocked queues the ops that replace the user options of the
+// file at path.
+func (s *Store) updateMetadataLocked(tenantID, path string, options map[string]string, cond Preconditions, ops *[]metaOp) (*ObjectInfo, error) {
 	inode, err := s.resolvePathLocked(tenantID, path)
 	if err != nil {
 		return nil, pathError("update metadata", path, err)
@@ -705,6 +855,12 @@ func (s *Store) UpdateMetadata(ctx context.Context, tenantID, path string, optio
 	if inode.Kind != fileKindFile {
 		return nil, pathError("update metadata", path, ErrIsDir)
 	}
+	if err := checkPreconditions(inode, cond); err != nil {
+		return nil, pathError("update metadata", path, err)
+	}
+	if err := checkObjectLock(inode, nowUnix()); err != nil {
+		return nil, pathError("update metadata", path, err)
+	}
 	next := cloneInode(inode)
 	now := nowUnix()
 	next.Options = copyOptions(options)
@@ -712,15 +868,20 @@ func (s *Store) UpdateMetadata(ctx context.Context, tenantID, path string, optio
 	next.MetadataGeneration++
 	next.UpdatedAt = now
 	next.CTime = now
-	if err := s.commitMetaLocked([]metaOp{{Type: "put_inode", Inode: next}}); err != nil {
-		return nil, err
-	}
+	*ops = append(*ops, metaOp{Type: "put_inode", Inode: next})
 	info := objectInfoFromInode(next, path)
 	return &info, nil
 }
 
-// DeleteObject removes one active file from the namespace and releases its references.
+// DeleteObject removes one active file or symlink from the namespace and
+// releases its references once no hard link names it.
 func (s *Store) DeleteObject(ctx context.Context, tenantID, path string) error {
+	return s.DeleteObjectWithOptions(ctx, tenantID, path, DeleteOptions{})
+}
+
+// DeleteObjectWithOptions removes a file or symlink like DeleteObject once
+// opts.Preconditions hold for it.
+func (s *Store) DeleteObjectWithOptions(ctx context.Context, tenantID, path string, opts DeleteOptions) error {
 	if err := s.beginOp(ctx); err != nil {
 		return err
 	}
@@ -734,62 +895,127 @@ func (s *Store) DeleteObject(ctx context.Context, tenantID, path string) error {
 	}
 	s.metaMu.Lock()
 	defer s.metaMu.Unlock()
-	inode, err := s.resolvePathLocked(tenantID, path)
+	var ops []metaOp
+	if err := s.deleteObjectLocked(tenantID, path, opts.Preconditions, &ops); err != nil {
+		return err
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// deleteObjectLocked queues the ops that remove the file or symlink at path.
+func (s *Store) deleteObjectLocked(tenantID, path string, cond Preconditions, ops *[]metaOp) error {
+	inode, err := s.lookupPathLocked(tenantID, path)
 	if err != nil {
 		return pathError("delete", path, err)
 	}
-	if inode.Kind != fileKindFile {
+	if inode.Kind == fileKindDir {
 		return pathError("delete", path, ErrIsDir)
 	}
+	if err := checkPreconditions(inode, cond); err != nil {
+		return pathError("delete", path, err)
+	}
+	if err := checkObjectLock(inode, nowUnix()); err != nil {
+		return pathError("delete", path, err)
+	}
 	parentID, name, err := s.resolveParentLocked(tenantID, path)
 	if err != nil {
 		return pathError("delete", path, err)
 	}
 	now := nowUnix()
-	next := cloneInode(inode)
-	next.State = fileStateDeleted
-	next.DeletedAt = now
-	next.UpdatedAt = now
-	next.CTime = now
-	next.Generation++
-	ops := []metaOp{
-		{Type: "put_inode", Inode: next},
-		{Type: "delete_dirent", ParentID: parentID, Name: name},
+	if !s.moveToTrashLocked(inode, parentID, name, path, ops, now) {
+		s.removeLinkLocked(inode, parentID, name, path, true, ops, now)
 	}
-	addDeletedManifestOpsLocked(s.meta, inode.ManifestID, &ops, now)
-	return s.commitMetaLocked(ops)
+	return nil
 }
 
-// DeleteTenant immediately detaches the tenant namespace. Child inodes, manifests,
-// chunks, and segment files are reclaimed asynchronously by GC.
+// DeleteTenant immediately detaches the tenant namespace and drops its
+// snapshots, object versions, and settings. Child inodes, manifests, chunks, and segment files are reclaimed
+// asynchronously by GC.
 func (s *Store) DeleteTenant(ctx context.Context, tenantID string) error {
+	_, err := s.DeleteTenantWithOptions(ctx, tenantID, DeleteTenantOptions{})
+	return err
+}
+
+// DeleteTenantWithOptions deletes a tenant like DeleteTenant and, with
+// opts.Shred, destroys its data keys in the same transaction and then their
+// scope key.
+func (s *Store) DeleteTenantWithOptions(ctx context.Context, tenantID string, opts DeleteTenantOptions) (*DeleteTenantResult, error) {
 	if err := s.beginOp(ctx); err != nil {
-		return err
+		return nil, err
 	}
 	defer s.endOp()
 	if err := validateTenantID(tenantID, s.cfg); err != nil {
-		return err
+		return nil, err
+	}
+	if opts.Shred {
+		// Holding keyMu keeps puts from recreating the keyring, and with it
+		// the scope key, until the scope key is destroyed.
+		s.keyMu.Lock()
+		defer s.keyMu.Unlock()
 	}
 	s.metaMu.Lock()
-	defer s.metaMu.Unlock()
+	result, err := s.deleteTenantLocked(tenantID, opts)
+	s.metaMu.Unlock()
+	if err != nil || !opts.Shred {
+		return result, err
+	}
+	s.forgetDataKeysLocked(tenantID)
+	if len(result.ShreddedKeys) > 0 {
+		// The copies of the destroyed data keys left in checkpoints, txlogs
+		// and retained history unwrap only with this scope key.
+		if err := s.cfg.KeyProvider.(ScopeKeyProvider).DestroyScopeKey(ctx, tenantID); err != nil {
+			return result, fmt.Errorf("destroy scope key of %q: %w", tenantID, err)
+		}
+	}
+	return result, nil
+}
+
+func (s *Store) deleteTenantLocked(tenantID string, opts DeleteTenantOptions) (*DeleteTenantResult, error) {
 	rootID := s.meta.Tenants[tenantID]
 	if rootID == 0 {
-		return fs.ErrNotExist
+		return nil, fs.ErrNotExist
 	}
 	root := s.activeInodeLocked(rootID)
 	if root == nil {
-		return fs.ErrNotExist
+		return nil, fs.ErrNotExist
 	}
 	now := nowUnix()
-	next := cloneInode(root)
-	next.State = fileStateDeleted
-	next.DeletedAt = now
-	next.UpdatedAt = now
-	next.Generation++
-	return s.commitMetaLocked([]metaOp{
-		{Type: "del_tenant", TenantID: tenantID},
-		{Type: "put_inode", Inode: next},
-	})
+	if err := s.checkSubtreeLockLocked("delete tenant", rootID, "", now); err != nil {
+		return nil, err
+	}
+	ops := []metaOp{{Type: "del_tenant", TenantID: tenantID}}
+	if opts.Shred || !s.moveToTrashLocked(root, 0, "", "", &ops, now) {
+		next := cloneInode(root)
+		next.State = fileStateDeleted
+		next.DeletedAt = now
+		next.UpdatedAt = now
+		next.Generation++
+		ops = append(ops, metaOp{Type: "put_inode", Inode: next})
+	}
+	manifestRecords := map[string]*manifestRecord{}
+	manifestDeltas := map[string]int{}
+	chunkDeltas := map[string]int{}
+	for _, snapshot := range s.meta.Snapshots {
+		if snapshot.TenantID == tenantID {
+			ops = append(ops, metaOp{Type: "delete_snapshot", TenantID: tenantID, Name: snapshot.Name})
+			s.addSnapshotRefDeltasLocked(snapshot, -1, manifestRecords, manifestDeltas, chunkDeltas)
+		}
+	}
+	s.dropTenantVersionsLocked(tenantID, &ops, manifestRecords, manifestDeltas, chunkDeltas)
+	if s.meta.TenantSettings[tenantID] != nil {
+		ops = append(ops, metaOp{Type: "delete_tenant_settings", TenantID: tenantID})
+	}
+	appendRefDeltaOpsLocked(s.meta, &ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+	result := &DeleteTenantResult{}
+	if opts.Shred {
+		if err := s.shredTenantOpsLocked(tenantID, &ops, result); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	return result, nil
 }
 
 // Close stops background work, waits for in-flight operations, checkpoints
@@ -808,9 +1034,12 @@ func (s *Store) Close() error {
 		s.bgWG.Wait()
 		s.opWG.Wait()
 		closeErr = errors.Join(closeErr, s.closeHandles())
+		closeErr = errors.Join(closeErr, s.sealActiveSegment(), s.sealErr())
 
 		s.metaMu.Lock()
-		closeErr = errors.Join(closeErr, s.checkpointMetaLocked())
+		if !s.readOnly {
+			closeErr = errors.Join(closeErr, s.checkpointMetaLocked())
+		}
 		if s.metaLog != nil {
 			closeErr = errors.Join(closeErr, s.metaLog.Close())
 			s.metaLog = nil
@@ -850,26 +1079,90 @@ func (s *Store) ensureTenantRoot(tenantID string) error {
 		MTime:               now,
 		ModTime:             now,
 	}
-	return s.commitMetaLocked([]metaOp{
+	return s.commitMetaFinalLocked([]metaOp{
 		{Type: "put_tenant", TenantID: tenantID, ChildID: root.InodeID},
 		{Type: "put_inode", Inode: root},
 	})
 }
 
+// commitMetaLocked applies ops in memory and waits until their txlog frame is
+// durable, holding metaMu throughout, so a caller that commits several times
+// stays atomic against other writers. The frame still joins the batch of any
+// committers waiting in commitMetaFinalLocked, but writers arriving during
+// the sync wait for the next one, so it is meant for maintenance such as GC
+// and repair. If the batch fails, every transaction queued after it is taken
+// out of meta before the error is returned.
 func (s *Store) commitMetaLocked(ops []metaOp) error {
+	pending, err := s.enqueueMetaTxLocked(ops)
+	if pending == nil || err != nil {
+		return err
+	}
+	s.metaGroup.await(s, pending)
+	return s.finishMetaTxLocked(pending)
+}
+
+// commitMetaFinalLocked commits ops like commitMetaLocked but releases
+// metaMu while the frame becomes durable, so concurrent committers share one
+// sync, and holds it again on return. Other writers may run in between, so it
+// is only for a caller's last commit: nothing after it may rely on state read
+// before it. Readers do not see the transaction before it is durable.
+func (s *Store) commitMetaFinalLocked(ops []metaOp) error {
+	pending, err := s.enqueueMetaTxLocked(ops)
+	if pending == nil || err != nil {
+		return err
+	}
+	s.metaMu.Unlock()
+	s.metaGroup.await(s, pending)
+	s.metaMu.Lock()
+	return s.finishMetaTxLocked(pending)
+}
+
+// enqueueMetaTxLocked applies ops in memory and queues their txlog frame. It
+// returns nil without error when there is nothing to commit.
+func (s *Store) enqueueMetaTxLocked(ops []metaOp) (*pendingMetaTx, error) {
 	if len(ops) == 0 {
-		return nil
+		return nil, nil
+	}
+	if err := s.settleMetaLocked(); err != nil {
+		return nil, err
+	}
+	if s.readOnly {
+		return nil, ErrReadOnly
+	}
+	if s.metaLog == nil {
+		return nil, errMetadataLogClosed
 	}
 	txid := s.meta.TxID + 1
-	tx := metaTx{TxID: txid, Ops: ops}
-	if err := writeMetaTx(s.metaLog, tx); err != nil {
-		return err
+	tx := metaTx{TxID: txid, Time: nowUnix(), Ops: ops}
+	frame, err := encodeMetaFrame(tx)
+	if err != nil {
+		return nil, err
+	}
+	pending := &pendingMetaTx{
+		tx:          tx,
+		frame:       frame,
+		log:         s.metaLog,
+		logName:     s.metaLogName,
+		undo:        captureMetaUndo(s.meta, ops),
+		prevTxID:    s.meta.TxID,
+		prevUpdated: s.meta.UpdatedAt,
+	}
+	pending.events = applyMetaTxWatched(s.meta, tx)
+	s.metaInflight = append(s.metaInflight, pending)
+	s.metaGroup.enqueue(pending)
+	return pending, nil
+}
+
+// finishMetaTxLocked settles a transaction whose batch has been written.
+func (s *Store) finishMetaTxLocked(pending *pendingMetaTx) error {
+	if pending.err != nil {
+		s.settleMetaLocked()
+		return pending.err
 	}
-	applyMetaTx(s.meta, tx)
 	s.commitsSinceCheckpoint++
-	if err := saveSuperBlock(s.fs, s.metaDir, s.meta.TxID, s.metaLogName); err != nil {
-		s.lastCheckpointErr = err
-		return err
+	if pending.superErr != nil {
+		s.lastCheckpointErr = pending.superErr
+		return pending.superErr
 	}
 	s.lastCheckpointErr = nil
 	if s.commitsSinceCheckpoint >= metaCheckpointInterval {
@@ -881,14 +1174,18 @@ func (s *Store) commitMetaLocked(ops []metaOp) error {
 }
 
 func (s *Store) checkpointMetaLocked() error {
+	s.metaGroup.waitIdle()
+	if err := s.settleMetaLocked(); err != nil {
+		return err
+	}
 	if s.metaLog == nil {
 		return errMetadataLogClosed
 	}
-	compactMetadata(s.meta)
-	if err := saveMetaCheckpoint(s.fs, s.metaDir, s.meta); err != nil {
+	if err := s.saveCheckpointImageLocked(); err != nil {
 		s.lastCheckpointErr = err
 		return err
 	}
+	s.metaCheckpointTxID = s.meta.TxID
 	newLog, newName, err := s.createMetaLogGenerationLocked(nextMetaLogName(s.metaLogName))
 	if err != nil {
 		s.lastCheckpointErr = err
@@ -908,22 +1205,34 @@ func (s *Store) checkpointMetaLocked() error {
 	}
 	oldLog := s.metaLog
 	oldName := s.metaLogName
+	oldStart := s.metaLogStartTxID
 	s.metaLog = newLog
 	s.metaLogName = newName
+	s.metaLogStartTxID = s.meta.TxID
 	s.commitsSinceCheckpoint = 0
 	s.lastCheckpointErr = nil
 	var cleanupErr error
 	if oldLog != nil {
 		cleanupErr = errors.Join(cleanupErr, oldLog.Close())
 	}
+	// The replaced generation stays until the next checkpoint so the previous
+	// checkpoint plus the txlog can still rebuild this one.
+	retire := s.metaPrevLogs
+	s.metaPrevLogs = nil
 	if oldName != "" && oldName != newName {
-		if err := s.fs.Remove(filepath.Join(metaTxLogDir(s.metaDir), oldName)); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			cleanupErr = errors.Join(cleanupErr, err)
-		}
+		s.metaPrevLogs = []retainedLog{{name: oldName, start: oldStart, end: s.meta.TxID}}
+	}
+	for _, log := range retire {
+		cleanupErr = errors.Join(cleanupErr, s.retireMetaLogLocked(log.name, log.start, log.end))
+	}
+	if s.retentionEnabled() {
+		cleanupErr = errors.Join(cleanupErr, s.pruneRetainedLocked(time.Now()))
 	}
+	cleanupErr = errors.Join(cleanupErr, removeLegacyMetaCheckpoint(s.fs, s.metaDir))
 	if cleanupErr != nil {
 		s.lastCheckpointErr = cleanupErr
 	}
+	s.maybeStartMetaMergeLocked()
 	return cleanupErr
 }
 
@@ -959,32 +1268,11 @@ func (s *Store) activeInodeLocked(id uint64) *inodeRecord {
 	return inode
 }
 
+// resolvePathLocked resolves path under the root of tenantID, following
+// symlinks in every component.
 func (s *Store) resolvePathLocked(tenantID, path string) (*inodeRecord, error) {
-	rootID := s.meta.Tenants[tenantID]
-	if rootID == 0 {
-		return nil, fs.ErrNotExist
-	}
-	current := s.activeInodeLocked(rootID)
-	if current == nil {
-		return nil, fs.ErrNotExist
-	}
-	if path == "" {
-		return current, nil
-	}
-	for _, name := range strings.Split(path, "/") {
-		if current.Kind != fileKindDir {
-			return nil, ErrNotDir
-		}
-		childID := s.meta.DirEntries[current.InodeID][name]
-		if childID == 0 {
-			return nil, fs.ErrNotExist
-		}
-		current = s.activeInodeLocked(childID)
-		if current == nil {
-			return nil, fs.ErrNotExist
-		}
-	}
-	return current, nil
+	inode, _, err := s.walkPathLocked(tenantID, path, true, false)
+	return inode, err
 }
 
 func (s *Store) resolveParentLocked(tenantID, path string) (uint64, string, error) {
@@ -1082,7 +1370,9 @@ func appendRefDeltaOpsLocked(meta *metadata, ops *[]metaOp, manifestRecords map[
 		if next.RefCount < 0 {
 			next.RefCount = 0
 		}
-		if next.RefCount > 0 {
+		// A shredded chunk stays unreadable while deleted files still
+		// reference it.
+		if next.RefCount > 0 && next.State != chunkStateShredded {
 			next.State = chunkStateActive
 			next.LastSeenAt = now
 			next.DeletedAt = 0
@@ -1107,6 +1397,7 @@ func addDeletedManifestOpsLocked(meta *metadata, manifestID string, ops *[]metaO
 func cloneInode(inode *inodeRecord) *inodeRecord {
 	next := *inode
 	next.Options = copyOptions(inode.Options)
+	next.OtherLinks = append([]dirLink(nil), inode.OtherLinks...)
 	return &next
 }
 
@@ -1117,7 +1408,7 @@ func cloneManifest(manifest *manifestRecord) *manifestRecord {
 }
 
 func objectInfoFromInode(inode *inodeRecord, path string) ObjectInfo {
-	return ObjectInfo{
+	info := ObjectInfo{
 		FileID:     inodeFileID(inode.InodeID),
 		TenantID:   inode.TenantID,
 		Path:       path,
@@ -1128,15 +1419,22 @@ func objectInfoFromInode(inode *inodeRecord, path string) ObjectInfo {
 		CreatedAt:  time.Unix(0, inode.CreatedAt),
 		UpdatedAt:  time.Unix(0, inode.UpdatedAt),
 		Options:    copyOptions(inode.Options),
+		LegalHold:  inode.LegalHold,
+	}
+	if inode.RetainUntil != 0 {
+		info.RetainUntil = time.Unix(0, inode.RetainUntil)
 	}
+	return info
 }
 
 func inodeFileID(id uint64) string {
 	return fmt.Sprintf("inode-%016d", id)
 }
 
-func (s *Store) dedupScopeID(tenantID string) string {
-	if s.cfg.DedupScope == DedupScopeTenant {
+// dedupScopeID returns the scope that hashes of tenantID's writes are bound
+// to under cfg, or "" for the global scope.
+func dedupScopeID(cfg Config, tenantID string) string {
+	if cfg.DedupScope == DedupScopeTenant {
 		return tenantID
 	}
 	return ""
@@ -1172,21 +1470,7 @@ func (s *Store) releasePreparedPins(prepared *preparedObject) {
 		s.unpinSegment(segmentID)
 	}
 	prepared.pinned = nil
-}
-
-func (s *Store) removePreparedSegments(prepared *preparedObject) error {
-	var errs []error
-	for _, seg := range prepared.segments {
-		segmentPath := s.segmentPath(seg)
-		if err := s.fs.Remove(segmentPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			errs = append(errs, fmt.Errorf("remove prepared segment %s: %w", segmentPath, err))
-		}
-		stagingPath := s.stagingSegmentPath(seg)
-		if err := s.fs.Remove(stagingPath); err != nil && !errors.Is(err, fs.ErrNotExist) {
-			errs = append(errs, fmt.Errorf("remove prepared staging segment %s: %w", stagingPath, err))
-		}
-	}
-	return errors.Join(errs...)
+	s.releaseOpenSegments(prepared)
 }
 
 func (s *Store) cleanupStagingAndOrphans() error {
@@ -1207,7 +1491,7 @@ func (s *Store) cleanupStagingAndOrphans() error {
 			referenced[s.segmentPath(seg)] = true
 		}
 	}
-	return afero.Walk(s.fs, s.segmentsDir, func(path string, info os.FileInfo, err error) error {
+	if err := afero.Walk(s.fs, s.segmentsDir, func(path string, info os.FileInfo, err error) error {
 		if err != nil || info == nil || info.IsDir() {
 			return err
 		}
@@ -1215,6 +1499,17 @@ func (s *Store) cleanupStagingAndOrphans() error {
 			return s.fs.Remove(path)
 		}
 		return nil
+	}); err != nil {
+		return err
+	}
+	return afero.Walk(s.fs, s.parityDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info == nil || info.IsDir() {
+			return err
+		}
+		if strings.HasSuffix(path, ".tmp") || !referenced[s.paritySegmentPath(path)] {
+			return s.fs.Remove(path)
+		}
+		return nil
 	})
 }
 
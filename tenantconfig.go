@@ -0,0 +1,130 @@
+package blobfs
+
+import (
+	"context"
+	"time"
+)
+
+// SetTenantConfig replaces the configuration overrides of tenantID. A zero
+// TenantConfig removes them. Writes already stored keep the settings they
+// were written with.
+func (s *Store) SetTenantConfig(ctx context.Context, tenantID string, cfg TenantConfig) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("set tenant config", tenantID, err)
+	}
+	if err := validateConfig(applyTenantConfig(s.cfg, tenantConfigRecord(cfg))); err != nil {
+		return pathError("set tenant config", tenantID, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.updateTenantSettingsLocked(tenantID, func(settings *tenantSettings) {
+		settings.Config = tenantConfigRecord(cfg)
+	})
+}
+
+// TenantConfig returns the configuration overrides of tenantID.
+func (s *Store) TenantConfig(ctx context.Context, tenantID string) (TenantConfig, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return TenantConfig{}, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return TenantConfig{}, pathError("tenant config", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil || settings.Config == nil {
+		return TenantConfig{}, nil
+	}
+	config := settings.Config
+	return TenantConfig{
+		MaxFileSize:      config.MaxFileSize,
+		Compression:      CompressionType(config.Compression),
+		CompressionLevel: int(config.CompressionLevel),
+		DedupScope:       DedupScope(config.DedupScope),
+		Chunking: ChunkingConfig{
+			Algorithm: config.ChunkAlgorithm,
+			MinSize:   int(config.ChunkMinSize),
+			AvgSize:   int(config.ChunkAvgSize),
+			MaxSize:   int(config.ChunkMaxSize),
+		},
+		SafetyWindow: time.Duration(config.SafetyWindow),
+	}, nil
+}
+
+// tenantConfigRecord returns the persisted form of cfg, or nil when it
+// overrides nothing.
+func tenantConfigRecord(cfg TenantConfig) *tenantConfig {
+	if cfg == (TenantConfig{}) {
+		return nil
+	}
+	return &tenantConfig{
+		MaxFileSize:      cfg.MaxFileSize,
+		Compression:      string(cfg.Compression),
+		CompressionLevel: int64(cfg.CompressionLevel),
+		DedupScope:       string(cfg.DedupScope),
+		ChunkAlgorithm:   cfg.Chunking.Algorithm,
+		ChunkMinSize:     int64(cfg.Chunking.MinSize),
+		ChunkAvgSize:     int64(cfg.Chunking.AvgSize),
+		ChunkMaxSize:     int64(cfg.Chunking.MaxSize),
+		SafetyWindow:     int64(cfg.SafetyWindow),
+	}
+}
+
+// applyTenantConfig returns cfg with the non-zero overrides of config applied.
+func applyTenantConfig(cfg Config, config *tenantConfig) Config {
+	if config == nil {
+		return cfg
+	}
+	if config.MaxFileSize != 0 {
+		cfg.MaxFileSize = config.MaxFileSize
+	}
+	if config.Compression != "" {
+		// A level belongs to its codec, so a codec override never inherits
+		// the store level.
+		cfg.Compression = CompressionType(config.Compression)
+		cfg.CompressionLevel = int(config.CompressionLevel)
+	} else if config.CompressionLevel != 0 {
+		cfg.CompressionLevel = int(config.CompressionLevel)
+	}
+	if config.DedupScope != "" {
+		cfg.DedupScope = DedupScope(config.DedupScope)
+	}
+	if config.ChunkAlgorithm != "" {
+		cfg.Chunking.Algorithm = config.ChunkAlgorithm
+	}
+	if config.ChunkMinSize != 0 {
+		cfg.Chunking.MinSize = int(config.ChunkMinSize)
+	}
+	if config.ChunkAvgSize != 0 {
+		cfg.Chunking.AvgSize = int(config.ChunkAvgSize)
+	}
+	if config.ChunkMaxSize != 0 {
+		cfg.Chunking.MaxSize = int(config.ChunkMaxSize)
+	}
+	if config.SafetyWindow > 0 {
+		cfg.GC.SafetyWindow = time.Duration(config.SafetyWindow)
+	} else if config.SafetyWindow < 0 {
+		cfg.GC.SafetyWindow = 0
+	}
+	return cfg
+}
+
+// tenantConfig returns the store configuration as it applies to tenantID.
+func (s *Store) tenantConfig(tenantID string) Config {
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	return s.tenantConfigLocked(tenantID)
+}
+
+func (s *Store) tenantConfigLocked(tenantID string) Config {
+	if settings := s.meta.TenantSettings[tenantID]; settings != nil {
+		return applyTenantConfig(s.cfg, settings.Config)
+	}
+	return s.cfg
+}
@@ -0,0 +1,125 @@
+package blobfs
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestTenantConfigOverridesWrites(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := testContext(t)
+	for _, bad := range []TenantConfig{
+		{Chunking: ChunkingConfig{MinSize: 64}},
+		{Compression: "lz4"},
+		{DedupScope: "cluster"},
+		{MaxFileSize: -1},
+	} {
+		if err := store.SetTenantConfig(ctx, "tenant-a", bad); err == nil {
+			t.Fatalf("set tenant config %+v succeeded", bad)
+		}
+	}
+	cfg := TenantConfig{MaxFileSize: 64, Chunking: ChunkingConfig{MinSize: 32, AvgSize: 64, MaxSize: 128}}
+	if err := store.SetTenantConfig(ctx, "tenant-a", cfg); err != nil {
+		t.Fatalf("set tenant config: %v", err)
+	}
+	data := strings.Repeat("0123456789", 6)
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte(data))
+	putTestBytes(t, store, "tenant-b", "b.txt", []byte(data))
+	if _, err := store.Put(ctx, "tenant-a", "big.txt", strings.NewReader(data+data), nil); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("put past tenant max file size = %v", err)
+	}
+	putTestBytes(t, store, "tenant-b", "big.txt", []byte(data+data))
+	file, err := store.OpenFile("tenant-a/a.txt", os.O_WRONLY, 0o644)
+	if err != nil {
+		t.Fatalf("open file: %v", err)
+	}
+	if _, err := file.WriteAt([]byte("x"), 64); !errors.Is(err, ErrTooLarge) {
+		t.Fatalf("vfs write past tenant max file size = %v", err)
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	chunksA := manifestChunkCount(t, store, "tenant-a", "a.txt")
+	chunksB := manifestChunkCount(t, store, "tenant-b", "b.txt")
+	if chunksA != 1 || chunksB < 3 {
+		t.Fatalf("chunks = %d for tenant-a, %d for tenant-b", chunksA, chunksB)
+	}
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+	if got, err := store.TenantConfig(ctx, "tenant-a"); err != nil || got != cfg {
+		t.Fatalf("tenant config after reopen = %+v, %v", got, err)
+	}
+	if err := store.SetTenantConfig(ctx, "tenant-a", TenantConfig{}); err != nil {
+		t.Fatalf("clear tenant config: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "big.txt", []byte(data+data))
+}
+
+func TestTenantDedupScopeOverride(t *testing.T) {
+	cfg := testConfig()
+	cfg.DedupScope = DedupScopeGlobal
+	store, err := Open(t.TempDir(), cfg)
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx := testContext(t)
+	data := []byte("content written by several tenants")
+	putTestBytes(t, store, "tenant-a", "a.txt", data)
+	if err := store.SetTenantConfig(ctx, "tenant-a", TenantConfig{DedupScope: DedupScopeTenant}); err != nil {
+		t.Fatalf("set tenant config: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "b.txt", data)
+	putTestBytes(t, store, "tenant-c", "c.txt", data)
+
+	if usage, err := store.Usage(ctx, "tenant-c"); err != nil || usage.PhysicalBytes != 0 {
+		t.Fatalf("tenant-c usage = %+v, %v", usage, err)
+	}
+	if _, err := store.CopyObject(ctx, "tenant-a", "b.txt", "tenant-c", "b.txt"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("copy from opted-out tenant = %v", err)
+	}
+	if err := store.Move(ctx, "tenant-c", "c.txt", "tenant-a", "c.txt"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("move into opted-out tenant = %v", err)
+	}
+	if err := store.SetTenantConfig(ctx, "tenant-a", TenantConfig{}); err != nil {
+		t.Fatalf("clear tenant config: %v", err)
+	}
+	if _, err := store.CopyObject(ctx, "tenant-a", "a.txt", "tenant-c", "a.txt"); err != nil {
+		t.Fatalf("copy globally scoped content: %v", err)
+	}
+	if _, err := store.CopyObject(ctx, "tenant-a", "b.txt", "tenant-c", "b.txt"); !errors.Is(err, ErrCrossTenant) {
+		t.Fatalf("copy tenant-scoped content = %v", err)
+	}
+	for _, path := range []string{"a.txt", "b.txt"} {
+		if result, err := store.CheckObject(ctx, "tenant-a", path); err != nil || !result.Healthy {
+			t.Fatalf("check %s = %+v, %v", path, result, err)
+		}
+	}
+}
+
+func manifestChunkCount(t *testing.T, store *Store, tenantID, path string) int {
+	t.Helper()
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	inode, err := store.resolvePathLocked(tenantID, path)
+	if err != nil {
+		t.Fatalf("resolve %s: %v", path, err)
+	}
+	return len(store.meta.Manifests[inode.ManifestID].Chunks)
+}
@@ -2,19 +2,34 @@ package blobfs
 
 import (
 	"errors"
+	"io"
 	"io/fs"
+	"os"
 	"path"
+	"strings"
+	"time"
+
+	"github.com/spf13/afero"
 )
 
 var (
-	_ fs.FS        = tenantFS{}
-	_ fs.StatFS    = tenantFS{}
-	_ fs.ReadDirFS = tenantFS{}
+	_ fs.FS         = tenantFS{}
+	_ fs.StatFS     = tenantFS{}
+	_ fs.ReadDirFS  = tenantFS{}
+	_ fs.ReadFileFS = tenantFS{}
+	_ fs.SubFS      = tenantFS{}
+	_ fs.GlobFS     = tenantFS{}
+
+	_ afero.Fs        = tenantAfero{}
+	_ afero.Symlinker = tenantAfero{}
 )
 
+// tenantFS serves the tree below dir in tenantID; an empty dir is the tenant
+// root.
 type tenantFS struct {
 	store    *Store
 	tenantID string
+	dir      string
 }
 
 // TenantFS returns an io/fs view rooted at tenantID.
@@ -27,7 +42,8 @@ func (t tenantFS) Open(name string) (fs.File, error) {
 	if err != nil {
 		return nil, err
 	}
-	return t.store.Open(fullPath)
+	file, err := t.store.Open(fullPath)
+	return file, t.renameError(err, name)
 }
 
 func (t tenantFS) Stat(name string) (fs.FileInfo, error) {
@@ -35,36 +51,302 @@ func (t tenantFS) Stat(name string) (fs.FileInfo, error) {
 	if err != nil {
 		return nil, err
 	}
-	return t.store.Stat(fullPath)
+	info, err := t.store.Stat(fullPath)
+	return info, t.renameError(err, name)
 }
 
 func (t tenantFS) ReadDir(name string) ([]fs.DirEntry, error) {
-	fullPath, err := t.fullPath("readdir", name)
-	if err != nil {
-		return nil, err
-	}
-	file, err := t.store.Open(fullPath)
+	file, err := t.Open(name)
 	if err != nil {
 		return nil, err
 	}
 	dir, ok := file.(fs.ReadDirFile)
 	if !ok {
 		closeErr := file.Close()
-		return nil, errors.Join(fs.ErrInvalid, closeErr)
+		return nil, errors.Join(&fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}, closeErr)
 	}
 	entries, readErr := dir.ReadDir(-1)
 	return entries, errors.Join(readErr, file.Close())
 }
 
+func (t tenantFS) ReadFile(name string) ([]byte, error) {
+	file, err := t.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	data, readErr := io.ReadAll(file)
+	if readErr != nil {
+		readErr = &fs.PathError{Op: "read", Path: name, Err: readErr}
+	}
+	return data, errors.Join(readErr, file.Close())
+}
+
+// Sub returns the view rooted at dir. Like fs.Sub it does not require dir to
+// exist; opening names below a missing dir fails instead.
+func (t tenantFS) Sub(dir string) (fs.FS, error) {
+	if !validFSPath(dir) {
+		return nil, invalidPath("sub", dir)
+	}
+	if dir == "." {
+		return t, nil
+	}
+	t.dir = path.Join(t.dir, dir)
+	return t, nil
+}
+
+func (t tenantFS) Glob(pattern string) ([]string, error) {
+	// Hide this method so fs.Glob walks the tree through ReadDir.
+	return fs.Glob(struct{ fs.ReadDirFS }{t}, pattern)
+}
+
 func (t tenantFS) fullPath(op, name string) (string, error) {
 	if err := validateTenantID(t.tenantID, t.store.cfg); err != nil {
 		return "", pathError(op, t.tenantID, err)
 	}
-	if name == "." {
-		return t.tenantID, nil
+	if !validFSPath(name) {
+		return "", invalidPath(op, name)
 	}
-	if !fs.ValidPath(name) {
+	return path.Join(t.tenantID, t.dir, name), nil
+}
+
+// renameError reports err against the name the caller used rather than the
+// tenant-prefixed store path.
+func (t tenantFS) renameError(err error, name string) error {
+	if pathErr, ok := err.(*fs.PathError); ok && pathErr.Path != name {
+		return &fs.PathError{Op: pathErr.Op, Path: name, Err: pathErr.Err}
+	}
+	return err
+}
+
+// validFSPath is fs.ValidPath without backslashes, which the store reads as
+// separators and would otherwise alias other names.
+func validFSPath(name string) bool {
+	return fs.ValidPath(name) && !strings.Contains(name, "\\")
+}
+
+// tenantAfero is a writable afero view of one tenant. Names are taken
+// relative to the tenant root, a leading slash included, and cannot leave
+// it: ".." components are rejected and symlinks resolve inside the tenant.
+type tenantAfero struct {
+	store    *Store
+	tenantID string
+}
+
+// TenantAfero returns a writable afero.Fs confined to tenantID.
+func (s *Store) TenantAfero(tenantID string) afero.Fs {
+	return tenantAfero{store: s, tenantID: tenantID}
+}
+
+// fullPath maps name to the store path below the tenant root.
+func (t tenantAfero) fullPath(op, name string) (string, error) {
+	if err := validateTenantID(t.tenantID, t.store.cfg); err != nil {
+		return "", pathError(op, t.tenantID, err)
+	}
+	clean := strings.ReplaceAll(name, "\\", "/")
+	if len(clean) > 1 && clean[1] == ':' {
 		return "", invalidPath(op, name)
 	}
-	return path.Join(t.tenantID, name), nil
+	for _, part := range strings.Split(clean, "/") {
+		if part == ".." {
+			return "", invalidPath(op, name)
+		}
+	}
+	clean = strings.Trim(clean, "/")
+	if clean == "" || clean == "." {
+		return t.tenantID, nil
+	}
+	return t.tenantID + "/" + clean, nil
+}
+
+// relName strips the tenant prefix from store paths in err.
+func (t tenantAfero) relName(err error) error {
+	if pathErr, ok := err.(*os.PathError); ok {
+		return &os.PathError{Op: pathErr.Op, Path: t.strip(pathErr.Path), Err: pathErr.Err}
+	}
+	if linkErr, ok := err.(*os.LinkError); ok {
+		return &os.LinkError{Op: linkErr.Op, Old: t.strip(linkErr.Old), New: t.strip(linkErr.New), Err: linkErr.Err}
+	}
+	return err
+}
+
+func (t tenantAfero) strip(name string) string {
+	if name == t.tenantID {
+		return "/"
+	}
+	if rest, ok := strings.CutPrefix(name, t.tenantID+"/"); ok {
+		return "/" + rest
+	}
+	return name
+}
+
+func (t tenantAfero) wrapFile(file afero.File, err error) (afero.File, error) {
+	if err != nil {
+		return nil, t.relName(err)
+	}
+	return &tenantAferoFile{File: file, name: t.strip(file.Name())}, nil
+}
+
+func (t tenantAfero) Create(name string) (afero.File, error) {
+	return t.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+}
+
+func (t tenantAfero) Mkdir(name string, perm os.FileMode) error {
+	fullPath, err := t.fullPath("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.Mkdir(fullPath, perm))
+}
+
+func (t tenantAfero) MkdirAll(name string, perm os.FileMode) error {
+	fullPath, err := t.fullPath("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.MkdirAll(fullPath, perm))
+}
+
+func (t tenantAfero) Open(name string) (afero.File, error) {
+	return t.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (t tenantAfero) OpenFile(name string, flag int, perm os.FileMode) (afero.File, error) {
+	fullPath, err := t.fullPath("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return t.wrapFile(t.store.OpenFile(fullPath, flag, perm))
+}
+
+// Remove deletes name. The tenant root itself cannot be removed here; use
+// DeleteTenant.
+func (t tenantAfero) Remove(name string) error {
+	fullPath, err := t.fullPath("remove", name)
+	if err != nil {
+		return err
+	}
+	if fullPath == t.tenantID {
+		return invalidPath("remove", name)
+	}
+	return t.relName(t.store.Remove(fullPath))
+}
+
+// RemoveAll deletes name and everything below it. Called on the tenant root
+// it empties the tenant but keeps the root.
+func (t tenantAfero) RemoveAll(name string) error {
+	fullPath, err := t.fullPath("removeall", name)
+	if err != nil {
+		return err
+	}
+	if fullPath != t.tenantID {
+		return t.relName(t.store.RemoveAll(fullPath))
+	}
+	entries, err := afero.ReadDir(t.store, fullPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return t.relName(err)
+	}
+	for _, entry := range entries {
+		if err := t.store.RemoveAll(fullPath + "/" + entry.Name()); err != nil {
+			return t.relName(err)
+		}
+	}
+	return nil
+}
+
+func (t tenantAfero) Rename(oldname, newname string) error {
+	oldPath, err := t.fullPath("rename", oldname)
+	if err != nil {
+		return err
+	}
+	newPath, err := t.fullPath("rename", newname)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.Rename(oldPath, newPath))
+}
+
+func (t tenantAfero) Stat(name string) (os.FileInfo, error) {
+	fullPath, err := t.fullPath("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	info, err := t.store.Stat(fullPath)
+	return info, t.relName(err)
+}
+
+func (t tenantAfero) Name() string {
+	return t.store.Name() + ":" + t.tenantID
+}
+
+func (t tenantAfero) Chmod(name string, mode os.FileMode) error {
+	fullPath, err := t.fullPath("chmod", name)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.Chmod(fullPath, mode))
+}
+
+func (t tenantAfero) Chown(name string, uid, gid int) error {
+	fullPath, err := t.fullPath("chown", name)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.Chown(fullPath, uid, gid))
+}
+
+func (t tenantAfero) Chtimes(name string, atime, mtime time.Time) error {
+	fullPath, err := t.fullPath("chtimes", name)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.Chtimes(fullPath, atime, mtime))
+}
+
+// SymlinkIfPossible creates newname pointing at oldname. The target is stored
+// as given and, like every symlink, resolves inside the tenant.
+func (t tenantAfero) SymlinkIfPossible(oldname, newname string) error {
+	newPath, err := t.fullPath("symlink", newname)
+	if err != nil {
+		return err
+	}
+	return t.relName(t.store.SymlinkIfPossible(oldname, newPath))
+}
+
+func (t tenantAfero) ReadlinkIfPossible(name string) (string, error) {
+	fullPath, err := t.fullPath("readlink", name)
+	if err != nil {
+		return "", err
+	}
+	target, err := t.store.ReadlinkIfPossible(fullPath)
+	return target, t.relName(err)
+}
+
+func (t tenantAfero) LstatIfPossible(name string) (os.FileInfo, bool, error) {
+	fullPath, err := t.fullPath("lstat", name)
+	if err != nil {
+		return nil, true, err
+	}
+	info, ok, err := t.store.LstatIfPossible(fullPath)
+	return info, ok, t.relName(err)
+}
+
+// tenantAferoFile reports its name relative to the tenant root.
+type tenantAferoFile struct {
+	afero.File
+	name string
+}
+
+func (f *tenantAferoFile) Name() string {
+	return f.name
+}
+
+// ReadDir keeps fs.ReadDirFile available through the wrapper.
+func (f *tenantAferoFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	if dir, ok := f.File.(fs.ReadDirFile); ok {
+		return dir.ReadDir(n)
+	}
+	return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: fs.ErrInvalid}
 }
@@ -0,0 +1,114 @@
+package blobfs
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/afero"
+)
+
+func TestTenantFSPassesFSTest(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.MkdirAll("tenant-a/docs/sub", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/empty", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "top.txt", []byte("top"))
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("alpha"))
+	putTestBytes(t, store, "tenant-a", "docs/sub/b.txt", []byte("content spanning several chunks"))
+	putTestBytes(t, store, "tenant-b", "other.txt", []byte("other"))
+
+	tenantFS := store.TenantFS("tenant-a")
+	if err := fstest.TestFS(tenantFS, "top.txt", "docs/a.txt", "docs/sub/b.txt", "empty"); err != nil {
+		t.Fatal(err)
+	}
+	sub, err := fs.Sub(tenantFS, "docs")
+	if err != nil {
+		t.Fatalf("sub: %v", err)
+	}
+	if err := fstest.TestFS(sub, "a.txt", "sub/b.txt"); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := fs.ReadFile(sub, "sub/b.txt"); err != nil || string(data) != "content spanning several chunks" {
+		t.Fatalf("sub read = %q, %v", data, err)
+	}
+	if matches, err := fs.Glob(tenantFS, "docs/*.txt"); err != nil || len(matches) != 1 || matches[0] != "docs/a.txt" {
+		t.Fatalf("glob = %v, %v", matches, err)
+	}
+	if _, err := tenantFS.Open(`docs\a.txt`); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("open with backslash = %v", err)
+	}
+	if _, err := fs.Stat(tenantFS, "other.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat other tenant = %v", err)
+	}
+}
+
+func TestTenantAferoIsConfinedToTenant(t *testing.T) {
+	store := openTestStore(t)
+	putTestBytes(t, store, "tenant-b", "secret.txt", []byte("secret"))
+	fsys := store.TenantAfero("tenant-a")
+
+	if err := fsys.MkdirAll("/docs/sub", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	if err := afero.WriteFile(fsys, "docs/sub/a.txt", []byte("alpha"), 0o644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+	if err := fsys.Rename("/docs/sub/a.txt", "docs/b.txt"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "docs/b.txt"); string(got) != "alpha" {
+		t.Fatalf("store content = %q", got)
+	}
+	file, err := fsys.Open("/docs/b.txt")
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if file.Name() != "/docs/b.txt" {
+		t.Fatalf("file name = %q", file.Name())
+	}
+	if err := file.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if entries, err := afero.ReadDir(fsys, "/"); err != nil || len(entries) != 1 || entries[0].Name() != "docs" {
+		t.Fatalf("readdir root = %v, %v", entries, err)
+	}
+
+	for _, name := range []string{"../tenant-b/secret.txt", "/docs/../../tenant-b/secret.txt", `..\tenant-b\secret.txt`, "C:/secret.txt"} {
+		if _, err := fsys.Open(name); !errors.Is(err, fs.ErrInvalid) {
+			t.Fatalf("open %q = %v", name, err)
+		}
+	}
+	if err := fsys.Rename("docs/b.txt", "../tenant-b/b.txt"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("rename out of tenant = %v", err)
+	}
+	if _, err := fsys.Stat("secret.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat other tenant file = %v", err)
+	} else if pathErr, ok := err.(*os.PathError); !ok || pathErr.Path != "/secret.txt" {
+		t.Fatalf("stat error path = %v", err)
+	}
+	linker := fsys.(afero.Symlinker)
+	if err := linker.SymlinkIfPossible("/tenant-b/secret.txt", "escape"); err != nil {
+		t.Fatalf("symlink: %v", err)
+	}
+	if _, err := afero.ReadFile(fsys, "escape"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("read through escaping symlink = %v", err)
+	}
+	if err := fsys.Remove("/"); !errors.Is(err, fs.ErrInvalid) {
+		t.Fatalf("remove root = %v", err)
+	}
+	if err := fsys.RemoveAll("/"); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+	if entries, err := afero.ReadDir(fsys, "/"); err != nil || len(entries) != 0 {
+		t.Fatalf("readdir after remove all = %v, %v", entries, err)
+	}
+	if got := readTestBytes(t, store, "tenant-b", "secret.txt"); string(got) != "secret" {
+		t.Fatalf("other tenant content = %q", got)
+	}
+}
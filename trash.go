@@ -0,0 +1,206 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// SetTrash changes the trash mode of tenantID. Disabling the trash keeps the
+// entries already in it until they expire or are emptied.
+func (s *Store) SetTrash(ctx context.Context, tenantID string, cfg TrashConfig) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("set trash", tenantID, err)
+	}
+	if cfg.MaxAge < 0 {
+		return pathError("set trash", tenantID, errors.New("trash max age must be non-negative"))
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.updateTenantSettingsLocked(tenantID, func(settings *tenantSettings) {
+		settings.Trash = cfg.Enabled
+		settings.TrashMaxAge = int64(cfg.MaxAge)
+	})
+}
+
+// Trash returns the trash mode of tenantID.
+func (s *Store) Trash(ctx context.Context, tenantID string) (TrashConfig, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return TrashConfig{}, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return TrashConfig{}, pathError("trash", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil {
+		return TrashConfig{}, nil
+	}
+	return TrashConfig{Enabled: settings.Trash, MaxAge: time.Duration(settings.TrashMaxAge)}, nil
+}
+
+// ListTrash returns the trash entries of tenantID, most recently deleted
+// first. Entries of a deleted tenant are listed too.
+func (s *Store) ListTrash(ctx context.Context, tenantID string) ([]TrashEntry, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("list trash", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	var entries []TrashEntry
+	for _, entry := range s.meta.Trash {
+		if entry.TenantID != tenantID {
+			continue
+		}
+		info := TrashEntry{
+			ID:        entry.InodeID,
+			TenantID:  entry.TenantID,
+			Path:      entry.Path,
+			DeletedAt: time.Unix(0, entry.DeletedAt),
+		}
+		if inode := s.meta.Inodes[entry.InodeID]; inode != nil {
+			info.IsDir = inode.Kind == fileKindDir
+		}
+		if entry.ExpiresAt != 0 {
+			info.ExpiresAt = time.Unix(0, entry.ExpiresAt)
+		}
+		entries = append(entries, info)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if !entries[i].DeletedAt.Equal(entries[j].DeletedAt) {
+			return entries[i].DeletedAt.After(entries[j].DeletedAt)
+		}
+		return entries[i].ID > entries[j].ID
+	})
+	return entries, nil
+}
+
+// Restore moves the trash entry id of tenantID back to its original path. The
+// parent directory must exist and the path must be free; a deleted tenant can
+// only be restored while no tenant of that name exists.
+func (s *Store) Restore(ctx context.Context, tenantID string, id uint64) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("restore", tenantID, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	entry := s.meta.Trash[id]
+	inode := s.activeInodeLocked(id)
+	if entry == nil || entry.TenantID != tenantID || inode == nil {
+		return notExist("restore", strconv.FormatUint(id, 10))
+	}
+	ops := []metaOp{{Type: "delete_trash", ChildID: id}}
+	if entry.Path == "" {
+		if s.meta.Tenants[tenantID] != 0 {
+			return exists("restore", tenantID)
+		}
+		ops = append(ops, metaOp{Type: "put_tenant", TenantID: tenantID, ChildID: id})
+		if err := s.checkQuotaLocked(ops); err != nil {
+			return pathError("restore", tenantID, err)
+		}
+		return s.commitMetaFinalLocked(ops)
+	}
+	parentID, name, err := s.resolveParentLocked(tenantID, entry.Path)
+	if err != nil {
+		return pathError("restore", entry.Path, err)
+	}
+	if s.activeInodeLocked(s.meta.DirEntries[parentID][name]) != nil {
+		return exists("restore", entry.Path)
+	}
+	now := nowUnix()
+	next := cloneInode(inode)
+	next.ParentInode = parentID
+	next.Name = name
+	next.NamespaceGeneration++
+	if next.Kind == fileKindFile {
+		next.Generation = max(next.Generation, s.versionFloorLocked(tenantID, entry.Path))
+	}
+	next.Generation++
+	next.CTime = now
+	next.UpdatedAt = now
+	ops = append(ops,
+		metaOp{Type: "put_dirent", ParentID: parentID, Name: name, ChildID: id},
+		metaOp{Type: "put_inode", Inode: next},
+	)
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return pathError("restore", entry.Path, err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// EmptyTrash drops every trash entry of tenantID. The detached nodes become
+// unreachable and the next RunGC reclaims them.
+func (s *Store) EmptyTrash(ctx context.Context, tenantID string) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("empty trash", tenantID, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	var ops []metaOp
+	for id, entry := range s.meta.Trash {
+		if entry.TenantID == tenantID {
+			ops = append(ops, metaOp{Type: "delete_trash", ChildID: id})
+		}
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// moveToTrashLocked queues the ops that detach inode from parentID/name into
+// the trash of its tenant. It reports false when the tenant has no trash or
+// other hard links still name the file, so the caller deletes as usual.
+func (s *Store) moveToTrashLocked(inode *inodeRecord, parentID uint64, name, path string, ops *[]metaOp, now int64) bool {
+	settings := s.meta.TenantSettings[inode.TenantID]
+	if settings == nil || !settings.Trash || linkCount(inode) > 1 {
+		return false
+	}
+	entry := &trashEntry{InodeID: inode.InodeID, TenantID: inode.TenantID, Path: path, DeletedAt: now}
+	if settings.TrashMaxAge > 0 {
+		entry.ExpiresAt = now + settings.TrashMaxAge
+	}
+	if parentID != 0 {
+		next := cloneInode(inode)
+		next.Generation++
+		next.NamespaceGeneration++
+		next.CTime = now
+		next.UpdatedAt = now
+		*ops = append(*ops,
+			metaOp{Type: "delete_dirent", ParentID: parentID, Name: name},
+			metaOp{Type: "put_inode", Inode: next},
+		)
+	}
+	*ops = append(*ops, metaOp{Type: "put_trash", Trash: entry})
+	return true
+}
+
+// markTrashReachableLocked adds the subtrees of unexpired trash entries to
+// reachable and queues the removal of expired entries.
+func (s *Store) markTrashReachableLocked(now int64, reachable map[uint64]bool, result *GCResult, ops *[]metaOp) {
+	for id, entry := range s.meta.Trash {
+		if entry.ExpiresAt != 0 && entry.ExpiresAt <= now {
+			*ops = append(*ops, metaOp{Type: "delete_trash", ChildID: id})
+			result.TrashExpired++
+			continue
+		}
+		s.markReachableLocked(id, reachable)
+	}
+}
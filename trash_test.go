@@ -0,0 +1,110 @@
+package blobfs
+
+import (
+	"errors"
+	"io/fs"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func TestTrashRestoresDeletedTrees(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	ctx := testContext(t)
+	if err := store.SetTrash(ctx, "tenant-a", TrashConfig{Enabled: true}); err != nil {
+		t.Fatalf("set trash: %v", err)
+	}
+	if err := store.MkdirAll("tenant-a/docs/sub", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/sub/a.txt", []byte("alpha"))
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("beta"))
+	if err := store.RemoveAll("tenant-a/docs"); err != nil {
+		t.Fatalf("remove all: %v", err)
+	}
+	if err := store.DeleteObject(ctx, "tenant-a", "b.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.RunGC(ctx, GCOptions{CandidateConfirmCycles: 1, SafetyWindow: -1}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	store, err = OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer store.Close()
+
+	entries, err := store.ListTrash(ctx, "tenant-a")
+	if err != nil || len(entries) != 2 || entries[0].Path != "b.txt" || entries[1].Path != "docs" || !entries[1].IsDir || !entries[1].ExpiresAt.IsZero() {
+		t.Fatalf("trash = %+v, %v", entries, err)
+	}
+	if _, err := store.Stat("tenant-a/docs"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("stat trashed dir = %v", err)
+	}
+	if err := store.Restore(ctx, "tenant-a", entries[1].ID); err != nil {
+		t.Fatalf("restore dir: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "docs/sub/a.txt"); string(got) != "alpha" {
+		t.Fatalf("restored content = %q", got)
+	}
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("replacement"))
+	if err := store.Restore(ctx, "tenant-a", entries[0].ID); !errors.Is(err, fs.ErrExist) {
+		t.Fatalf("restore over existing = %v", err)
+	}
+	if err := store.Restore(ctx, "tenant-b", entries[0].ID); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("restore from other tenant = %v", err)
+	}
+	if err := store.EmptyTrash(ctx, "tenant-a"); err != nil {
+		t.Fatalf("empty trash: %v", err)
+	}
+	if entries, err := store.ListTrash(ctx, "tenant-a"); err != nil || len(entries) != 0 {
+		t.Fatalf("trash after empty = %+v, %v", entries, err)
+	}
+}
+
+func TestTrashKeepsDeletedTenantUntilExpiry(t *testing.T) {
+	store := openTestStore(t)
+	ctx := testContext(t)
+	if err := store.SetTrash(ctx, "tenant-a", TrashConfig{Enabled: true, MaxAge: time.Hour}); err != nil {
+		t.Fatalf("set trash: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("alpha"))
+	if err := store.DeleteTenant(ctx, "tenant-a"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	entries, err := store.ListTrash(ctx, "tenant-a")
+	if err != nil || len(entries) != 1 || entries[0].Path != "" || entries[0].ExpiresAt.IsZero() {
+		t.Fatalf("trash = %+v, %v", entries, err)
+	}
+	if err := store.Restore(ctx, "tenant-a", entries[0].ID); err != nil {
+		t.Fatalf("restore tenant: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "a.txt"); string(got) != "alpha" {
+		t.Fatalf("restored tenant content = %q", got)
+	}
+
+	// Settings go with the tenant, so enable the trash again with an expiry
+	// that has already passed by the time GC runs.
+	if err := store.SetTrash(ctx, "tenant-a", TrashConfig{Enabled: true, MaxAge: time.Nanosecond}); err != nil {
+		t.Fatalf("set trash: %v", err)
+	}
+	if err := store.Remove("tenant-a/a.txt"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	result, err := store.RunGC(ctx, GCOptions{CandidateConfirmCycles: 1, SafetyWindow: -1})
+	if err != nil || result.TrashExpired != 1 || result.ChunksDeleted == 0 {
+		t.Fatalf("gc = %+v, %v", result, err)
+	}
+	if entries, err := store.ListTrash(ctx, "tenant-a"); err != nil || len(entries) != 0 {
+		t.Fatalf("trash after expiry = %+v, %v", entries, err)
+	}
+}
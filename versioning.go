@@ -0,0 +1,484 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+func versionKey(tenantID, path string) string {
+	return tenantID + "/" + path
+}
+
+func cloneVersionHistory(history *versionHistory) *versionHistory {
+	next := *history
+	next.Versions = make([]objectVersion, len(history.Versions))
+	for i := range history.Versions {
+		next.Versions[i] = history.Versions[i]
+		next.Versions[i].Options = copyOptions(history.Versions[i].Options)
+	}
+	return &next
+}
+
+func versionFromInode(inode *inodeRecord, now int64) objectVersion {
+	return objectVersion{
+		VersionID:    inode.Generation,
+		Size:         inode.Size,
+		FileHash:     inode.FileHash,
+		ManifestID:   inode.ManifestID,
+		Options:      copyOptions(inode.Options),
+		Mode:         inode.Mode,
+		MTime:        inode.MTime,
+		NoncurrentAt: now,
+	}
+}
+
+// inodeFromVersion builds a detached file inode that reads a noncurrent
+// version through the manifest reference the history holds.
+func inodeFromVersion(tenantID string, version *objectVersion) *inodeRecord {
+	return &inodeRecord{
+		TenantID:   tenantID,
+		Kind:       fileKindFile,
+		State:      fileStateActive,
+		Size:       version.Size,
+		FileHash:   version.FileHash,
+		ManifestID: version.ManifestID,
+		Options:    copyOptions(version.Options),
+		Mode:       version.Mode,
+		MTime:      version.MTime,
+		ModTime:    version.MTime,
+		Generation: version.VersionID,
+		UpdatedAt:  version.NoncurrentAt,
+	}
+}
+
+func objectVersionFromRecord(path string, version *objectVersion) ObjectVersion {
+	return ObjectVersion{
+		Path:         path,
+		VersionID:    version.VersionID,
+		DeleteMarker: version.DeleteMarker,
+		Size:         version.Size,
+		FileHash:     version.FileHash,
+		ModTime:      time.Unix(0, version.MTime),
+		NoncurrentAt: time.Unix(0, version.NoncurrentAt),
+		Options:      copyOptions(version.Options),
+	}
+}
+
+func (s *Store) versioningEnabledLocked(tenantID string) bool {
+	settings := s.meta.TenantSettings[tenantID]
+	return settings != nil && settings.Versioning
+}
+
+// versionFloorLocked returns the newest version ID recorded for path. A file
+// created at the path must start above it so version IDs never repeat.
+func (s *Store) versionFloorLocked(tenantID, path string) uint64 {
+	history := s.meta.Versions[versionKey(tenantID, path)]
+	if history == nil || len(history.Versions) == 0 {
+		return 0
+	}
+	return history.Versions[len(history.Versions)-1].VersionID
+}
+
+// appendVersionsLocked pushes versions onto the history of path and queues
+// the updated history.
+func (s *Store) appendVersionsLocked(tenantID, path string, ops *[]metaOp, versions ...objectVersion) {
+	history := &versionHistory{TenantID: tenantID, Path: path}
+	if current := s.meta.Versions[versionKey(tenantID, path)]; current != nil {
+		history = cloneVersionHistory(current)
+	}
+	history.Versions = append(history.Versions, versions...)
+	*ops = append(*ops, metaOp{Type: "put_versions", Versions: history})
+}
+
+// retireFileLocked releases the content of a file that leaves the namespace.
+// With versioning enabled the content stays referenced as a noncurrent
+// version, followed by a delete marker when the path is deleted.
+func (s *Store) retireFileLocked(inode *inodeRecord, path string, deleteMarker bool, ops *[]metaOp, now int64) {
+	if !s.versioningEnabledLocked(inode.TenantID) {
+		addDeletedManifestOpsLocked(s.meta, inode.ManifestID, ops, now)
+		return
+	}
+	versions := []objectVersion{versionFromInode(inode, now)}
+	if deleteMarker {
+		versions = append(versions, objectVersion{VersionID: inode.Generation + 1, DeleteMarker: true, NoncurrentAt: now})
+	}
+	s.appendVersionsLocked(inode.TenantID, path, ops, versions...)
+}
+
+// SetVersioning changes the versioning mode of tenantID. Disabling versioning
+// suspends it: existing versions are kept until they expire or are deleted.
+func (s *Store) SetVersioning(ctx context.Context, tenantID string, cfg VersioningConfig) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("set versioning", tenantID, err)
+	}
+	if cfg.MaxVersions < 0 || cfg.MaxAge < 0 {
+		return pathError("set versioning", tenantID, errors.New("version limits must be non-negative"))
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	return s.updateTenantSettingsLocked(tenantID, func(settings *tenantSettings) {
+		settings.Versioning = cfg.Enabled
+		settings.MaxVersions = cfg.MaxVersions
+		settings.VersionMaxAge = int64(cfg.MaxAge)
+	})
+}
+
+// Versioning returns the versioning mode of tenantID.
+func (s *Store) Versioning(ctx context.Context, tenantID string) (VersioningConfig, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return VersioningConfig{}, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return VersioningConfig{}, pathError("versioning", tenantID, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	settings := s.meta.TenantSettings[tenantID]
+	if settings == nil {
+		return VersioningConfig{}, nil
+	}
+	return VersioningConfig{
+		Enabled:     settings.Versioning,
+		MaxVersions: settings.MaxVersions,
+		MaxAge:      time.Duration(settings.VersionMaxAge),
+	}, nil
+}
+
+// currentFileLocked returns the live file at path, or nil when the path is
+// missing or names a directory or symlink.
+func (s *Store) currentFileLocked(tenantID, path string) *inodeRecord {
+	inode, err := s.lookupPathLocked(tenantID, path)
+	if err != nil || inode.Kind != fileKindFile {
+		return nil
+	}
+	return inode
+}
+
+// ListVersions returns every version of path, newest first. The live file, or
+// the newest delete marker when the path is deleted, is marked IsLatest.
+func (s *Store) ListVersions(ctx context.Context, tenantID, path string) ([]ObjectVersion, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("list versions", tenantID, err)
+	}
+	path, err := normalizePath(path, s.cfg)
+	if err != nil {
+		return nil, pathError("list versions", path, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	var versions []ObjectVersion
+	if current := s.currentFileLocked(tenantID, path); current != nil {
+		version := versionFromInode(current, 0)
+		info := objectVersionFromRecord(path, &version)
+		info.NoncurrentAt = time.Time{}
+		versions = append(versions, info)
+	}
+	if history := s.meta.Versions[versionKey(tenantID, path)]; history != nil {
+		for i := len(history.Versions) - 1; i >= 0; i-- {
+			versions = append(versions, objectVersionFromRecord(path, &history.Versions[i]))
+		}
+	}
+	if len(versions) == 0 {
+		return nil, notExist("list versions", path)
+	}
+	versions[0].IsLatest = true
+	return versions, nil
+}
+
+// OpenVersion opens a reader for one version of path. Opening a delete marker
+// fails with ErrDeleteMarker.
+func (s *Store) OpenVersion(ctx context.Context, tenantID, path string, versionID uint64) (*ObjectReader, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("open version", tenantID, err)
+	}
+	path, err := normalizePath(path, s.cfg)
+	if err != nil {
+		return nil, pathError("open version", path, err)
+	}
+	s.metaMu.RLock()
+	defer s.metaMu.RUnlock()
+	if current := s.currentFileLocked(tenantID, path); current != nil && current.Generation == versionID {
+		return s.openInodeReaderLocked(current, path, 0, -1)
+	}
+	version := s.findVersionLocked(tenantID, path, versionID)
+	if version == nil {
+		return nil, notExist("open version", path)
+	}
+	if version.DeleteMarker {
+		return nil, pathError("open version", path, ErrDeleteMarker)
+	}
+	return s.openInodeReaderLocked(inodeFromVersion(tenantID, version), path, 0, -1)
+}
+
+func (s *Store) findVersionLocked(tenantID, path string, versionID uint64) *objectVersion {
+	history := s.meta.Versions[versionKey(tenantID, path)]
+	if history == nil {
+		return nil
+	}
+	for i := range history.Versions {
+		if history.Versions[i].VersionID == versionID {
+			return &history.Versions[i]
+		}
+	}
+	return nil
+}
+
+// RestoreVersion makes a copy of a noncurrent version the current content of
+// path. The restored version also stays in the history. The replaced file is
+// kept as a noncurrent version when versioning is enabled.
+func (s *Store) RestoreVersion(ctx context.Context, tenantID, path string, versionID uint64) (*ObjectInfo, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return nil, pathError("restore version", tenantID, err)
+	}
+	path, err := normalizePath(path, s.cfg)
+	if err != nil {
+		return nil, pathError("restore version", path, err)
+	}
+	if err := s.ensureTenantRoot(tenantID); err != nil {
+		return nil, err
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	parentID, name, err := s.resolveParentLocked(tenantID, path)
+	if err != nil {
+		return nil, pathError("restore version", path, err)
+	}
+	existing := s.activeInodeLocked(s.meta.DirEntries[parentID][name])
+	if existing != nil && existing.Kind != fileKindFile {
+		return nil, pathError("restore version", path, ErrIsDir)
+	}
+	if existing != nil && existing.Generation == versionID {
+		info := objectInfoFromInode(existing, path)
+		return &info, nil
+	}
+	found := s.findVersionLocked(tenantID, path, versionID)
+	if found == nil {
+		return nil, notExist("restore version", path)
+	}
+	if found.DeleteMarker {
+		return nil, pathError("restore version", path, ErrDeleteMarker)
+	}
+	now := nowUnix()
+	if err := checkObjectLock(existing, now); err != nil {
+		return nil, pathError("restore version", path, err)
+	}
+	var ops []metaOp
+	inode, err := s.putFileContentLocked(tenantID, path, parentID, name, existing, *found, &ops, now)
+	if err != nil {
+		return nil, pathError("restore version", path, err)
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return nil, pathError("restore version", path, err)
+	}
+	if err := s.commitMetaFinalLocked(ops); err != nil {
+		return nil, err
+	}
+	info := objectInfoFromInode(inode, path)
+	return &info, nil
+}
+
+// DeleteVersion permanently removes one version of path and releases its
+// content. Deleting the latest version promotes the next newest version; when
+// that is a delete marker the path stays deleted.
+func (s *Store) DeleteVersion(ctx context.Context, tenantID, path string, versionID uint64) error {
+	if err := s.beginOp(ctx); err != nil {
+		return err
+	}
+	defer s.endOp()
+	if err := validateTenantID(tenantID, s.cfg); err != nil {
+		return pathError("delete version", tenantID, err)
+	}
+	path, err := normalizePath(path, s.cfg)
+	if err != nil {
+		return pathError("delete version", path, err)
+	}
+	s.metaMu.Lock()
+	defer s.metaMu.Unlock()
+	now := nowUnix()
+	var ops []metaOp
+	history := &versionHistory{TenantID: tenantID, Path: path}
+	if current := s.meta.Versions[versionKey(tenantID, path)]; current != nil {
+		history = cloneVersionHistory(current)
+	}
+	current := s.currentFileLocked(tenantID, path)
+	removedLatest := false
+	if current != nil && current.Generation == versionID {
+		if err := checkObjectLock(current, now); err != nil {
+			return pathError("delete version", path, err)
+		}
+		parentID, name, err := s.resolveParentLocked(tenantID, path)
+		if err != nil {
+			return pathError("delete version", path, err)
+		}
+		if linkCount(current) > 1 {
+			// Other hard links still name the content.
+			s.removeLinkLocked(current, parentID, name, path, false, &ops, now)
+		} else {
+			next := cloneInode(current)
+			next.State = fileStateDeleted
+			next.DeletedAt = now
+			next.UpdatedAt = now
+			next.CTime = now
+			next.Generation++
+			ops = append(ops, metaOp{Type: "put_inode", Inode: next}, metaOp{Type: "delete_dirent", ParentID: parentID, Name: name})
+			addDeletedManifestOpsLocked(s.meta, current.ManifestID, &ops, now)
+		}
+		removedLatest = true
+	} else {
+		index := -1
+		for i := range history.Versions {
+			if history.Versions[i].VersionID == versionID {
+				index = i
+			}
+		}
+		if index < 0 {
+			return notExist("delete version", path)
+		}
+		removed := history.Versions[index]
+		history.Versions = append(history.Versions[:index], history.Versions[index+1:]...)
+		if !removed.DeleteMarker {
+			addDeletedManifestOpsLocked(s.meta, removed.ManifestID, &ops, now)
+		}
+		removedLatest = current == nil && index == len(history.Versions)
+	}
+	if removedLatest && len(history.Versions) > 0 && !history.Versions[len(history.Versions)-1].DeleteMarker {
+		if parentID, name, err := s.resolveParentLocked(tenantID, path); err == nil {
+			promoted := history.Versions[len(history.Versions)-1]
+			history.Versions = history.Versions[:len(history.Versions)-1]
+			// The history reference on the manifest moves to the promoted inode.
+			inode := inodeFromVersion(tenantID, &promoted)
+			inode.InodeID = s.nextInodeIDLocked()
+			inode.ParentInode = parentID
+			inode.Name = name
+			inode.ContentGeneration = 1
+			inode.MetadataGeneration = 1
+			inode.NamespaceGeneration = 1
+			inode.CreatedAt = now
+			inode.UpdatedAt = now
+			inode.CTime = now
+			ops = append(ops, metaOp{Type: "put_dirent", ParentID: parentID, Name: name, ChildID: inode.InodeID}, metaOp{Type: "put_inode", Inode: inode})
+		}
+	}
+	if len(history.Versions) > 0 {
+		ops = append(ops, metaOp{Type: "put_versions", Versions: history})
+	} else if s.meta.Versions[versionKey(tenantID, path)] != nil {
+		ops = append(ops, metaOp{Type: "delete_versions", TenantID: tenantID, Name: path})
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// versionLimits returns the noncurrent version limits that apply to history:
+// at most maxVersions are kept and none older than maxAge. Zero disables a
+// limit.
+type versionLimits func(history *versionHistory) (maxVersions int, maxAge int64)
+
+// tenantVersionLimits applies the limits set through SetVersioning.
+func (s *Store) tenantVersionLimits(history *versionHistory) (int, int64) {
+	settings := s.meta.TenantSettings[history.TenantID]
+	if settings == nil {
+		return 0, 0
+	}
+	return settings.MaxVersions, settings.VersionMaxAge
+}
+
+// expireVersionsLocked drops noncurrent versions of histories beyond the
+// limits returned for them, and delete markers left without an older version
+// to hide. It returns the versions dropped.
+func (s *Store) expireVersionsLocked(now int64, histories []*versionHistory, limits versionLimits, ops *[]metaOp) []ExpiredObject {
+	manifestRecords := map[string]*manifestRecord{}
+	manifestDeltas := map[string]int{}
+	chunkDeltas := map[string]int{}
+	var expired []ExpiredObject
+	for _, history := range histories {
+		maxVersions, maxAge := limits(history)
+		if maxVersions == 0 && maxAge == 0 {
+			continue
+		}
+		current := s.currentFileLocked(history.TenantID, history.Path)
+		kept := make([]objectVersion, 0, len(history.Versions))
+		noncurrent := 0
+		for i := len(history.Versions) - 1; i >= 0; i-- {
+			version := history.Versions[i]
+			latest := current == nil && i == len(history.Versions)-1
+			if !latest {
+				noncurrent++
+				tooMany := maxVersions > 0 && noncurrent > maxVersions
+				tooOld := maxAge > 0 && now-version.NoncurrentAt > maxAge
+				if tooMany || tooOld {
+					s.dropVersionLocked(&version, manifestRecords, manifestDeltas, chunkDeltas)
+					expired = append(expired, ExpiredObject{TenantID: history.TenantID, Path: history.Path, VersionID: version.VersionID, Noncurrent: true})
+					continue
+				}
+			}
+			kept = append(kept, version)
+		}
+		// kept is newest first; a delete marker needs an older real version.
+		hidden := false
+		for i := len(kept) - 1; i >= 0; i-- {
+			if !kept[i].DeleteMarker {
+				hidden = true
+				continue
+			}
+			if !hidden {
+				expired = append(expired, ExpiredObject{TenantID: history.TenantID, Path: history.Path, VersionID: kept[i].VersionID, Noncurrent: true})
+				kept = append(kept[:i], kept[i+1:]...)
+			}
+		}
+		if len(kept) == len(history.Versions) {
+			continue
+		}
+		if len(kept) == 0 {
+			*ops = append(*ops, metaOp{Type: "delete_versions", TenantID: history.TenantID, Name: history.Path})
+			continue
+		}
+		next := &versionHistory{TenantID: history.TenantID, Path: history.Path, Versions: make([]objectVersion, 0, len(kept))}
+		for i := len(kept) - 1; i >= 0; i-- {
+			next.Versions = append(next.Versions, kept[i])
+		}
+		*ops = append(*ops, metaOp{Type: "put_versions", Versions: next})
+	}
+	appendRefDeltaOpsLocked(s.meta, ops, manifestRecords, manifestDeltas, chunkDeltas, now)
+	return expired
+}
+
+// dropTenantVersionsLocked queues the removal of every version history of
+// tenantID and adds the released references to the delta maps.
+func (s *Store) dropTenantVersionsLocked(tenantID string, ops *[]metaOp, manifestRecords map[string]*manifestRecord, manifestDeltas, chunkDeltas map[string]int) {
+	for _, history := range s.meta.Versions {
+		if history.TenantID != tenantID {
+			continue
+		}
+		for i := range history.Versions {
+			s.dropVersionLocked(&history.Versions[i], manifestRecords, manifestDeltas, chunkDeltas)
+		}
+		*ops = append(*ops, metaOp{Type: "delete_versions", TenantID: tenantID, Name: history.Path})
+	}
+}
+
+func (s *Store) dropVersionLocked(version *objectVersion, manifestRecords map[string]*manifestRecord, manifestDeltas, chunkDeltas map[string]int) {
+	if version.DeleteMarker {
+		return
+	}
+	if manifest := s.meta.Manifests[version.ManifestID]; manifest != nil {
+		manifestRecords[manifest.ManifestID] = manifest
+		addManifestRefDelta(manifest, -1, manifestDeltas, chunkDeltas)
+	}
+}
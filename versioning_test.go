@@ -0,0 +1,179 @@
+package blobfs
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func readTestVersion(t *testing.T, store *Store, tenantID, path string, versionID uint64) string {
+	t.Helper()
+	reader, err := store.OpenVersion(testContext(t), tenantID, path, versionID)
+	if err != nil {
+		t.Fatalf("open version %d: %v", versionID, err)
+	}
+	defer reader.Close()
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("read version %d: %v", versionID, err)
+	}
+	return string(data)
+}
+
+func TestVersioningKeepsOverwritesAndDeleteMarkers(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	if err := store.SetVersioning(testContext(t), "tenant-a", VersioningConfig{Enabled: true}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	first := putTestBytes(t, store, "tenant-a", "a.txt", []byte("one"))
+	second := putTestBytes(t, store, "tenant-a", "a.txt", []byte("two"))
+	if second.Generation <= first.Generation {
+		t.Fatalf("generations = %d, %d", first.Generation, second.Generation)
+	}
+	if err := store.DeleteObject(testContext(t), "tenant-a", "a.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if _, err := store.OpenObject(testContext(t), "tenant-a", "a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("open deleted = %v", err)
+	}
+	if _, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1, Compact: true}); err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	checkpointTestStore(t, store)
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	versions, err := reopened.ListVersions(testContext(t), "tenant-a", "a.txt")
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	if len(versions) != 3 || !versions[0].DeleteMarker || !versions[0].IsLatest ||
+		versions[1].VersionID != second.Generation || versions[2].VersionID != first.Generation {
+		t.Fatalf("versions = %+v", versions)
+	}
+	if _, err := reopened.OpenVersion(testContext(t), "tenant-a", "a.txt", versions[0].VersionID); !errors.Is(err, ErrDeleteMarker) {
+		t.Fatalf("open delete marker = %v", err)
+	}
+	if got := readTestVersion(t, reopened, "tenant-a", "a.txt", first.Generation); got != "one" {
+		t.Fatalf("first version = %q", got)
+	}
+
+	restored, err := reopened.RestoreVersion(testContext(t), "tenant-a", "a.txt", first.Generation)
+	if err != nil {
+		t.Fatalf("restore version: %v", err)
+	}
+	if restored.Generation <= versions[0].VersionID {
+		t.Fatalf("restored generation %d does not follow marker %d", restored.Generation, versions[0].VersionID)
+	}
+	if got := readTestBytes(t, reopened, "tenant-a", "a.txt"); string(got) != "one" {
+		t.Fatalf("restored content = %q", got)
+	}
+	versions, err = reopened.ListVersions(testContext(t), "tenant-a", "a.txt")
+	if err != nil || len(versions) != 4 || versions[0].VersionID != restored.Generation {
+		t.Fatalf("versions after restore = %+v, %v", versions, err)
+	}
+}
+
+func TestDeleteVersionPromotesPreviousVersion(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.SetVersioning(testContext(t), "tenant-a", VersioningConfig{Enabled: true}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	first := putTestBytes(t, store, "tenant-a", "a.txt", []byte("one"))
+	second := putTestBytes(t, store, "tenant-a", "a.txt", []byte("two"))
+	if err := store.DeleteObject(testContext(t), "tenant-a", "a.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	versions, err := store.ListVersions(testContext(t), "tenant-a", "a.txt")
+	if err != nil {
+		t.Fatalf("list versions: %v", err)
+	}
+	// Removing the delete marker brings the newest version back.
+	if err := store.DeleteVersion(testContext(t), "tenant-a", "a.txt", versions[0].VersionID); err != nil {
+		t.Fatalf("delete marker: %v", err)
+	}
+	if got := readTestBytes(t, store, "tenant-a", "a.txt"); string(got) != "two" {
+		t.Fatalf("content after removing marker = %q", got)
+	}
+	// Removing the current version promotes the one before it.
+	if err := store.DeleteVersion(testContext(t), "tenant-a", "a.txt", second.Generation); err != nil {
+		t.Fatalf("delete current version: %v", err)
+	}
+	info, err := store.StatObject(testContext(t), "tenant-a", "a.txt")
+	if err != nil || info.Generation != first.Generation {
+		t.Fatalf("stat after promote = %+v, %v", info, err)
+	}
+	if err := store.DeleteVersion(testContext(t), "tenant-a", "a.txt", first.Generation); err != nil {
+		t.Fatalf("delete last version: %v", err)
+	}
+	if _, err := store.ListVersions(testContext(t), "tenant-a", "a.txt"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("list after deleting every version = %v", err)
+	}
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	for _, manifest := range store.meta.Manifests {
+		if manifest.RefCount != 0 {
+			t.Fatalf("manifest still referenced: %+v", manifest)
+		}
+	}
+}
+
+func TestGCExpiresVersionsBeyondLimit(t *testing.T) {
+	store := openTestStore(t)
+	if err := store.SetVersioning(testContext(t), "tenant-a", VersioningConfig{Enabled: true, MaxVersions: 1}); err != nil {
+		t.Fatalf("set versioning: %v", err)
+	}
+	cfg, err := store.Versioning(testContext(t), "tenant-a")
+	if err != nil || !cfg.Enabled || cfg.MaxVersions != 1 {
+		t.Fatalf("versioning = %+v, %v", cfg, err)
+	}
+	first := putTestBytes(t, store, "tenant-a", "a.txt", []byte("one"))
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("two"))
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("three"))
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("bee"))
+	if err := store.Rename("tenant-a/b.txt", "tenant-a/a.txt"); err != nil {
+		t.Fatalf("rename over versioned file: %v", err)
+	}
+	result, err := store.RunGC(testContext(t), GCOptions{CandidateConfirmCycles: 1})
+	if err != nil {
+		t.Fatalf("gc: %v", err)
+	}
+	if result.VersionsExpired != 2 {
+		t.Fatalf("versions expired = %d, want 2", result.VersionsExpired)
+	}
+	versions, err := store.ListVersions(testContext(t), "tenant-a", "a.txt")
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("versions = %+v, %v", versions, err)
+	}
+	if got := readTestVersion(t, store, "tenant-a", "a.txt", versions[1].VersionID); got != "three" {
+		t.Fatalf("kept version = %q", got)
+	}
+	store.metaMu.RLock()
+	manifest := store.meta.Manifests[first.ManifestID]
+	store.metaMu.RUnlock()
+	if manifest != nil && manifest.RefCount != 0 {
+		t.Fatalf("expired version still referenced: %+v", manifest)
+	}
+
+	if err := store.DeleteTenant(testContext(t), "tenant-a"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+	store.metaMu.RLock()
+	defer store.metaMu.RUnlock()
+	if len(store.meta.Versions) != 0 || len(store.meta.TenantSettings) != 0 {
+		t.Fatalf("tenant delete kept versions=%d settings=%d", len(store.meta.Versions), len(store.meta.TenantSettings))
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -87,6 +88,9 @@ func (s *Store) OpenFileContext(ctx context.Context, name string, flag int, perm
 		if flag&os.O_CREATE != 0 && flag&os.O_EXCL != 0 {
 			return nil, exists("open", name)
 		}
+		if writable && info.locked {
+			return nil, pathError("open", name, ErrObjectLocked)
+		}
 	}
 	if !writable {
 		reader, err := s.OpenObject(ctx, tenantID, path)
@@ -147,6 +151,8 @@ func (s *Store) OpenFileContext(ctx context.Context, name string, flag int, perm
 		path:           path,
 		session:        session,
 		sessionName:    sessionName,
+		openedAt:       nowUnix(),
+		maxFileSize:    s.tenantConfig(tenantID).MaxFileSize,
 		size:           size,
 		offset:         offset,
 		mode:           mode.Perm(),
@@ -217,7 +223,7 @@ func (s *Store) Mkdir(name string, perm os.FileMode) error {
 		MTime:               now,
 		ModTime:             now,
 	}
-	return s.commitMetaLocked([]metaOp{
+	return s.commitMetaFinalLocked([]metaOp{
 		{Type: "put_inode", Inode: inode},
 		{Type: "put_dirent", ParentID: parentID, Name: base, ChildID: inode.InodeID},
 	})
@@ -248,7 +254,8 @@ func (s *Store) MkdirAll(name string, perm os.FileMode) error {
 	now := nowUnix()
 	pendingDirs := map[uint64]*inodeRecord{}
 	ops := []metaOp{}
-	for _, part := range strings.Split(path, "/") {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
 		current := s.activeInodeLocked(currentID)
 		if current == nil {
 			current = pendingDirs[currentID]
@@ -262,6 +269,14 @@ func (s *Store) MkdirAll(name string, perm os.FileMode) error {
 			if child == nil {
 				return pathError("mkdir", name, fs.ErrNotExist)
 			}
+			if child.Kind == fileKindSymlink {
+				// Only existing components can be links, so the walk
+				// sees no pending directories.
+				if child, err = s.resolvePathLocked(tenantID, strings.Join(parts[:i+1], "/")); err != nil {
+					return pathError("mkdir", name, err)
+				}
+				childID = child.InodeID
+			}
 			if child.Kind != fileKindDir {
 				return pathError("mkdir", name, ErrNotDir)
 			}
@@ -289,10 +304,11 @@ func (s *Store) MkdirAll(name string, perm os.FileMode) error {
 		ops = append(ops, metaOp{Type: "put_inode", Inode: inode}, metaOp{Type: "put_dirent", ParentID: currentID, Name: part, ChildID: inode.InodeID})
 		currentID = inode.InodeID
 	}
-	return s.commitMetaLocked(ops)
+	return s.commitMetaFinalLocked(ops)
 }
 
-// Remove deletes a single file or empty directory from the namespace.
+// Remove deletes a single file, symlink, or empty directory from the
+// namespace. Removing one hard link of a file keeps the others.
 func (s *Store) Remove(name string) error {
 	if err := s.beginOp(s.ctx); err != nil {
 		return err
@@ -307,7 +323,7 @@ func (s *Store) Remove(name string) error {
 	}
 	s.metaMu.Lock()
 	defer s.metaMu.Unlock()
-	inode, err := s.resolvePathLocked(tenantID, path)
+	inode, err := s.lookupPathLocked(tenantID, path)
 	if err != nil {
 		return pathError("remove", name, err)
 	}
@@ -319,17 +335,28 @@ func (s *Store) Remove(name string) error {
 		return pathError("remove", name, err)
 	}
 	now := nowUnix()
+	if inode.Kind != fileKindDir {
+		if err := checkObjectLock(inode, now); err != nil {
+			return pathError("remove", name, err)
+		}
+		var ops []metaOp
+		if !s.moveToTrashLocked(inode, parentID, base, path, &ops, now) {
+			s.removeLinkLocked(inode, parentID, base, path, true, &ops, now)
+		}
+		return s.commitMetaFinalLocked(ops)
+	}
+	var ops []metaOp
+	if s.moveToTrashLocked(inode, parentID, base, path, &ops, now) {
+		return s.commitMetaFinalLocked(ops)
+	}
 	next := cloneInode(inode)
 	next.State = fileStateDeleted
 	next.DeletedAt = now
 	next.UpdatedAt = now
 	next.CTime = now
 	next.Generation++
-	ops := []metaOp{{Type: "put_inode", Inode: next}, {Type: "delete_dirent", ParentID: parentID, Name: base}}
-	if inode.Kind == fileKindFile {
-		addDeletedManifestOpsLocked(s.meta, inode.ManifestID, &ops, now)
-	}
-	return s.commitMetaLocked(ops)
+	ops = append(ops, metaOp{Type: "put_inode", Inode: next}, metaOp{Type: "delete_dirent", ParentID: parentID, Name: base})
+	return s.commitMetaFinalLocked(ops)
 }
 
 // RemoveAll detaches a path from the namespace. Directory descendants become
@@ -352,7 +379,7 @@ func (s *Store) RemoveAll(name string) error {
 	}
 	s.metaMu.Lock()
 	defer s.metaMu.Unlock()
-	inode, err := s.resolvePathLocked(tenantID, path)
+	inode, err := s.lookupPathLocked(tenantID, path)
 	if err != nil {
 		return pathError("remove", name, err)
 	}
@@ -361,7 +388,24 @@ func (s *Store) RemoveAll(name string) error {
 		return pathError("remove", name, err)
 	}
 	now := nowUnix()
-	ops := []metaOp{{Type: "delete_dirent", ParentID: parentID, Name: base}}
+	if inode.Kind != fileKindDir {
+		if err := checkObjectLock(inode, now); err != nil {
+			return pathError("remove", name, err)
+		}
+		var ops []metaOp
+		if !s.moveToTrashLocked(inode, parentID, base, path, &ops, now) {
+			s.removeLinkLocked(inode, parentID, base, path, true, &ops, now)
+		}
+		return s.commitMetaFinalLocked(ops)
+	}
+	if err := s.checkSubtreeLockLocked("remove", inode.InodeID, path, now); err != nil {
+		return err
+	}
+	var ops []metaOp
+	if s.moveToTrashLocked(inode, parentID, base, path, &ops, now) {
+		return s.commitMetaFinalLocked(ops)
+	}
+	ops = append(ops, metaOp{Type: "delete_dirent", ParentID: parentID, Name: base})
 	// RemoveAll is an immediate namespace detach. For huge directory trees we do
 	// not synchronously walk every descendant; unreachable child inodes and their
 	// chunk references are reclaimed by GC.
@@ -371,13 +415,11 @@ func (s *Store) RemoveAll(name string) error {
 	next.UpdatedAt = now
 	next.Generation++
 	ops = append(ops, metaOp{Type: "put_inode", Inode: next})
-	if inode.Kind == fileKindFile {
-		addDeletedManifestOpsLocked(s.meta, inode.ManifestID, &ops, now)
-	}
-	return s.commitMetaLocked(ops)
+	return s.commitMetaFinalLocked(ops)
 }
 
-// Rename moves or replaces a file or directory within one tenant namespace.
+// Rename moves or replaces a file or directory. Moving between tenants
+// requires DedupScopeGlobal because the moved files keep their chunks.
 func (s *Store) Rename(oldname, newname string) error {
 	if err := s.beginOp(s.ctx); err != nil {
 		return err
@@ -395,11 +437,36 @@ func (s *Store) Rename(oldname, newname string) error {
 		return pathError("rename", oldname, fs.ErrInvalid)
 	}
 	if oldTenant != newTenant {
-		return pathError("rename", newname, fs.ErrInvalid)
+		if err := s.checkCrossTenant(oldTenant, newTenant); err != nil {
+			return pathError("rename", newname, err)
+		}
+		if err := s.ensureTenantRoot(newTenant); err != nil {
+			return err
+		}
 	}
 	s.metaMu.Lock()
 	defer s.metaMu.Unlock()
-	source, err := s.resolvePathLocked(oldTenant, oldPath)
+	return s.renameLocked(oldTenant, oldPath, newTenant, newPath, oldname, newname)
+}
+
+// renameLocked moves the node at oldTenant/oldPath to newTenant/newPath,
+// replacing a compatible target. oldname and newname label returned errors.
+func (s *Store) renameLocked(oldTenant, oldPath, newTenant, newPath, oldname, newname string) error {
+	var ops []metaOp
+	if err := s.renameOpsLocked(oldTenant, oldPath, newTenant, newPath, oldname, newname, Preconditions{}, &ops); err != nil {
+		return err
+	}
+	if err := s.checkQuotaLocked(ops); err != nil {
+		return pathError("rename", newname, err)
+	}
+	return s.commitMetaFinalLocked(ops)
+}
+
+// renameOpsLocked queues the ops of renameLocked. IfGenerationMatch and
+// IfETagMatch in cond apply to the source, and IfNoneMatch requires that
+// nothing exists at the target.
+func (s *Store) renameOpsLocked(oldTenant, oldPath, newTenant, newPath, oldname, newname string, cond Preconditions, ops *[]metaOp) error {
+	source, err := s.lookupPathLocked(oldTenant, oldPath)
 	if err != nil {
 		return pathError("rename", oldname, err)
 	}
@@ -417,10 +484,37 @@ func (s *Store) Rename(oldname, newname string) error {
 	if source.Kind == fileKindDir && s.isDescendantLocked(newParentID, source.InodeID) {
 		return pathError("rename", newname, fs.ErrInvalid)
 	}
+	var moved []*inodeRecord
+	if oldTenant != newTenant {
+		// Descendants carry their tenant too, so a hard link left behind in
+		// the old tenant would point across tenants.
+		moved = append(moved, source)
+		s.walkSubtreeLocked(source.InodeID, func(_ uint64, _ string, inode *inodeRecord) {
+			moved = append(moved, inode)
+		})
+		for _, inode := range moved {
+			if linkCount(inode) > 1 {
+				return pathError("rename", oldname, fs.ErrInvalid)
+			}
+			if s.tenantScopedLocked(inode) {
+				return pathError("rename", oldname, ErrCrossTenant)
+			}
+		}
+	}
 	targetID := s.meta.DirEntries[newParentID][newBase]
 	target := s.activeInodeLocked(targetID)
+	if err := checkPreconditions(source, Preconditions{IfGenerationMatch: cond.IfGenerationMatch, IfETagMatch: cond.IfETagMatch}); err != nil {
+		return pathError("rename", oldname, err)
+	}
+	if cond.IfNoneMatch && target != nil {
+		return pathError("rename", newname, ErrPreconditionFailed)
+	}
+	if target != nil && target.InodeID == source.InodeID {
+		// Both names are hard links to the same file.
+		return nil
+	}
 	now := nowUnix()
-	ops := []metaOp{{Type: "delete_dirent", ParentID: oldParentID, Name: oldBase}}
+	*ops = append(*ops, metaOp{Type: "delete_dirent", ParentID: oldParentID, Name: oldBase})
 	if target != nil {
 		if source.Kind == fileKindDir {
 			if target.Kind != fileKindDir {
@@ -432,19 +526,36 @@ func (s *Store) Rename(oldname, newname string) error {
 		} else if target.Kind == fileKindDir {
 			return pathError("rename", newname, ErrIsDir)
 		}
-		tombstone := cloneInode(target)
-		tombstone.State = fileStateDeleted
-		tombstone.DeletedAt = now
-		tombstone.UpdatedAt = now
-		tombstone.Generation++
-		ops = append(ops, metaOp{Type: "put_inode", Inode: tombstone})
-		if target.Kind == fileKindFile {
-			addDeletedManifestOpsLocked(s.meta, target.ManifestID, &ops, now)
+		if target.Kind == fileKindDir {
+			tombstone := cloneInode(target)
+			tombstone.State = fileStateDeleted
+			tombstone.DeletedAt = now
+			tombstone.UpdatedAt = now
+			tombstone.Generation++
+			*ops = append(*ops, metaOp{Type: "put_inode", Inode: tombstone})
+		} else {
+			if err := checkObjectLock(target, now); err != nil {
+				return pathError("rename", newname, err)
+			}
+			s.removeLinkLocked(target, newParentID, newBase, newPath, false, ops, now)
 		}
 	}
 	next := cloneInode(source)
-	next.ParentInode = newParentID
-	next.Name = newBase
+	if source.Kind == fileKindFile {
+		// Keep version IDs at the target path increasing past its history.
+		next.Generation = max(next.Generation, s.versionFloorLocked(newTenant, newPath))
+		if target != nil && s.versioningEnabledLocked(newTenant) {
+			next.Generation = max(next.Generation, target.Generation)
+		}
+	}
+	next.TenantID = newTenant
+	// Renaming a secondary hard link leaves the primary dirent in place.
+	if source.ParentInode == oldParentID && source.Name == oldBase {
+		next.ParentInode = newParentID
+		next.Name = newBase
+	} else if i := slices.Index(next.OtherLinks, dirLink{ParentID: oldParentID, Name: oldBase}); i >= 0 {
+		next.OtherLinks[i] = dirLink{ParentID: newParentID, Name: newBase}
+	}
 	next.Generation++
 	next.MetadataGeneration++
 	next.NamespaceGeneration++
@@ -452,8 +563,13 @@ func (s *Store) Rename(oldname, newname string) error {
 	next.MTime = now
 	next.ModTime = now
 	next.UpdatedAt = now
-	ops = append(ops, metaOp{Type: "put_inode", Inode: next}, metaOp{Type: "put_dirent", ParentID: newParentID, Name: newBase, ChildID: source.InodeID})
-	return s.commitMetaLocked(ops)
+	*ops = append(*ops, metaOp{Type: "put_inode", Inode: next}, metaOp{Type: "put_dirent", ParentID: newParentID, Name: newBase, ChildID: source.InodeID})
+	for _, inode := range moved[min(1, len(moved)):] {
+		child := cloneInode(inode)
+		child.TenantID = newTenant
+		*ops = append(*ops, metaOp{Type: "put_inode", Inode: child})
+	}
+	return nil
 }
 
 // Stat returns metadata for a VFS path.
@@ -472,6 +588,7 @@ func (s *Store) Stat(name string) (os.FileInfo, error) {
 		return nil, pathError("stat", name, err)
 	}
 	info := fileInfoFromInode(inode)
+	info.name = pathBase(path)
 	if path == "" {
 		info.name = tenantID
 	}
@@ -536,7 +653,7 @@ func (s *Store) updateVFSMetadata(op, name string, edit func(*inodeRecord)) erro
 	next.MetadataGeneration++
 	next.CTime = now
 	next.UpdatedAt = now
-	return s.commitMetaLocked([]metaOp{{Type: "put_inode", Inode: next}})
+	return s.commitMetaFinalLocked([]metaOp{{Type: "put_inode", Inode: next}})
 }
 
 func (s *Store) openDirFile(name, tenantID, path string, root bool) (afero.File, error) {
@@ -612,6 +729,9 @@ func (s *Store) isDescendantLocked(nodeID, ancestorID uint64) bool {
 }
 
 func (s *Store) createWriteSession() (afero.File, string, error) {
+	if s.readOnly {
+		return nil, "", ErrReadOnly
+	}
 	s.writeSessionMu.Lock()
 	if s.openWriteSessions >= s.cfg.MaxOpenWriteSessions {
 		s.writeSessionMu.Unlock()
@@ -705,6 +825,7 @@ func (s *Store) splitVFSPath(name string) (tenantID, path string, root bool, err
 type vfsNodeInfo struct {
 	exists     bool
 	isDir      bool
+	locked     bool
 	generation uint64
 	size       int64
 	mode       os.FileMode
@@ -723,6 +844,7 @@ func (s *Store) vfsNodeInfo(tenantID, path string) (vfsNodeInfo, error) {
 	return vfsNodeInfo{
 		exists:     true,
 		isDir:      inode.Kind == fileKindDir,
+		locked:     objectLocked(inode, nowUnix()),
 		generation: inode.Generation,
 		size:       inode.Size,
 		mode:       info.mode,
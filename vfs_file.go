@@ -23,6 +23,8 @@ type blobVFSFile struct {
 	reader         *ObjectReader
 	session        afero.File
 	sessionName    string
+	openedAt       int64
+	maxFileSize    int64
 	size           int64
 	offset         int64
 	mode           os.FileMode
@@ -189,7 +191,7 @@ func (f *blobVFSFile) writeAtLocked(p []byte, off int64) (int, error) {
 	if end < off {
 		return 0, ErrTooLarge
 	}
-	if end > f.store.cfg.MaxFileSize {
+	if end > f.maxFileSize {
 		return 0, ErrTooLarge
 	}
 	n, err := f.session.WriteAt(p, off)
@@ -339,7 +341,7 @@ func (f *blobVFSFile) Truncate(size int64) error {
 	if f.isDir || !f.writable || f.session == nil || size < 0 {
 		return os.ErrInvalid
 	}
-	if size > f.store.cfg.MaxFileSize {
+	if size > f.maxFileSize {
 		return ErrTooLarge
 	}
 	if err := f.session.Truncate(size); err != nil {
@@ -0,0 +1,398 @@
+package blobfs
+
+import (
+	"context"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// watchHistoryLimit bounds the committed events kept in memory for watchers
+// that resume from an earlier txid.
+const watchHistoryLimit = 4096
+
+// Watcher streams committed namespace events in txid order. It is not safe
+// for concurrent use.
+type Watcher struct {
+	store   *Store
+	ctx     context.Context
+	filter  WatchFilter
+	after   uint64
+	pending []WatchEvent
+}
+
+// Watch streams namespace events committed after fromTxID. A consumer starts
+// from StatsSnapshot.TxID and resumes with the TxID of the last event it
+// handled. Events older than the in-memory history are rebuilt from retained
+// metadata generations; without them Watch returns ErrWatchExpired.
+func (s *Store) Watch(ctx context.Context, fromTxID uint64, filter WatchFilter) (*Watcher, error) {
+	if err := s.beginOp(ctx); err != nil {
+		return nil, err
+	}
+	defer s.endOp()
+	if filter.TenantID != "" {
+		if err := validateTenantID(filter.TenantID, s.cfg); err != nil {
+			return nil, err
+		}
+	}
+	if filter.PathPrefix != "" {
+		prefix, err := normalizePath(filter.PathPrefix, s.cfg)
+		if err != nil {
+			return nil, pathError("watch", filter.PathPrefix, err)
+		}
+		filter.PathPrefix = prefix
+	}
+	w := &Watcher{store: s, ctx: ctx, filter: filter, after: fromTxID}
+	s.watchMu.Lock()
+	floor := s.watchFloor
+	s.watchMu.Unlock()
+	if fromTxID >= floor {
+		return w, nil
+	}
+	s.metaMu.RLock()
+	events, err := s.retainedWatchEventsLocked(fromTxID, floor)
+	s.metaMu.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	w.pending = w.match(events)
+	w.after = floor
+	return w, nil
+}
+
+// Next blocks until the next matching event is committed. It returns the
+// watch context's error once it is done, os.ErrClosed after the store closes,
+// and ErrWatchExpired when the watcher fell behind the retained history.
+func (w *Watcher) Next() (WatchEvent, error) {
+	for {
+		if len(w.pending) > 0 {
+			event := w.pending[0]
+			w.pending = w.pending[1:]
+			return event, nil
+		}
+		if err := contextError(w.ctx); err != nil {
+			return WatchEvent{}, err
+		}
+		events, wake, err := w.store.watchEventsAfter(w.after)
+		if err != nil {
+			return WatchEvent{}, err
+		}
+		if len(events) > 0 {
+			w.after = events[len(events)-1].TxID
+			w.pending = w.match(events)
+			continue
+		}
+		select {
+		case <-wake:
+		case <-w.ctx.Done():
+			return WatchEvent{}, w.ctx.Err()
+		case <-w.store.closed:
+			return WatchEvent{}, os.ErrClosed
+		}
+	}
+}
+
+func (w *Watcher) match(events []WatchEvent) []WatchEvent {
+	matched := make([]WatchEvent, 0, len(events))
+	for _, event := range events {
+		if w.filter.matches(event) {
+			matched = append(matched, event)
+		}
+	}
+	return matched
+}
+
+func (f WatchFilter) matches(event WatchEvent) bool {
+	if f.TenantID != "" && event.TenantID != f.TenantID {
+		return false
+	}
+	if f.PathPrefix == "" || event.Type == WatchTenantDelete {
+		return true
+	}
+	return pathHasPrefix(event.Path, f.PathPrefix) ||
+		(event.OldPath != "" && pathHasPrefix(event.OldPath, f.PathPrefix))
+}
+
+// pathHasPrefix matches whole path components, so "docs" covers "docs" and
+// "docs/a" but not "docs2".
+func pathHasPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// watchEventsAfter returns the recorded events committed after txid, or a
+// channel that is closed when the next transaction is published.
+func (s *Store) watchEventsAfter(txid uint64) ([]WatchEvent, <-chan struct{}, error) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	if txid < s.watchFloor {
+		return nil, nil, ErrWatchExpired
+	}
+	i := sort.Search(len(s.watchEvents), func(i int) bool { return s.watchEvents[i].TxID > txid })
+	if i == len(s.watchEvents) {
+		if s.watchWake == nil {
+			s.watchWake = make(chan struct{})
+		}
+		return nil, s.watchWake, nil
+	}
+	return append([]WatchEvent(nil), s.watchEvents[i:]...), nil, nil
+}
+
+// publishWatchEvents records the events of durable transactions and wakes
+// waiting watchers. Batches arrive in txid order from the group commit leader.
+func (s *Store) publishWatchEvents(batch []*pendingMetaTx) {
+	s.watchMu.Lock()
+	defer s.watchMu.Unlock()
+	for _, item := range batch {
+		s.watchEvents = append(s.watchEvents, item.events...)
+	}
+	s.watchEvents, s.watchFloor = trimWatchHistory(s.watchEvents, s.watchFloor)
+	if s.watchWake != nil {
+		close(s.watchWake)
+		s.watchWake = nil
+	}
+}
+
+// trimWatchHistory drops the oldest transactions once events exceed
+// watchHistoryLimit and returns the new floor: every transaction after it is
+// still complete in the history.
+func trimWatchHistory(events []WatchEvent, floor uint64) ([]WatchEvent, uint64) {
+	if len(events) <= watchHistoryLimit {
+		return events, floor
+	}
+	cut := len(events) - watchHistoryLimit
+	floor = events[cut-1].TxID
+	for cut < len(events) && events[cut].TxID == floor {
+		cut++
+	}
+	return append([]WatchEvent(nil), events[cut:]...), floor
+}
+
+// retainedWatchEventsLocked rebuilds the events of transactions in
+// (fromTxID, throughTxID] from the retained image and log generations.
+func (s *Store) retainedWatchEventsLocked(fromTxID, throughTxID uint64) ([]WatchEvent, error) {
+	if !s.retentionEnabled() {
+		return nil, ErrWatchExpired
+	}
+	meta, err := s.restoreMetadataLocked(restoreTarget{txid: fromTxID})
+	if err != nil {
+		return nil, ErrWatchExpired
+	}
+	var events []WatchEvent
+	err = s.scanRetainedLogsLocked(fromTxID, func(tx metaTx) (bool, error) {
+		if tx.TxID <= meta.TxID {
+			return true, nil
+		}
+		if tx.TxID > throughTxID || tx.TxID != meta.TxID+1 {
+			return false, nil
+		}
+		events = append(events, applyMetaTxWatched(meta, tx)...)
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if meta.TxID != throughTxID {
+		return nil, ErrWatchExpired
+	}
+	return events, nil
+}
+
+// applyMetaTxWatched applies tx and returns the namespace events it commits.
+// Paths of removed or moved nodes come from the state before tx, and paths of
+// created or moved nodes from the state after it. A node is tracked at the
+// dirent its inode names; further hard links are tracked through their dirent
+// ops.
+func applyMetaTxWatched(meta *metadata, tx metaTx) []WatchEvent {
+	type inodeChange struct {
+		id      uint64
+		oldPath string
+		oldOK   bool
+		prev    *inodeRecord
+	}
+	type direntKey struct {
+		parentID uint64
+		name     string
+	}
+	type direntChange struct {
+		key      direntKey
+		oldChild uint64
+		oldPath  string
+		oldOK    bool
+	}
+	var changes []inodeChange
+	seen := map[uint64]bool{}
+	var dirents []direntChange
+	touched := map[direntKey]uint64{}
+	for _, op := range tx.Ops {
+		switch op.Type {
+		case "put_dirent", "delete_dirent":
+			key := direntKey{op.ParentID, op.Name}
+			if _, ok := touched[key]; ok {
+				continue
+			}
+			change := direntChange{key: key, oldChild: meta.DirEntries[op.ParentID][op.Name]}
+			touched[key] = change.oldChild
+			if child := meta.Inodes[change.oldChild]; child != nil && !isPrimaryDirent(child, op.ParentID, op.Name) {
+				change.oldPath, change.oldOK = direntWatchPath(meta, op.ParentID, op.Name)
+			}
+			dirents = append(dirents, change)
+		case "put_inode":
+			if op.Inode == nil || seen[op.Inode.InodeID] {
+				continue
+			}
+			id := op.Inode.InodeID
+			seen[id] = true
+			prev := meta.Inodes[id]
+			oldPath, oldOK := watchPath(meta, prev)
+			changes = append(changes, inodeChange{id: id, oldPath: oldPath, oldOK: oldOK, prev: prev})
+		}
+	}
+	applyMetaTx(meta, tx)
+	// heldBefore reports whether key named id before tx.
+	heldBefore := func(key direntKey, id uint64) bool {
+		if child, ok := touched[key]; ok {
+			return child == id
+		}
+		return meta.DirEntries[key.parentID][key.name] == id
+	}
+
+	at := time.Unix(0, tx.Time)
+	var events []WatchEvent
+	for _, op := range tx.Ops {
+		if op.Type == "del_tenant" {
+			events = append(events, WatchEvent{TxID: tx.TxID, Type: WatchTenantDelete, TenantID: op.TenantID, Time: at})
+		}
+	}
+	for _, change := range changes {
+		inode := meta.Inodes[change.id]
+		newPath, newOK := watchPath(meta, inode)
+		event := WatchEvent{TxID: tx.TxID, Time: at, Path: newPath}
+		switch {
+		case !change.oldOK && !newOK:
+			continue
+		case !change.oldOK:
+			event.Type = WatchCreate
+		case !newOK:
+			inode = change.prev
+			event.Type = WatchDelete
+			event.Path = change.oldPath
+		case change.prev.TenantID != inode.TenantID:
+			// A move between tenants is a delete in one feed and a create in
+			// the other, so tenant-filtered watchers see both sides.
+			events = append(events, WatchEvent{
+				TxID:       tx.TxID,
+				Type:       WatchDelete,
+				TenantID:   change.prev.TenantID,
+				Path:       change.oldPath,
+				IsDir:      change.prev.Kind == fileKindDir,
+				Generation: change.prev.Generation,
+				Time:       at,
+			})
+			event.Type = WatchCreate
+		case heldBefore(direntKey{inode.ParentInode, inode.Name}, inode.InodeID) && !isPrimaryDirent(change.prev, inode.ParentInode, inode.Name):
+			// The primary link went away and the inode moved to one of its
+			// other hard links.
+			event.Type = WatchDelete
+			event.Path = change.oldPath
+		case change.oldPath != newPath:
+			event.Type = WatchRename
+			event.OldPath = change.oldPath
+		case inode.ContentGeneration != change.prev.ContentGeneration:
+			event.Type = WatchOverwrite
+		case inode.Generation != change.prev.Generation:
+			event.Type = WatchMetadata
+		default:
+			continue
+		}
+		event.TenantID = inode.TenantID
+		event.IsDir = inode.Kind == fileKindDir
+		event.Generation = inode.Generation
+		events = append(events, event)
+	}
+	type linkEvent struct {
+		inode *inodeRecord
+		path  string
+	}
+	var removed, added []linkEvent
+	for _, change := range dirents {
+		newChild := meta.DirEntries[change.key.parentID][change.key.name]
+		if newChild == change.oldChild {
+			continue
+		}
+		if change.oldOK {
+			removed = append(removed, linkEvent{inode: meta.Inodes[change.oldChild], path: change.oldPath})
+		}
+		inode := meta.Inodes[newChild]
+		if inode == nil || inode.State != fileStateActive || isPrimaryDirent(inode, change.key.parentID, change.key.name) {
+			continue
+		}
+		if newPath, ok := direntWatchPath(meta, change.key.parentID, change.key.name); ok {
+			added = append(added, linkEvent{inode: inode, path: newPath})
+		}
+	}
+	for _, link := range removed {
+		event := WatchEvent{TxID: tx.TxID, Type: WatchDelete, TenantID: link.inode.TenantID, Path: link.path, Generation: link.inode.Generation, Time: at}
+		for i := range added {
+			if added[i].inode.InodeID == link.inode.InodeID {
+				event.Type = WatchRename
+				event.OldPath = link.path
+				event.Path = added[i].path
+				added = append(added[:i], added[i+1:]...)
+				break
+			}
+		}
+		events = append(events, event)
+	}
+	for _, link := range added {
+		events = append(events, WatchEvent{TxID: tx.TxID, Type: WatchCreate, TenantID: link.inode.TenantID, Path: link.path, Generation: link.inode.Generation, Time: at})
+	}
+	return events
+}
+
+// isPrimaryDirent reports whether parentID/name is the dirent inode records
+// as its own position.
+func isPrimaryDirent(inode *inodeRecord, parentID uint64, name string) bool {
+	return inode.ParentInode == parentID && inode.Name == name
+}
+
+// direntWatchPath returns the tenant-relative path of the dirent name in the
+// directory parentID.
+func direntWatchPath(meta *metadata, parentID uint64, name string) (string, bool) {
+	parent := meta.Inodes[parentID]
+	if parent == nil || parent.State != fileStateActive {
+		return "", false
+	}
+	if parent.ParentInode == 0 {
+		return name, meta.Tenants[parent.TenantID] == parent.InodeID
+	}
+	dir, ok := watchPath(meta, parent)
+	return dir + "/" + name, ok
+}
+
+// watchPath returns the tenant-relative path of an active inode reachable from
+// its tenant root. Tenant roots and detached nodes report false.
+func watchPath(meta *metadata, inode *inodeRecord) (string, bool) {
+	if inode == nil || inode.State != fileStateActive || inode.ParentInode == 0 {
+		return "", false
+	}
+	var parts []string
+	for node := inode; node.ParentInode != 0; {
+		if meta.DirEntries[node.ParentInode][node.Name] != node.InodeID {
+			return "", false
+		}
+		parts = append(parts, node.Name)
+		parent := meta.Inodes[node.ParentInode]
+		if parent == nil || parent.State != fileStateActive || len(parts) > len(meta.Inodes) {
+			return "", false
+		}
+		node = parent
+		if node.ParentInode == 0 && meta.Tenants[node.TenantID] != node.InodeID {
+			return "", false
+		}
+	}
+	for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+		parts[i], parts[j] = parts[j], parts[i]
+	}
+	return strings.Join(parts, "/"), true
+}
@@ -0,0 +1,208 @@
+package blobfs
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/spf13/afero"
+)
+
+func nextWatchEvents(t *testing.T, w *Watcher, n int) []WatchEvent {
+	t.Helper()
+	events := make([]WatchEvent, 0, n)
+	for len(events) < n {
+		event, err := w.Next()
+		if err != nil {
+			t.Fatalf("watch next after %d events: %v", len(events), err)
+		}
+		events = append(events, event)
+	}
+	return events
+}
+
+func watchStartTxID(t *testing.T, store *Store) uint64 {
+	t.Helper()
+	stats, err := store.Stats(testContext(t))
+	if err != nil {
+		t.Fatalf("stats: %v", err)
+	}
+	return stats.TxID
+}
+
+func TestWatchStreamsNamespaceEvents(t *testing.T) {
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx, cancel := context.WithTimeout(testContext(t), 5*time.Second)
+	defer cancel()
+	w, err := store.Watch(ctx, watchStartTxID(t, store), WatchFilter{})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+
+	if err := store.MkdirAll("tenant-a/docs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("one"))
+	putTestBytes(t, store, "tenant-a", "docs/a.txt", []byte("two"))
+	if _, err := store.UpdateMetadata(testContext(t), "tenant-a", "docs/a.txt", map[string]string{"k": "v"}); err != nil {
+		t.Fatalf("update metadata: %v", err)
+	}
+	if err := store.Rename("tenant-a/docs/a.txt", "tenant-a/docs/b.txt"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	if err := store.DeleteObject(testContext(t), "tenant-a", "docs/b.txt"); err != nil {
+		t.Fatalf("delete: %v", err)
+	}
+	if err := store.DeleteTenant(testContext(t), "tenant-a"); err != nil {
+		t.Fatalf("delete tenant: %v", err)
+	}
+
+	want := []struct {
+		typ     WatchEventType
+		path    string
+		oldPath string
+		isDir   bool
+	}{
+		{WatchCreate, "docs", "", true},
+		{WatchCreate, "docs/a.txt", "", false},
+		{WatchOverwrite, "docs/a.txt", "", false},
+		{WatchMetadata, "docs/a.txt", "", false},
+		{WatchRename, "docs/b.txt", "docs/a.txt", false},
+		{WatchDelete, "docs/b.txt", "", false},
+		{WatchTenantDelete, "", "", false},
+	}
+	events := nextWatchEvents(t, w, len(want))
+	var last uint64
+	for i, event := range events {
+		if event.Type != want[i].typ || event.Path != want[i].path || event.OldPath != want[i].oldPath || event.IsDir != want[i].isDir {
+			t.Fatalf("event %d = %+v, want %+v", i, event, want[i])
+		}
+		if event.TenantID != "tenant-a" || event.TxID < last || event.Time.IsZero() {
+			t.Fatalf("event %d = %+v", i, event)
+		}
+		last = event.TxID
+	}
+}
+
+func TestWatchFiltersByTenantAndPrefix(t *testing.T) {
+	store, err := OpenFS(afero.NewMemMapFs(), "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	defer store.Close()
+	ctx, cancel := context.WithTimeout(testContext(t), 5*time.Second)
+	defer cancel()
+	w, err := store.Watch(ctx, watchStartTxID(t, store), WatchFilter{TenantID: "tenant-a", PathPrefix: "docs"})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if err := store.MkdirAll("tenant-b/docs", 0o755); err != nil {
+		t.Fatalf("mkdir: %v", err)
+	}
+	putTestBytes(t, store, "tenant-b", "docs/skip.txt", []byte("other tenant"))
+	putTestBytes(t, store, "tenant-a", "docs2.txt", []byte("sibling prefix"))
+	putTestBytes(t, store, "tenant-a", "docs", []byte("exact"))
+	if err := store.Rename("tenant-a/docs", "tenant-a/moved"); err != nil {
+		t.Fatalf("rename: %v", err)
+	}
+	events := nextWatchEvents(t, w, 2)
+	if events[0].Type != WatchCreate || events[0].Path != "docs" {
+		t.Fatalf("first event = %+v", events[0])
+	}
+	if events[1].Type != WatchRename || events[1].OldPath != "docs" || events[1].Path != "moved" {
+		t.Fatalf("rename out of prefix = %+v", events[1])
+	}
+
+	if _, err := store.Watch(ctx, 0, WatchFilter{PathPrefix: "/abs"}); err == nil {
+		t.Fatal("absolute prefix should be rejected")
+	}
+	short, shortCancel := context.WithTimeout(testContext(t), 20*time.Millisecond)
+	defer shortCancel()
+	idle, err := store.Watch(short, watchStartTxID(t, store), WatchFilter{})
+	if err != nil {
+		t.Fatalf("watch: %v", err)
+	}
+	if _, err := idle.Next(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("idle next = %v", err)
+	}
+}
+
+func TestWatchResumesAfterReopen(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("a"))
+	checkpointTestStore(t, store)
+	resume := watchStartTxID(t, store)
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("b"))
+	simulateCrashWithoutCheckpoint(t, store)
+
+	reopened, err := OpenFS(fsys, "/blobfs", testConfig())
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	ctx, cancel := context.WithTimeout(testContext(t), 5*time.Second)
+	defer cancel()
+	w, err := reopened.Watch(ctx, resume, WatchFilter{})
+	if err != nil {
+		t.Fatalf("watch from txlog: %v", err)
+	}
+	if event := nextWatchEvents(t, w, 1)[0]; event.Type != WatchCreate || event.Path != "b.txt" || event.TxID <= resume {
+		t.Fatalf("replayed event = %+v", event)
+	}
+	if _, err := reopened.Watch(ctx, 0, WatchFilter{}); !errors.Is(err, ErrWatchExpired) {
+		t.Fatalf("watch before txlog without retention = %v", err)
+	}
+	if err := reopened.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+	if _, err := w.Next(); err == nil {
+		t.Fatal("next after close should fail")
+	}
+}
+
+func TestWatchRebuildsEventsFromRetainedHistory(t *testing.T) {
+	fsys := afero.NewMemMapFs()
+	store, err := OpenFS(fsys, "/blobfs", retentionTestConfig(8))
+	if err != nil {
+		t.Fatalf("open: %v", err)
+	}
+	putTestBytes(t, store, "tenant-a", "a.txt", []byte("a"))
+	checkpointTestStore(t, store)
+	resume := watchStartTxID(t, store)
+	putTestBytes(t, store, "tenant-a", "b.txt", []byte("b"))
+	if err := store.Remove("tenant-a/a.txt"); err != nil {
+		t.Fatalf("remove: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	reopened, err := OpenFS(fsys, "/blobfs", retentionTestConfig(8))
+	if err != nil {
+		t.Fatalf("reopen: %v", err)
+	}
+	defer reopened.Close()
+	ctx, cancel := context.WithTimeout(testContext(t), 5*time.Second)
+	defer cancel()
+	w, err := reopened.Watch(ctx, resume, WatchFilter{})
+	if err != nil {
+		t.Fatalf("watch from retained history: %v", err)
+	}
+	putTestBytes(t, reopened, "tenant-a", "c.txt", []byte("c"))
+	events := nextWatchEvents(t, w, 3)
+	got := []string{string(events[0].Type) + ":" + events[0].Path, string(events[1].Type) + ":" + events[1].Path, string(events[2].Type) + ":" + events[2].Path}
+	want := []string{"create:b.txt", "delete:a.txt", "create:c.txt"}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+}